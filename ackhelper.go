@@ -23,5 +23,9 @@ func (ah *AckHelper) GetAck(echohash common.Hash) []byte {
 
 //SaveAck save ack to db
 func (ah *AckHelper) SaveAck(echohash common.Hash, msg encoding.Messager, ack []byte) {
+	//announcements are never handled twice, don't fill db with their acks
+	if _, ok := msg.(*encoding.ChannelAnnouncement); ok {
+		return
+	}
 	ah.db.SaveAckNoTx(echohash, ack)
 }
@@ -18,6 +18,7 @@ import (
 
 	"runtime/debug"
 
+	"github.com/SmartMeshFoundation/Atmosphere/autopilot"
 	"github.com/SmartMeshFoundation/Atmosphere/blockchain"
 	"github.com/SmartMeshFoundation/Atmosphere/channel"
 	"github.com/SmartMeshFoundation/Atmosphere/channel/channeltype"
@@ -83,7 +84,8 @@ type Service struct {
 	StateMachineEventHandler *stateMachineEventHandler
 	BlockChainEvents         *blockchain.Events
 	db                       *models.ModelDB
-	FeePolicy                fee.Charger //Mediation fee
+	uow                      *models.UnitOfWork //unit of work of the message or StateChange being handled, only used in the main loop
+	FeePolicy                fee.Charger        //Mediation fee
 	NotifyHandler            *notify.Handler
 	PfsProxy                 pfsproxy.PfsProxy
 
@@ -125,11 +127,21 @@ type Service struct {
 	ReceivedMediatedTrasnferListenerMap   map[*ReceivedMediatedTrasnferListener]bool //for tokenswap
 	SentMediatedTransferListenerMap       map[*SentMediatedTransferListener]bool     //for tokenswap
 	HealthCheckMap                        map[common.Address]bool
+	Channel2RebalanceKey                  map[common.Hash]common.Hash //channel being rebalanced automatically -> key of its state manager
+	AutopilotTracker                      *autopilot.Tracker
 	quitChan                              chan struct{} //for quit notification
 	isStarting                            bool
 	StopCreateNewTransfers                bool // 是否停止接收新交易,默认false,目前仅在用户调用prepare-update接口的时候,会被置为true,直到重启		// boolean to check whether stop receiving new transfers, default to false. Currently it sets to true when clients invoke prepare-update, till it reconnects.
 	EthConnectionStatus                   chan netshare.Status
 	ChanHistoryContractEventsDealComplete chan struct{}
+	resendAfterHistoryEvents              bool //resend messages not acked after history events on chain are handled
+	secretRegisterScheduler               *secretRegisterScheduler
+	disputeResolver                       *disputeResolver
+	autoSettleScheduler                   *autoSettleScheduler
+	settleOperations                      *settleOperationManager
+	revealMargin                          *revealMarginMonitor
+	routingHistory                        *routingHistory
+	channelGossip                         *channelGossip
 }
 
 //NewPhotonService create atmosphere service
@@ -156,6 +168,8 @@ func NewPhotonService(chain *rpc.BlockChainService, privateKey *ecdsa.PrivateKey
 		ReceivedMediatedTrasnferListenerMap:   make(map[*ReceivedMediatedTrasnferListener]bool),
 		SentMediatedTransferListenerMap:       make(map[*SentMediatedTransferListener]bool),
 		HealthCheckMap:                        make(map[common.Address]bool),
+		Channel2RebalanceKey:                  make(map[common.Hash]common.Hash),
+		AutopilotTracker:                      autopilot.NewTracker(db),
 		quitChan:                              make(chan struct{}),
 		isStarting:                            true,
 		StopCreateNewTransfers:                false,
@@ -165,6 +179,13 @@ func NewPhotonService(chain *rpc.BlockChainService, privateKey *ecdsa.PrivateKey
 	rs.BlockNumber.Store(int64(0))
 	rs.MessageHandler = newPhotonMessageHandler(rs)
 	rs.StateMachineEventHandler = newStateMachineEventHandler(rs)
+	rs.secretRegisterScheduler = newSecretRegisterScheduler(rs)
+	rs.disputeResolver = newDisputeResolver(rs)
+	rs.autoSettleScheduler = newAutoSettleScheduler(rs)
+	rs.settleOperations = newSettleOperationManager(rs)
+	rs.revealMargin = newRevealMarginMonitor(rs)
+	rs.routingHistory = newRoutingHistory(rs)
+	rs.channelGossip = newChannelGossip(rs)
 	rs.Protocol = network.NewPhotonProtocol(transport, privateKey, rs)
 	//todo fixme MatrixTransport should have a better contructor function
 	mtransport, ok := rs.Transport.(*network.MatrixMixTransport)
@@ -199,8 +220,8 @@ func NewPhotonService(chain *rpc.BlockChainService, privateKey *ecdsa.PrivateKey
 		rs.BlockChainEvents.Config.RPCPollPeriod = params.DefaultEthRPCPollPeriodForTest
 	}
 	// pathfinder
-	if config.PfsHost != "" {
-		rs.PfsProxy = pfsproxy.NewPfsProxy(config.PfsHost, rs.PrivateKey)
+	if len(config.PfsHosts) > 0 {
+		rs.PfsProxy = pfsproxy.NewMultiPfsProxy(config.PfsHosts, rs.PrivateKey, rs.verifyPfsPath)
 	}
 	// fee module
 	if config.EnableMediationFee {
@@ -226,6 +247,16 @@ func (rs *Service) Start() (err error) {
 
 	rs.registerRegistry()
 	rs.Protocol.Start()
+	if rs.Config.EnableMeshDiscovery {
+		deviceType := network.DeviceTypeOther
+		if params.MobileMode {
+			deviceType = network.DeviceTypeMobile
+		}
+		err = rs.Protocol.StartMeshDiscovery(rs.Config.MeshDiscoveryAddress, deviceType)
+		if err != nil {
+			log.Error(fmt.Sprintf("start mesh discovery err %s", err))
+		}
+	}
 	rs.restore()
 
 	go func() {
@@ -352,6 +383,10 @@ func (rs *Service) loop() {
 						close(rs.ChanHistoryContractEventsDealComplete)
 						rs.ChanHistoryContractEventsDealComplete = nil
 					}
+					if rs.resendAfterHistoryEvents {
+						rs.resendAfterHistoryEvents = false
+						rs.reSendEnvelopMessage()
+					}
 				}
 			} else {
 				log.Info("Events.StateChangeChannel closed")
@@ -382,6 +417,7 @@ func (rs *Service) loop() {
 			if s == netshare.Connected {
 				rs.handleEthRPCConnectionOK()
 			} else {
+				rs.revealMargin.onDisconnect()
 				rs.NotifyHandler.Notify(notify.LevelWarn, "公链连接失败,正在尝试重连")
 			}
 		case <-rs.quitChan:
@@ -506,17 +542,21 @@ func (rs *Service) sendAsync(recipient common.Address, msg encoding.SignedMessag
 	}
 	envelopMessager, ok := msg.(encoding.EnvelopMessager)
 	if ok && envelopMessager != nil {
-		rs.db.NewSentEnvelopMessager(envelopMessager, recipient)
-	}
-	result := rs.Protocol.SendAsync(recipient, msg)
-	go func() {
-		defer rpanic.PanicRecover(fmt.Sprintf("send %s, msg:%s", utils.APex(recipient), msg))
-		<-result.Result //always success
-		rs.ProtocolMessageSendComplete <- &protocolMessage{
-			receiver: recipient,
-			Message:  msg,
-		}
-	}()
+		rs.dao().NewSentEnvelopMessager(envelopMessager, recipient)
+	}
+	//对方收到消息之前, 相关的修改必须已经保存了
+	// related modifications must be saved before partner receives this message
+	rs.dao().AfterCommit(func() {
+		result := rs.Protocol.SendAsync(recipient, msg)
+		go func() {
+			defer rpanic.PanicRecover(fmt.Sprintf("send %s, msg:%s", utils.APex(recipient), msg))
+			<-result.Result //always success
+			rs.ProtocolMessageSendComplete <- &protocolMessage{
+				receiver: recipient,
+				Message:  msg,
+			}
+		}()
+	})
 	return nil
 }
 
@@ -548,7 +588,7 @@ func (rs *Service) registerSecret(secret common.Hash) {
 	for _, hashchannel := range rs.Token2Hashlock2Channels {
 		for _, ch := range hashchannel[hashlock] {
 			err := ch.RegisterSecret(secret)
-			err = rs.db.UpdateChannelNoTx(channel.NewChannelSerialization(ch))
+			err = rs.dao().UpdateChannelNoTx(channel.NewChannelSerialization(ch))
 			if err != nil {
 				log.Error(fmt.Sprintf("RegisterSecret %s to channel %s  err: %s",
 					utils.HPex(secret), ch.ChannelIdentifier.String(), err))
@@ -565,7 +605,7 @@ func (rs *Service) registerRevealedLockSecretHash(lockSecretHash, secret common.
 	for _, hashchannel := range rs.Token2Hashlock2Channels {
 		for _, ch := range hashchannel[lockSecretHash] {
 			err := ch.RegisterRevealedSecretHash(lockSecretHash, secret, blockNumber)
-			err = rs.db.UpdateChannelNoTx(channel.NewChannelSerialization(ch))
+			err = rs.dao().UpdateChannelNoTx(channel.NewChannelSerialization(ch))
 			if err != nil {
 				log.Error(fmt.Sprintf("RegisterSecret %s to channel %s  err: %s",
 					utils.HPex(lockSecretHash), ch.ChannelIdentifier.String(), err))
@@ -628,6 +668,8 @@ func (rs *Service) registerTokenNetwork(tokenAddress common.Address) (err error)
 		return
 	}
 	g := graph.NewChannelGraph(rs.NodeAddress, tokenAddress, edges)
+	g.History = rs.routingHistory
+	g.Announcements = rs.channelGossip
 	rs.Token2ChannelGraph[tokenAddress] = g
 	//add channel I participant
 	css, err := rs.db.GetChannelList(tokenAddress, utils.EmptyAddress)
@@ -730,13 +772,13 @@ func (rs *Service) directTransferAsync(tokenAddress, target common.Address, amou
 	*/
 	tr.FakeLockSecretHash = utils.NewRandomHash()
 	log.Trace(fmt.Sprintf("send direct transfer, use fake lockSecertHash %s to trace transfer status", tr.FakeLockSecretHash.String()))
-	rs.db.NewTransferStatus(tokenAddress, tr.FakeLockSecretHash)
+	rs.dao().NewTransferStatus(tokenAddress, tr.FakeLockSecretHash)
 	err = rs.sendAsync(directChannel.PartnerState.Address, tr)
 	if err != nil {
 		result.Result <- err
 		return
 	}
-	rs.db.UpdateTransferStatusMessage(tokenAddress, tr.FakeLockSecretHash, "DirectTransfer 正在发送")
+	rs.dao().UpdateTransferStatusMessage(tokenAddress, tr.FakeLockSecretHash, "DirectTransfer 正在发送")
 	/*
 		Transfer is success
 		whenever partner receive this transfer  or not
@@ -779,25 +821,34 @@ Calls:
  *			2.1 taker should contain lockSecretHash, but no secret.
  *			2.2 maker should contain lockSecretHash and secret.
  */
-func (rs *Service) startMediatedTransferInternal(tokenAddress, target common.Address, amount *big.Int, fee *big.Int, lockSecretHash common.Hash, expiration int64, secret common.Hash) (result *utils.AsyncResult, stateManager *transfer.StateManager) {
+func (rs *Service) startMediatedTransferInternal(tokenAddress, target common.Address, amount *big.Int, fee *big.Int, lockSecretHash common.Hash, expiration int64, secret common.Hash, constraints *mediatedtransfer.TransferConstraints, hints []*encoding.RouteHint) (result *utils.AsyncResult, stateManager *transfer.StateManager) {
 	var availableRoutes []*route.State
 	var err error
 	targetAmount := new(big.Int).Sub(amount, fee)
 	result = utils.NewAsyncResult()
-	if rs.PfsProxy != nil {
+	//pathfinder doesn't know the route hints
+	usePfs := rs.PfsProxy != nil && len(hints) == 0
+	if usePfs {
 		availableRoutes, err = rs.getBestRoutesFromPfs(rs.NodeAddress, target, tokenAddress, targetAmount)
 		if err != nil {
-			result.Result <- errors.New("get route from pathfinder failed")
-			return
+			log.Warn(fmt.Sprintf("get route from pathfinder failed, use local routes instead, err = %s", err))
 		}
-	} else {
+	}
+	if !usePfs || err != nil {
 		g := rs.getToken2ChannelGraph(tokenAddress)
-		availableRoutes = g.GetBestRoutes(rs.Protocol, rs.NodeAddress, target, amount, targetAmount, graph.EmptyExlude, rs)
+		availableRoutes = g.GetBestRoutesWithHints(rs.Protocol, rs.NodeAddress, target, amount, targetAmount, graph.EmptyExlude, rs, hints)
 	}
 	if len(availableRoutes) <= 0 {
+		rs.dao().UpdateTransferStatus(tokenAddress, lockSecretHash, models.TransferStatusFailed, "no available route")
 		result.Result <- errors.New("no available route")
 		return
 	}
+	if constraints != nil && constraints.MaxFee != nil && fee.Cmp(constraints.MaxFee) > 0 {
+		err = fmt.Errorf("fee %s exceeds max fee %s", fee, constraints.MaxFee)
+		rs.dao().UpdateTransferStatus(tokenAddress, lockSecretHash, models.TransferStatusFailed, err.Error())
+		result.Result <- err
+		return
+	}
 	if rs.Config.IsMeshNetwork {
 		result.Result <- errors.New("no mediated transfer on mesh only network")
 		return
@@ -810,6 +861,15 @@ func (rs *Service) startMediatedTransferInternal(tokenAddress, target common.Add
 			r.TotalFee = fee //use the user's fee to replace algorithm's
 		}
 	}
+	stateManager = rs.initiateMediatedTransfer(tokenAddress, target, amount, lockSecretHash, expiration, secret, availableRoutes, result, constraints, hints)
+	return
+}
+
+/*
+initiateMediatedTransfer 使用已经选好的路由,创建发起方的 StateManager 并开始交易.
+*/
+// initiateMediatedTransfer : create the initiator's StateManager with routes already chosen and start the transfer.
+func (rs *Service) initiateMediatedTransfer(tokenAddress, target common.Address, amount *big.Int, lockSecretHash common.Hash, expiration int64, secret common.Hash, availableRoutes []*route.State, result *utils.AsyncResult, constraints *mediatedtransfer.TransferConstraints, hints []*encoding.RouteHint) (stateManager *transfer.StateManager) {
 	routesState := route.NewRoutesState(availableRoutes)
 	transferState := &mediatedtransfer.LockedTransferState{
 		TargetAmount:   new(big.Int).Set(amount),
@@ -821,6 +881,7 @@ func (rs *Service) startMediatedTransferInternal(tokenAddress, target common.Add
 		LockSecretHash: lockSecretHash,
 		Secret:         secret,
 		Fee:            utils.BigInt0,
+		RouteHints:     hints,
 	}
 	/*
 		发起方每次切换路径不再切换密码,不切换依然可以保证安全
@@ -834,6 +895,7 @@ func (rs *Service) startMediatedTransferInternal(tokenAddress, target common.Add
 		Secret:         secret,
 		LockSecretHash: lockSecretHash,
 		Db:             rs.db,
+		Constraints:    constraints,
 	}
 	stateManager = transfer.NewStateManager(initiator.StateTransition, nil, initiator.NameInitiatorTransition, lockSecretHash, transferState.Token)
 	smkey := utils.Sha3(lockSecretHash[:], tokenAddress[:])
@@ -841,9 +903,8 @@ func (rs *Service) startMediatedTransferInternal(tokenAddress, target common.Add
 	if manager != nil {
 		panic(fmt.Sprintf("manager must be never exist"))
 	}
-	rs.Transfer2StateManager[smkey] = stateManager
+	rs.addStateManager(smkey, stateManager)
 	rs.Transfer2Result[smkey] = result
-	//rs.db.AddStateManager(stateManager)
 	rs.StateMachineEventHandler.dispatch(stateManager, initInitiator)
 	return
 }
@@ -852,7 +913,7 @@ func (rs *Service) startMediatedTransferInternal(tokenAddress, target common.Add
 1. user start a mediated transfer
 2. user start a mediated transfer with secret
 */
-func (rs *Service) startMediatedTransfer(tokenAddress, target common.Address, amount *big.Int, fee *big.Int, secret common.Hash) (result *utils.AsyncResult) {
+func (rs *Service) startMediatedTransfer(tokenAddress, target common.Address, amount *big.Int, fee *big.Int, secret common.Hash, constraints *mediatedtransfer.TransferConstraints, hints []*encoding.RouteHint) (result *utils.AsyncResult) {
 	lockSecretHash := utils.EmptyHash
 	if secret != utils.EmptyHash {
 		lockSecretHash = utils.ShaSecret(secret.Bytes())
@@ -881,14 +942,74 @@ func (rs *Service) startMediatedTransfer(tokenAddress, target common.Address, am
 	/*
 		发起方在这里记录发起的交易状态,后续UpdateTransferStatus会更新DB中的值
 	*/
-	rs.db.NewTransferStatus(tokenAddress, lockSecretHash)
-	result, _ = rs.startMediatedTransferInternal(tokenAddress, target, amount, fee, lockSecretHash, 0, secret)
+	rs.dao().NewTransferStatus(tokenAddress, lockSecretHash)
+	result, _ = rs.startMediatedTransferInternal(tokenAddress, target, amount, fee, lockSecretHash, 0, secret, constraints, hints)
 	result.LockSecretHash = lockSecretHash
 	return
 }
 
-//receive a MediatedTransfer, i'm a hop node
-func (rs *Service) mediateMediatedTransfer(msg *encoding.MediatedTransfer, ch *channel.Channel) {
+/*
+addStateManager 把新建的 StateManager 放入 Transfer2StateManager 并保存到数据库, 此后发给它的 StateChange 都会写入日志.
+*/
+// addStateManager : put a new StateManager into Transfer2StateManager and save it to db, StateChanges dispatched to it are logged from now on.
+func (rs *Service) addStateManager(key common.Hash, stateManager *transfer.StateManager) {
+	stateManager.Key = key
+	rs.Transfer2StateManager[key] = stateManager
+	err := rs.db.AddStateManager(stateManager)
+	if err != nil {
+		log.Error(fmt.Sprintf("AddStateManager %s err %s", utils.HPex(stateManager.Identifier), err))
+	}
+}
+
+/*
+beginUnitOfWork 开始处理一个消息或者 StateChange, 此后通过 dao 做的修改都推迟到调用返回的 commit 时在一个事务中完成.
+可以嵌套, 只有最外层的 commit 才真正提交. 只能在处理消息和 StateChange 的 goroutine 中使用.
+提交失败的时候内存中的通道和状态机已经和数据库不一致了, 和以前数据库保存出错一样, 只能退出.
+*/
+/*
+ *	beginUnitOfWork : begin handling a message or StateChange, modifications done through dao from now on are deferred
+ *	until the returned commit is called and done in one transaction.
+ *	It can be nested, only the outermost commit really commits. It must be used in the goroutine handling messages and StateChanges only.
+ *	When commit fails, channels and state machines in memory are no longer the same as db, we can only quit, as before when db fails.
+ */
+func (rs *Service) beginUnitOfWork() (commit func()) {
+	if rs.uow != nil {
+		return func() {}
+	}
+	uow := rs.db.BeginUnitOfWork()
+	rs.uow = uow
+	return func() {
+		rs.uow = nil
+		err := uow.Commit()
+		if err != nil {
+			//数据库保存错误,不可能发生,一旦发生了,程序只能退出.
+			// database fault, impossible to happen. If occurs, we can only quit.
+			panic(fmt.Sprintf("commit unit of work err %s", err))
+		}
+	}
+}
+
+//dao returns the unit of work in progress, or db itself if there is none
+func (rs *Service) dao() models.Dao {
+	if rs.uow != nil {
+		return rs.uow
+	}
+	return rs.db
+}
+
+//removeStoredStateManager remove StateManager and its logs from db
+func (rs *Service) removeStoredStateManager(stateManager *transfer.StateManager) {
+	if stateManager == nil || stateManager.ID == 0 {
+		return
+	}
+	err := rs.dao().RemoveStateManager(stateManager)
+	if err != nil {
+		log.Error(fmt.Sprintf("RemoveStateManager %s err %s", utils.HPex(stateManager.Identifier), err))
+	}
+}
+
+//receive a MediatedTransfer, i'm a hop node, onionHop is nil if it's a cleartext transfer
+func (rs *Service) mediateMediatedTransfer(msg *encoding.MediatedTransfer, ch *channel.Channel, onionHop *mediatedtransfer.OnionHop) {
 	tokenAddress := ch.TokenAddress
 	smkey := utils.Sha3(msg.LockSecretHash[:], tokenAddress[:])
 	stateManager := rs.Transfer2StateManager[smkey]
@@ -914,53 +1035,114 @@ func (rs *Service) mediateMediatedTransfer(msg *encoding.MediatedTransfer, ch *c
 	fromChannel := ch
 	fromRoute := graph.Channel2RouteState(fromChannel, msg.Sender, amount, rs)
 	fromTransfer := mediatedtransfer.LockedTransferFromMessage(msg, ch.TokenAddress)
+	if onionHop != nil {
+		//we only know the amount to forward, the rest is our fee
+		fromTransfer.TargetAmount = onionHop.Amount
+		fromTransfer.Fee = new(big.Int).Sub(msg.PaymentAmount, onionHop.Amount)
+		fromTransfer.OnionHop = onionHop
+	}
+	/*
+		超过了对这个上家或者这个 token 的风险限制, 直接拒绝, 不会创建 MediationPairState
+	*/
+	// exceeds risk limits of this partner or this token, reject it and no MediationPairState is created
+	var rejectReason string
+	if err := rs.checkMediationLimits(ch, msg.PaymentAmount); err != nil {
+		rejectReason = err.Error()
+	}
 	if stateManager != nil {
 		if stateManager.Name != mediator.NameMediatorTransition {
 			log.Error(fmt.Sprintf("receive mediator transfer,but i'm not a mediator,msg=%s,stateManager=%s", msg, utils.StringInterface(stateManager, 3)))
 			return
 		}
+		if onionHop != nil && len(rejectReason) == 0 {
+			//routes are used up by the first transfer
+			rejectReason = "onion routed transfer received again"
+		}
 		stateChange := &mediatedtransfer.MediatorReReceiveStateChange{
 			Message:      msg,
 			FromTransfer: fromTransfer,
 			FromRoute:    fromRoute,
 			BlockNumber:  rs.GetBlockNumber(),
+			RevealMargin: rs.revealMargin.margin(),
+			RejectReason: rejectReason,
 		}
 		rs.StateMachineEventHandler.dispatch(stateManager, stateChange)
 	} else {
 		ourAddress := rs.NodeAddress
 		exclude := graph.MakeExclude(msg.Sender, msg.Initiator)
+		if msg.Initiator == targetAddr {
+			//circular transfer such as rebalance, initiator is the target too.
+			exclude = graph.MakeExclude(msg.Sender)
+		}
 		var avaiableRoutes []*route.State
-		if rs.PfsProxy != nil {
-			var err error
-			avaiableRoutes, err = rs.getBestRoutesFromPfs(rs.NodeAddress, targetAddr, tokenAddress, targetAmount)
-			if err != nil {
-				log.Error(fmt.Sprintf("get route from pathfinder failed, err = %s", err.Error()))
+		if len(rejectReason) > 0 {
+			//no need to find routes
+		} else if onionHop != nil {
+			//the only route is the next hop in the onion
+			c := rs.getToken2ChannelGraph(ch.TokenAddress).GetPartenerAddress2Channel(onionHop.NextHop)
+			if c != nil {
+				avaiableRoutes = append(avaiableRoutes, graph.Channel2RouteState(c, onionHop.NextHop, onionHop.Amount, rs))
 			}
 		} else {
-			g := rs.getToken2ChannelGraph(ch.TokenAddress) //must exist
-			avaiableRoutes = g.GetBestRoutes(rs.Protocol, rs.NodeAddress, targetAddr, amount, targetAmount, exclude, rs)
+			var err error
+			usePfs := rs.PfsProxy != nil && len(msg.RouteHints) == 0
+			if usePfs {
+				avaiableRoutes, err = rs.getBestRoutesFromPfs(rs.NodeAddress, targetAddr, tokenAddress, targetAmount)
+				if err != nil {
+					log.Warn(fmt.Sprintf("get route from pathfinder failed, use local routes instead, err = %s", err))
+				}
+			}
+			if !usePfs || err != nil {
+				g := rs.getToken2ChannelGraph(ch.TokenAddress) //must exist
+				avaiableRoutes = g.GetBestRoutesWithHints(rs.Protocol, rs.NodeAddress, targetAddr, amount, targetAmount, exclude, rs, msg.RouteHints)
+			}
 		}
 		routesState := route.NewRoutesState(avaiableRoutes)
 		blockNumber := rs.GetBlockNumber()
 		initMediator := &mediatedtransfer.ActionInitMediatorStateChange{
-			OurAddress:  ourAddress,
-			FromTranfer: fromTransfer,
-			Routes:      routesState,
-			FromRoute:   fromRoute,
-			BlockNumber: blockNumber,
-			Message:     msg,
-			Db:          rs.db,
+			OurAddress:   ourAddress,
+			FromTranfer:  fromTransfer,
+			Routes:       routesState,
+			FromRoute:    fromRoute,
+			BlockNumber:  blockNumber,
+			Message:      msg,
+			Db:           rs.db,
+			RevealMargin: rs.revealMargin.margin(),
+			RejectReason: rejectReason,
 		}
 		stateManager = transfer.NewStateManager(mediator.StateTransition, nil, mediator.NameMediatorTransition, fromTransfer.LockSecretHash, fromTransfer.Token)
-		//rs.db.AddStateManager(stateManager)
-		rs.Transfer2StateManager[smkey] = stateManager //for path A-B-C-F-B-D-E ,node B will have two StateManagers for one identifier
+		rs.addStateManager(smkey, stateManager) //for path A-B-C-F-B-D-E ,node B will have two StateManagers for one identifier
 		rs.StateMachineEventHandler.dispatch(stateManager, initMediator)
 	}
 }
 
-//receive a MediatedTransfer, i'm the target
-func (rs *Service) targetMediatedTransfer(msg *encoding.MediatedTransfer, ch *channel.Channel) {
+//initiatorLastHop returns TransferConstraints.LastHop of our transfer whose initiator StateManager is stored with key
+func (rs *Service) initiatorLastHop(key common.Hash) common.Address {
+	mgr := rs.Transfer2StateManager[key]
+	if mgr == nil || mgr.Name != initiator.NameInitiatorTransition {
+		return utils.EmptyAddress
+	}
+	state, ok := mgr.CurrentState.(*mediatedtransfer.InitiatorState)
+	if !ok || state.Constraints == nil {
+		return utils.EmptyAddress
+	}
+	return state.Constraints.LastHop
+}
+
+//receive a MediatedTransfer, i'm the target, initiator is peeled from the onion if it's an onion routed transfer
+func (rs *Service) targetMediatedTransfer(msg *encoding.MediatedTransfer, ch *channel.Channel, initiator common.Address) {
 	smkey := utils.Sha3(msg.LockSecretHash[:], ch.TokenAddress[:])
+	var rejectReason string
+	if initiator == rs.NodeAddress {
+		/*
+			给自己的交易(比如 rebalance),发起方的 StateManager 已经占用了这个 key
+		*/
+		// transfer to ourselves such as rebalance, the key is already used by initiator's StateManager.
+		if lastHop := rs.initiatorLastHop(smkey); lastHop != utils.EmptyAddress && lastHop != msg.Sender {
+			rejectReason = fmt.Sprintf("transfer to ourselves must come back from %s", utils.APex2(lastHop))
+		}
+		smkey = utils.Sha3(msg.LockSecretHash[:], ch.TokenAddress[:], rs.NodeAddress[:])
+	}
 	stateManager := rs.Transfer2StateManager[smkey]
 	/*
 		第一次收到这个密码,
@@ -991,17 +1173,20 @@ func (rs *Service) targetMediatedTransfer(msg *encoding.MediatedTransfer, ch *ch
 	fromChannel := g.GetPartenerAddress2Channel(msg.Sender)
 	fromRoute := graph.Channel2RouteState(fromChannel, msg.Sender, msg.PaymentAmount, rs)
 	fromTransfer := mediatedtransfer.LockedTransferFromMessage(msg, ch.TokenAddress)
+	fromTransfer.Initiator = initiator
+	fromTransfer.Target = rs.NodeAddress
 	initTarget := &mediatedtransfer.ActionInitTargetStateChange{
-		OurAddress:  rs.NodeAddress,
-		FromRoute:   fromRoute,
-		FromTranfer: fromTransfer,
-		BlockNumber: rs.GetBlockNumber(),
-		Message:     msg,
-		Db:          rs.db,
+		OurAddress:   rs.NodeAddress,
+		FromRoute:    fromRoute,
+		FromTranfer:  fromTransfer,
+		BlockNumber:  rs.GetBlockNumber(),
+		Message:      msg,
+		Db:           rs.db,
+		Hold:         initiator != rs.NodeAddress && rs.db.IsHoldRequested(ch.TokenAddress, msg.LockSecretHash),
+		RejectReason: rejectReason,
 	}
 	stateManager = transfer.NewStateManager(target.StateTransiton, nil, target.NameTargetTransition, fromTransfer.LockSecretHash, fromTransfer.Token)
-	//rs.db.AddStateManager(stateManager)
-	rs.Transfer2StateManager[smkey] = stateManager
+	rs.addStateManager(smkey, stateManager)
 	rs.StateMachineEventHandler.dispatch(stateManager, initTarget)
 	// notify upper
 	rs.NotifyHandler.NotifyReceiveMediatedTransfer(msg, ch)
@@ -1150,7 +1335,7 @@ func (rs *Service) cooperativeSettleChannel(channelIdentifier common.Hash) (resu
 		return
 	}
 	c.State = channeltype.StateCooprativeSettle
-	err = rs.db.UpdateChannelNoTx(channel.NewChannelSerialization(c))
+	err = rs.dao().UpdateChannelNoTx(channel.NewChannelSerialization(c))
 	if err != nil {
 		result.Result <- err
 	}
@@ -1172,7 +1357,7 @@ func (rs *Service) prepareCooperativeSettleChannel(channelIdentifier common.Hash
 		result.Result <- err
 		return
 	}
-	err = rs.db.UpdateChannelNoTx(channel.NewChannelSerialization(c))
+	err = rs.dao().UpdateChannelNoTx(channel.NewChannelSerialization(c))
 	result.Result <- err
 	return
 }
@@ -1189,7 +1374,7 @@ func (rs *Service) cancelPrepareForCooperativeSettleChannelOrWithdraw(channelIde
 		result.Result <- err
 		return
 	}
-	err = rs.db.UpdateChannelNoTx(channel.NewChannelSerialization(c))
+	err = rs.dao().UpdateChannelNoTx(channel.NewChannelSerialization(c))
 	result.Result <- err
 	return
 }
@@ -1213,7 +1398,7 @@ func (rs *Service) withdraw(channelIdentifier common.Hash, amount *big.Int) (res
 		return
 	}
 	c.State = channeltype.StateWithdraw
-	err = rs.db.UpdateChannelNoTx(channel.NewChannelSerialization(c))
+	err = rs.dao().UpdateChannelNoTx(channel.NewChannelSerialization(c))
 	if err != nil {
 		result.Result <- err
 	}
@@ -1235,7 +1420,7 @@ func (rs *Service) prepareForWithdraw(channelIdentifier common.Hash) (result *ut
 		result.Result <- err
 		return
 	}
-	err = rs.db.UpdateChannelNoTx(channel.NewChannelSerialization(c))
+	err = rs.dao().UpdateChannelNoTx(channel.NewChannelSerialization(c))
 	result.Result <- err
 	return
 }
@@ -1286,7 +1471,7 @@ func (rs *Service) tokenSwapMaker(tokenswap *TokenSwap) (result *utils.AsyncResu
 	}
 	rs.SentMediatedTransferListenerMap[&sentMtrHook] = true
 	rs.ReceivedMediatedTrasnferListenerMap[&receiveMtrHook] = true
-	result, _ = rs.startMediatedTransferInternal(tokenswap.FromToken, tokenswap.ToNodeAddress, tokenswap.FromAmount, utils.BigInt0, tokenswap.LockSecretHash, 0, tokenswap.Secret)
+	result, _ = rs.startMediatedTransferInternal(tokenswap.FromToken, tokenswap.ToNodeAddress, tokenswap.FromAmount, utils.BigInt0, tokenswap.LockSecretHash, 0, tokenswap.Secret, nil, nil)
 	return
 }
 
@@ -1294,15 +1479,15 @@ func (rs *Service) tokenSwapMaker(tokenswap *TokenSwap) (result *utils.AsyncResu
 taker process token swap
 taker's action is triggered by maker's mediated transfer.
 */
-func (rs *Service) messageTokenSwapTaker(msg *encoding.MediatedTransfer, tokenswap *TokenSwap) (remove bool) {
+func (rs *Service) messageTokenSwapTaker(msg *encoding.MediatedTransfer, initiator, target common.Address, tokenswap *TokenSwap) (remove bool) {
 	var hashlock = msg.LockSecretHash
 	var hasReceiveRevealSecret bool
 	var stateManager *transfer.StateManager
 	if msg.LockSecretHash != tokenswap.LockSecretHash ||
 		msg.PaymentAmount.Cmp(tokenswap.FromAmount) != 0 ||
-		msg.Initiator != tokenswap.FromNodeAddress ||
+		initiator != tokenswap.FromNodeAddress ||
 		rs.getTokenForChannelIdentifier(msg.ChannelIdentifier) != tokenswap.FromToken ||
-		msg.Target != tokenswap.ToNodeAddress {
+		target != tokenswap.ToNodeAddress {
 		log.Info("receive a mediated transfer, not match tokenswap condition")
 		return false
 	}
@@ -1340,7 +1525,7 @@ func (rs *Service) messageTokenSwapTaker(msg *encoding.MediatedTransfer, tokensw
 		taker and maker may have direct channels on these two tokens.
 	*/
 	takerExpiration := msg.Expiration - int64(rs.Config.RevealTimeout)
-	result, stateManager := rs.startMediatedTransferInternal(tokenswap.ToToken, tokenswap.FromNodeAddress, tokenswap.ToAmount, utils.BigInt0, tokenswap.LockSecretHash, takerExpiration, utils.EmptyHash)
+	result, stateManager := rs.startMediatedTransferInternal(tokenswap.ToToken, tokenswap.FromNodeAddress, tokenswap.ToAmount, utils.BigInt0, tokenswap.LockSecretHash, takerExpiration, utils.EmptyHash, nil, nil)
 	if stateManager == nil {
 		log.Error(fmt.Sprintf("taker tokenwap error %s", <-result.Result))
 		return false
@@ -1396,7 +1581,70 @@ func (rs *Service) cancelTransfer(req *cancelTransferReq) (result *utils.AsyncRe
 		LockSecretHash: req.LockSecretHash,
 	}
 	rs.StateMachineEventHandler.dispatch(manager, stateChange)
-	rs.db.UpdateTransferStatus(req.TokenAddress, req.LockSecretHash, models.TransferStatusCanceled, "交易撤销")
+	rs.dao().UpdateTransferStatus(req.TokenAddress, req.LockSecretHash, models.TransferStatusCanceled, "交易撤销")
+	result.Result <- nil
+	return
+}
+
+/*
+heldTransfers 所有等待应用 settle 或者 cancel 的交易
+*/
+// heldTransfers : all transfers waiting for application to settle or cancel.
+func (rs *Service) heldTransfers() (transfers []*TransferDataResponse) {
+	for _, manager := range rs.Transfer2StateManager {
+		state, ok := manager.CurrentState.(*mediatedtransfer.TargetState)
+		if !ok || state.State != mediatedtransfer.StateHeld {
+			continue
+		}
+		transfers = append(transfers, &TransferDataResponse{
+			Initiator:      state.FromTransfer.Initiator.String(),
+			Target:         state.FromTransfer.Target.String(),
+			Token:          state.FromTransfer.Token.String(),
+			Amount:         state.FromTransfer.Amount,
+			LockSecretHash: state.FromTransfer.LockSecretHash.String(),
+			Expiration:     state.FromTransfer.Expiration - state.BlockNumber,
+		})
+	}
+	return
+}
+
+/*
+settleOrCancelHeldTransfer 应用接受或者拒绝 hold 住的交易.
+接受必须在 reveal timeout 之前,否则无法安全的拿到钱.
+*/
+/*
+ *	settleOrCancelHeldTransfer : application accepts or refuses a held transfer.
+ *	It can only be accepted before reveal timeout, otherwise tokens can not be got safely.
+ */
+func (rs *Service) settleOrCancelHeldTransfer(req *heldTransferReq, settle bool) (result *utils.AsyncResult) {
+	result = utils.NewAsyncResult()
+	smKey := utils.Sha3(req.LockSecretHash[:], req.TokenAddress[:])
+	manager := rs.Transfer2StateManager[smKey]
+	if manager == nil || manager.Name != target.NameTargetTransition {
+		result.Result <- errors.New("can not found held transfer")
+		return
+	}
+	state, ok := manager.CurrentState.(*mediatedtransfer.TargetState)
+	if !ok || state.State != mediatedtransfer.StateHeld {
+		result.Result <- errors.New("transfer is not held")
+		return
+	}
+	var stateChange transfer.StateChange
+	if settle {
+		revealTimeout := state.FromRoute.RevealTimeout()
+		if margin := rs.revealMargin.margin(); margin > revealTimeout {
+			//registering secret on chain may be slow now
+			revealTimeout = margin
+		}
+		if !mediator.IsSafeToWait(state.FromTransfer, revealTimeout, rs.GetBlockNumber()) {
+			result.Result <- fmt.Errorf("too late to settle, lock expires at %d", state.FromTransfer.Expiration)
+			return
+		}
+		stateChange = &mediatedtransfer.ActionSettleHeldTransferStateChange{LockSecretHash: req.LockSecretHash}
+	} else {
+		stateChange = &mediatedtransfer.ActionCancelHeldTransferStateChange{LockSecretHash: req.LockSecretHash}
+	}
+	rs.StateMachineEventHandler.dispatch(manager, stateChange)
 	result.Result <- nil
 	return
 }
@@ -1407,7 +1655,7 @@ func (rs *Service) handleSentMessage(sentMessage *protocolMessage) {
 	echohash := utils.Sha3(data, sentMessage.receiver[:])
 	_, ok2 := sentMessage.Message.(encoding.EnvelopMessager)
 	if ok2 {
-		rs.db.DeleteEnvelopMessager(echohash)
+		rs.dao().DeleteEnvelopMessager(echohash)
 	}
 	switch msg := sentMessage.Message.(type) {
 	case *encoding.DirectTransfer:
@@ -1419,31 +1667,31 @@ func (rs *Service) handleSentMessage(sentMessage *protocolMessage) {
 		if r, ok := rs.Transfer2Result[smkey]; ok {
 			r.Result <- nil
 		}
-		rs.db.UpdateTransferStatus(ch.TokenAddress, msg.FakeLockSecretHash, models.TransferStatusSuccess, "DirectTransfer 发送成功,交易成功")
+		rs.dao().UpdateTransferStatus(ch.TokenAddress, msg.FakeLockSecretHash, models.TransferStatusSuccess, "DirectTransfer 发送成功,交易成功")
 	case *encoding.MediatedTransfer:
 		ch, err := rs.findChannelByIdentifier(msg.ChannelIdentifier)
 		if err != nil {
 			log.Error(err.Error())
 		}
-		rs.db.UpdateTransferStatusMessage(ch.TokenAddress, msg.LockSecretHash, "MediatedTransfer 发送成功")
+		rs.dao().UpdateTransferStatusMessage(ch.TokenAddress, msg.LockSecretHash, "MediatedTransfer 发送成功")
 	case *encoding.RevealSecret:
 		// save log to db
 		channels := rs.findAllChannelsByLockSecretHash(msg.LockSecretHash())
 		for _, c := range channels {
-			rs.db.UpdateTransferStatusMessage(c.TokenAddress, msg.LockSecretHash(), "RevealSecret 发送成功")
+			rs.dao().UpdateTransferStatusMessage(c.TokenAddress, msg.LockSecretHash(), "RevealSecret 发送成功")
 		}
 	case *encoding.UnLock:
 		ch, err := rs.findChannelByIdentifier(msg.ChannelIdentifier)
 		if err != nil {
 			log.Error(err.Error())
 		}
-		rs.db.UpdateTransferStatus(ch.TokenAddress, msg.LockSecretHash(), models.TransferStatusSuccess, "UnLock 发送成功,交易成功.")
+		rs.dao().UpdateTransferStatus(ch.TokenAddress, msg.LockSecretHash(), models.TransferStatusSuccess, "UnLock 发送成功,交易成功.")
 	case *encoding.AnnounceDisposedResponse:
 		ch, err := rs.findChannelByIdentifier(msg.ChannelIdentifier)
 		if err != nil {
 			log.Error(err.Error())
 		}
-		rs.db.UpdateTransferStatusMessage(ch.TokenAddress, msg.LockSecretHash, "AnnounceDisposedResponse 发送成功")
+		rs.dao().UpdateTransferStatusMessage(ch.TokenAddress, msg.LockSecretHash, "AnnounceDisposedResponse 发送成功")
 	}
 	rs.conditionQuitWhenReceiveAck(sentMessage.Message)
 	//log.Trace(fmt.Sprintf("msg receive ack :%s", utils.StringInterface(sentMessage, 2)))
@@ -1504,7 +1752,7 @@ func (rs *Service) handleReq(req *apiReq) {
 		if r.IsDirectTransfer {
 			result = rs.directTransferAsync(r.TokenAddress, r.Target, r.Amount)
 		} else {
-			result = rs.startMediatedTransfer(r.TokenAddress, r.Target, r.Amount, r.Fee, r.Secret)
+			result = rs.startMediatedTransfer(r.TokenAddress, r.Target, r.Amount, r.Fee, r.Secret, r.Constraints, r.RouteHints)
 		}
 	case newChannelReqName:
 		r := req.Req.(*newChannelReq)
@@ -1549,6 +1797,30 @@ func (rs *Service) handleReq(req *apiReq) {
 	case cancelTransfer:
 		r := req.Req.(*cancelTransferReq)
 		result = rs.cancelTransfer(r)
+	case rebalanceReqName:
+		r := req.Req.(*rebalanceReq)
+		result = rs.rebalanceChannel(r.TokenAddress, r.Partner, r.Amount, r.MaxFee)
+	case heldTransfersReqName:
+		result = utils.NewAsyncResult()
+		result.Tag = rs.heldTransfers()
+		result.Result <- nil
+	case settleHeldTransferReqName:
+		r := req.Req.(*heldTransferReq)
+		result = rs.settleOrCancelHeldTransfer(r, true)
+	case cancelHeldTransferReqName:
+		r := req.Req.(*heldTransferReq)
+		result = rs.settleOrCancelHeldTransfer(r, false)
+	case settleOperationReqName:
+		r := req.Req.(*settleOperationReq)
+		result = utils.NewAsyncResult()
+		op, err := rs.settleOperations.start(r.addr, r.timeout, rs.GetBlockNumber())
+		result.Tag = &op
+		result.Result <- err
+	case autopilotDecisionsReqName:
+		r := req.Req.(*autopilotDecisionsReq)
+		result = utils.NewAsyncResult()
+		result.Tag = rs.autopilotDecisions(r.Policy)
+		result.Result <- nil
 	default:
 		panic("unkown req")
 	}
@@ -1563,7 +1835,7 @@ func (rs *Service) updateChannelAndSaveAck(c *channel.Channel, tag interface{})
 	}
 	echohash := t.EchoHash
 	ack := rs.Protocol.CreateAck(echohash)
-	err := rs.db.UpdateChannelAndSaveAck(channel.NewChannelSerialization(c), echohash, ack.Pack())
+	err := rs.dao().UpdateChannelAndSaveAck(channel.NewChannelSerialization(c), echohash, ack.Pack())
 	if err != nil {
 		log.Error(fmt.Sprintf("UpdateChannelAndSaveAck %s", err))
 	}
@@ -1606,6 +1878,18 @@ func (rs *Service) findAllChannelsByLockSecretHash(lockSecretHash common.Hash) (
 	return
 }
 
+//findAllClosedChannels returns all my channels closed but not settled yet
+func (rs *Service) findAllClosedChannels() (channels []*channel.Channel) {
+	for _, g := range rs.Token2ChannelGraph {
+		for _, ch := range g.ChannelIdentifier2Channel {
+			if ch.State == channeltype.StateClosed {
+				channels = append(channels, ch)
+			}
+		}
+	}
+	return
+}
+
 func (rs *Service) submitBalanceProofToPfs(ch *channel.Channel) {
 	if rs.PfsProxy == nil {
 		return
@@ -1626,6 +1910,54 @@ func (rs *Service) submitBalanceProofToPfs(ch *channel.Channel) {
 	}
 }
 
+/*
+verifyPfsPath pfs 返回的路径中每一跳都必须是本地已知的打开的通道, 第一跳必须是自己参与的通道.
+*/
+/*
+ *	verifyPfsPath : every hop of a path returned by pfs must be an open channel known locally,
+ *	and the first hop must be our own channel.
+ */
+func (rs *Service) verifyPfsPath(peerFrom, peerTo, token common.Address, amount *big.Int, path *pfsproxy.FindPathResponse) error {
+	if len(path.Result) == 0 {
+		return errors.New("empty path")
+	}
+	if path.Fee == nil || path.Fee.Sign() < 0 {
+		return fmt.Errorf("invalid fee %s", path.Fee)
+	}
+	hops := path.Result
+	//some pfs return mediators only
+	if common.HexToAddress(hops[len(hops)-1]) != peerTo {
+		hops = append(hops[:len(hops):len(hops)], peerTo.String())
+	}
+	if path.PathHop != len(hops)-1 {
+		return fmt.Errorf("path hop %d doesn't match path length %d", path.PathHop, len(hops))
+	}
+	from := peerFrom
+	for i, hop := range hops {
+		if !common.IsHexAddress(hop) {
+			return fmt.Errorf("invalid address %s", hop)
+		}
+		to := common.HexToAddress(hop)
+		if i == 0 && from == rs.NodeAddress {
+			ch := rs.getChannel(token, to)
+			if ch == nil || ch.State != channeltype.StateOpened {
+				return fmt.Errorf("no open channel with %s", utils.APex2(to))
+			}
+		} else {
+			//closed channels are removed from db
+			t, _, p1, p2, err := rs.db.GetNonParticipantChannelByID(blockchain.CalcChannelID(token, from, to))
+			if err != nil {
+				return fmt.Errorf("unknown channel %s-%s", utils.APex2(from), utils.APex2(to))
+			}
+			if t != token || !(p1 == from && p2 == to || p1 == to && p2 == from) {
+				return fmt.Errorf("channel %s-%s doesn't match", utils.APex2(from), utils.APex2(to))
+			}
+		}
+		from = to
+	}
+	return nil
+}
+
 func (rs *Service) getBestRoutesFromPfs(peerFrom, peerTo, token common.Address, amount *big.Int) (routes []*route.State, err error) {
 	var paths []pfsproxy.FindPathResponse
 	paths, err = rs.PfsProxy.FindPath(peerFrom, peerTo, token, amount)
@@ -1642,8 +1974,12 @@ func (rs *Service) getBestRoutesFromPfs(peerFrom, peerTo, token common.Address,
 			continue
 		}
 		r := route.NewState(ch)
-		r.Fee = rs.FeePolicy.GetNodeChargeFee(partnerAddress, token, amount)
 		r.TotalFee = path.Fee
+		if r.TotalFee == nil {
+			r.TotalFee = big.NewInt(0)
+		}
+		//fee of mediators after us are included in what we send to partner, and we charge on it
+		r.Fee = rs.FeePolicy.GetNodeChargeFee(partnerAddress, token, new(big.Int).Add(amount, r.TotalFee))
 		routes = append(routes, r)
 	}
 	return
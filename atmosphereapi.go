@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"time"
 
+	"github.com/SmartMeshFoundation/Atmosphere/autopilot"
 	"github.com/SmartMeshFoundation/Atmosphere/channel"
 
 	"github.com/SmartMeshFoundation/Atmosphere/transfer/mtree"
@@ -23,9 +24,11 @@ import (
 
 	"github.com/SmartMeshFoundation/Atmosphere/channel/channeltype"
 	"github.com/SmartMeshFoundation/Atmosphere/dto"
+	"github.com/SmartMeshFoundation/Atmosphere/encoding"
 	"github.com/SmartMeshFoundation/Atmosphere/log"
 	"github.com/SmartMeshFoundation/Atmosphere/models"
 	"github.com/SmartMeshFoundation/Atmosphere/network"
+	"github.com/SmartMeshFoundation/Atmosphere/network/graph"
 	"github.com/SmartMeshFoundation/Atmosphere/pfsproxy"
 	"github.com/SmartMeshFoundation/Atmosphere/rerr"
 	"github.com/SmartMeshFoundation/Atmosphere/transfer"
@@ -306,9 +309,18 @@ func (r *API) GetTokenTokenNetorks() (tokens []string) {
 	return
 }
 
-//Transfer transfer and wait
-func (r *API) Transfer(token common.Address, amount *big.Int, fee *big.Int, target common.Address, secret common.Hash, timeout time.Duration, isDirectTransfer bool) (result *utils.AsyncResult, err error) {
-	result, err = r.TransferInternal(token, amount, fee, target, secret, isDirectTransfer)
+/*
+Transfer transfer and wait
+constraints 限制交易的总手续费,锁定时间以及截止块数, nil 表示不限制.
+hints 是收款人提供的到达它的最后几跳, 用于到达私有通道或者手机后面的收款人, nil 表示没有.
+*/
+/*
+ *	Transfer : transfer and wait
+ *	constraints limits total fee, lock time and deadline block of this transfer, nil means no limit.
+ *	hints are the last hops to reach the target provided by the target, for targets behind private channels or phones, nil means none.
+ */
+func (r *API) Transfer(token common.Address, amount *big.Int, fee *big.Int, target common.Address, secret common.Hash, timeout time.Duration, isDirectTransfer bool, constraints *mediatedtransfer.TransferConstraints, hints []*encoding.RouteHint) (result *utils.AsyncResult, err error) {
+	result, err = r.TransferInternal(token, amount, fee, target, secret, isDirectTransfer, constraints, hints)
 	if err != nil {
 		return
 	}
@@ -326,8 +338,8 @@ func (r *API) Transfer(token common.Address, amount *big.Int, fee *big.Int, targ
 }
 
 // TransferAsync :
-func (r *API) TransferAsync(tokenAddress common.Address, amount *big.Int, fee *big.Int, target common.Address, secret common.Hash, isDirectTransfer bool) (result *utils.AsyncResult, err error) {
-	result, err = r.TransferInternal(tokenAddress, amount, fee, target, secret, isDirectTransfer)
+func (r *API) TransferAsync(tokenAddress common.Address, amount *big.Int, fee *big.Int, target common.Address, secret common.Hash, isDirectTransfer bool, constraints *mediatedtransfer.TransferConstraints, hints []*encoding.RouteHint) (result *utils.AsyncResult, err error) {
+	result, err = r.TransferInternal(tokenAddress, amount, fee, target, secret, isDirectTransfer, constraints, hints)
 	if err != nil {
 		return
 	}
@@ -341,7 +353,7 @@ func (r *API) TransferAsync(tokenAddress common.Address, amount *big.Int, fee *b
 }
 
 //TransferInternal :
-func (r *API) TransferInternal(tokenAddress common.Address, amount *big.Int, fee *big.Int, target common.Address, secret common.Hash, isDirectTransfer bool) (result *utils.AsyncResult, err error) {
+func (r *API) TransferInternal(tokenAddress common.Address, amount *big.Int, fee *big.Int, target common.Address, secret common.Hash, isDirectTransfer bool, constraints *mediatedtransfer.TransferConstraints, hints []*encoding.RouteHint) (result *utils.AsyncResult, err error) {
 	tokens := r.Tokens()
 	found := false
 	for _, t := range tokens {
@@ -370,9 +382,18 @@ func (r *API) TransferInternal(tokenAddress common.Address, amount *big.Int, fee
 		err = rerr.ErrInvalidAmount
 		return
 	}
+	if len(hints) > 0 {
+		if isDirectTransfer {
+			err = errors.New("route hints are only for mediated transfer")
+			return
+		}
+		if err = graph.CheckRouteHints(tokenAddress, target, hints); err != nil {
+			return
+		}
+	}
 	log.Debug(fmt.Sprintf("initiating transfer initiator=%s target=%s token=%s amount=%d secret=%s",
 		r.Atmosphere.NodeAddress.String(), target.String(), tokenAddress.String(), amount, secret.String()))
-	result = r.Atmosphere.transferAsyncClient(tokenAddress, amount, fee, target, secret, isDirectTransfer)
+	result = r.Atmosphere.transferAsyncClient(tokenAddress, amount, fee, target, secret, isDirectTransfer, constraints, hints)
 	return
 }
 
@@ -398,6 +419,42 @@ func (r *API) AllowRevealSecret(lockSecretHash common.Hash, tokenAddress common.
 	return
 }
 
+/*
+HoldTransfer 收到这个锁以后 hold 住,在应用 settle 或者 cancel 之前既不索要密码,也不披露密码.
+必须在收到交易之前调用, LockSecretHash 需要事先和付款人约定.
+*/
+/*
+ *	HoldTransfer : hold the transfer with this lockSecretHash when it's received,
+ *	neither secret is requested nor revealed until it's settled or canceled.
+ *	It must be called before the transfer is received, lockSecretHash should be agreed with the payer in advance.
+ */
+func (r *API) HoldTransfer(lockSecretHash common.Hash, tokenAddress common.Address) error {
+	return r.Atmosphere.db.NewHoldRequest(tokenAddress, lockSecretHash)
+}
+
+// GetHeldTransfers : transfers to me which are held until settled or canceled, only those asked by HoldTransfer are held.
+func (r *API) GetHeldTransfers() (transfers []*TransferDataResponse, err error) {
+	result := r.Atmosphere.heldTransfersClient()
+	err = <-result.Result
+	if err != nil {
+		return
+	}
+	transfers, _ = result.Tag.([]*TransferDataResponse)
+	return
+}
+
+// SettleHeldTransfer : accept a held transfer, secret will be requested from initiator or revealed to the previous node.
+func (r *API) SettleHeldTransfer(lockSecretHash common.Hash, tokenAddress common.Address) error {
+	result := r.Atmosphere.settleHeldTransferClient(lockSecretHash, tokenAddress)
+	return <-result.Result
+}
+
+// CancelHeldTransfer : refuse a held transfer, the lock is disposed and tokens go back to the initiator.
+func (r *API) CancelHeldTransfer(lockSecretHash common.Hash, tokenAddress common.Address) error {
+	result := r.Atmosphere.cancelHeldTransferClient(lockSecretHash, tokenAddress)
+	return <-result.Result
+}
+
 // RegisterSecret :
 func (r *API) RegisterSecret(secret common.Hash, tokenAddress common.Address) (err error) {
 	lockSecretHash := utils.ShaSecret(secret.Bytes())
@@ -577,7 +634,58 @@ func (r *API) CancelPrepareForCooperativeSettle(tokenAddress, partnerAddress com
 	return r.Atmosphere.db.GetChannelByAddress(c.ChannelIdentifier.ChannelIdentifier)
 }
 
-//Withdraw on a channel opened with `partner_address` for the given `token_address`. return when state has been updated to database
+/*
+StartSettleOperation 先尝试合作关闭通道, 在 timeout 个块内没有成功就改为 close, 并在 settle 窗口结束时自动 settle.
+立即返回, 通过 GetSettleOperation 查询进度.
+*/
+/*
+ *	StartSettleOperation : try cooperative settle first, if it doesn't succeed in timeout blocks, fall back to close
+ *	and settle automatically when settle window ends.
+ *	It returns immediately, progress can be queried by GetSettleOperation.
+ */
+func (r *API) StartSettleOperation(channelIdentifier common.Hash, timeout int64) (op *models.SettleOperation, err error) {
+	if timeout <= 0 {
+		timeout = params.DefaultCooperativeSettleTimeout
+	}
+	result := r.Atmosphere.settleOperationClient(channelIdentifier, timeout)
+	err = <-result.Result
+	log.Trace(fmt.Sprintf("%s StartSettleOperation , err %v", utils.HPex(channelIdentifier), err))
+	if err != nil {
+		return
+	}
+	op = result.Tag.(*models.SettleOperation)
+	return
+}
+
+//GetSettleOperation returns progress of settle operation of this channel
+func (r *API) GetSettleOperation(channelIdentifier common.Hash) (op *models.SettleOperation, err error) {
+	o, found := r.Atmosphere.settleOperations.get(channelIdentifier)
+	if !found {
+		err = rerr.ChannelNotFound(fmt.Sprintf("no settle operation for channel %s", channelIdentifier.String()))
+		return
+	}
+	return &o, nil
+}
+
+//GetSettleOperations returns all settle operations
+func (r *API) GetSettleOperations() []models.SettleOperation {
+	return r.Atmosphere.settleOperations.all()
+}
+
+/*
+Withdraw 在通道上取现,需要先 PrepareForWithdraw, 取现上链之前通道不能交易.
+合约的 withDraw 会把 open_block_number 改成当前块号,之前签署的 balance proof 全部失效,
+所以取现过程中不能保持交易,不停机调整通道大小需要合约支持.
+存款不改变 open_block_number, Deposit 过程中通道一直可以交易.
+*/
+/*
+ *	Withdraw on a channel opened with `partner_address` for the given `token_address`. return when state has been updated to database
+ *
+ *	Channel must be prepared for withdraw and can not transfer until withdraw is on chain.
+ *	withDraw of the contract sets open_block_number to current block, which invalidates every balance proof signed before,
+ *	so the channel can not keep transferring while withdraw is confirming, resizing without downtime needs contract support.
+ *	Deposit never changes open_block_number, the channel is usable all the time.
+ */
 func (r *API) Withdraw(tokenAddress, partnerAddress common.Address, amount *big.Int) (c *channeltype.Serialization, err error) {
 	c, err = r.Atmosphere.db.GetChannel(tokenAddress, partnerAddress)
 	if c.State != channeltype.StateOpened && c.State != channeltype.StatePrepareForWithdraw {
@@ -1088,6 +1196,45 @@ func (r *API) CancelTransfer(lockSecretHash common.Hash, tokenAddress common.Add
 	return <-result.Result
 }
 
+/*
+Rebalance send `amount` to ourselves, out through one of our other channels and back through the channel with `partner`,
+so our distributable balance on that channel grows by `amount`. fee paid to mediated nodes will never exceed `maxFee`.
+wait until the rebalance finishes if timeout > 0.
+*/
+func (r *API) Rebalance(tokenAddress, partner common.Address, amount, maxFee *big.Int, timeout time.Duration) (result *utils.AsyncResult, err error) {
+	if amount == nil || amount.Cmp(utils.BigInt0) <= 0 {
+		err = rerr.ErrInvalidAmount
+		return
+	}
+	if maxFee == nil {
+		maxFee = utils.BigInt0
+	}
+	if maxFee.Cmp(utils.BigInt0) < 0 {
+		err = errors.New("invalid max fee")
+		return
+	}
+	if r.Atmosphere.StopCreateNewTransfers {
+		err = rerr.ErrStopCreateNewTransfer
+		return
+	}
+	log.Debug(fmt.Sprintf("rebalance token=%s partner=%s amount=%s maxFee=%s", tokenAddress.String(), partner.String(), amount, maxFee))
+	result = r.Atmosphere.rebalanceClient(tokenAddress, partner, amount, maxFee)
+	if timeout > 0 {
+		select {
+		case <-time.After(timeout):
+			return result, errors.New("timeout")
+		case err = <-result.Result:
+		}
+		return
+	}
+	timeoutCh := time.After(300 * time.Millisecond)
+	select {
+	case <-timeoutCh:
+	case err = <-result.Result:
+	}
+	return
+}
+
 type balanceProof struct {
 	Nonce             uint64      `json:"nonce"`
 	TransferAmount    *big.Int    `json:"transfer_amount"`
@@ -1173,6 +1320,117 @@ func (r *API) SetFeePolicy(fp *models.FeePolicy) error {
 	return feeModule.SetFeePolicy(fp)
 }
 
+// GetAutopilotPolicy : returns the autopilot policy of token, nil if never set
+func (r *API) GetAutopilotPolicy(tokenAddress common.Address) (p *models.AutopilotPolicy, err error) {
+	return r.Atmosphere.db.GetAutopilotPolicy(tokenAddress)
+}
+
+// SetAutopilotPolicy : autopilot takes effect at the next run
+func (r *API) SetAutopilotPolicy(p *models.AutopilotPolicy) error {
+	if p.Budget == nil || p.Budget.Cmp(utils.BigInt0) < 0 {
+		return errors.New("invalid budget")
+	}
+	if p.ChannelDeposit == nil || p.ChannelDeposit.Cmp(utils.BigInt0) <= 0 {
+		return errors.New("invalid channel deposit")
+	}
+	if p.TargetChannels < 0 || p.MaxIdleBlocks < 0 || p.MinPartnerChannels < 0 {
+		return errors.New("target_channels, max_idle_blocks and min_partner_channels must not be negative")
+	}
+	if p.SettleTimeout != 0 && (p.SettleTimeout < params.DefaultChannelSettleTimeoutMin || p.SettleTimeout > params.DefaultChannelSettleTimeoutMax) {
+		return rerr.ErrInvalidSettleTimeout
+	}
+	for _, t := range r.Tokens() {
+		if t == p.TokenAddress {
+			return r.Atmosphere.db.SaveAutopilotPolicy(p)
+		}
+	}
+	return rerr.UnknownTokenAddress(p.TokenAddress.String())
+}
+
+// GetMediationLimits : all risk limits of mediation
+func (r *API) GetMediationLimits() []*models.MediationLimit {
+	return r.Atmosphere.db.GetAllMediationLimits()
+}
+
+// SetMediationLimit : create or replace risk limit of mediation, empty partner means limit of the whole token. it takes effect on next mediated transfer
+func (r *API) SetMediationLimit(l *models.MediationLimit) error {
+	if l.MaxLockedAmount != nil && l.MaxLockedAmount.Sign() < 0 {
+		return errors.New("invalid max_locked_amount")
+	}
+	if l.MaxTransferAmount != nil && l.MaxTransferAmount.Sign() < 0 {
+		return errors.New("invalid max_transfer_amount")
+	}
+	if l.MaxPendingLocks < 0 {
+		return errors.New("max_pending_locks must not be negative")
+	}
+	for _, t := range r.Tokens() {
+		if t == l.TokenAddress {
+			return r.Atmosphere.db.SaveMediationLimit(l)
+		}
+	}
+	return rerr.UnknownTokenAddress(l.TokenAddress.String())
+}
+
+// RemoveMediationLimit : empty partner means limit of the whole token
+func (r *API) RemoveMediationLimit(tokenAddress, partnerAddress common.Address) error {
+	return r.Atmosphere.db.RemoveMediationLimit(tokenAddress, partnerAddress)
+}
+
+// RoutingHistoryInfo : routing results of a channel and how likely a transfer via it succeeds now
+type RoutingHistoryInfo struct {
+	*models.RoutingHistory
+	Amount             *big.Int `json:"amount"`
+	SuccessProbability float64  `json:"success_probability"`
+}
+
+// GetRoutingHistory : routing results of all channels, success probability is for amount, or amount of the latest result if amount is nil
+func (r *API) GetRoutingHistory(amount *big.Int) (infos []*RoutingHistoryInfo) {
+	for _, h := range r.Atmosphere.db.GetAllRoutingHistory() {
+		info := &RoutingHistoryInfo{
+			RoutingHistory: h,
+			Amount:         amount,
+		}
+		if info.Amount == nil && len(h.Events) > 0 {
+			info.Amount = h.Events[len(h.Events)-1].Amount
+		}
+		if info.Amount == nil {
+			info.Amount = big.NewInt(0)
+		}
+		info.SuccessProbability = r.Atmosphere.routingHistory.SuccessProbability(h.TokenAddress, h.PartnerAddress, info.Amount)
+		infos = append(infos, info)
+	}
+	return
+}
+
+// ResetRoutingHistory : forget routing results of channel with partner, or all channels if both token and partner are empty
+func (r *API) ResetRoutingHistory(tokenAddress, partnerAddress common.Address) error {
+	if tokenAddress == utils.EmptyAddress && partnerAddress == utils.EmptyAddress {
+		return r.Atmosphere.db.RemoveAllRoutingHistory()
+	}
+	return r.Atmosphere.db.RemoveRoutingHistory(tokenAddress, partnerAddress)
+}
+
+// AutopilotDecisions : what autopilot would do right now on token, nothing is executed.
+func (r *API) AutopilotDecisions(tokenAddress common.Address) (actions []*autopilot.Action, err error) {
+	p, err := r.Atmosphere.db.GetAutopilotPolicy(tokenAddress)
+	if err != nil {
+		return
+	}
+	if p == nil {
+		err = errors.New("no autopilot policy for this token")
+		return
+	}
+	//dry run even if the policy is not enabled
+	p.Enable = true
+	result := r.Atmosphere.autopilotDecisionsClient(p)
+	err = <-result.Result
+	if err != nil {
+		return
+	}
+	actions, _ = result.Tag.([]*autopilot.Action)
+	return
+}
+
 // FindPath :
 func (r *API) FindPath(targetAddress, tokenAddress common.Address, amount *big.Int) (routes []pfsproxy.FindPathResponse, err error) {
 	if r.Atmosphere.PfsProxy == nil {
@@ -1186,6 +1444,59 @@ func (r *API) FindPath(targetAddress, tokenAddress common.Address, amount *big.I
 	return
 }
 
+// GetAllSecretRegisterCost : cost of registering secrets on chain, total cost and details of every secret
+func (r *API) GetAllSecretRegisterCost() (resp *dto.APIResponse) {
+	type responce struct {
+		TotalCost *big.Int                     `json:"total_cost"`
+		Details   []*models.SecretRegisterCost `json:"details"`
+	}
+	var data responce
+	var err error
+	data.Details, err = r.Atmosphere.db.GetAllSecretRegisterCost()
+	if err != nil {
+		return dto.NewExceptionAPIResponse(err)
+	}
+	data.TotalCost = big.NewInt(0)
+	for _, c := range data.Details {
+		data.TotalCost.Add(data.TotalCost, c.Cost)
+	}
+	return dto.NewSuccessAPIResponse(data)
+}
+
+// GetDisputeActions : on-chain actions after channels closed and their outcomes
+func (r *API) GetDisputeActions() (resp *dto.APIResponse) {
+	actions, err := r.Atmosphere.db.GetAllDisputeActions()
+	if err != nil {
+		return dto.NewExceptionAPIResponse(err)
+	}
+	return dto.NewSuccessAPIResponse(actions)
+}
+
+// GetAutoSettles : channels settled automatically or waiting to be settled
+func (r *API) GetAutoSettles() (resp *dto.APIResponse) {
+	settles, err := r.Atmosphere.db.GetAllAutoSettles()
+	if err != nil {
+		return dto.NewExceptionAPIResponse(err)
+	}
+	return dto.NewSuccessAPIResponse(settles)
+}
+
+// GetRevealMargin : blocks a lock must have left before this node forwards it, and chain conditions it depends on
+func (r *API) GetRevealMargin() (resp *dto.APIResponse) {
+	type responce struct {
+		RevealTimeout int                     `json:"reveal_timeout"`
+		RevealMargin  int                     `json:"reveal_margin"`
+		Conditions    *params.ChainConditions `json:"conditions"`
+	}
+	m := r.Atmosphere.revealMargin
+	data := &responce{
+		RevealTimeout: m.revealTimeout,
+		Conditions:    m.conditions(),
+	}
+	data.RevealMargin = m.policy.Margin(m.revealTimeout, data.Conditions)
+	return dto.NewSuccessAPIResponse(data)
+}
+
 // GetAllFeeChargeRecord :
 func (r *API) GetAllFeeChargeRecord() (resp *dto.APIResponse) {
 	type responce struct {
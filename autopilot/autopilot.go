@@ -0,0 +1,148 @@
+package autopilot
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+
+	"github.com/SmartMeshFoundation/Atmosphere/models"
+	"github.com/SmartMeshFoundation/Atmosphere/utils"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+//ActionType what autopilot wants to do
+type ActionType string
+
+const (
+	//ActionOpen open and fund a new channel
+	ActionOpen ActionType = "open"
+	//ActionClose close an idle channel
+	ActionClose ActionType = "close"
+)
+
+/*
+Action :
+one decision of autopilot, it's executed or only reported when dry run.
+*/
+type Action struct {
+	Type              ActionType     `json:"type"`
+	TokenAddress      common.Address `json:"token_address"`
+	Partner           common.Address `json:"partner_address"`
+	ChannelIdentifier common.Hash    `json:"channel_identifier,omitempty"`
+	Amount            *big.Int       `json:"amount,omitempty"`
+	Reason            string         `json:"reason"`
+}
+
+func (a *Action) String() string {
+	return fmt.Sprintf("%s token=%s partner=%s amount=%s reason=%s", a.Type, utils.APex2(a.TokenAddress), utils.APex2(a.Partner), a.Amount, a.Reason)
+}
+
+/*
+ChannelInfo :
+what autopilot knows about one of our channels
+*/
+type ChannelInfo struct {
+	ChannelIdentifier common.Hash
+	Partner           common.Address
+	Deposit           *big.Int //our deposit
+	CanTransfer       bool     //false when closing, settling, withdrawing...
+	LastActiveBlock   int64
+	OpenedByAutopilot bool //only channels opened by autopilot are closed by it
+}
+
+/*
+Candidate :
+a node we may open channel with, Channels is how many channels it has in the ChannelGraph or pfs
+*/
+type Candidate struct {
+	Address  common.Address
+	Channels int
+}
+
+type candidateList []*Candidate
+
+func (cl candidateList) Len() int {
+	return len(cl)
+}
+func (cl candidateList) Less(i, j int) bool {
+	if cl[i].Channels != cl[j].Channels {
+		return cl[i].Channels > cl[j].Channels
+	}
+	return cl[i].Address.Hex() < cl[j].Address.Hex()
+}
+func (cl candidateList) Swap(i, j int) {
+	cl[i], cl[j] = cl[j], cl[i]
+}
+
+/*
+Decide 根据策略给出 autopilot 在这个 token 上应该做的事情,本身没有任何副作用.
+1. 关闭 autopilot 建立的超过 MaxIdleBlocks 没有任何交易的通道, 运营者手工建立的通道从不关闭
+2. 在预算允许的范围内,选择通道最多的节点建立通道,直到通道数量达到 TargetChannels
+pending 是已经发起但是还没有在链上完成的建立通道请求.
+*/
+/*
+ *	Decide : function to return what autopilot should do on this token according to the policy, it has no side effect.
+ *
+ *	1. close channels opened by autopilot which have no transfer for more than MaxIdleBlocks, channels opened by the operator are never closed.
+ *	2. open channels with the best connected nodes while budget permits, until we have TargetChannels channels.
+ *	`pending` are channel openings sent but not confirmed on chain yet.
+ */
+func Decide(policy *models.AutopilotPolicy, blockNumber int64, channels []*ChannelInfo, candidates []*Candidate, pending map[common.Address]bool) (actions []*Action) {
+	if policy == nil || !policy.Enable {
+		return
+	}
+	hasChannel := make(map[common.Address]bool)
+	active := len(pending)
+	committed := big.NewInt(0)
+	if policy.ChannelDeposit != nil {
+		committed.Mul(policy.ChannelDeposit, big.NewInt(int64(len(pending))))
+	}
+	for _, c := range channels {
+		hasChannel[c.Partner] = true
+		if !c.CanTransfer {
+			continue
+		}
+		if c.OpenedByAutopilot && policy.MaxIdleBlocks > 0 && blockNumber-c.LastActiveBlock > policy.MaxIdleBlocks {
+			actions = append(actions, &Action{
+				Type:              ActionClose,
+				TokenAddress:      policy.TokenAddress,
+				Partner:           c.Partner,
+				ChannelIdentifier: c.ChannelIdentifier,
+				Reason:            fmt.Sprintf("idle for %d blocks", blockNumber-c.LastActiveBlock),
+			})
+			continue
+		}
+		active++
+		committed.Add(committed, c.Deposit)
+	}
+	if policy.ChannelDeposit == nil || policy.ChannelDeposit.Sign() <= 0 || policy.Budget == nil {
+		return
+	}
+	sorted := make(candidateList, 0, len(candidates))
+	for _, c := range candidates {
+		if hasChannel[c.Address] || pending[c.Address] || c.Channels < policy.MinPartnerChannels {
+			continue
+		}
+		sorted = append(sorted, c)
+	}
+	sort.Sort(sorted)
+	for _, c := range sorted {
+		if active >= policy.TargetChannels {
+			break
+		}
+		total := new(big.Int).Add(committed, policy.ChannelDeposit)
+		if total.Cmp(policy.Budget) > 0 {
+			break
+		}
+		actions = append(actions, &Action{
+			Type:         ActionOpen,
+			TokenAddress: policy.TokenAddress,
+			Partner:      c.Address,
+			Amount:       new(big.Int).Set(policy.ChannelDeposit),
+			Reason:       fmt.Sprintf("node has %d channels", c.Channels),
+		})
+		committed = total
+		active++
+	}
+	return
+}
@@ -0,0 +1,151 @@
+package autopilot
+
+import (
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/SmartMeshFoundation/Atmosphere/models"
+	"github.com/SmartMeshFoundation/Atmosphere/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestPolicy() *models.AutopilotPolicy {
+	return &models.AutopilotPolicy{
+		TokenAddress:       utils.NewRandomAddress(),
+		Enable:             true,
+		Budget:             big.NewInt(300),
+		TargetChannels:     3,
+		ChannelDeposit:     big.NewInt(100),
+		MaxIdleBlocks:      1000,
+		MinPartnerChannels: 2,
+	}
+}
+
+func TestDecideOpen(t *testing.T) {
+	p := newTestPolicy()
+	existing := &ChannelInfo{
+		ChannelIdentifier: utils.NewRandomHash(),
+		Partner:           utils.NewRandomAddress(),
+		Deposit:           big.NewInt(100),
+		CanTransfer:       true,
+		LastActiveBlock:   900,
+	}
+	best := &Candidate{utils.NewRandomAddress(), 10}
+	second := &Candidate{utils.NewRandomAddress(), 5}
+	third := &Candidate{utils.NewRandomAddress(), 3}
+	lonely := &Candidate{utils.NewRandomAddress(), 1}
+	candidates := []*Candidate{lonely, third, {existing.Partner, 20}, best, second}
+	actions := Decide(p, 1000, []*ChannelInfo{existing}, candidates, nil)
+	assert.EqualValues(t, 2, len(actions))
+	assert.EqualValues(t, ActionOpen, actions[0].Type)
+	assert.EqualValues(t, best.Address, actions[0].Partner)
+	assert.EqualValues(t, second.Address, actions[1].Partner)
+	assert.EqualValues(t, p.ChannelDeposit, actions[1].Amount)
+
+	//budget only allows one more channel
+	p.Budget = big.NewInt(250)
+	actions = Decide(p, 1000, []*ChannelInfo{existing}, candidates, nil)
+	assert.EqualValues(t, 1, len(actions))
+
+	//pending openings count in budget and channel number
+	p.Budget = big.NewInt(300)
+	actions = Decide(p, 1000, []*ChannelInfo{existing}, candidates, map[common.Address]bool{best.Address: true})
+	assert.EqualValues(t, 1, len(actions))
+	assert.EqualValues(t, second.Address, actions[0].Partner)
+
+	p.Enable = false
+	assert.Empty(t, Decide(p, 1000, []*ChannelInfo{existing}, candidates, nil))
+}
+
+func TestDecideCloseIdle(t *testing.T) {
+	p := newTestPolicy()
+	p.TargetChannels = 1
+	idle := &ChannelInfo{
+		ChannelIdentifier: utils.NewRandomHash(),
+		Partner:           utils.NewRandomAddress(),
+		Deposit:           big.NewInt(100),
+		CanTransfer:       true,
+		LastActiveBlock:   100,
+		OpenedByAutopilot: true,
+	}
+	manual := &ChannelInfo{
+		ChannelIdentifier: utils.NewRandomHash(),
+		Partner:           utils.NewRandomAddress(),
+		Deposit:           big.NewInt(100),
+		CanTransfer:       true,
+		LastActiveBlock:   100,
+	}
+	closing := &ChannelInfo{
+		ChannelIdentifier: utils.NewRandomHash(),
+		Partner:           utils.NewRandomAddress(),
+		Deposit:           big.NewInt(100),
+		CanTransfer:       false,
+		LastActiveBlock:   100,
+		OpenedByAutopilot: true,
+	}
+	candidate := &Candidate{utils.NewRandomAddress(), 4}
+	actions := Decide(p, 2000, []*ChannelInfo{idle, closing}, []*Candidate{candidate, {closing.Partner, 10}}, nil)
+	assert.EqualValues(t, 2, len(actions))
+	assert.EqualValues(t, ActionClose, actions[0].Type)
+	assert.EqualValues(t, idle.ChannelIdentifier, actions[0].ChannelIdentifier)
+	assert.EqualValues(t, ActionOpen, actions[1].Type)
+	assert.EqualValues(t, candidate.Address, actions[1].Partner)
+
+	//channels opened by the operator are never closed
+	actions = Decide(p, 2000, []*ChannelInfo{manual}, nil, nil)
+	assert.Empty(t, actions)
+
+	p.MaxIdleBlocks = 0
+	assert.Empty(t, Decide(p, 2000, []*ChannelInfo{idle, closing}, []*Candidate{candidate}, nil))
+}
+
+func TestTracker(t *testing.T) {
+	dbPath := filepath.Join(os.TempDir(), "autopilottracker.db")
+	os.Remove(dbPath)
+	db, err := models.OpenDb(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(dbPath)
+	tr := NewTracker(db)
+	ch := utils.NewRandomHash()
+	assert.EqualValues(t, 10, tr.Observe(ch, 1, 10))
+	assert.EqualValues(t, 10, tr.Observe(ch, 1, 20))
+	assert.EqualValues(t, 30, tr.Observe(ch, 3, 30))
+
+	token := utils.NewRandomAddress()
+	ok := utils.NewRandomAddress()
+	failed := utils.NewRandomAddress()
+	waiting := utils.NewRandomAddress()
+	tr.AddPending(token, ok, utils.NewAsyncResultWithError(nil))
+	tr.AddPending(token, failed, utils.NewAsyncResultWithError(errors.New("fail")))
+	tr.AddPending(token, waiting, utils.NewAsyncResult())
+	assert.Empty(t, tr.Pending(utils.NewRandomAddress(), nil))
+	pending := tr.Pending(token, nil)
+	assert.EqualValues(t, map[common.Address]bool{ok: true, waiting: true}, pending)
+	pending = tr.Pending(token, map[common.Address]bool{ok: true})
+	assert.EqualValues(t, map[common.Address]bool{waiting: true}, pending)
+
+	//the first channel appearing is autopilot's, a channel opened again later is not
+	assert.True(t, tr.OpenedByAutopilot(token, ok, 5))
+	assert.True(t, tr.OpenedByAutopilot(token, ok, 5))
+	assert.False(t, tr.OpenedByAutopilot(token, ok, 50))
+	assert.False(t, tr.OpenedByAutopilot(token, failed, 5))
+	assert.False(t, tr.OpenedByAutopilot(token, utils.NewRandomAddress(), 5))
+
+	//everything but pending openings survives restart
+	db.CloseDB()
+	db, err = models.OpenDb(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.CloseDB()
+	tr = NewTracker(db)
+	assert.EqualValues(t, 30, tr.Observe(ch, 3, 100))
+	assert.True(t, tr.OpenedByAutopilot(token, ok, 5))
+	assert.Empty(t, tr.Pending(token, nil))
+}
@@ -0,0 +1,120 @@
+package autopilot
+
+import (
+	"fmt"
+
+	"github.com/SmartMeshFoundation/Atmosphere/log"
+	"github.com/SmartMeshFoundation/Atmosphere/models"
+	"github.com/SmartMeshFoundation/Atmosphere/utils"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+type pendingKey struct {
+	token   common.Address
+	partner common.Address
+}
+
+/*
+Tracker :
+remembers channels' activity, channels opened by autopilot and pending channel openings between two runs of autopilot.
+activity and channels opened by autopilot are saved in db, so idle time is not reset by restart,
+pending openings are kept in memory only.
+must be accessed in one thread.
+*/
+type Tracker struct {
+	db      *models.ModelDB
+	pending map[pendingKey]*utils.AsyncResult
+}
+
+//NewTracker create Tracker
+func NewTracker(db *models.ModelDB) *Tracker {
+	return &Tracker{
+		db:      db,
+		pending: make(map[pendingKey]*utils.AsyncResult),
+	}
+}
+
+/*
+Observe record the sum of both participants' nonce of a channel,
+returns the last block at which it changed.
+*/
+func (t *Tracker) Observe(channelIdentifier common.Hash, nonce uint64, blockNumber int64) (lastActiveBlock int64) {
+	a, err := t.db.GetChannelActivity(channelIdentifier)
+	if err != nil {
+		log.Error(fmt.Sprintf("GetChannelActivity %s err %s", utils.HPex(channelIdentifier), err))
+	}
+	if a == nil || a.Nonce != nonce {
+		a = &models.ChannelActivity{ChannelIdentifier: channelIdentifier, Nonce: nonce, BlockNumber: blockNumber}
+		err = t.db.SaveChannelActivity(a)
+		if err != nil {
+			log.Error(fmt.Sprintf("SaveChannelActivity %s err %s", utils.HPex(channelIdentifier), err))
+		}
+	}
+	return a.BlockNumber
+}
+
+//AddPending remember a channel opening sent to chain, and that the channel is opened by autopilot
+func (t *Tracker) AddPending(tokenAddress, partner common.Address, result *utils.AsyncResult) {
+	err := t.db.SaveAutopilotChannel(&models.AutopilotChannel{TokenAddress: tokenAddress, Partner: partner})
+	if err != nil {
+		log.Error(fmt.Sprintf("SaveAutopilotChannel %s err %s", utils.APex2(partner), err))
+	}
+	t.pending[pendingKey{tokenAddress, partner}] = result
+}
+
+/*
+Pending returns channel openings on the token not finished,
+an opening is finished when it fails or the channel appears in `opened`.
+*/
+func (t *Tracker) Pending(tokenAddress common.Address, opened map[common.Address]bool) (pending map[common.Address]bool) {
+	pending = make(map[common.Address]bool)
+	for key, result := range t.pending {
+		if key.token != tokenAddress {
+			continue
+		}
+		if opened[key.partner] {
+			delete(t.pending, key)
+			continue
+		}
+		select {
+		case err := <-result.Result:
+			if err != nil {
+				delete(t.pending, key)
+				//no channel is opened
+				err = t.db.RemoveAutopilotChannel(key.token, key.partner)
+				if err != nil {
+					log.Error(fmt.Sprintf("RemoveAutopilotChannel %s err %s", utils.APex2(key.partner), err))
+				}
+				continue
+			}
+			//success, but ChannelNew event may not arrive yet.
+			result.Result <- nil
+		default:
+		}
+		pending[key.partner] = true
+	}
+	return
+}
+
+/*
+OpenedByAutopilot returns true if the channel with partner opened at openBlockNumber is opened by autopilot,
+the first channel with partner appearing after autopilot's opening is regarded as the one.
+*/
+func (t *Tracker) OpenedByAutopilot(tokenAddress, partner common.Address, openBlockNumber int64) bool {
+	c, err := t.db.GetAutopilotChannel(tokenAddress, partner)
+	if err != nil {
+		log.Error(fmt.Sprintf("GetAutopilotChannel %s err %s", utils.APex2(partner), err))
+		return false
+	}
+	if c == nil {
+		return false
+	}
+	if c.OpenBlockNumber == 0 {
+		c.OpenBlockNumber = openBlockNumber
+		err = t.db.SaveAutopilotChannel(c)
+		if err != nil {
+			log.Error(fmt.Sprintf("SaveAutopilotChannel %s err %s", utils.APex2(partner), err))
+		}
+	}
+	return c.OpenBlockNumber == openBlockNumber
+}
@@ -0,0 +1,110 @@
+package atmosphere
+
+import (
+	"fmt"
+
+	"github.com/SmartMeshFoundation/Atmosphere/autopilot"
+	"github.com/SmartMeshFoundation/Atmosphere/log"
+	"github.com/SmartMeshFoundation/Atmosphere/models"
+	"github.com/SmartMeshFoundation/Atmosphere/notify"
+	"github.com/SmartMeshFoundation/Atmosphere/params"
+	"github.com/SmartMeshFoundation/Atmosphere/utils"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+/*
+autopilotDecisions 收集 token 上我的通道以及 ChannelGraph 和 pfs 中的其他节点,计算 autopilot 应该采取的动作,但是并不执行.
+*/
+// autopilotDecisions : collect our channels and other nodes in ChannelGraph and pfs of the token, compute what autopilot should do without doing it.
+func (rs *Service) autopilotDecisions(policy *models.AutopilotPolicy) (actions []*autopilot.Action) {
+	g := rs.Token2ChannelGraph[policy.TokenAddress]
+	if g == nil {
+		return
+	}
+	blockNumber := rs.GetBlockNumber()
+	var channels []*autopilot.ChannelInfo
+	opened := make(map[common.Address]bool)
+	for _, c := range g.ChannelIdentifier2Channel {
+		nonce := c.OurState.BalanceProofState.Nonce + c.PartnerState.BalanceProofState.Nonce
+		channels = append(channels, &autopilot.ChannelInfo{
+			ChannelIdentifier: c.ChannelIdentifier.ChannelIdentifier,
+			Partner:           c.PartnerState.Address,
+			Deposit:           c.OurState.ContractBalance,
+			CanTransfer:       c.CanTransfer(),
+			LastActiveBlock:   rs.AutopilotTracker.Observe(c.ChannelIdentifier.ChannelIdentifier, nonce, blockNumber),
+			OpenedByAutopilot: rs.AutopilotTracker.OpenedByAutopilot(policy.TokenAddress, c.PartnerState.Address, c.ChannelIdentifier.OpenBlockNumber),
+		})
+		opened[c.PartnerState.Address] = true
+	}
+	nodes := g.NodesChannelNumber()
+	if rs.PfsProxy != nil {
+		/*
+			pfs 知道的通道可能比我们自己的 ChannelGraph 更多
+		*/
+		// pfs may know more channels than our ChannelGraph
+		pfsNodes, err := rs.PfsProxy.GetNodes(policy.TokenAddress)
+		if err != nil {
+			log.Warn(fmt.Sprintf("get nodes from pfs err %s, use ChannelGraph only", err))
+		}
+		for _, n := range pfsNodes {
+			if n.Channels > nodes[n.Address] {
+				nodes[n.Address] = n.Channels
+			}
+		}
+	}
+	var candidates []*autopilot.Candidate
+	for addr, n := range nodes {
+		if addr == rs.NodeAddress {
+			continue
+		}
+		candidates = append(candidates, &autopilot.Candidate{Address: addr, Channels: n})
+	}
+	return autopilot.Decide(policy, blockNumber, channels, candidates, rs.AutopilotTracker.Pending(policy.TokenAddress, opened))
+}
+
+/*
+runAutopilot 每隔 params.DefaultAutopilotInterval 块,对每个启用了 autopilot 的 token 执行一次决策.
+dry run 模式下只记录日志,不建立也不关闭任何通道.
+*/
+/*
+ *	runAutopilot : function to run autopilot every params.DefaultAutopilotInterval blocks for each token with autopilot enabled.
+ *
+ *	Note that in dry run mode decisions are only logged, no channel is opened or closed.
+ */
+func (rs *Service) runAutopilot(blockNumber int64) {
+	if blockNumber%params.DefaultAutopilotInterval != 0 || rs.Config.IsMeshNetwork {
+		return
+	}
+	for _, policy := range rs.db.GetAllAutopilotPolicies() {
+		if !policy.Enable {
+			continue
+		}
+		actions := rs.autopilotDecisions(policy)
+		for _, a := range actions {
+			if policy.DryRun {
+				log.Info(fmt.Sprintf("autopilot dry run: %s", a))
+				continue
+			}
+			log.Info(fmt.Sprintf("autopilot: %s", a))
+			var result *utils.AsyncResult
+			switch a.Type {
+			case autopilot.ActionOpen:
+				settleTimeout := policy.SettleTimeout
+				if settleTimeout <= 0 {
+					settleTimeout = params.DefaultSettleTimeout
+				}
+				result = rs.Chain.TokenNetworkProxy.DepositAsync(a.TokenAddress, rs.NodeAddress, a.Partner, a.Amount, settleTimeout)
+				rs.AutopilotTracker.AddPending(a.TokenAddress, a.Partner, result)
+			case autopilot.ActionClose:
+				result = rs.closeOrSettleChannel(a.ChannelIdentifier, closeChannelReqName)
+				go func(a *autopilot.Action, result *utils.AsyncResult) {
+					err := <-result.Result
+					if err != nil {
+						log.Error(fmt.Sprintf("autopilot close channel %s err %s", a.ChannelIdentifier.String(), err))
+					}
+				}(a, result)
+			}
+			rs.NotifyHandler.Notify(notify.LevelInfo, fmt.Sprintf("autopilot %s", a))
+		}
+	}
+}
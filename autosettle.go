@@ -0,0 +1,156 @@
+package atmosphere
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/SmartMeshFoundation/Atmosphere/channel"
+	"github.com/SmartMeshFoundation/Atmosphere/log"
+	"github.com/SmartMeshFoundation/Atmosphere/models"
+	"github.com/SmartMeshFoundation/Atmosphere/notify"
+	"github.com/SmartMeshFoundation/Atmosphere/params"
+	"github.com/SmartMeshFoundation/Atmosphere/utils"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+/*
+autoSettleScheduler 通道关闭以后, settle 窗口结束时自动 settle, 需要启动时指定 --auto-settle,
+也可以只为某一个通道添加计划.
+计划保存在数据库中, 重启以后继续执行.
+settle 之前要等 dispute 中的 unlock 等操作都结束, 否则对方给我的锁就没有机会解锁了.
+成功或者失败都会通知用户, 失败太多次以后放弃, 需要用户手工 settle.
+*/
+/*
+ *	autoSettleScheduler : settle closed channels automatically when settle window ends, it's enabled by --auto-settle,
+ *	or plan can be added for a single channel.
+ *	Plans are saved in db and continue after restart.
+ *	Before settle, it waits until dispute actions such as unlock are finished, otherwise locks partner sent me have no chance to be unlocked.
+ *	User is notified on success or failure, after too many failures it gives up and user should settle manually.
+ */
+type autoSettleScheduler struct {
+	enabled bool
+	db      *models.ModelDB
+	//all functions below are only called in main loop
+	findChannel    func(channelIdentifier common.Hash) *channel.Channel
+	closedChannels func() []*channel.Channel
+	hasDispute     func(channelIdentifier common.Hash) bool
+	settle         func(ch *channel.Channel) *utils.AsyncResult
+	notify         func(level notify.Level, info interface{})
+	lock           sync.Mutex
+	inflight       map[common.Hash]bool
+	wg             sync.WaitGroup
+}
+
+func newAutoSettleScheduler(rs *Service) *autoSettleScheduler {
+	return &autoSettleScheduler{
+		enabled: rs.Config.AutoSettle,
+		db:      rs.db,
+		findChannel: func(channelIdentifier common.Hash) *channel.Channel {
+			ch, err := rs.findChannelByIdentifier(channelIdentifier)
+			if err != nil {
+				return nil
+			}
+			return ch
+		},
+		closedChannels: rs.findAllClosedChannels,
+		hasDispute:     rs.disputeResolver.hasPending,
+		settle: func(ch *channel.Channel) *utils.AsyncResult {
+			return ch.Settle()
+		},
+		notify:   rs.NotifyHandler.Notify,
+		inflight: make(map[common.Hash]bool),
+	}
+}
+
+//onChannelClosed plan to settle this channel if auto settle is enabled
+func (s *autoSettleScheduler) onChannelClosed(ch *channel.Channel) {
+	if !s.enabled {
+		return
+	}
+	s.add(ch)
+}
+
+//add plan to settle this closed channel even if auto settle is not enabled
+func (s *autoSettleScheduler) add(ch *channel.Channel) {
+	_, err := s.db.NewAutoSettle(&models.AutoSettle{
+		ChannelIdentifier: ch.ChannelIdentifier.ChannelIdentifier,
+		OpenBlockNumber:   ch.ChannelIdentifier.OpenBlockNumber,
+		TokenAddress:      ch.TokenAddress,
+		PartnerAddress:    ch.PartnerState.Address,
+		SettleBlock:       ch.ExternState.ClosedBlock + int64(ch.SettleTimeout) + params.PunishBlockNumber,
+	})
+	if err != nil {
+		log.Error(err.Error())
+	}
+}
+
+//onBlock settle all channels whose settle window has ended
+func (s *autoSettleScheduler) onBlock(blockNumber int64) {
+	if s.enabled {
+		//channels closed when node is offline or before auto settle is enabled
+		for _, ch := range s.closedChannels() {
+			s.add(ch)
+		}
+	}
+	//plans added for single channel are executed even if auto settle is not enabled
+	settles, err := s.db.GetPendingAutoSettles()
+	if err != nil {
+		log.Error(err.Error())
+		return
+	}
+	for _, a := range settles {
+		if s.isInflight(a.ChannelIdentifier) {
+			continue
+		}
+		ch := s.findChannel(a.ChannelIdentifier)
+		if ch == nil || ch.ChannelIdentifier.OpenBlockNumber != a.OpenBlockNumber {
+			//settled by partner or cooperative settled
+			a.Status = models.AutoSettleSettled
+			s.save(a)
+			continue
+		}
+		if blockNumber <= a.SettleBlock || s.hasDispute(a.ChannelIdentifier) {
+			continue
+		}
+		s.lock.Lock()
+		s.inflight[a.ChannelIdentifier] = true
+		s.lock.Unlock()
+		a.Attempts++
+		log.Info(fmt.Sprintf("settle channel %s automatically, attempts=%d", utils.HPex(a.ChannelIdentifier), a.Attempts))
+		result := s.settle(ch)
+		s.wg.Add(1)
+		go func(a *models.AutoSettle) {
+			defer s.wg.Done()
+			err := <-result.Result
+			if err == nil {
+				a.Status = models.AutoSettleSettled
+				s.notify(notify.LevelInfo, fmt.Sprintf("通道自动settle成功,ChannelIdentifier=%s", a.ChannelIdentifier.String()))
+			} else {
+				a.LastError = err.Error()
+				if a.Attempts >= params.AutoSettleMaxAttempts {
+					a.Status = models.AutoSettleFailed
+					s.notify(notify.LevelError, fmt.Sprintf("通道自动settle失败,请手工settle,ChannelIdentifier=%s,err=%s", a.ChannelIdentifier.String(), err))
+				} else {
+					s.notify(notify.LevelWarn, fmt.Sprintf("通道自动settle失败,稍后重试,ChannelIdentifier=%s,err=%s", a.ChannelIdentifier.String(), err))
+				}
+			}
+			s.save(a)
+		}(a)
+	}
+}
+
+func (s *autoSettleScheduler) isInflight(channelIdentifier common.Hash) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.inflight[channelIdentifier]
+}
+
+func (s *autoSettleScheduler) save(a *models.AutoSettle) {
+	err := s.db.UpdateAutoSettle(a)
+	s.lock.Lock()
+	delete(s.inflight, a.ChannelIdentifier)
+	s.lock.Unlock()
+	if err != nil {
+		log.Error(err.Error())
+	}
+}
@@ -0,0 +1,107 @@
+package atmosphere
+
+import (
+	"errors"
+	"math/big"
+	"sync"
+	"testing"
+
+	"github.com/SmartMeshFoundation/Atmosphere/channel"
+	"github.com/SmartMeshFoundation/Atmosphere/channel/channeltype"
+	"github.com/SmartMeshFoundation/Atmosphere/models"
+	"github.com/SmartMeshFoundation/Atmosphere/notify"
+	"github.com/SmartMeshFoundation/Atmosphere/params"
+	"github.com/SmartMeshFoundation/Atmosphere/utils"
+	"github.com/SmartMeshFoundation/Atmosphere/utils/utest"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestAutoSettleScheduler(t *testing.T) {
+	db, err := newTestDb()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.CloseDB()
+	ch1 := utest.MakeRoute(utest.HOP1, big.NewInt(100), utest.UnitSettleTimeout, utest.UnitRevealTimeout, 100, utils.NewRandomHash()).Channel()
+	ch1.State = channeltype.StateClosed
+	ch2 := utest.MakeRoute(utest.HOP2, big.NewInt(100), utest.UnitSettleTimeout, utest.UnitRevealTimeout, 100, utils.NewRandomHash()).Channel()
+	ch2.State = channeltype.StateClosed
+	channels := map[common.Hash]*channel.Channel{
+		ch1.ChannelIdentifier.ChannelIdentifier: ch1,
+		ch2.ChannelIdentifier.ChannelIdentifier: ch2,
+	}
+	var lock sync.Mutex
+	var settled []common.Hash
+	var notices []notify.Level
+	fail := false
+	dispute := true
+	s := &autoSettleScheduler{
+		enabled: true,
+		db:      db,
+		findChannel: func(channelIdentifier common.Hash) *channel.Channel {
+			return channels[channelIdentifier]
+		},
+		closedChannels: func() []*channel.Channel { return []*channel.Channel{ch2} },
+		hasDispute: func(channelIdentifier common.Hash) bool {
+			return dispute && channelIdentifier == ch1.ChannelIdentifier.ChannelIdentifier
+		},
+		settle: func(ch *channel.Channel) *utils.AsyncResult {
+			settled = append(settled, ch.ChannelIdentifier.ChannelIdentifier)
+			if fail {
+				return utils.NewAsyncResultWithError(errors.New("tx failed"))
+			}
+			return utils.NewAsyncResultWithError(nil)
+		},
+		notify: func(level notify.Level, info interface{}) {
+			lock.Lock()
+			notices = append(notices, level)
+			lock.Unlock()
+		},
+		inflight: make(map[common.Hash]bool),
+	}
+	onBlock := func(blockNumber int64) {
+		s.onBlock(blockNumber)
+		s.wg.Wait()
+	}
+	settleBlock := 100 + int64(utest.UnitSettleTimeout) + params.PunishBlockNumber
+
+	//ch2 is found when scanning closed channels
+	s.onChannelClosed(ch1)
+	onBlock(settleBlock)
+	if len(settled) != 0 {
+		t.Fatalf("settle window is not over")
+	}
+	//ch1 waits for dispute
+	onBlock(settleBlock + 1)
+	if len(settled) != 1 || settled[0] != ch2.ChannelIdentifier.ChannelIdentifier || len(notices) != 1 || notices[0] != notify.LevelInfo {
+		t.Fatalf("expect ch2 settled,got %v,notices %v", settled, notices)
+	}
+	dispute = false
+	fail = true
+	for i := 0; i < params.AutoSettleMaxAttempts+1; i++ {
+		onBlock(settleBlock + 2 + int64(i))
+	}
+	if len(settled) != 1+params.AutoSettleMaxAttempts || notices[len(notices)-1] != notify.LevelError {
+		t.Fatalf("expect give up after %d attempts,got %d,notices %v", params.AutoSettleMaxAttempts, len(settled)-1, notices)
+	}
+	all, err := db.GetAllAutoSettles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := make(map[common.Hash]models.AutoSettleStatus)
+	for _, a := range all {
+		status[a.ChannelIdentifier] = a.Status
+	}
+	if status[ch1.ChannelIdentifier.ChannelIdentifier] != models.AutoSettleFailed || status[ch2.ChannelIdentifier.ChannelIdentifier] != models.AutoSettleSettled {
+		t.Errorf("wrong status %v", status)
+	}
+
+	//disabled, nothing happens
+	s.enabled = false
+	ch3 := utest.MakeRoute(utest.HOP3, big.NewInt(100), utest.UnitSettleTimeout, utest.UnitRevealTimeout, 100, utils.NewRandomHash()).Channel()
+	s.onChannelClosed(ch3)
+	all, err = db.GetAllAutoSettles()
+	if err != nil || len(all) != 2 {
+		t.Errorf("expect 2 plans,got %d err %v", len(all), err)
+	}
+}
@@ -345,7 +345,7 @@ func needConfirm(eventName string) bool {
 
 //eventChannelOpenAndDeposit2StateChange to state change
 func eventChannelOpenAndDeposit2StateChange(ev *contracts.TokenNetworkChannelOpenedAndDeposit) (ch1 *mediatedtransfer.ContractNewChannelStateChange, ch2 *mediatedtransfer.ContractBalanceStateChange) {
-	channelIdentifier := calcChannelID(ev.Token, ev.Participant, ev.Partner)
+	channelIdentifier := CalcChannelID(ev.Token, ev.Participant, ev.Partner)
 	ch1 = &mediatedtransfer.ContractNewChannelStateChange{
 		ChannelIdentifier: &contracts.ChannelUniqueID{
 			ChannelIdentifier: channelIdentifier,
@@ -366,8 +366,8 @@ func eventChannelOpenAndDeposit2StateChange(ev *contracts.TokenNetworkChannelOpe
 	return
 }
 
-//注意与合约上计算方式保持完全一致.
-func calcChannelID(token, p1, p2 common.Address) common.Hash {
+//CalcChannelID 注意与合约上计算方式保持完全一致.
+func CalcChannelID(token, p1, p2 common.Address) common.Hash {
 	var channelID common.Hash
 	if bytes.Compare(p1[:], p2[:]) < 0 {
 		channelID = utils.Sha3(p1[:], p2[:], token[:])
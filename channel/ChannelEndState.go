@@ -88,7 +88,9 @@ func (node *EndState) SetContractTransferAmount(amount *big.Int) {
 func (node *EndState) contractLocksRoot() common.Hash {
 	return node.BalanceProofState.ContractLocksRoot
 }
-func (node *EndState) contractTransferAmount() *big.Int {
+
+//ContractTransferAmount transfer amount of this participant on contract
+func (node *EndState) ContractTransferAmount() *big.Int {
 	return node.BalanceProofState.ContractTransferAmount
 }
 
@@ -170,6 +172,11 @@ func (node *EndState) UpdateContractBalance(balance *big.Int) error {
 	return nil
 }
 
+//GetLock returns the pending or unclaimed lock of lockSecretHash, nil if not found
+func (node *EndState) GetLock(lockSecretHash common.Hash) *mtree.Lock {
+	return node.getLockByHashlock(lockSecretHash)
+}
+
 //getLockByHashlock returns the hash corresponding Lock,nil if not found
 func (node *EndState) getLockByHashlock(lockSecretHash common.Hash) *mtree.Lock {
 	lock, ok := node.Lock2PendingLocks[lockSecretHash]
@@ -207,24 +207,21 @@ func (c *Channel) HandleChannelPunished(beneficiaries common.Address) {
 HandleClosed handles this channel was closed on blockchain
 1. 更新NonClosing 一方的 ContractTransferAmount 和 LocksRoot,
 2. 对方可能用旧的BalanceProof, 所以未必与我保存的 TransferAmount 和 LocksRoot一致
-3. 如果我不是关闭方,那么需要更新对方的 BalanceProof
-4. 我持有的知道密码的锁,需要解锁.
+3. 更新对方的 BalanceProof 以及解锁我持有的知道密码的锁由 dispute 处理, 这里只更新状态.
 */
 /*
  *	HandleClosed : It handles events of closing channel.
  *
  *		1. Update ContractTransferAmount & LocksRoot of the non-closing participant.
  *		2. That participant may submit used BalanceProof, in which TransferAmount & LocksRoot are not consistent with mine.
- *		3. If I am not the non-closing participant, then update the BalanceProof of my channel partner.
- *		4. All locks I am holding that have known secrets must be unlocked.
+ *		3. Updating BalanceProof of my partner and unlocking locks I hold with known secrets are done by dispute,
+ *		only state is updated here.
  */
 func (c *Channel) HandleClosed(closingAddress common.Address, transferredAmount *big.Int, locksRoot common.Hash) {
 	endStateUpdatedOnContract := c.PartnerState
-	balanceProof := c.PartnerState.BalanceProofState
 	//依据合约上保存的 ContractTransferAmount 以及 LocksRoot 来更新我本地的
 	//the channel was closed, update our half of the state if we need to
 	if closingAddress != c.OurState.Address {
-		c.ExternState.UpdateTransfer(c.TokenAddress, balanceProof)
 		endStateUpdatedOnContract = c.OurState
 	}
 	endStateUpdatedOnContract.SetContractTransferAmount(transferredAmount)
@@ -233,9 +230,9 @@ func (c *Channel) HandleClosed(closingAddress common.Address, transferredAmount
 		校验数据,如果没有用最新的数据来更新链上信息,有可能是一种攻击,也有可能是我本地的数据是错误的.
 	*/
 	// Verify data, if no more update message, which might be attack, or which might be local storage error.
-	if endStateUpdatedOnContract.TransferAmount().Cmp(endStateUpdatedOnContract.contractTransferAmount()) != 0 {
+	if endStateUpdatedOnContract.TransferAmount().Cmp(endStateUpdatedOnContract.ContractTransferAmount()) != 0 {
 		log.Error(fmt.Sprintf("Channel %s closed,but contract transfer amount is %s, and local stored %s's transfer amount is %s",
-			utils.HPex(c.ChannelIdentifier.ChannelIdentifier), endStateUpdatedOnContract.contractTransferAmount(),
+			utils.HPex(c.ChannelIdentifier.ChannelIdentifier), endStateUpdatedOnContract.ContractTransferAmount(),
 			utils.APex2(endStateUpdatedOnContract.Address), endStateUpdatedOnContract.TransferAmount(),
 		))
 		//todo 报告错误给最上层,可能是一个 bug? 一种攻击?,还是我自己存储数据有问题
@@ -249,18 +246,6 @@ func (c *Channel) HandleClosed(closingAddress common.Address, transferredAmount
 		//todo 报告错误给最上层,可能是一个 bug? 一种攻击?,还是我自己存储数据有问题
 		// todo throw error to the uppermost layer, maybe a bug? an attack? or just local storage error.
 	}
-	unlockProofs := c.PartnerState.GetKnownUnlocks()
-	if len(unlockProofs) > 0 {
-		result := c.ExternState.Unlock(c.TokenAddress, unlockProofs, c.PartnerState.contractTransferAmount())
-		go func() {
-			err := <-result.Result
-			if err != nil {
-				//todo 需要回报错误给Photon 调用者
-				// todo need to report error to Atmosphere
-				log.Info(fmt.Sprintf("Unlock failed because of %s", err))
-			}
-		}()
-	}
 
 	c.State = channeltype.StateClosed
 }
@@ -162,12 +162,65 @@ func StartMain() (*atmosphere.API, error) {
 		},
 		cli.StringFlag{
 			Name:  "pfs",
-			Usage: "pathfinder service host,example http://127.0.0.1:9000",
+			Usage: "pathfinder service hosts separated by comma, used in order, example http://127.0.0.1:9000,http://127.0.0.1:9001",
 		},
 		cli.BoolFlag{
 			Name:  "enable-fork-confirm",
 			Usage: "enable fork confirm when receive events from chain",
 		},
+		cli.StringFlag{
+			Name:  "rebalance-threshold",
+			Usage: "rebalance a channel automatically when its distributable balance drops below this amount, disabled if not set",
+		},
+		cli.StringFlag{
+			Name:  "rebalance-max-fee",
+			Usage: "max fee for one automatic rebalance, default 0",
+		},
+		cli.StringFlag{
+			Name:  "secret-register-max-gas-price",
+			Usage: "max gas price in wei to register secrets on chain when locks are about to expire",
+		},
+		cli.Int64Flag{
+			Name:  "secret-register-escalate-blocks",
+			Usage: "gas price of registering secrets increases in this many blocks before locks expire",
+			Value: params.DefaultRevealTimeout,
+		},
+		cli.IntFlag{
+			Name:  "reveal-margin-max-extra-blocks",
+			Usage: "at most this many blocks are added to reveal timeout when chain is slow, congested or disconnected, mediators refuse locks expire sooner",
+			Value: params.DefaultRevealTimeout,
+		},
+		cli.BoolFlag{
+			Name:  "auto-settle",
+			Usage: "settle closed channels automatically when settle window ends",
+		},
+		cli.IntFlag{
+			Name:  "routing-history-half-life",
+			Usage: "minutes after which a transfer success or failure via a channel counts half when choosing routes",
+			Value: int(params.DefaultRoutingHistoryHalfLife / time.Minute),
+		},
+		cli.BoolFlag{
+			Name:  "channel-gossip",
+			Usage: "announce fees and capacities of channels to neighbours, and use announcements of other nodes when routing",
+		},
+		cli.IntFlag{
+			Name:  "channel-announce-interval",
+			Usage: "minutes after which our channels are announced again even if nothing changes",
+			Value: int(params.DefaultChannelAnnounceInterval / time.Minute),
+		},
+		cli.BoolFlag{
+			Name:  "onion-routing",
+			Usage: "hide initiator and target of our transfers from mediators if all nodes on the route have announced onion support, needs --channel-gossip",
+		},
+		cli.BoolFlag{
+			Name:  "mesh-discovery",
+			Usage: "find nodes in the LAN by signed udp beacons, so meshboxes and phones can reach each other without internet",
+		},
+		cli.StringFlag{
+			Name:  "mesh-discovery-address",
+			Usage: "multicast group or broadcast address:port where beacons are sent and received",
+			Value: params.DefaultMeshDiscoveryAddress,
+		},
 	}
 	app.Flags = append(app.Flags, debug.Flags...)
 	app.Action = mainCtx
@@ -428,12 +481,79 @@ func config(ctx *cli.Context) (config *params.Config, err error) {
 			log.Warn("reveal timeout should > 0")
 		}
 	}
-	config.PfsHost = ctx.String("pfs")
-	if len(config.PfsHost) > 0 && config.NetworkMode != params.MixUDPMatrix {
-		err = fmt.Errorf("atmosphere start with pfs %s, but not use matrix, exit", config.PfsHost)
+	for _, host := range strings.Split(ctx.String("pfs"), ",") {
+		host = strings.TrimSpace(host)
+		if len(host) > 0 {
+			config.PfsHosts = append(config.PfsHosts, host)
+		}
+	}
+	if len(config.PfsHosts) > 0 && config.NetworkMode != params.MixUDPMatrix {
+		err = fmt.Errorf("atmosphere start with pfs %s, but not use matrix, exit", ctx.String("pfs"))
 		return
 	}
 	config.EnableForkConfirm = ctx.Bool("enable-fork-confirm")
+	if len(ctx.String("secret-register-max-gas-price")) > 0 {
+		maxGasPrice, ok := new(big.Int).SetString(ctx.String("secret-register-max-gas-price"), 0)
+		if !ok || maxGasPrice.Cmp(big.NewInt(params.DefaultGasPrice)) < 0 {
+			err = fmt.Errorf("invalid secret-register-max-gas-price %s, it can not be less than %s", ctx.String("secret-register-max-gas-price"), big.NewInt(params.DefaultGasPrice))
+			return
+		}
+		config.SecretRegisterGasPolicy.MaxGasPrice = maxGasPrice
+	}
+	config.SecretRegisterGasPolicy.EscalateBlocks = ctx.Int64("secret-register-escalate-blocks")
+	//we cannot register secret in time if gas price is higher than what we are willing to pay
+	config.RevealMarginPolicy.CongestedGasPrice = config.SecretRegisterGasPolicy.MaxGasPrice
+	config.RevealMarginPolicy.MaxExtraBlocks = ctx.Int("reveal-margin-max-extra-blocks")
+	if config.RevealMarginPolicy.MaxExtraBlocks < 0 {
+		err = fmt.Errorf("invalid reveal-margin-max-extra-blocks %d", config.RevealMarginPolicy.MaxExtraBlocks)
+		return
+	}
+	config.AutoSettle = ctx.Bool("auto-settle")
+	if ctx.Int("routing-history-half-life") <= 0 {
+		err = fmt.Errorf("invalid routing-history-half-life %d", ctx.Int("routing-history-half-life"))
+		return
+	}
+	config.RoutingHistoryHalfLife = time.Duration(ctx.Int("routing-history-half-life")) * time.Minute
+	config.EnableChannelGossip = ctx.Bool("channel-gossip")
+	if ctx.Int("channel-announce-interval") <= 0 {
+		err = fmt.Errorf("invalid channel-announce-interval %d", ctx.Int("channel-announce-interval"))
+		return
+	}
+	config.ChannelAnnounceInterval = time.Duration(ctx.Int("channel-announce-interval")) * time.Minute
+	config.EnableOnionRouting = ctx.Bool("onion-routing")
+	if config.EnableOnionRouting && !config.EnableChannelGossip {
+		err = fmt.Errorf("onion-routing needs channel-gossip")
+		return
+	}
+	config.EnableMeshDiscovery = ctx.Bool("mesh-discovery")
+	config.MeshDiscoveryAddress = ctx.String("mesh-discovery-address")
+	if config.EnableMeshDiscovery {
+		if _, err = net.ResolveUDPAddr("udp4", config.MeshDiscoveryAddress); err != nil {
+			err = fmt.Errorf("invalid mesh-discovery-address %s, err %s", config.MeshDiscoveryAddress, err)
+			return
+		}
+		if config.NetworkMode == params.XMPPOnly {
+			err = fmt.Errorf("mesh-discovery needs udp")
+			return
+		}
+	}
+	if len(ctx.String("rebalance-threshold")) > 0 {
+		threshold, ok := new(big.Int).SetString(ctx.String("rebalance-threshold"), 0)
+		if !ok || threshold.Sign() <= 0 {
+			err = fmt.Errorf("invalid rebalance-threshold %s", ctx.String("rebalance-threshold"))
+			return
+		}
+		config.RebalanceThreshold = threshold
+		config.RebalanceMaxFee = big.NewInt(0)
+		if len(ctx.String("rebalance-max-fee")) > 0 {
+			maxFee, ok := new(big.Int).SetString(ctx.String("rebalance-max-fee"), 0)
+			if !ok || maxFee.Sign() < 0 {
+				err = fmt.Errorf("invalid rebalance-max-fee %s", ctx.String("rebalance-max-fee"))
+				return
+			}
+			config.RebalanceMaxFee = maxFee
+		}
+	}
 	return
 }
 
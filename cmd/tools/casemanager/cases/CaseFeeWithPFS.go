@@ -20,10 +20,15 @@ func (cm *CaseManager) CaseFeeWithPFS() (err error) {
 			env.KillAllPhotonNodes()
 		}
 	}()
+	// 使用进程内启动的pfs, 不依赖外部服务
+	pfs, err := env.StartPfs("127.0.0.1:7000")
+	if err != nil {
+		return
+	}
+	defer pfs.Stop()
 	// 源数据
 	params := []string{
-		"--fee", "--pfs=http://transport01.smartmesh.cn:7002",
-		//"--fee", "--pfs=http://192.168.124.9:7000",
+		"--fee", "--pfs=http://127.0.0.1:7000",
 	}
 	var transferAmount int32
 	var fee int64
@@ -0,0 +1,127 @@
+package cases
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/SmartMeshFoundation/Atmosphere/cmd/tools/casemanager/models"
+	"github.com/SmartMeshFoundation/Atmosphere/params"
+)
+
+// crashCaseReplayQuitEvents 发起方(节点1),中间节点(节点2),接收方(节点3)在一次正常交易中会经过的所有 ConditionQuit 点
+var crashCaseReplayQuitEvents = [][]string{
+	{
+		"ActionInitInitiatorStateChange",
+		"EventSendMediatedTransferBefore",
+		"EventSendMediatedTransferAfter",
+		"ReceiveMediatedTransferAck",
+		"ReceiveSecretRequestStateChange",
+		"EventSendRevealSecretBefore",
+		"EventSendRevealSecretAfter",
+		"ReceiveRevealSecretAck",
+		"ReceiveSecretRevealStateChange",
+		"EventSendUnlockBefore",
+		"EventSendUnlockAfter",
+	},
+	{
+		"ActionInitMediatorStateChange",
+		"EventSendMediatedTransferBefore",
+		"EventSendMediatedTransferAfter",
+		"ReceiveMediatedTransferAck",
+		"ReceiveSecretRequestStateChange",
+		"ReceiveSecretRevealStateChange",
+		"EventSendRevealSecretBefore",
+		"EventSendRevealSecretAfter",
+		"ReceiveRevealSecretAck",
+		"ReceiveUnlockStateChange",
+		"EventSendUnlockBefore",
+		"EventSendUnlockAfter",
+	},
+	{
+		"ActionInitTargetStateChange",
+		"EventSendSecretRequestBefore",
+		"EventSendSecretRequestAfter",
+		"ReceiveSecretRequestAck",
+		"ReceiveSecretRevealStateChange",
+		"EventSendRevealSecretBefore",
+		"EventSendRevealSecretAfter",
+		"ReceiveRevealSecretAck",
+		"ReceiveUnlockStateChange",
+	},
+}
+
+// CrashCaseReplay 崩溃恢复-StateChange 日志重放
+// 节点1通过节点2向节点3发送20个token,节点1,2,3依次在各自的每一个 ConditionQuit 点崩溃,
+// 重启崩溃的节点以后,交易从日志中恢复并继续,最终各通道的数据必须和不崩溃时完全一样.
+func (cm *CaseManager) CrashCaseReplay() (err error) {
+	models.Logger.Println("CrashCaseReplay BEGIN ====>")
+	expected, err := cm.crashCaseReplayOnce(-1, "")
+	if err != nil {
+		return
+	}
+	for node, quitEvents := range crashCaseReplayQuitEvents {
+		for _, quitEvent := range quitEvents {
+			var cds []*models.Channel
+			cds, err = cm.crashCaseReplayOnce(node, quitEvent)
+			if err != nil {
+				return
+			}
+			for i, cd := range cds {
+				if cd.Balance != expected[i].Balance || cd.LockedAmount != expected[i].LockedAmount ||
+					cd.PartnerBalance != expected[i].PartnerBalance || cd.PartnerLockedAmount != expected[i].PartnerLockedAmount {
+					models.Logger.Printf("node %d crash at %s, channel %s differs from transfer without crash\n", node+1, quitEvent, cd.Name)
+					return cm.caseFail("CrashCaseReplay")
+				}
+			}
+		}
+	}
+	models.Logger.Println("CrashCaseReplay END ====> SUCCESS")
+	return
+}
+
+// crashCaseReplayOnce 第 crashNode 个节点(从0开始)在 quitEvent 崩溃并重启, quitEvent 为空时不崩溃, 返回交易结束以后 cd12, cd23 的数据
+func (cm *CaseManager) crashCaseReplayOnce(crashNode int, quitEvent string) (cds []*models.Channel, err error) {
+	env, err := models.NewTestEnv("./cases/CrashCaseReplay.ENV")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if env.Debug == false {
+			env.KillAllPhotonNodes()
+		}
+	}()
+	var transAmount int32 = 20
+	tokenAddress := env.Tokens[0].TokenAddress.String()
+	N1, N2, N3 := env.Nodes[0], env.Nodes[1], env.Nodes[2]
+	models.Logger.Println(env.CaseName + fmt.Sprintf(" node %d crash at ", crashNode+1) + quitEvent)
+	for i, n := range []*models.PhotonNode{N1, N2, N3} {
+		if i == crashNode {
+			n.StartWithConditionQuit(env, &params.ConditionQuit{
+				QuitEvent: quitEvent,
+			})
+		} else {
+			n.Start(env)
+		}
+	}
+	go N1.SendTrans(tokenAddress, transAmount, N3.Address, false)
+	time.Sleep(time.Second * 3)
+	if crashNode >= 0 {
+		N := env.Nodes[crashNode]
+		if N.IsRunning() {
+			msg := "Node " + N.Name + " should be exited at " + quitEvent + ",but it still running, FAILED !!!"
+			models.Logger.Println(msg)
+			err = fmt.Errorf(msg)
+			return
+		}
+		N.ReStartWithoutConditionquit(env)
+	}
+	time.Sleep(time.Second * 30)
+	cd12 := N1.GetChannelWith(N2, tokenAddress).PrintDataAfterRestart()
+	cd23 := N2.GetChannelWith(N3, tokenAddress).PrintDataAfterRestart()
+	if !cd12.CheckEqualByPartnerNode(env) || !cd23.CheckEqualByPartnerNode(env) {
+		err = cm.caseFail(env.CaseName)
+		return
+	}
+	cds = []*models.Channel{cd12, cd23}
+	return
+}
@@ -23,6 +23,8 @@ import (
 	"github.com/SmartMeshFoundation/Atmosphere/accounts"
 	"github.com/SmartMeshFoundation/Atmosphere/contracts"
 	"github.com/SmartMeshFoundation/Atmosphere/contracts/test/tokens/tokenerc223approve"
+	"github.com/SmartMeshFoundation/Atmosphere/network/helper"
+	"github.com/SmartMeshFoundation/Atmosphere/pfsproxy"
 	"github.com/SmartMeshFoundation/Atmosphere/utils"
 	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
@@ -430,6 +432,29 @@ func (env *TestEnv) KillAllPhotonNodes() {
 	Logger.Println("Kill all atmosphere nodes SUCCESS")
 }
 
+// StartPfs : start pfs of this repo in process for nodes started with --pfs=http://listenAddress, old pfs data is removed
+func (env *TestEnv) StartPfs(listenAddress string) (*pfsproxy.PfsServer, error) {
+	dataDir := filepath.Join(env.DataDir, "pfs")
+	err := os.RemoveAll(dataDir)
+	if err == nil {
+		err = os.MkdirAll(dataDir, os.ModePerm)
+	}
+	if err != nil {
+		return nil, err
+	}
+	client, err := helper.NewSafeClient(env.EthRPCEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	s, err := pfsproxy.NewPfsServer(filepath.Join(dataDir, "pfs.db"), client, common.HexToAddress(env.TokenNetworkAddress))
+	if err != nil {
+		return nil, err
+	}
+	s.Start(listenAddress)
+	Logger.Printf("pfs started on %s\n", listenAddress)
+	return s, nil
+}
+
 // ClearHistoryData :
 func (env *TestEnv) ClearHistoryData() {
 	if env.DataDir == "" {
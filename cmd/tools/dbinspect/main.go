@@ -0,0 +1,291 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/SmartMeshFoundation/Atmosphere/channel"
+	"github.com/SmartMeshFoundation/Atmosphere/channel/channeltype"
+	"github.com/SmartMeshFoundation/Atmosphere/models"
+	"github.com/SmartMeshFoundation/Atmosphere/transfer"
+	"github.com/SmartMeshFoundation/Atmosphere/transfer/mediatedtransfer"
+	_ "github.com/SmartMeshFoundation/Atmosphere/transfer/mediatedtransfer/initiator" //register StateTransition
+	_ "github.com/SmartMeshFoundation/Atmosphere/transfer/mediatedtransfer/mediator"
+	_ "github.com/SmartMeshFoundation/Atmosphere/transfer/mediatedtransfer/target"
+	"github.com/SmartMeshFoundation/Atmosphere/transfer/mtree"
+	"github.com/SmartMeshFoundation/Atmosphere/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/urfave/cli"
+)
+
+/*
+dbinspect 以只读方式打开节点的数据库, 节点不需要运行.
+可以列出 StateManager, 通道, 未完成的锁以及还没有收到 ack 的消息,
+也可以把记录下来的 StateChange 重新交给 initiator/mediator/target 的状态机处理, 打印每一个 Event,
+用来重现卡住的交易.
+重放只在内存中进行, 不会修改数据库, 也不会发送任何消息或者交易.
+*/
+/*
+ *	dbinspect opens db of a node read-only, node doesn't need to be running.
+ *	It lists StateManagers, channels, pending locks and messages not acked yet,
+ *	and replays recorded StateChanges through initiator/mediator/target state machines, printing every Event,
+ *	to reproduce a stuck transfer.
+ *	Replay happens in memory only, it never modifies db, sends messages or transactions.
+ */
+func main() {
+	app := cli.NewApp()
+	app.Name = "dbinspect"
+	app.Usage = "inspect db of a stopped atmosphere node"
+	app.Version = "0.1"
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "db",
+			Usage: "path of the db file of node, for example ~/.atmosphere/0x1a9e/log.db",
+		},
+	}
+	app.Commands = []cli.Command{
+		{
+			Name:   "statemanagers",
+			Usage:  "list all StateManagers and state changes not included in their snapshots",
+			Action: listStateManagers,
+		},
+		{
+			Name:   "channels",
+			Usage:  "list all channels",
+			Action: listChannels,
+		},
+		{
+			Name:   "locks",
+			Usage:  "list pending and unclaimed locks of all channels",
+			Action: listLocks,
+		},
+		{
+			Name:   "messages",
+			Usage:  "list messages sent but not acked yet",
+			Action: listMessages,
+		},
+		{
+			Name:  "replay",
+			Usage: "replay state changes logged after the snapshot of a StateManager and print every event",
+			Flags: []cli.Flag{
+				cli.Int64Flag{
+					Name:  "id",
+					Usage: "id of the StateManager, 0 means all",
+				},
+				cli.BoolFlag{
+					Name:  "full",
+					Usage: "replay all state changes from the beginning in the audit log instead of from the snapshot",
+				},
+			},
+			Action: replay,
+		},
+	}
+	err := app.Run(os.Args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+}
+
+func openDb(ctx *cli.Context) (*models.ModelDB, error) {
+	dbPath := ctx.GlobalString("db")
+	if len(dbPath) == 0 {
+		return nil, fmt.Errorf("must specify --db")
+	}
+	return models.OpenDbReadOnly(dbPath)
+}
+
+func listStateManagers(ctx *cli.Context) error {
+	db, err := openDb(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.CloseDB()
+	logs := db.GetAllStateChangeLogs()
+	for _, mgr := range db.GetAllStateManagers() {
+		fmt.Printf("StateManager id=%d name=%s identifier=%s key=%s lastStateChangeID=%d audits=%d\n",
+			mgr.ID, mgr.Name, utils.HPex(mgr.Identifier), utils.HPex(mgr.Key), mgr.LastStateChangeID, len(db.GetStateChangeAudits(mgr.ID)))
+		fmt.Printf("  state %T=%s\n", mgr.CurrentState, utils.StringInterface(mgr.CurrentState, 3))
+		for _, l := range logs {
+			if l.StateManagerID == mgr.ID {
+				fmt.Printf("  log %d %T=%s\n", l.ID, l.StateChange, utils.StringInterface(l.StateChange, 2))
+			}
+		}
+	}
+	return nil
+}
+
+func listChannels(ctx *cli.Context) error {
+	db, err := openDb(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.CloseDB()
+	cs, err := db.GetChannelList(utils.EmptyAddress, utils.EmptyAddress)
+	if err != nil {
+		return err
+	}
+	for _, c := range cs {
+		fmt.Printf("channel %s token=%s partner=%s state=%s ourBalance=%s partnerBalance=%s ourLocks=%d partnerLocks=%d\n",
+			utils.HPex(c.ChannleAddress()), utils.APex2(c.TokenAddress()), utils.APex2(c.PartnerAddress()), c.State,
+			c.OurBalance(), c.PartnerBalance(), len(c.OurLeaves), len(c.PartnerLeaves))
+	}
+	return nil
+}
+
+func listLocks(ctx *cli.Context) error {
+	db, err := openDb(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.CloseDB()
+	cs, err := db.GetChannelList(utils.EmptyAddress, utils.EmptyAddress)
+	if err != nil {
+		return err
+	}
+	printLock := func(c *channeltype.Serialization, side string, l *mtree.Lock, secret common.Hash) {
+		fmt.Printf("channel %s %s lockSecretHash=%s amount=%s expiration=%d secret=%s\n",
+			utils.HPex(c.ChannleAddress()), side, utils.HPex(l.LockSecretHash), l.Amount, l.Expiration, utils.HPex(secret))
+	}
+	for _, c := range cs {
+		for _, l := range c.OurLock2PendingLocks() {
+			printLock(c, "our pending", l.Lock, utils.EmptyHash)
+		}
+		for _, l := range c.OurLock2UnclaimedLocks() {
+			printLock(c, "our unclaimed", l.Lock, l.Secret)
+		}
+		for _, l := range c.PartnerLock2PendingLocks() {
+			printLock(c, "partner pending", l.Lock, utils.EmptyHash)
+		}
+		for _, l := range c.PartnerLock2UnclaimedLocks() {
+			printLock(c, "partner unclaimed", l.Lock, l.Secret)
+		}
+	}
+	return nil
+}
+
+func listMessages(ctx *cli.Context) error {
+	db, err := openDb(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.CloseDB()
+	for _, m := range db.GetAllOrderedSentEnvelopMessager() {
+		fmt.Printf("message echohash=%s receiver=%s time=%s %s\n",
+			utils.BPex(m.EchoHash), utils.APex2(m.Receiver), m.Time.Format("2006-01-02 15:04:05"), m.Message)
+	}
+	return nil
+}
+
+/*
+replay 用数据库中保存的通道重新构造出内存中的通道, 然后从 StateManager 的快照开始,
+按顺序处理快照之后记录的 StateChange, 打印状态机产生的 Event 以及最终的状态.
+快照保存以后之前的 StateChange 记录就删除了, 指定 --full 时从空的状态开始, 重放 audit 日志中的所有 StateChange.
+注意通道是数据库中现在的状态, 不是当时的状态, 从头重放的时候通道相关的检查可能和当时不一样.
+*/
+/*
+ *	replay : channels are rebuilt in memory from db, then starting from the snapshot of StateManager,
+ *	state changes logged after it are handled in order, events emitted by state machine and the final state are printed.
+ *	Logs before a snapshot are removed once it's saved, with --full it starts from an empty state and replays
+ *	all state changes in the audit log.
+ *	Note that channels are as they are in db now rather than at that time,
+ *	checks about channels may differ from that time when replayed from the beginning.
+ */
+func replay(ctx *cli.Context) error {
+	db, err := openDb(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.CloseDB()
+	channels, err := loadChannels(db)
+	if err != nil {
+		return err
+	}
+	findChannel := func(channelIdentifier common.Hash) *channel.Channel {
+		return channels[channelIdentifier]
+	}
+	id := ctx.Int64("id")
+	full := ctx.Bool("full")
+	logs := db.GetAllStateChangeLogs()
+	for _, mgr := range db.GetAllStateManagers() {
+		if id != 0 && mgr.ID != id {
+			continue
+		}
+		fmt.Printf("StateManager id=%d name=%s identifier=%s\n", mgr.ID, mgr.Name, utils.HPex(mgr.Identifier))
+		mgr.FuncStateTransition = transfer.GetStateTransition(mgr.Name)
+		if mgr.FuncStateTransition == nil {
+			fmt.Printf("  unknown state transition %s\n", mgr.Name)
+			continue
+		}
+		mgrLogs := logs
+		if full {
+			mgr.CurrentState = nil
+			mgrLogs = nil
+			for _, a := range db.GetStateChangeAudits(mgr.ID) {
+				l := models.StateChangeLog(*a)
+				mgrLogs = append(mgrLogs, &l)
+			}
+		}
+		err = mediatedtransfer.RestoreState(mgr.CurrentState, db, findChannel)
+		if err != nil {
+			fmt.Printf("  restore state err %s\n", err)
+			continue
+		}
+		for _, l := range mgrLogs {
+			if l.StateManagerID != mgr.ID {
+				continue
+			}
+			err = mediatedtransfer.RestoreStateChange(l.StateChange, db, findChannel)
+			if err != nil {
+				fmt.Printf("  restore state change %d err %s\n", l.ID, err)
+				break
+			}
+			fmt.Printf("  state change %d %T=%s\n", l.ID, l.StateChange, utils.StringInterface(l.StateChange, 2))
+			for _, e := range mgr.Dispatch(l.StateChange) {
+				fmt.Printf("    event %T=%s\n", e, utils.StringInterface(e, 2))
+			}
+		}
+		fmt.Printf("  final state %T=%s\n", mgr.CurrentState, utils.StringInterface(mgr.CurrentState, 3))
+	}
+	return nil
+}
+
+/*
+loadChannels 构造出的通道没有连接到链上, 私钥也是随机生成的, 只能用于状态机的计算.
+*/
+// loadChannels : channels built are not connected to chain and have a random private key, they are only for state machine.
+func loadChannels(db *models.ModelDB) (channels map[common.Hash]*channel.Channel, err error) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		return
+	}
+	cs, err := db.GetChannelList(utils.EmptyAddress, utils.EmptyAddress)
+	if err != nil {
+		return
+	}
+	channels = make(map[common.Hash]*channel.Channel)
+	for _, c := range cs {
+		ourState := channel.NewChannelEndState(c.OurAddress, c.OurContractBalance,
+			c.OurBalanceProof, mtree.NewMerkleTree(c.OurLeaves))
+		partnerState := channel.NewChannelEndState(c.PartnerAddress(),
+			c.PartnerContractBalance,
+			c.PartnerBalanceProof, mtree.NewMerkleTree(c.PartnerLeaves))
+		externState := channel.NewChannelExternalState(func(*channel.Channel, common.Hash) {}, nil,
+			c.ChannelIdentifier, key, nil, db, c.ClosedBlock,
+			c.OurAddress, c.PartnerAddress())
+		ch, err2 := channel.NewChannel(ourState, partnerState, externState, c.TokenAddress(), c.ChannelIdentifier, c.RevealTimeout, c.SettleTimeout)
+		if err2 != nil {
+			fmt.Printf("ignore channel %s err %s\n", utils.HPex(c.ChannleAddress()), err2)
+			continue
+		}
+		ch.OurState.Lock2PendingLocks = c.OurLock2PendingLocks()
+		ch.OurState.Lock2UnclaimedLocks = c.OurLock2UnclaimedLocks()
+		ch.PartnerState.Lock2PendingLocks = c.PartnerLock2PendingLocks()
+		ch.PartnerState.Lock2UnclaimedLocks = c.PartnerLock2UnclaimedLocks()
+		ch.State = c.State
+		ch.ExternState.SettledBlock = c.SettledBlock
+		channels[c.ChannelIdentifier.ChannelIdentifier] = ch
+	}
+	return
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+
+	"github.com/SmartMeshFoundation/Atmosphere/internal/debug"
+	"github.com/SmartMeshFoundation/Atmosphere/log"
+	"github.com/SmartMeshFoundation/Atmosphere/network/helper"
+	"github.com/SmartMeshFoundation/Atmosphere/params"
+	"github.com/SmartMeshFoundation/Atmosphere/pfsproxy"
+	"github.com/SmartMeshFoundation/Atmosphere/utils"
+	ethutils "github.com/ethereum/go-ethereum/cmd/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/node"
+	"gopkg.in/urfave/cli.v1"
+)
+
+/*
+pfs 是仓库内自带的 path finding 服务, 实现了节点 --pfs 参数使用的全部接口.
+它从 TokenNetwork 的链上事件构建通道网络, 接收节点提交的 BalanceProof 和手续费设置, 为节点查找手续费最少的路径.
+用于自己部署 pfs 以及不依赖外部服务运行需要 pfs 的测试.
+*/
+/*
+ *	pfs is the path finding service in this repo, it implements all the api nodes use with --pfs.
+ *	It builds the channel network from events of TokenNetwork, accepts balance proofs and fee policies nodes submit,
+ *	and finds paths with the least fee for nodes.
+ *	It's used to host pfs yourself and run tests needing pfs without external service.
+ */
+func main() {
+	app := cli.NewApp()
+	app.Name = "pfs"
+	app.Usage = "path finding service for atmosphere nodes"
+	app.Version = "0.1"
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "eth-rpc-endpoint",
+			Usage: `"host:port" address of ethereum JSON-RPC server.`,
+			Value: node.DefaultIPCEndpoint("geth"),
+		},
+		cli.StringFlag{
+			Name:  "token-network-address",
+			Usage: `hex encoded address of the token network contract.`,
+		},
+		cli.StringFlag{
+			Name:  "listen-address",
+			Usage: `"host:port" for the pfs to listen on, nodes use http://host:port as --pfs.`,
+			Value: "0.0.0.0:7000",
+		},
+		ethutils.DirectoryFlag{
+			Name:  "datadir",
+			Usage: "Directory for storing pfs data.",
+			Value: ethutils.DirectoryString{Value: filepath.Join(params.DefaultDataDir(), "pfs")},
+		},
+	}
+	app.Flags = append(app.Flags, debug.Flags...)
+	app.Action = mainCtx
+	app.Before = func(ctx *cli.Context) error {
+		return debug.Setup(ctx)
+	}
+	app.After = func(ctx *cli.Context) error {
+		debug.Exit()
+		return nil
+	}
+	err := app.Run(os.Args)
+	if err != nil {
+		fmt.Printf("quit with err %s\n", err)
+	}
+}
+
+func mainCtx(ctx *cli.Context) (err error) {
+	tokenNetworkAddress, err := utils.HexToAddress(ctx.String("token-network-address"))
+	if err == nil && tokenNetworkAddress == utils.EmptyAddress {
+		err = errors.New("token-network-address is needed")
+	}
+	if err != nil {
+		return
+	}
+	dataDir := ctx.String("datadir")
+	err = os.MkdirAll(dataDir, os.ModePerm)
+	if err != nil {
+		return
+	}
+	client, err := helper.NewSafeClient(ctx.String("eth-rpc-endpoint"))
+	if err != nil {
+		return
+	}
+	defer client.Close()
+	s, err := pfsproxy.NewPfsServer(filepath.Join(dataDir, fmt.Sprintf("pfs-%s.db", common.Bytes2Hex(tokenNetworkAddress[:4]))), client, tokenNetworkAddress)
+	if err != nil {
+		return
+	}
+	s.Start(ctx.String("listen-address"))
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt)
+	<-quit
+	log.Info("pfs quit now")
+	s.Stop()
+	return nil
+}
@@ -18,11 +18,32 @@ contract SecretRegistry {
     /// @param secret The secret used to lock the hash time lock.
     /// @return true if secret was registered, false if the secret was already registered.
     function registerSecret(bytes32 secret) public returns (bool) {
-        bytes32 secrethash = sha256(abi.encodePacked(secret));
         //secret already registered
-        if (secret == 0x0 || secrethash_to_block[secrethash] > 0) {
+        if (!_registerSecret(secret)) {
             revert();
         }
+        return true;
+    }
+
+    /// @notice Registers multiple hash time lock secrets in one transaction.
+    /// Secrets already registered are skipped, so that one of them doesn't make the whole batch fail.
+    /// @param secrets The secrets used to lock the hash time locks.
+    /// @return true if all secrets were registered, false if any of them was already registered.
+    function registerSecretBatch(bytes32[] secrets) public returns (bool) {
+        bool completeSuccess = true;
+        for (uint i = 0; i < secrets.length; i++) {
+            if (!_registerSecret(secrets[i])) {
+                completeSuccess = false;
+            }
+        }
+        return completeSuccess;
+    }
+
+    function _registerSecret(bytes32 secret) internal returns (bool) {
+        bytes32 secrethash = sha256(abi.encodePacked(secret));
+        if (secret == 0x0 || secrethash_to_block[secrethash] > 0) {
+            return false;
+        }
         secrethash_to_block[secrethash] = block.number;
         emit SecretRevealed(secret);
         return true;
@@ -177,7 +177,7 @@ func (_ECVerify *ECVerifyTransactorRaw) Transact(opts *bind.TransactOpts, method
 }
 
 // SecretRegistryABI is the input ABI used to generate the binding from.
-const SecretRegistryABI = "[{\"constant\":false,\"inputs\":[{\"name\":\"secret\",\"type\":\"bytes32\"}],\"name\":\"registerSecret\",\"outputs\":[{\"name\":\"\",\"type\":\"bool\"}],\"payable\":false,\"stateMutability\":\"nonpayable\",\"type\":\"function\"},{\"constant\":true,\"inputs\":[{\"name\":\"\",\"type\":\"bytes32\"}],\"name\":\"secrethash_to_block\",\"outputs\":[{\"name\":\"\",\"type\":\"uint256\"}],\"payable\":false,\"stateMutability\":\"view\",\"type\":\"function\"},{\"constant\":true,\"inputs\":[],\"name\":\"contract_version\",\"outputs\":[{\"name\":\"\",\"type\":\"string\"}],\"payable\":false,\"stateMutability\":\"view\",\"type\":\"function\"},{\"constant\":true,\"inputs\":[{\"name\":\"secrethash\",\"type\":\"bytes32\"}],\"name\":\"getSecretRevealBlockHeight\",\"outputs\":[{\"name\":\"\",\"type\":\"uint256\"}],\"payable\":false,\"stateMutability\":\"view\",\"type\":\"function\"},{\"anonymous\":false,\"inputs\":[{\"indexed\":true,\"name\":\"secret\",\"type\":\"bytes32\"}],\"name\":\"SecretRevealed\",\"type\":\"event\"}]"
+const SecretRegistryABI = "[{\"constant\":false,\"inputs\":[{\"name\":\"secret\",\"type\":\"bytes32\"}],\"name\":\"registerSecret\",\"outputs\":[{\"name\":\"\",\"type\":\"bool\"}],\"payable\":false,\"stateMutability\":\"nonpayable\",\"type\":\"function\"},{\"constant\":false,\"inputs\":[{\"name\":\"secrets\",\"type\":\"bytes32[]\"}],\"name\":\"registerSecretBatch\",\"outputs\":[{\"name\":\"\",\"type\":\"bool\"}],\"payable\":false,\"stateMutability\":\"nonpayable\",\"type\":\"function\"},{\"constant\":true,\"inputs\":[{\"name\":\"\",\"type\":\"bytes32\"}],\"name\":\"secrethash_to_block\",\"outputs\":[{\"name\":\"\",\"type\":\"uint256\"}],\"payable\":false,\"stateMutability\":\"view\",\"type\":\"function\"},{\"constant\":true,\"inputs\":[],\"name\":\"contract_version\",\"outputs\":[{\"name\":\"\",\"type\":\"string\"}],\"payable\":false,\"stateMutability\":\"view\",\"type\":\"function\"},{\"constant\":true,\"inputs\":[{\"name\":\"secrethash\",\"type\":\"bytes32\"}],\"name\":\"getSecretRevealBlockHeight\",\"outputs\":[{\"name\":\"\",\"type\":\"uint256\"}],\"payable\":false,\"stateMutability\":\"view\",\"type\":\"function\"},{\"anonymous\":false,\"inputs\":[{\"indexed\":true,\"name\":\"secret\",\"type\":\"bytes32\"}],\"name\":\"SecretRevealed\",\"type\":\"event\"}]"
 
 // SecretRegistryBin is the compiled bytecode used for deploying new contracts.
 const SecretRegistryBin = `0x608060405234801561001057600080fd5b5061032f806100206000396000f3006080604052600436106100615763ffffffff7c010000000000000000000000000000000000000000000000000000000060003504166312ad8bfc81146100665780639734030914610092578063b32c65c8146100bc578063c1f6294614610146575b600080fd5b34801561007257600080fd5b5061007e60043561015e565b604080519115158252519081900360200190f35b34801561009e57600080fd5b506100aa6004356102a8565b60408051918252519081900360200190f35b3480156100c857600080fd5b506100d16102ba565b6040805160208082528351818301528351919283929083019185019080838360005b8381101561010b5781810151838201526020016100f3565b50505050905090810190601f1680156101385780820380516001836020036101000a031916815260200191505b509250505060405180910390f35b34801561015257600080fd5b506100aa6004356102f1565b6040805160208082018490528251808303820181529183019283905281516000938493600293909282918401908083835b602083106101cc57805182527fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffe0909201916020918201910161018f565b51815160209384036101000a7fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff018019909216911617905260405191909301945091925050808303816000865af115801561022b573d6000803e3d6000fd5b5050506040513d602081101561024057600080fd5b5051905082158061025d5750600081815260208190526040812054115b1561026757600080fd5b6000818152602081905260408082204390555184917f9b7ddc883342824bd7ddbff103e7a69f8f2e60b96c075cd1b8b8b9713ecc75a491a250600192915050565b60006020819052908152604090205481565b60408051808201909152600581527f302e352e5f000000000000000000000000000000000000000000000000000000602082015281565b600090815260208190526040902054905600a165627a7a7230582052c221c99826eeb65ea7ad88e920cfcc8d1f54a2a9dfed68dda83eb32a97b7b00029`
@@ -436,6 +436,27 @@ func (_SecretRegistry *SecretRegistryTransactorSession) RegisterSecret(secret [3
 	return _SecretRegistry.Contract.RegisterSecret(&_SecretRegistry.TransactOpts, secret)
 }
 
+// RegisterSecretBatch is a paid mutator transaction binding the contract method 0xbbe8a9b6.
+//
+// Solidity: function registerSecretBatch(secrets bytes32[]) returns(bool)
+func (_SecretRegistry *SecretRegistryTransactor) RegisterSecretBatch(opts *bind.TransactOpts, secrets [][32]byte) (*types.Transaction, error) {
+	return _SecretRegistry.contract.Transact(opts, "registerSecretBatch", secrets)
+}
+
+// RegisterSecretBatch is a paid mutator transaction binding the contract method 0xbbe8a9b6.
+//
+// Solidity: function registerSecretBatch(secrets bytes32[]) returns(bool)
+func (_SecretRegistry *SecretRegistrySession) RegisterSecretBatch(secrets [][32]byte) (*types.Transaction, error) {
+	return _SecretRegistry.Contract.RegisterSecretBatch(&_SecretRegistry.TransactOpts, secrets)
+}
+
+// RegisterSecretBatch is a paid mutator transaction binding the contract method 0xbbe8a9b6.
+//
+// Solidity: function registerSecretBatch(secrets bytes32[]) returns(bool)
+func (_SecretRegistry *SecretRegistryTransactorSession) RegisterSecretBatch(secrets [][32]byte) (*types.Transaction, error) {
+	return _SecretRegistry.Contract.RegisterSecretBatch(&_SecretRegistry.TransactOpts, secrets)
+}
+
 // SecretRegistrySecretRevealedIterator is returned from FilterSecretRevealed and is used to iterate over the raw logs and unpacked data for SecretRevealed events raised by the SecretRegistry contract.
 type SecretRegistrySecretRevealedIterator struct {
 	Event *SecretRegistrySecretRevealed // Event containing the contract specifics and raw log
@@ -0,0 +1,299 @@
+package atmosphere
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+
+	"github.com/SmartMeshFoundation/Atmosphere/channel"
+	"github.com/SmartMeshFoundation/Atmosphere/channel/channeltype"
+	"github.com/SmartMeshFoundation/Atmosphere/log"
+	"github.com/SmartMeshFoundation/Atmosphere/models"
+	"github.com/SmartMeshFoundation/Atmosphere/transfer"
+	"github.com/SmartMeshFoundation/Atmosphere/utils"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+//disputeExecutor sends dispute txs of a channel, it's channel.ExternalState except in test
+type disputeExecutor interface {
+	UpdateTransfer(tokenAddress common.Address, bp *transfer.BalanceProofState) (result *utils.AsyncResult)
+	Unlock(tokenAddress common.Address, unlockproofs []*channeltype.UnlockProof, argTransferdAmount *big.Int) (result *utils.AsyncResult)
+	PunishObsoleteUnlock(tokenAddress common.Address, lockhash, additionalHash common.Hash, cheaterSignature []byte) (result *utils.AsyncResult)
+}
+
+/*
+disputeResolver 负责通道关闭以后所有需要在链上执行的操作:
+1. 对方关闭通道, 提交对方给我的最新 BalanceProof
+2. 解锁对方给我的, 我知道密码的锁, 如果密码还没有在链上注册, 先注册密码
+3. 对方 unlock 了他声明放弃的锁, 惩罚对方
+这些操作保存在数据库中, 每个块检查一次, 失败的操作在下一个块重试, 直到成功或者 settle timeout.
+unlock 必须等 BalanceProof 更新成功以后才能进行, 因为合约需要用到对方的 locksroot.
+*/
+/*
+ *	disputeResolver : it's in charge of all on-chain actions after channel closed:
+ *	1. partner closed channel, submit the latest BalanceProof partner gave me
+ *	2. unlock locks partner sent me with known secrets, register secret first if it's not registered on chain
+ *	3. partner unlocked a lock he has announced disposed, punish him
+ *	These actions are saved in db and checked every block, failed action is retried in next block until success or settle timeout.
+ *	Unlock must wait until BalanceProof is updated, because contract needs locksroot of partner.
+ */
+type disputeResolver struct {
+	db *models.ModelDB
+	//all functions below are only called in main loop
+	findChannel    func(channelIdentifier common.Hash) *channel.Channel
+	closedChannels func() []*channel.Channel
+	executor       func(ch *channel.Channel) disputeExecutor
+	registerSecret func(secret common.Hash)
+	lock           sync.Mutex
+	inflight       map[string]bool
+	wg             sync.WaitGroup
+}
+
+func newDisputeResolver(rs *Service) *disputeResolver {
+	return &disputeResolver{
+		db: rs.db,
+		findChannel: func(channelIdentifier common.Hash) *channel.Channel {
+			ch, err := rs.findChannelByIdentifier(channelIdentifier)
+			if err != nil {
+				return nil
+			}
+			return ch
+		},
+		closedChannels: rs.findAllClosedChannels,
+		executor: func(ch *channel.Channel) disputeExecutor {
+			return ch.ExternState
+		},
+		registerSecret: rs.secretRegisterScheduler.add,
+		inflight:       make(map[string]bool),
+	}
+}
+
+//hasPending returns true if there are actions of this channel not finished
+func (d *disputeResolver) hasPending(channelIdentifier common.Hash) bool {
+	actions, err := d.db.GetPendingDisputeActions()
+	if err != nil {
+		log.Error(err.Error())
+		return false
+	}
+	for _, a := range actions {
+		if a.ChannelIdentifier == channelIdentifier {
+			return true
+		}
+	}
+	return false
+}
+
+func disputeDeadline(ch *channel.Channel) int64 {
+	return ch.ExternState.ClosedBlock + int64(ch.SettleTimeout)
+}
+
+func (d *disputeResolver) newAction(ch *channel.Channel, actionType models.DisputeActionType, lockHash common.Hash) bool {
+	created, err := d.db.NewDisputeAction(&models.DisputeAction{
+		ChannelIdentifier: ch.ChannelIdentifier.ChannelIdentifier,
+		OpenBlockNumber:   ch.ChannelIdentifier.OpenBlockNumber,
+		Type:              actionType,
+		LockHash:          lockHash,
+		Deadline:          disputeDeadline(ch),
+	})
+	if err != nil {
+		log.Error(err.Error())
+	}
+	return created
+}
+
+//onChannelClosed plan actions for a channel just closed
+func (d *disputeResolver) onChannelClosed(ch *channel.Channel, closingAddress common.Address) {
+	bp := ch.PartnerState.BalanceProofState
+	if closingAddress != ch.OurState.Address && bp != nil && bp.Nonce > 0 {
+		d.newAction(ch, models.DisputeUpdateBalanceProof, utils.EmptyHash)
+	}
+	d.planUnlocks(ch)
+}
+
+/*
+planUnlocks 对方给我的锁, 只要知道密码并且我没有声明放弃, 就需要解锁.
+通道关闭以后仍然有可能知道新的密码, 所以每个块都要检查.
+*/
+// planUnlocks : locks partner sent me need to be unlocked if secret is known and I haven't announced disposed, secret may be known after closed, so check it every block.
+func (d *disputeResolver) planUnlocks(ch *channel.Channel) {
+	for lockSecretHash, l := range ch.PartnerState.Lock2UnclaimedLocks {
+		if d.db.IsLockSecretHashChannelIdentifierDisposed(lockSecretHash, ch.ChannelIdentifier.ChannelIdentifier) {
+			continue
+		}
+		if d.newAction(ch, models.DisputeUnlock, lockSecretHash) {
+			//contract accepts unlock only if secret is registered before expiration
+			d.registerSecret(l.Secret)
+		}
+	}
+}
+
+//onPartnerUnlock partner unlocked one of my locks, punish him if he has announced disposed it
+func (d *disputeResolver) onPartnerUnlock(ch *channel.Channel, lockHash common.Hash) {
+	ad := d.db.GetReceiviedAnnounceDisposed(lockHash, ch.ChannelIdentifier.ChannelIdentifier)
+	if ad == nil {
+		return
+	}
+	log.Info(fmt.Sprintf("partner %s unlocked lock %s he has disposed, punish him", utils.APex2(ch.PartnerState.Address), utils.HPex(lockHash)))
+	d.newAction(ch, models.DisputePunish, lockHash)
+}
+
+//onBlock send all actions ready to go
+func (d *disputeResolver) onBlock(blockNumber int64) {
+	for _, ch := range d.closedChannels() {
+		if blockNumber < disputeDeadline(ch) {
+			d.planUnlocks(ch)
+		}
+	}
+	actions, err := d.db.GetPendingDisputeActions()
+	if err != nil {
+		log.Error(err.Error())
+		return
+	}
+	waitBalanceProof := make(map[common.Hash]bool)
+	channel2Unlocks := make(map[common.Hash][]*models.DisputeAction)
+	for _, a := range actions {
+		if a.Type == models.DisputeUpdateBalanceProof {
+			waitBalanceProof[a.ChannelIdentifier] = true
+		}
+	}
+	for _, a := range actions {
+		if d.isInflight(a) {
+			continue
+		}
+		ch := d.findChannel(a.ChannelIdentifier)
+		if ch == nil || ch.ChannelIdentifier.OpenBlockNumber != a.OpenBlockNumber || ch.State != channeltype.StateClosed {
+			d.finish(a, blockNumber, models.DisputeExpired, errors.New("channel is not closed any more"))
+			continue
+		}
+		if blockNumber >= a.Deadline {
+			d.finish(a, blockNumber, models.DisputeExpired, fmt.Errorf("settle timeout at block %d", a.Deadline))
+			continue
+		}
+		executor := d.executor(ch)
+		switch a.Type {
+		case models.DisputeUpdateBalanceProof:
+			d.send(a, blockNumber, executor.UpdateTransfer(ch.TokenAddress, ch.PartnerState.BalanceProofState))
+		case models.DisputeUnlock:
+			if waitBalanceProof[a.ChannelIdentifier] {
+				//wait until balance proof of partner is on chain
+				continue
+			}
+			channel2Unlocks[a.ChannelIdentifier] = append(channel2Unlocks[a.ChannelIdentifier], a)
+		case models.DisputePunish:
+			ad := d.db.GetReceiviedAnnounceDisposed(a.LockHash, a.ChannelIdentifier)
+			if ad == nil {
+				d.finish(a, blockNumber, models.DisputeExpired, errors.New("AnnounceDisposed not found"))
+				continue
+			}
+			d.send(a, blockNumber, executor.PunishObsoleteUnlock(ch.TokenAddress, a.LockHash, ad.AdditionalHash, ad.Signature))
+		}
+	}
+	for channelIdentifier, unlocks := range channel2Unlocks {
+		d.sendUnlocks(d.findChannel(channelIdentifier), unlocks, blockNumber)
+	}
+}
+
+/*
+sendUnlocks 同一个通道的 unlock 必须依次进行, 因为每次 unlock 都会改变合约上的 transferAmount.
+*/
+// sendUnlocks : unlocks of one channel must be sent one by one, because every unlock changes transferAmount on contract.
+func (d *disputeResolver) sendUnlocks(ch *channel.Channel, unlocks []*models.DisputeAction, blockNumber int64) {
+	channelKey := string(ch.ChannelIdentifier.ChannelIdentifier[:])
+	d.lock.Lock()
+	busy := d.inflight[channelKey]
+	d.lock.Unlock()
+	if busy {
+		return
+	}
+	var proofs []*channeltype.UnlockProof
+	var ready []*models.DisputeAction
+	for _, a := range unlocks {
+		l, ok := ch.PartnerState.Lock2UnclaimedLocks[a.LockHash]
+		if !ok {
+			d.finish(a, blockNumber, models.DisputeExpired, errors.New("lock not found"))
+			continue
+		}
+		proofs = append(proofs, channel.ComputeProofForLock(l.Lock, ch.PartnerState.Tree))
+		ready = append(ready, a)
+	}
+	if len(ready) == 0 {
+		return
+	}
+	d.lock.Lock()
+	d.inflight[channelKey] = true
+	for _, a := range ready {
+		d.inflight[string(a.Key)] = true
+		a.Attempts++
+	}
+	d.lock.Unlock()
+	result := d.executor(ch).Unlock(ch.TokenAddress, proofs, ch.PartnerState.ContractTransferAmount())
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		err := <-result.Result
+		for _, a := range ready {
+			//Unlock marks every lock unlocked successfully even if some of them failed
+			if err == nil || d.db.IsThisLockHasUnlocked(a.ChannelIdentifier, a.LockHash) {
+				d.finish(a, blockNumber, models.DisputeSuccess, nil)
+			} else {
+				d.retry(a, err)
+			}
+		}
+		d.lock.Lock()
+		delete(d.inflight, channelKey)
+		d.lock.Unlock()
+	}()
+}
+
+func (d *disputeResolver) isInflight(a *models.DisputeAction) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.inflight[string(a.Key)]
+}
+
+func (d *disputeResolver) send(a *models.DisputeAction, blockNumber int64, result *utils.AsyncResult) {
+	d.lock.Lock()
+	d.inflight[string(a.Key)] = true
+	d.lock.Unlock()
+	a.Attempts++
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		err := <-result.Result
+		if err == nil {
+			d.finish(a, blockNumber, models.DisputeSuccess, nil)
+		} else {
+			d.retry(a, err)
+		}
+	}()
+}
+
+func (d *disputeResolver) retry(a *models.DisputeAction, err error) {
+	log.Error(fmt.Sprintf("dispute %s on channel %s failed %s, retry in next block", a.Type, utils.HPex(a.ChannelIdentifier), err))
+	a.LastError = err.Error()
+	d.save(a)
+}
+
+func (d *disputeResolver) finish(a *models.DisputeAction, blockNumber int64, status models.DisputeStatus, err error) {
+	a.Status = status
+	a.DoneBlock = blockNumber
+	if err != nil {
+		a.LastError = err.Error()
+		log.Error(fmt.Sprintf("dispute %s on channel %s,lock=%s %s: %s, you may lose your token",
+			a.Type, utils.HPex(a.ChannelIdentifier), utils.HPex(a.LockHash), status, err))
+	} else {
+		log.Info(fmt.Sprintf("dispute %s on channel %s,lock=%s %s", a.Type, utils.HPex(a.ChannelIdentifier), utils.HPex(a.LockHash), status))
+	}
+	d.save(a)
+}
+
+func (d *disputeResolver) save(a *models.DisputeAction) {
+	err := d.db.UpdateDisputeAction(a)
+	d.lock.Lock()
+	delete(d.inflight, string(a.Key))
+	d.lock.Unlock()
+	if err != nil {
+		log.Error(err.Error())
+	}
+}
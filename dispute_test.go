@@ -0,0 +1,154 @@
+package atmosphere
+
+import (
+	"errors"
+	"math/big"
+	"sync"
+	"testing"
+
+	"github.com/SmartMeshFoundation/Atmosphere/channel"
+	"github.com/SmartMeshFoundation/Atmosphere/channel/channeltype"
+	"github.com/SmartMeshFoundation/Atmosphere/models"
+	"github.com/SmartMeshFoundation/Atmosphere/transfer"
+	"github.com/SmartMeshFoundation/Atmosphere/transfer/mtree"
+	"github.com/SmartMeshFoundation/Atmosphere/utils"
+	"github.com/SmartMeshFoundation/Atmosphere/utils/utest"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+type fakeDisputeExecutor struct {
+	lock    sync.Mutex
+	calls   []string
+	unlocks [][]*channeltype.UnlockProof
+	fail    bool
+}
+
+func (f *fakeDisputeExecutor) result(call string) *utils.AsyncResult {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.calls = append(f.calls, call)
+	if f.fail {
+		return utils.NewAsyncResultWithError(errors.New("tx failed"))
+	}
+	return utils.NewAsyncResultWithError(nil)
+}
+
+func (f *fakeDisputeExecutor) UpdateTransfer(tokenAddress common.Address, bp *transfer.BalanceProofState) (result *utils.AsyncResult) {
+	return f.result("update")
+}
+
+func (f *fakeDisputeExecutor) Unlock(tokenAddress common.Address, unlockproofs []*channeltype.UnlockProof, argTransferdAmount *big.Int) (result *utils.AsyncResult) {
+	f.unlocks = append(f.unlocks, unlockproofs)
+	return f.result("unlock")
+}
+
+func (f *fakeDisputeExecutor) PunishObsoleteUnlock(tokenAddress common.Address, lockhash, additionalHash common.Hash, cheaterSignature []byte) (result *utils.AsyncResult) {
+	return f.result("punish")
+}
+
+func TestDisputeResolver(t *testing.T) {
+	db, err := newTestDb()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.CloseDB()
+	ch := utest.MakeRoute(utest.HOP1, big.NewInt(100), utest.UnitSettleTimeout, utest.UnitRevealTimeout, 100, utils.NewRandomHash()).Channel()
+	ch.State = channeltype.StateClosed
+	ch.PartnerState.BalanceProofState.Nonce = 5
+	secret1, secret2 := utils.NewRandomHash(), utils.NewRandomHash()
+	lock1 := &mtree.Lock{Expiration: 200, Amount: big.NewInt(1), LockSecretHash: utils.ShaSecret(secret1[:])}
+	lock2 := &mtree.Lock{Expiration: 200, Amount: big.NewInt(1), LockSecretHash: utils.ShaSecret(secret2[:])}
+	ch.PartnerState.Tree = mtree.NewMerkleTree([]*mtree.Lock{lock1, lock2})
+	ch.PartnerState.Lock2UnclaimedLocks = map[common.Hash]channeltype.UnlockPartialProof{
+		lock1.LockSecretHash: {Lock: lock1, LockHash: lock1.Hash(), Secret: secret1},
+		lock2.LockSecretHash: {Lock: lock2, LockHash: lock2.Hash(), Secret: secret2},
+	}
+	//I have announced disposed lock2, never unlock it
+	err = db.MarkLockSecretHashDisposed(lock2.LockSecretHash, ch.ChannelIdentifier.ChannelIdentifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	executor := &fakeDisputeExecutor{}
+	var registered []common.Hash
+	d := &disputeResolver{
+		db: db,
+		findChannel: func(channelIdentifier common.Hash) *channel.Channel {
+			if channelIdentifier == ch.ChannelIdentifier.ChannelIdentifier {
+				return ch
+			}
+			return nil
+		},
+		closedChannels: func() []*channel.Channel { return []*channel.Channel{ch} },
+		executor:       func(*channel.Channel) disputeExecutor { return executor },
+		registerSecret: func(secret common.Hash) { registered = append(registered, secret) },
+		inflight:       make(map[string]bool),
+	}
+	onBlock := func(blockNumber int64) {
+		d.onBlock(blockNumber)
+		d.wg.Wait()
+	}
+
+	//partner closed, update balance proof and unlock lock1
+	d.onChannelClosed(ch, ch.PartnerState.Address)
+	d.onChannelClosed(ch, ch.PartnerState.Address)
+	if len(registered) != 1 || registered[0] != secret1 {
+		t.Fatalf("secret1 should be registered once,got %v", registered)
+	}
+	//failed update is retried, unlock waits for it
+	executor.fail = true
+	onBlock(101)
+	executor.fail = false
+	onBlock(102)
+	if len(executor.calls) != 2 || executor.calls[0] != "update" || executor.calls[1] != "update" {
+		t.Fatalf("expect update twice,got %v", executor.calls)
+	}
+	onBlock(103)
+	if len(executor.calls) != 3 || executor.calls[2] != "unlock" || len(executor.unlocks[0]) != 1 || executor.unlocks[0][0].Lock != lock1 {
+		t.Fatalf("expect unlock of lock1,got %v", executor.calls)
+	}
+	onBlock(104)
+	if len(executor.calls) != 3 {
+		t.Fatalf("nothing to do,got %v", executor.calls)
+	}
+
+	//partner unlocked a lock he has disposed
+	lockHash := utils.NewRandomHash()
+	err = db.MarkLockHashCanPunish(models.NewReceivedAnnounceDisposed(lockHash, ch.ChannelIdentifier.ChannelIdentifier, utils.NewRandomHash(), ch.ChannelIdentifier.OpenBlockNumber, []byte{1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.onPartnerUnlock(ch, utils.NewRandomHash())
+	d.onPartnerUnlock(ch, lockHash)
+	onBlock(105)
+	if len(executor.calls) != 4 || executor.calls[3] != "punish" {
+		t.Fatalf("expect punish,got %v", executor.calls)
+	}
+
+	//too late after settle timeout
+	lockHash2 := utils.NewRandomHash()
+	err = db.MarkLockHashCanPunish(models.NewReceivedAnnounceDisposed(lockHash2, ch.ChannelIdentifier.ChannelIdentifier, utils.NewRandomHash(), ch.ChannelIdentifier.OpenBlockNumber, []byte{1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.onPartnerUnlock(ch, lockHash2)
+	onBlock(150)
+	if len(executor.calls) != 4 {
+		t.Fatalf("should not punish after settle timeout,got %v", executor.calls)
+	}
+
+	actions, err := db.GetAllDisputeActions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := make(map[models.DisputeActionType][]models.DisputeStatus)
+	for _, a := range actions {
+		status[a.Type] = append(status[a.Type], a.Status)
+		if a.Type == models.DisputeUpdateBalanceProof && (a.Attempts != 2 || a.LastError == "") {
+			t.Errorf("update should be tried twice,attempts=%d,last error=%s", a.Attempts, a.LastError)
+		}
+	}
+	if len(actions) != 4 || len(status[models.DisputePunish]) != 2 ||
+		status[models.DisputeUpdateBalanceProof][0] != models.DisputeSuccess || status[models.DisputeUnlock][0] != models.DisputeSuccess {
+		t.Errorf("wrong actions %v", status)
+	}
+}
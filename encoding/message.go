@@ -15,7 +15,10 @@ import (
 
 	"encoding/hex"
 
+	"time"
+
 	"github.com/SmartMeshFoundation/Atmosphere/contracts"
+	"github.com/SmartMeshFoundation/Atmosphere/encoding/onion"
 	"github.com/SmartMeshFoundation/Atmosphere/log"
 	"github.com/SmartMeshFoundation/Atmosphere/params"
 	"github.com/SmartMeshFoundation/Atmosphere/transfer/mtree"
@@ -72,6 +75,11 @@ const (
 	*/
 	// Respond Refund
 	AnnounceDisposedTransferResponseCmdID
+	/*
+		公布通道的手续费和大致容量, 在邻居之间转发
+	*/
+	// announce fee and coarse capacity of a channel, flooded between neighbours
+	ChannelAnnouncementCmdID
 )
 
 const signatureLength = 65
@@ -187,6 +195,8 @@ func (t MessageType) String() string {
 		return "WithdrawRequest"
 	case WithdrawResponseCmdID:
 		return "WithdrawResponse"
+	case ChannelAnnouncementCmdID:
+		return "ChannelAnnouncement"
 	default:
 		return "<unknown>"
 	}
@@ -869,6 +879,12 @@ Initial `amount` should be expected received amount + fees.
 Fees are always payable by the initiator.
 
 `initiator` is the party that knows the secret to the `hashlock`
+
+An onion routed transfer has empty `target` and `initiator`, and carries an onion packet instead,
+so every mediator only knows its neighbours, the amount to forward and the expiration.
+
+`route_hints` are the last hops to reach a `target` behind private or mobile-only channels,
+they are provided by the target and forwarded unchanged, so every mediator can find a route to the target.
 */
 type MediatedTransfer struct {
 	EnvelopMessage
@@ -878,13 +894,62 @@ type MediatedTransfer struct {
 	Target         common.Address
 	Initiator      common.Address
 	Fee            *big.Int
+	Onion          []byte       //onion packet for the receiver, only when Target and Initiator are empty
+	RouteHints     []*RouteHint //at most params.MaxRouteHints
 }
 
 //String is fmt.Stringer
 func (m *MediatedTransfer) String() string {
-	return fmt.Sprintf("Message{type=MediatedTransfer expiration=%d,target=%s,initiator=%s,hashlock=%s,amount=%s,fee=%s,%s}",
+	return fmt.Sprintf("Message{type=MediatedTransfer expiration=%d,target=%s,initiator=%s,hashlock=%s,amount=%s,fee=%s,onion=%v,hints=%d,%s}",
 		m.Expiration, utils.APex2(m.Target), utils.APex2(m.Initiator),
-		utils.HPex(m.LockSecretHash), m.PaymentAmount, m.Fee, m.EnvelopMessage.String())
+		utils.HPex(m.LockSecretHash), m.PaymentAmount, m.Fee, m.IsOnion(), len(m.RouteHints), m.EnvelopMessage.String())
+}
+
+/*
+RouteHint 收款人提供的到达自己的一跳, Node 通过通道 ChannelIdentifier 把交易转给路径上的下一个节点,
+下一个节点是下一个 RouteHint 的 Node, 最后一个 RouteHint 的下一个节点是收款人.
+FeeConstant 和 FeePercent 是 Node 在这个通道上收取的手续费.
+*/
+/*
+ *	RouteHint : one hop to reach the target provided by the target itself, Node forwards the transfer to the next node through channel ChannelIdentifier,
+ *	the next node is Node of the next RouteHint, and the target for the last one.
+ *	FeeConstant and FeePercent are the fee Node charges on this channel.
+ */
+type RouteHint struct {
+	Node              common.Address `json:"node"`
+	ChannelIdentifier common.Hash    `json:"channel_identifier"`
+	FeeConstant       *big.Int       `json:"fee_constant"`
+	FeePercent        int64          `json:"fee_percent"`
+}
+
+const routeHintLength = 20 + 32 + 32 + 8
+
+//envelopMessageLength length of EnvelopMessage after the message specific fields
+const envelopMessageLength = 8 + 32 + 8 + 32 + 32 + signatureLength
+
+func (h *RouteHint) pack(buf *bytes.Buffer) {
+	buf.Write(h.Node[:])
+	buf.Write(h.ChannelIdentifier[:])
+	buf.Write(utils.BigIntTo32Bytes(h.FeeConstant))
+	binary.Write(buf, binary.BigEndian, h.FeePercent)
+}
+
+func (h *RouteHint) unpack(buf *bytes.Buffer) {
+	buf.Read(h.Node[:])
+	buf.Read(h.ChannelIdentifier[:])
+	h.FeeConstant = utils.ReadBigInt(buf)
+	binary.Read(buf, binary.BigEndian, &h.FeePercent)
+}
+
+//String is fmt.Stringer
+func (h *RouteHint) String() string {
+	return fmt.Sprintf("RouteHint{node=%s,channel=%s,fee_constant=%s,fee_percent=%d}",
+		utils.APex2(h.Node), utils.HPex(h.ChannelIdentifier), h.FeeConstant, h.FeePercent)
+}
+
+//IsOnion returns true if target and initiator are hidden in the onion
+func (m *MediatedTransfer) IsOnion() bool {
+	return len(m.Onion) > 0
 }
 
 //NewMediatedTransfer create MediatedTransfer
@@ -925,6 +990,18 @@ func (m *MediatedTransfer) Pack() []byte {
 	_, err = buf.Write(m.Target[:])
 	_, err = buf.Write(m.Initiator[:])
 	_, err = buf.Write(utils.BigIntTo32Bytes(m.Fee))
+	if m.IsOnion() {
+		if m.Target != utils.EmptyAddress || m.Initiator != utils.EmptyAddress || len(m.Onion) != onion.PacketLength {
+			log.Crit(fmt.Sprintf("MediatedTransfer Pack invalid onion %s", m))
+		}
+		_, err = buf.Write(m.Onion)
+	}
+	if len(m.RouteHints) > params.MaxRouteHints {
+		log.Crit(fmt.Sprintf("MediatedTransfer Pack too many route hints %s", m))
+	}
+	for _, h := range m.RouteHints {
+		h.pack(buf)
+	}
 	m.EnvelopMessage.pack(buf)
 	if err != nil {
 		log.Crit(fmt.Sprintf("MediatedTransfer Pack err %s", err))
@@ -950,6 +1027,24 @@ func (m *MediatedTransfer) UnPack(data []byte) error {
 	_, err = buf.Read(m.Target[:])
 	_, err = buf.Read(m.Initiator[:])
 	m.Fee = utils.ReadBigInt(buf)
+	if m.Target == utils.EmptyAddress && m.Initiator == utils.EmptyAddress {
+		m.Onion = make([]byte, onion.PacketLength)
+		n, err := buf.Read(m.Onion)
+		if err != nil || n != onion.PacketLength {
+			return errors.New("MediatedTransfer unpack onion length error")
+		}
+	}
+	//route hints are between the fields above and the envelope
+	hintsLength := buf.Len() - envelopMessageLength
+	if hintsLength < 0 || hintsLength%routeHintLength != 0 || hintsLength/routeHintLength > params.MaxRouteHints {
+		return errors.New("MediatedTransfer unpack route hints length error")
+	}
+	m.RouteHints = nil
+	for i := 0; i < hintsLength/routeHintLength; i++ {
+		h := new(RouteHint)
+		h.unpack(buf)
+		m.RouteHints = append(m.RouteHints, h)
+	}
 	err = m.EnvelopMessage.unpack(buf)
 	if err != nil {
 		return err
@@ -1716,6 +1811,203 @@ func (m *SettleResponse) Sign(key *ecdsa.PrivateKey, msg MessagePacker) (err err
 	return
 }
 
+/*
+ChannelAnnouncement 节点公布自己在某个通道上的手续费和大致容量, 由邻居一跳一跳地转发给整个网络.
+公布的内容由 Announcer 签名, 整个消息由发送者(Announcer 或者转发的节点)签名, 这样 ack 总是发给上一跳.
+*/
+/*
+ *	ChannelAnnouncement : a node announces its fee and coarse capacity on one of its channels,
+ *	and neighbours flood it to the whole network hop by hop.
+ *	The announcement is signed by Announcer, and the whole message is signed by the sender(Announcer or a forwarder),
+ *	so the ack is always sent to the previous hop.
+ */
+type ChannelAnnouncement struct {
+	SignedMessage
+	TokenAddress      common.Address
+	ChannelIdentifier common.Hash
+	Announcer         common.Address
+	Partner           common.Address
+	Timestamp         int64 //unix time of announcing, a newer announcement replaces the older one
+	FeeConstant       *big.Int
+	FeePercent        int64
+	//CapacityBucket Announcer can send less than 2^CapacityBucket tokens to Partner, and no less than 2^(CapacityBucket-1)
+	CapacityBucket     uint8
+	Features           uint8 //features supported by Announcer, such as FeatureOnion
+	AnnouncerSignature []byte
+}
+
+const (
+	//FeatureOnion Announcer accepts onion routed MediatedTransfer
+	FeatureOnion = 1 << iota
+)
+
+const channelAnnouncementLength = 4 + 20 + 32 + 20 + 20 + 8 + 32 + 8 + 1 + 1 + signatureLength*2
+
+//NewChannelAnnouncement create ChannelAnnouncement, Announcer is set by SignAnnouncement
+func NewChannelAnnouncement(tokenAddress common.Address, channelIdentifier common.Hash, partner common.Address, timestamp int64, feeConstant *big.Int, feePercent int64, capacityBucket uint8) *ChannelAnnouncement {
+	p := &ChannelAnnouncement{
+		TokenAddress:      tokenAddress,
+		ChannelIdentifier: channelIdentifier,
+		Partner:           partner,
+		Timestamp:         timestamp,
+		FeeConstant:       new(big.Int).Set(feeConstant),
+		FeePercent:        feePercent,
+		CapacityBucket:    capacityBucket,
+	}
+	p.CmdID = ChannelAnnouncementCmdID
+	return p
+}
+
+//CapacityBucket returns bucket of capacity used by ChannelAnnouncement
+func CapacityBucket(capacity *big.Int) uint8 {
+	if capacity == nil || capacity.Sign() <= 0 {
+		return 0
+	}
+	if capacity.BitLen() > 255 {
+		return 255
+	}
+	return uint8(capacity.BitLen())
+}
+
+//MayHaveCapacity returns false only if Announcer surely cannot send amount tokens to Partner
+func (m *ChannelAnnouncement) MayHaveCapacity(amount *big.Int) bool {
+	if m.CapacityBucket == 255 {
+		return true
+	}
+	return amount.BitLen() <= int(m.CapacityBucket)
+}
+
+//Expired returns true if it's too old to be used or forwarded
+func (m *ChannelAnnouncement) Expired(now time.Time) bool {
+	return now.Unix() > m.Timestamp+int64(params.ChannelAnnouncementExpiration/time.Second)
+}
+
+func (m *ChannelAnnouncement) announcementSignData() []byte {
+	var err error
+	buf := new(bytes.Buffer)
+	_, err = buf.Write(m.TokenAddress[:])
+	_, err = buf.Write(m.ChannelIdentifier[:])
+	_, err = buf.Write(m.Announcer[:])
+	_, err = buf.Write(m.Partner[:])
+	err = binary.Write(buf, binary.BigEndian, m.Timestamp)
+	_, err = buf.Write(utils.BigIntTo32Bytes(m.FeeConstant))
+	err = binary.Write(buf, binary.BigEndian, m.FeePercent)
+	err = buf.WriteByte(m.CapacityBucket)
+	err = buf.WriteByte(m.Features)
+	_, err = buf.Write(utils.BigIntTo32Bytes(params.ChainID))
+	if err != nil {
+		log.Crit(fmt.Sprintf("ChannelAnnouncement announcementSignData err %s", err))
+	}
+	return buf.Bytes()
+}
+
+//SignAnnouncement announcer signs the announcement, it must be called before Sign
+func (m *ChannelAnnouncement) SignAnnouncement(key *ecdsa.PrivateKey) (err error) {
+	m.Announcer = crypto.PubkeyToAddress(key.PublicKey)
+	m.AnnouncerSignature, err = utils.SignData(key, m.announcementSignData())
+	return
+}
+
+//Forward returns a copy of announcement which should be signed by the forwarder
+func (m *ChannelAnnouncement) Forward() *ChannelAnnouncement {
+	p := NewChannelAnnouncement(m.TokenAddress, m.ChannelIdentifier, m.Partner, m.Timestamp, m.FeeConstant, m.FeePercent, m.CapacityBucket)
+	p.Features = m.Features
+	p.Announcer = m.Announcer
+	p.AnnouncerSignature = m.AnnouncerSignature
+	return p
+}
+
+//AnnouncerPublicKey recovers public key of Announcer from AnnouncerSignature
+func (m *ChannelAnnouncement) AnnouncerPublicKey() (*ecdsa.PublicKey, error) {
+	if len(m.AnnouncerSignature) != signatureLength {
+		return nil, errPacketLength
+	}
+	sig := make([]byte, signatureLength)
+	copy(sig, m.AnnouncerSignature)
+	sig[signatureLength-1] -= 27
+	pub, err := crypto.SigToPub(utils.Sha3(m.announcementSignData()).Bytes(), sig)
+	if err != nil {
+		return nil, err
+	}
+	if crypto.PubkeyToAddress(*pub) != m.Announcer {
+		return nil, errors.New("ChannelAnnouncement AnnouncerSignature not signed by announcer")
+	}
+	return pub, nil
+}
+
+//String is fmt.Stringer
+func (m *ChannelAnnouncement) String() string {
+	return fmt.Sprintf("Message{type=ChannelAnnouncement channel=%s,announcer=%s,partner=%s,timestamp=%d,feeConstant=%s,feePercent=%d,capacityBucket=%d,features=%d,sender=%s}",
+		utils.HPex(m.ChannelIdentifier), utils.APex2(m.Announcer), utils.APex2(m.Partner), m.Timestamp,
+		m.FeeConstant, m.FeePercent, m.CapacityBucket, m.Features, utils.APex2(m.Sender))
+}
+
+//Pack is MessagePacker
+func (m *ChannelAnnouncement) Pack() []byte {
+	var err error
+	buf := new(bytes.Buffer)
+	err = binary.Write(buf, binary.LittleEndian, m.CmdID)
+	_, err = buf.Write(m.TokenAddress[:])
+	_, err = buf.Write(m.ChannelIdentifier[:])
+	_, err = buf.Write(m.Announcer[:])
+	_, err = buf.Write(m.Partner[:])
+	err = binary.Write(buf, binary.BigEndian, m.Timestamp)
+	_, err = buf.Write(utils.BigIntTo32Bytes(m.FeeConstant))
+	err = binary.Write(buf, binary.BigEndian, m.FeePercent)
+	err = buf.WriteByte(m.CapacityBucket)
+	err = buf.WriteByte(m.Features)
+	_, err = buf.Write(m.AnnouncerSignature)
+	_, err = buf.Write(m.Signature)
+	if err != nil {
+		log.Crit(fmt.Sprintf("ChannelAnnouncement Pack err %s", err))
+	}
+	return buf.Bytes()
+}
+
+//UnPack is MessageUnpacker
+func (m *ChannelAnnouncement) UnPack(data []byte) error {
+	var t int32
+	var err error
+	m.CmdID = ChannelAnnouncementCmdID
+	if len(data) != channelAnnouncementLength {
+		return errPacketLength
+	}
+	buf := bytes.NewBuffer(data)
+	err = binary.Read(buf, binary.LittleEndian, &t)
+	if t != m.CmdID {
+		return fmt.Errorf("ChannelAnnouncement UnPack cmdid expect=%d,got=%d", ChannelAnnouncementCmdID, t)
+	}
+	_, err = buf.Read(m.TokenAddress[:])
+	_, err = buf.Read(m.ChannelIdentifier[:])
+	_, err = buf.Read(m.Announcer[:])
+	_, err = buf.Read(m.Partner[:])
+	err = binary.Read(buf, binary.BigEndian, &m.Timestamp)
+	m.FeeConstant = utils.ReadBigInt(buf)
+	err = binary.Read(buf, binary.BigEndian, &m.FeePercent)
+	m.CapacityBucket, err = buf.ReadByte()
+	m.Features, err = buf.ReadByte()
+	m.AnnouncerSignature = make([]byte, signatureLength)
+	_, err = buf.Read(m.AnnouncerSignature)
+	m.Signature = make([]byte, signatureLength)
+	_, err = buf.Read(m.Signature)
+	if err != nil {
+		return err
+	}
+	err = m.SignedMessage.verifySignature(data)
+	if err != nil {
+		return err
+	}
+	announcer, err := utils.Ecrecover(utils.Sha3(m.announcementSignData()), m.AnnouncerSignature)
+	if err != nil {
+		return err
+	}
+	if announcer != m.Announcer {
+		return fmt.Errorf("ChannelAnnouncement AnnouncerSignature err, announcer=%s,but signed by %s",
+			utils.APex2(m.Announcer), utils.APex2(announcer))
+	}
+	return nil
+}
+
 //MessageMap contains all message can send and receive.
 //DirectTransfer has been deprecated
 var MessageMap = map[int]Messager{
@@ -1733,6 +2025,7 @@ var MessageMap = map[int]Messager{
 	WithdrawResponseCmdID:                 new(WithdrawResponse),
 	SettleRequestCmdID:                    new(SettleRequest),
 	SettleResponseCmdID:                   new(SettleResponse),
+	ChannelAnnouncementCmdID:              new(ChannelAnnouncement),
 }
 
 func init() {
@@ -1751,4 +2044,5 @@ func init() {
 	gob.Register(&WithdrawResponse{})
 	gob.Register(&SettleRequest{})
 	gob.Register(&SettleResponse{})
+	gob.Register(&ChannelAnnouncement{})
 }
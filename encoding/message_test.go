@@ -17,6 +17,8 @@ import (
 
 	"fmt"
 
+	"github.com/SmartMeshFoundation/Atmosphere/encoding/onion"
+	"github.com/SmartMeshFoundation/Atmosphere/params"
 	"github.com/SmartMeshFoundation/Atmosphere/transfer/mtree"
 	"github.com/SmartMeshFoundation/Atmosphere/utils"
 	"github.com/davecgh/go-spew/spew"
@@ -187,6 +189,108 @@ func TestMediatedTransfer(t *testing.T) {
 	}
 }
 
+func TestOnionMediatedTransfer(t *testing.T) {
+	bp := &BalanceProof{
+		Nonce:             11,
+		ChannelIdentifier: utils.Sha3([]byte("123")),
+		TransferAmount:    big.NewInt(12),
+		OpenBlockNumber:   3,
+		Locksroot:         utils.EmptyHash,
+	}
+	lock := &mtree.Lock{
+		Amount:         big.NewInt(34),
+		Expiration:     4589895,
+		LockSecretHash: utils.ShaSecret([]byte("hashlock")),
+	}
+	key, _ := crypto.GenerateKey()
+	packet, err := onion.NewPacket([]*ecdsa.PublicKey{&key.PublicKey}, []*onion.Hop{{Initiator: utils.NewRandomAddress(), Amount: big.NewInt(34), Expiration: 4589895}}, lock.LockSecretHash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	m1 := NewMediatedTransfer(bp, lock, utils.EmptyAddress, utils.EmptyAddress, big.NewInt(0))
+	m1.Onion = packet
+	m1.Sign(GetTestPrivKey(), m1)
+	data := m1.Pack()
+	if len(data) > params.UDPMaxMessageSize {
+		t.Fatalf("onion MediatedTransfer too large %d", len(data))
+	}
+	m2 := new(MediatedTransfer)
+	err = m2.UnPack(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(m2.Pack(), data) || !bytes.Equal(m1.Onion, m2.Onion) || m2.Sender != m1.Sender {
+		t.Error("not equal")
+	}
+	//onion is covered by signature
+	data[200] ^= 1
+	m3 := new(MediatedTransfer)
+	if m3.UnPack(data) == nil && m3.Sender == m1.Sender {
+		t.Error("tampered onion should not be signed by sender")
+	}
+	if new(MediatedTransfer).UnPack(data[:200]) == nil {
+		t.Error("short onion should fail")
+	}
+}
+
+func TestMediatedTransferRouteHints(t *testing.T) {
+	bp := &BalanceProof{
+		Nonce:             11,
+		ChannelIdentifier: utils.Sha3([]byte("123")),
+		TransferAmount:    big.NewInt(12),
+		OpenBlockNumber:   3,
+		Locksroot:         utils.EmptyHash,
+	}
+	lock := &mtree.Lock{
+		Amount:         big.NewInt(34),
+		Expiration:     4589895,
+		LockSecretHash: utils.ShaSecret([]byte("hashlock")),
+	}
+	m1 := NewMediatedTransfer(bp, lock, utils.NewRandomAddress(), utils.NewRandomAddress(), big.NewInt(3))
+	for i := 0; i < params.MaxRouteHints; i++ {
+		m1.RouteHints = append(m1.RouteHints, &RouteHint{
+			Node:              utils.NewRandomAddress(),
+			ChannelIdentifier: utils.NewRandomHash(),
+			FeeConstant:       big.NewInt(int64(i + 1)),
+			FeePercent:        10000,
+		})
+	}
+	m1.Sign(GetTestPrivKey(), m1)
+	data := m1.Pack()
+	if len(data) > params.UDPMaxMessageSize {
+		t.Fatalf("MediatedTransfer with route hints too large %d", len(data))
+	}
+	m2 := new(MediatedTransfer)
+	if err := m2.UnPack(data); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(m2.Pack(), data) || m2.Sender != m1.Sender || len(m2.RouteHints) != len(m1.RouteHints) {
+		t.Fatal("not equal")
+	}
+	for i, h := range m2.RouteHints {
+		if !reflect.DeepEqual(h, m1.RouteHints[i]) {
+			t.Fatalf("hint %d expect %s,got %s", i, m1.RouteHints[i], h)
+		}
+	}
+	//route hints are covered by signature
+	data[160] ^= 1
+	m3 := new(MediatedTransfer)
+	if m3.UnPack(data) == nil && m3.Sender == m1.Sender {
+		t.Error("tampered route hints should not be signed by sender")
+	}
+	if new(MediatedTransfer).UnPack(data[:len(data)-1]) == nil {
+		t.Error("truncated route hints should fail")
+	}
+	//without route hints the format doesn't change
+	m4 := NewMediatedTransfer(bp, lock, m1.Target, m1.Initiator, m1.Fee)
+	m4.Sign(GetTestPrivKey(), m4)
+	data = m4.Pack()
+	m5 := new(MediatedTransfer)
+	if err := m5.UnPack(data); err != nil || len(m5.RouteHints) != 0 || len(data) != len(m1.Pack())-params.MaxRouteHints*routeHintLength {
+		t.Fatalf("unpack without route hints err %v", err)
+	}
+}
+
 func TestNewAnnounceDisposedTransfer(t *testing.T) {
 	bp := &AnnounceDisposedProof{
 		ChannelIDInMessage: ChannelIDInMessage{
@@ -463,3 +567,47 @@ func TestBigInt(t *testing.T) {
 		t.Error("not equal")
 	}
 }
+
+func TestChannelAnnouncement(t *testing.T) {
+	announcerKey, _ := crypto.GenerateKey()
+	m := NewChannelAnnouncement(utils.NewRandomAddress(), utils.NewRandomHash(), utils.NewRandomAddress(), 1000, big.NewInt(3), 10000, CapacityBucket(big.NewInt(100)))
+	m.Features = FeatureOnion
+	err := m.SignAnnouncement(announcerKey)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	//forwarded by another node
+	m = m.Forward()
+	err = m.Sign(GetTestPrivKey(), m)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	data := m.Pack()
+	m2 := new(ChannelAnnouncement)
+	err = m2.UnPack(data)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	assert.EqualValues(t, m, m2)
+	assert.EqualValues(t, GetTestAddress(), m2.Sender)
+	assert.EqualValues(t, crypto.PubkeyToAddress(announcerKey.PublicKey), m2.Announcer)
+	//100 is in [64,128)
+	assert.EqualValues(t, 7, m2.CapacityBucket)
+	assert.True(t, m2.MayHaveCapacity(big.NewInt(127)))
+	assert.False(t, m2.MayHaveCapacity(big.NewInt(128)))
+	pub, err := m2.AnnouncerPublicKey()
+	assert.Nil(t, err)
+	assert.EqualValues(t, announcerKey.PublicKey, *pub)
+	//forwarder cannot change the announcement
+	m3 := m2.Forward()
+	m3.FeeConstant = big.NewInt(1)
+	m3.Sign(GetTestPrivKey(), m3)
+	assert.NotNil(t, new(ChannelAnnouncement).UnPack(m3.Pack()))
+	m3 = m2.Forward()
+	m3.Features = 0
+	m3.Sign(GetTestPrivKey(), m3)
+	assert.NotNil(t, new(ChannelAnnouncement).UnPack(m3.Pack()))
+}
@@ -0,0 +1,260 @@
+package onion
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/SmartMeshFoundation/Atmosphere/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+const (
+	//Version of the packet format
+	Version = 0
+	//MaxHops max number of nodes after the initiator a packet can go through, including the target
+	MaxHops = 6
+
+	pubkeyLength      = 33
+	macLength         = 16
+	payloadLength     = 1 + 20 + 32 + 8
+	hopLength         = payloadLength + macLength
+	routingInfoLength = MaxHops * hopLength
+	numStreamBytes    = routingInfoLength + hopLength
+	//PacketLength length of every onion packet, no matter how many hops
+	PacketLength = 1 + pubkeyLength + routingInfoLength + macLength
+
+	flagForward = 0
+	flagFinal   = 1
+)
+
+var (
+	errInvalidPacket = errors.New("invalid onion packet")
+	errInvalidMac    = errors.New("onion packet mac mismatch")
+	errInvalidHops   = errors.New("invalid onion hops")
+)
+
+/*
+Hop 每个节点从洋葱中解出的信息
+中间节点得到下一跳的地址, 要转发的金额和锁的过期块,
+收款人的 NextHop 为空, 可以得到付款人地址, 应该收到的金额和过期块.
+*/
+/*
+ *	Hop : information a node gets after peeling the onion.
+ *	A mediator gets address of the next hop, amount to forward and expiration of the lock,
+ *	the target gets an empty NextHop, the initiator, amount and expiration it should receive.
+ */
+type Hop struct {
+	NextHop    common.Address
+	Initiator  common.Address
+	Amount     *big.Int
+	Expiration int64
+}
+
+//IsFinal returns true if it's the hop of the target
+func (h *Hop) IsFinal() bool {
+	return h.NextHop == utils.EmptyAddress
+}
+
+func (h *Hop) pack() []byte {
+	buf := new(bytes.Buffer)
+	if h.IsFinal() {
+		buf.WriteByte(flagFinal)
+		buf.Write(h.Initiator[:])
+	} else {
+		buf.WriteByte(flagForward)
+		buf.Write(h.NextHop[:])
+	}
+	buf.Write(utils.BigIntTo32Bytes(h.Amount))
+	binary.Write(buf, binary.BigEndian, h.Expiration)
+	return buf.Bytes()
+}
+
+func (h *Hop) unpack(data []byte) error {
+	var addr common.Address
+	copy(addr[:], data[1:21])
+	switch data[0] {
+	case flagForward:
+		if addr == utils.EmptyAddress {
+			return errInvalidHops
+		}
+		h.NextHop = addr
+	case flagFinal:
+		h.Initiator = addr
+	default:
+		return errInvalidHops
+	}
+	h.Amount = new(big.Int).SetBytes(data[21:53])
+	h.Expiration = int64(binary.BigEndian.Uint64(data[53:61]))
+	return nil
+}
+
+//sharedSecret sha256 of the compressed point key*pub
+func sharedSecret(pub *ecdsa.PublicKey, key *big.Int) []byte {
+	x, y := crypto.S256().ScalarMult(pub.X, pub.Y, key.Bytes())
+	s := sha256.Sum256(crypto.CompressPubkey(&ecdsa.PublicKey{Curve: crypto.S256(), X: x, Y: y}))
+	return s[:]
+}
+
+//blindingFactor a node uses it to derive the ephemeral key of the next node
+func blindingFactor(ephemeral *ecdsa.PublicKey, secret []byte) *big.Int {
+	h := sha256.Sum256(append(crypto.CompressPubkey(ephemeral), secret...))
+	b := new(big.Int).SetBytes(h[:])
+	return b.Mod(b, crypto.S256().Params().N)
+}
+
+func generateKey(keyType string, secret []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(keyType))
+	mac.Write(secret)
+	return mac.Sum(nil)
+}
+
+func generateCipherStream(key []byte, length int) []byte {
+	block, _ := aes.NewCipher(key)
+	stream := cipher.NewCTR(block, make([]byte, aes.BlockSize))
+	out := make([]byte, length)
+	stream.XORKeyStream(out, out)
+	return out
+}
+
+func calcMac(key []byte, data ...[]byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(nil)[:macLength]
+}
+
+func xor(dst, a, b []byte) {
+	for i := range dst {
+		dst[i] = a[i] ^ b[i]
+	}
+}
+
+//generateFiller the tail of routing info the last node would see, so every node sees the same length
+func generateFiller(secrets [][]byte) []byte {
+	numHops := len(secrets)
+	filler := make([]byte, (numHops-1)*hopLength)
+	for i := 1; i < numHops; i++ {
+		start := (MaxHops - i + 1) * hopLength
+		stream := generateCipherStream(generateKey("rho", secrets[i-1]), numStreamBytes)
+		xor(filler[:i*hopLength], filler[:i*hopLength], stream[start:start+i*hopLength])
+	}
+	return filler
+}
+
+/*
+NewPacket 构造经过 route 中所有节点的洋葱包, hops[i] 只有 route[i] 才能解开.
+assocData 绑定到每一层的 mac 中, 中间节点无法把洋葱挪到其他交易中使用.
+*/
+/*
+ *	NewPacket : build an onion packet through all nodes in route, hops[i] can only be peeled by route[i].
+ *	assocData is bound to mac of every layer, so a mediator cannot reuse the onion in another transfer.
+ */
+func NewPacket(route []*ecdsa.PublicKey, hops []*Hop, assocData []byte) ([]byte, error) {
+	numHops := len(route)
+	if numHops == 0 || numHops > MaxHops || len(hops) != numHops || !hops[numHops-1].IsFinal() {
+		return nil, errInvalidHops
+	}
+	for _, h := range hops[:numHops-1] {
+		if h.IsFinal() {
+			return nil, errInvalidHops
+		}
+	}
+	sessionKey, err := crypto.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	n := crypto.S256().Params().N
+	key := new(big.Int).Set(sessionKey.D)
+	secrets := make([][]byte, numHops)
+	for i, pub := range route {
+		if pub == nil || pub.X == nil {
+			return nil, errInvalidHops
+		}
+		x, y := crypto.S256().ScalarBaseMult(key.Bytes())
+		secrets[i] = sharedSecret(pub, key)
+		b := blindingFactor(&ecdsa.PublicKey{Curve: crypto.S256(), X: x, Y: y}, secrets[i])
+		key.Mul(key, b)
+		key.Mod(key, n)
+	}
+	filler := generateFiller(secrets)
+	routingInfo := make([]byte, routingInfoLength)
+	nextMac := make([]byte, macLength)
+	for i := numHops - 1; i >= 0; i-- {
+		stream := generateCipherStream(generateKey("rho", secrets[i]), numStreamBytes)
+		copy(routingInfo[hopLength:], routingInfo[:routingInfoLength-hopLength])
+		copy(routingInfo, hops[i].pack())
+		copy(routingInfo[payloadLength:], nextMac)
+		xor(routingInfo, routingInfo, stream[:routingInfoLength])
+		if i == numHops-1 {
+			copy(routingInfo[routingInfoLength-len(filler):], filler)
+		}
+		nextMac = calcMac(generateKey("mu", secrets[i]), routingInfo, assocData)
+	}
+	buf := new(bytes.Buffer)
+	buf.WriteByte(Version)
+	buf.Write(crypto.CompressPubkey(&sessionKey.PublicKey))
+	buf.Write(routingInfo)
+	buf.Write(nextMac)
+	return buf.Bytes(), nil
+}
+
+/*
+Peel 用我们的私钥解开洋葱的一层, 返回给我们的信息和要转发给下一跳的洋葱.
+如果我们是收款人, next 为空.
+*/
+/*
+ *	Peel : peel one layer of the onion with our private key,
+ *	returns the hop for us and the onion to forward to the next hop, next is nil if we are the target.
+ */
+func Peel(key *ecdsa.PrivateKey, packet []byte, assocData []byte) (hop *Hop, next []byte, err error) {
+	if len(packet) != PacketLength || packet[0] != Version {
+		return nil, nil, errInvalidPacket
+	}
+	ephemeral, err := crypto.DecompressPubkey(packet[1 : 1+pubkeyLength])
+	if err != nil {
+		return nil, nil, errInvalidPacket
+	}
+	routingInfo := packet[1+pubkeyLength : 1+pubkeyLength+routingInfoLength]
+	mac := packet[1+pubkeyLength+routingInfoLength:]
+	secret := sharedSecret(ephemeral, key.D)
+	if !hmac.Equal(mac, calcMac(generateKey("mu", secret), routingInfo, assocData)) {
+		return nil, nil, errInvalidMac
+	}
+	stream := generateCipherStream(generateKey("rho", secret), numStreamBytes)
+	padded := make([]byte, numStreamBytes)
+	copy(padded, routingInfo)
+	xor(padded, padded, stream)
+	hop = new(Hop)
+	if err = hop.unpack(padded[:payloadLength]); err != nil {
+		return nil, nil, err
+	}
+	if hop.IsFinal() {
+		return hop, nil, nil
+	}
+	b := blindingFactor(ephemeral, secret)
+	x, y := crypto.S256().ScalarMult(ephemeral.X, ephemeral.Y, b.Bytes())
+	buf := new(bytes.Buffer)
+	buf.WriteByte(Version)
+	buf.Write(crypto.CompressPubkey(&ecdsa.PublicKey{Curve: crypto.S256(), X: x, Y: y}))
+	buf.Write(padded[hopLength:])
+	buf.Write(padded[payloadLength:hopLength])
+	return hop, buf.Bytes(), nil
+}
+
+//String is the fmt.Stringer interface
+func (h *Hop) String() string {
+	if h.IsFinal() {
+		return fmt.Sprintf("Hop{final,Initiator=%s,Amount=%s,Expiration=%d}", utils.APex2(h.Initiator), h.Amount, h.Expiration)
+	}
+	return fmt.Sprintf("Hop{NextHop=%s,Amount=%s,Expiration=%d}", utils.APex2(h.NextHop), h.Amount, h.Expiration)
+}
@@ -0,0 +1,114 @@
+package onion
+
+import (
+	"crypto/ecdsa"
+	"math/big"
+	"testing"
+
+	"github.com/SmartMeshFoundation/Atmosphere/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func makeRoute(t *testing.T, n int) (keys []*ecdsa.PrivateKey, route []*ecdsa.PublicKey, hops []*Hop) {
+	initiator := utils.NewRandomAddress()
+	for i := 0; i < n; i++ {
+		key, err := crypto.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+		route = append(route, &key.PublicKey)
+	}
+	for i := 0; i < n; i++ {
+		hop := &Hop{
+			Amount:     big.NewInt(int64(100 - i)),
+			Expiration: int64(1000 - i*10),
+		}
+		if i < n-1 {
+			hop.NextHop = crypto.PubkeyToAddress(keys[i+1].PublicKey)
+		} else {
+			hop.Initiator = initiator
+		}
+		hops = append(hops, hop)
+	}
+	return
+}
+
+func TestPacket(t *testing.T) {
+	assocData := utils.NewRandomHash()
+	for n := 1; n <= MaxHops; n++ {
+		keys, route, hops := makeRoute(t, n)
+		packet, err := NewPacket(route, hops, assocData[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < n; i++ {
+			if len(packet) != PacketLength {
+				t.Fatalf("packet length %d", len(packet))
+			}
+			hop, next, err := Peel(keys[i], packet, assocData[:])
+			if err != nil {
+				t.Fatalf("hops %d,peel %d err %s", n, i, err)
+			}
+			if hop.NextHop != hops[i].NextHop || hop.Initiator != hops[i].Initiator ||
+				hop.Amount.Cmp(hops[i].Amount) != 0 || hop.Expiration != hops[i].Expiration {
+				t.Fatalf("hops %d,peel %d expect %s,got %s", n, i, hops[i], hop)
+			}
+			if hop.IsFinal() != (i == n-1) || (next == nil) != hop.IsFinal() {
+				t.Fatalf("hops %d,peel %d final error", n, i)
+			}
+			packet = next
+		}
+	}
+}
+
+func TestPacketInvalid(t *testing.T) {
+	assocData := utils.NewRandomHash()
+	keys, route, hops := makeRoute(t, 3)
+	packet, err := NewPacket(route, hops, assocData[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	//wrong key
+	if _, _, err = Peel(keys[1], packet, assocData[:]); err == nil {
+		t.Fatal("should fail with wrong key")
+	}
+	//another transfer
+	otherData := utils.NewRandomHash()
+	if _, _, err = Peel(keys[0], packet, otherData[:]); err == nil {
+		t.Fatal("should fail with wrong assoc data")
+	}
+	//tampered
+	for _, i := range []int{0, 1, 40, PacketLength - 1} {
+		tampered := append([]byte{}, packet...)
+		tampered[i] ^= 1
+		if _, _, err = Peel(keys[0], tampered, assocData[:]); err == nil {
+			t.Fatalf("should fail when byte %d is tampered", i)
+		}
+	}
+	if _, _, err = Peel(keys[0], packet[1:], assocData[:]); err == nil {
+		t.Fatal("should fail with short packet")
+	}
+	//tampered after the first hop is detected by the next hop
+	_, next, err := Peel(keys[0], packet, assocData[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	next[50] ^= 1
+	if _, _, err = Peel(keys[1], next, assocData[:]); err == nil {
+		t.Fatal("should fail when tampered by mediator")
+	}
+	//invalid hops
+	if _, err = NewPacket(route, hops[:2], assocData[:]); err == nil {
+		t.Fatal("last hop must be final")
+	}
+	hops[0].NextHop = common.Address{}
+	if _, err = NewPacket(route, hops, assocData[:]); err == nil {
+		t.Fatal("only last hop can be final")
+	}
+	_, route, hops = makeRoute(t, MaxHops+1)
+	if _, err = NewPacket(route, hops, assocData[:]); err == nil {
+		t.Fatal("too many hops")
+	}
+}
@@ -2,6 +2,7 @@ package atmosphere
 
 import (
 	"fmt"
+	"math/big"
 
 	"errors"
 
@@ -11,6 +12,7 @@ import (
 	"github.com/SmartMeshFoundation/Atmosphere/log"
 	"github.com/SmartMeshFoundation/Atmosphere/models"
 	"github.com/SmartMeshFoundation/Atmosphere/network/graph"
+	"github.com/SmartMeshFoundation/Atmosphere/notify"
 	"github.com/SmartMeshFoundation/Atmosphere/transfer"
 	"github.com/SmartMeshFoundation/Atmosphere/transfer/mediatedtransfer"
 	"github.com/SmartMeshFoundation/Atmosphere/transfer/mediatedtransfer/initiator"
@@ -35,8 +37,28 @@ func newStateMachineEventHandler(photon *Service) *stateMachineEventHandler {
 dispatch it to all state managers and log generated events
 */
 func (eh *stateMachineEventHandler) dispatchToAllTasks(st transfer.StateChange) {
-	for _, mgrs := range eh.atmosphere.Transfer2StateManager {
-		eh.dispatch(mgrs, st)
+	//所有 StateManager 的日志在一个事务中写入, 处理的结果也在一个事务中提交, 而不是每个 StateManager 各自两个事务
+	// logs of all StateManagers are written in one transaction and so are results of handling, instead of two transactions for every StateManager
+	var mgrs []*transfer.StateManager
+	for _, mgr := range eh.atmosphere.Transfer2StateManager {
+		mgrs = append(mgrs, mgr)
+	}
+	ids, err := eh.atmosphere.db.LogStateChanges(mgrs, st)
+	if err != nil {
+		//和提交 unit of work 失败一样,没有写入日志的 StateChange 不能处理,程序只能退出.
+		// the same as failure of committing unit of work, StateChange not logged must not be handled, we can only quit.
+		panic(fmt.Sprintf("LogStateChanges %s err %s", utils.StringInterface1(st), err))
+	}
+	commit := eh.atmosphere.beginUnitOfWork()
+	defer commit()
+	for i, mgr := range mgrs {
+		//可能已经被前面的 StateManager 移除了
+		// it may be removed by StateManager before
+		if eh.atmosphere.Transfer2StateManager[mgr.Key] != mgr {
+			continue
+		}
+		eh.updateStateManagerFromStateChange(mgr, st)
+		eh.applyStateChange(mgr, st, ids[i], false)
 	}
 }
 
@@ -59,17 +81,90 @@ func (eh *stateMachineEventHandler) dispatchByPendingLocksInChannel(channel *cha
 }
 
 func (eh *stateMachineEventHandler) dispatch(stateManager *transfer.StateManager, stateChange transfer.StateChange) (events []transfer.Event) {
+	id := eh.logStateChange(stateManager, stateChange)
 	eh.updateStateManagerFromStateChange(stateManager, stateChange)
+	return eh.applyStateChange(stateManager, stateChange, id, false)
+}
+
+/*
+replay 重启以后重新处理日志中还没有包含在快照里的 StateChange, 除了不再写日志以外和 dispatch 完全一样.
+这些 StateChange 要么当时没有产生任何事件, 要么是崩溃时事件引起的修改还没有提交, 所以重放产生的事件需要再处理一次.
+已经标记为 Applied 的 StateChange 只用来恢复状态, 事件不再处理, 否则会重复发送 MediatedTransfer, Unlock 等消息.
+*/
+/*
+ *	replay : handle StateChange in log which is not included in snapshot again after restart,
+ *	it's the same as dispatch except that nothing is logged.
+ *	These StateChanges either produced no event, or modifications caused by their events were not committed when crash,
+ *	so events produced by replay must be handled again.
+ *	StateChange marked Applied only restores the state, its events are not handled again,
+ *	otherwise messages like MediatedTransfer and Unlock would be sent twice.
+ */
+func (eh *stateMachineEventHandler) replay(stateManager *transfer.StateManager, l *models.StateChangeLog) (events []transfer.Event) {
+	eh.updateStateManagerFromStateChange(stateManager, l.StateChange)
+	return eh.applyStateChange(stateManager, l.StateChange, l.ID, l.Applied)
+}
+
+/*
+applyStateChange 状态机处理 stateChange, 事件引起的修改, 事件已处理的标记以及快照在同一个 unit of work 中提交,
+消息在提交以后才会发送.
+*/
+/*
+ *	applyStateChange : state machine handles stateChange, modifications caused by events, the applied mark and snapshot
+ *	are committed in the same unit of work, messages are sent only after that.
+ */
+func (eh *stateMachineEventHandler) applyStateChange(stateManager *transfer.StateManager, stateChange transfer.StateChange, id int64, applied bool) (events []transfer.Event) {
+	commit := eh.atmosphere.beginUnitOfWork()
+	defer commit()
 	events = stateManager.Dispatch(stateChange)
-	for _, e := range events {
-		err := eh.OnEvent(e, stateManager)
-		if err != nil {
-			log.Error(fmt.Sprintf("stateMachineEventHandler dispatch:%v\n", err))
+	if !applied {
+		for _, e := range events {
+			err := eh.OnEvent(e, stateManager)
+			if err != nil {
+				log.Error(fmt.Sprintf("stateMachineEventHandler dispatch:%v\n", err))
+			}
 		}
+		if len(events) > 0 && id != 0 {
+			err := eh.atmosphere.dao().MarkStateChangeApplied(id)
+			if err != nil {
+				log.Error(fmt.Sprintf("MarkStateChangeApplied %d err %s", id, err))
+			}
+		}
+	}
+	eh.snapshotStateManager(stateManager, id, len(events) > 0)
+	return
+}
+
+/*
+logStateChange 在状态机处理之前把 stateChange 写入数据库, stateManager 没有保存在数据库中的时候返回0, 比如 crashnode.
+写入失败的时候程序直接退出, 不能在没有日志的情况下处理它, 否则崩溃以后就无法恢复了.
+*/
+/*
+ *	logStateChange : write stateChange to db before state machine handles it, returns 0 if stateManager is not saved in db, such as crashnode.
+ *	Quit if it fails, it must not be handled without log, otherwise it can't be restored after crash.
+ */
+func (eh *stateMachineEventHandler) logStateChange(stateManager *transfer.StateManager, stateChange transfer.StateChange) (id int64) {
+	if stateManager.ID == 0 {
+		return
+	}
+	id, err := eh.atmosphere.db.LogStateChange(stateManager, stateChange)
+	if err != nil {
+		panic(fmt.Sprintf("LogStateChange %s err %s", utils.StringInterface1(stateChange), err))
 	}
 	return
 }
 
+//snapshotStateManager save snapshot of stateManager if needed, StateManager removed is not saved any more.
+func (eh *stateMachineEventHandler) snapshotStateManager(stateManager *transfer.StateManager, id int64, hasEvents bool) {
+	if id == 0 || eh.atmosphere.Transfer2StateManager[stateManager.Key] != stateManager ||
+		!stateManager.NeedSnapshot(id, hasEvents) {
+		return
+	}
+	err := eh.atmosphere.dao().SnapshotStateManager(stateManager, id)
+	if err != nil {
+		log.Error(fmt.Sprintf("SnapshotStateManager %s err %s", utils.HPex(stateManager.Identifier), err))
+	}
+}
+
 /*
 我要发送 reveal secret 出去了,应该让每个与密码相关的通道都知道密码.
 1.如果我是发送方,多注册一个密码没坏处
@@ -91,9 +186,18 @@ func (eh *stateMachineEventHandler) eventSendRevealSecret(event *mediatedtransfe
 	eh.atmosphere.registerSecret(event.Secret)
 	revealMessage := encoding.NewRevealSecret(event.Secret)
 	err = revealMessage.Sign(eh.atmosphere.PrivateKey, revealMessage)
-	err = eh.atmosphere.sendAsync(event.Receiver, revealMessage) //单独处理 reaveal secret
+	if event.Receiver == eh.atmosphere.NodeAddress {
+		/*
+			给自己的交易(比如 rebalance),发起方直接把密码告诉同一节点上的接收方
+		*/
+		// transfer to ourselves (rebalance for example), initiator tells the secret to target on the same node directly.
+		stateChange := &mediatedtransfer.ReceiveSecretRevealStateChange{Secret: event.Secret, Sender: eh.atmosphere.NodeAddress}
+		eh.dispatchBySecretHash(event.LockSecretHash, stateChange)
+	} else {
+		err = eh.atmosphere.sendAsync(event.Receiver, revealMessage) //单独处理 reaveal secret
+	}
 	if err == nil {
-		eh.atmosphere.db.UpdateTransferStatus(event.Token, revealMessage.LockSecretHash(), models.TransferStatusCanNotCancel, fmt.Sprintf("RevealSecret 正在发送 target=%s", utils.APex2(event.Receiver)))
+		eh.atmosphere.dao().UpdateTransferStatus(event.Token, revealMessage.LockSecretHash(), models.TransferStatusCanNotCancel, fmt.Sprintf("RevealSecret 正在发送 target=%s", utils.APex2(event.Receiver)))
 	}
 	return err
 }
@@ -107,11 +211,24 @@ func (eh *stateMachineEventHandler) eventSendSecretRequest(event *mediatedtransf
 	}
 	if stateManager.LastReceivedMessage == nil {
 		log.Warn(fmt.Sprintf("EventSendSecretRequest %s,but has no lastReceviedMessage", utils.StringInterface(event, 3)))
-		err = eh.atmosphere.db.UpdateChannelNoTx(channel.NewChannelSerialization(ch))
+		err = eh.atmosphere.dao().UpdateChannelNoTx(channel.NewChannelSerialization(ch))
 	} else {
 		eh.atmosphere.updateChannelAndSaveAck(ch, stateManager.LastReceivedMessage.Tag())
 		stateManager.LastReceivedMessage = nil
 	}
+	if event.Receiver == eh.atmosphere.NodeAddress {
+		/*
+			给自己的交易(比如 rebalance),接收方直接向同一节点上的发起方索要密码
+		*/
+		// transfer to ourselves (rebalance for example), target asks the initiator on the same node for the secret directly.
+		stateChange := &mediatedtransfer.ReceiveSecretRequestStateChange{
+			Amount:         new(big.Int).Set(event.Amount),
+			LockSecretHash: event.LockSecretHash,
+			Sender:         eh.atmosphere.NodeAddress,
+		}
+		eh.dispatchBySecretHash(event.LockSecretHash, stateChange)
+		return
+	}
 	err = eh.atmosphere.sendAsync(event.Receiver, secretRequest)
 	return
 }
@@ -119,10 +236,24 @@ func (eh *stateMachineEventHandler) eventSendMediatedTransfer(event *mediatedtra
 	receiver := event.Receiver
 	g := eh.atmosphere.getToken2ChannelGraph(event.Token)
 	ch := g.GetPartenerAddress2Channel(receiver)
-	mtr, err := ch.CreateMediatedTransfer(event.Initiator, event.Target, event.Fee, event.Amount, event.Expiration, event.LockSecretHash)
+	initiatorAddress, targetAddress, fee := event.Initiator, event.Target, event.Fee
+	onionPacket := event.Onion
+	if len(onionPacket) == 0 && stateManager.Name == initiator.NameInitiatorTransition {
+		onionPacket = eh.atmosphere.newOnion(event)
+	}
+	if len(onionPacket) > 0 {
+		//initiator and target are hidden in the onion
+		initiatorAddress, targetAddress, fee = utils.EmptyAddress, utils.EmptyAddress, utils.BigInt0
+	}
+	mtr, err := ch.CreateMediatedTransfer(initiatorAddress, targetAddress, fee, event.Amount, event.Expiration, event.LockSecretHash)
 	if err != nil {
 		return
 	}
+	mtr.Onion = onionPacket
+	if len(onionPacket) == 0 {
+		//mediators need hints to find the target, the onion knows the whole path
+		mtr.RouteHints = event.RouteHints
+	}
 	err = mtr.Sign(eh.atmosphere.PrivateKey, mtr)
 	err = ch.RegisterTransfer(eh.atmosphere.GetBlockNumber(), mtr)
 	if err != nil {
@@ -133,7 +264,7 @@ func (eh *stateMachineEventHandler) eventSendMediatedTransfer(event *mediatedtra
 		if stateManager.Name != initiator.NameInitiatorTransition {
 			log.Warn(fmt.Sprintf("EventSendMediatedTransfer %s,but has no lastReceviedMessage", utils.StringInterface(event, 3)))
 		}
-		err = eh.atmosphere.db.UpdateChannelNoTx(channel.NewChannelSerialization(ch))
+		err = eh.atmosphere.dao().UpdateChannelNoTx(channel.NewChannelSerialization(ch))
 	} else {
 		var fromCh *channel.Channel
 		fromCh, err = eh.atmosphere.findChannelByIdentifier(event.FromChannel)
@@ -143,23 +274,27 @@ func (eh *stateMachineEventHandler) eventSendMediatedTransfer(event *mediatedtra
 		t, _ := stateManager.LastReceivedMessage.Tag().(*transfer.MessageTag)
 		echohash := t.EchoHash
 		ack := eh.atmosphere.Protocol.CreateAck(echohash)
-		tx := eh.atmosphere.db.StartTx()
-		eh.atmosphere.db.SaveAck(echohash, ack.Pack(), tx)
-		err = eh.atmosphere.db.UpdateChannel(channel.NewChannelSerialization(ch), tx)
-		err = eh.atmosphere.db.UpdateChannel(channel.NewChannelSerialization(fromCh), tx)
+		//ack 和两个通道要么都保存, 要么都不保存
+		// ack and both channels are saved atomically
+		commit := eh.atmosphere.beginUnitOfWork()
+		dao := eh.atmosphere.dao()
+		dao.SaveAckNoTx(echohash, ack.Pack())
+		err = dao.UpdateChannelNoTx(channel.NewChannelSerialization(ch))
+		if err == nil {
+			err = dao.UpdateChannelNoTx(channel.NewChannelSerialization(fromCh))
+		}
+		commit()
 		if err != nil {
 			//数据库保存错误,不可能发生,一旦发生了,程序只能向上层报告错误.
 			// database cache fault, impossible to happen.
 			// If occurs, then throw this to upper layer.
-			//err=tx.Rollback()
 			panic(fmt.Sprintf("update channel err %s", err))
 		}
-		err = tx.Commit()
 		stateManager.LastReceivedMessage = nil
 	}
 	err = eh.atmosphere.sendAsync(receiver, mtr)
 	if err == nil {
-		eh.atmosphere.db.UpdateTransferStatus(ch.TokenAddress, mtr.LockSecretHash, models.TransferStatusCanCancel, fmt.Sprintf("MediatedTransfer 正在发送 target=%s", utils.APex2(receiver)))
+		eh.atmosphere.dao().UpdateTransferStatus(ch.TokenAddress, mtr.LockSecretHash, models.TransferStatusCanCancel, fmt.Sprintf("MediatedTransfer 正在发送 target=%s", utils.APex2(receiver)))
 	}
 	return
 }
@@ -167,23 +302,50 @@ func (eh *stateMachineEventHandler) eventSendUnlock(event *mediatedtransfer.Even
 	receiver := event.Receiver
 	g := eh.atmosphere.getToken2ChannelGraph(event.Token)
 	ch := g.GetPartenerAddress2Channel(receiver)
+	lock := ch.OurState.GetLock(event.LockSecretHash)
 	tr, err := ch.CreateUnlock(event.LockSecretHash)
 	if err != nil {
 		return
 	}
+	if lock != nil {
+		eh.atmosphere.routingHistory.record(event.Token, receiver, lock.Amount, true)
+	}
 	err = tr.Sign(eh.atmosphere.PrivateKey, tr)
 	err = ch.RegisterTransfer(eh.atmosphere.GetBlockNumber(), tr)
 	if err != nil {
 		return
 	}
 	eh.atmosphere.conditionQuit("EventSendUnlockBefore")
-	err = eh.atmosphere.db.UpdateChannelNoTx(channel.NewChannelSerialization(ch))
+	err = eh.atmosphere.dao().UpdateChannelNoTx(channel.NewChannelSerialization(ch))
 	err = eh.atmosphere.sendAsync(receiver, tr)
 	if err == nil {
-		eh.atmosphere.db.UpdateTransferStatusMessage(event.Token, event.LockSecretHash, fmt.Sprintf("Unlock 正在发送 target=%s", utils.APex2(receiver)))
+		eh.atmosphere.dao().UpdateTransferStatusMessage(event.Token, event.LockSecretHash, fmt.Sprintf("Unlock 正在发送 target=%s", utils.APex2(receiver)))
+	}
+	return
+}
+/*
+收到的交易被 hold 住了,不会发送任何消息,但是必须保存通道状态以及 ack, 并通知应用.
+*/
+/*
+ *	eventTransferHeld : the received transfer is held, no message will be sent,
+ *	but channel state and ack must be saved, and application should be notified.
+ */
+func (eh *stateMachineEventHandler) eventTransferHeld(event *mediatedtransfer.EventTransferHeld, stateManager *transfer.StateManager) (err error) {
+	ch := eh.atmosphere.getChannelWithAddr(event.ChannelIdentifier)
+	if ch == nil {
+		return fmt.Errorf("receive EventTransferHeld,but channel not exist %s", utils.HPex(event.ChannelIdentifier))
+	}
+	if stateManager.LastReceivedMessage == nil {
+		err = eh.atmosphere.dao().UpdateChannelNoTx(channel.NewChannelSerialization(ch))
+	} else {
+		eh.atmosphere.updateChannelAndSaveAck(ch, stateManager.LastReceivedMessage.Tag())
+		stateManager.LastReceivedMessage = nil
 	}
+	eh.atmosphere.NotifyHandler.Notify(notify.LevelInfo, fmt.Sprintf("transfer held, token=%s lockSecretHash=%s amount=%s initiator=%s expiration=%d",
+		event.Token.String(), event.LockSecretHash.String(), event.Amount, event.Initiator.String(), event.Expiration))
 	return
 }
+
 func (eh *stateMachineEventHandler) eventSendAnnouncedDisposed(event *mediatedtransfer.EventSendAnnounceDisposed, stateManager *transfer.StateManager) (err error) {
 	receiver := event.Receiver
 	g := eh.atmosphere.getToken2ChannelGraph(event.Token)
@@ -203,7 +365,7 @@ func (eh *stateMachineEventHandler) eventSendAnnouncedDisposed(event *mediatedtr
 	}
 	if stateManager.LastReceivedMessage == nil {
 		log.Warn(fmt.Sprintf("EventSendAnnounceDisposed %s,but has no lastReceviedMessage", utils.StringInterface(event, 3)))
-		err = eh.atmosphere.db.UpdateChannelNoTx(channel.NewChannelSerialization(ch))
+		err = eh.atmosphere.dao().UpdateChannelNoTx(channel.NewChannelSerialization(ch))
 	} else {
 		eh.atmosphere.updateChannelAndSaveAck(ch, stateManager.LastReceivedMessage.Tag())
 		//有可能同一个消息会引发两个 event send, 比如收到 中间节点EventAnnouceDisposed
@@ -232,7 +394,7 @@ func (eh *stateMachineEventHandler) eventSendAnnouncedDisposedResponse(event *me
 	eh.atmosphere.conditionQuit("EventSendAnnouncedDisposedResponseBefore")
 	if stateManager.LastReceivedMessage == nil {
 		log.Warn(fmt.Sprintf("EventSendAnnounceDisposedResponse %s,but has no lastReceviedMessage", utils.StringInterface(event, 3)))
-		err = eh.atmosphere.db.UpdateChannelNoTx(channel.NewChannelSerialization(ch))
+		err = eh.atmosphere.dao().UpdateChannelNoTx(channel.NewChannelSerialization(ch))
 	} else {
 		eh.atmosphere.updateChannelAndSaveAck(ch, stateManager.LastReceivedMessage.Tag())
 		stateManager.LastReceivedMessage = nil
@@ -241,23 +403,9 @@ func (eh *stateMachineEventHandler) eventSendAnnouncedDisposedResponse(event *me
 	return
 }
 func (eh *stateMachineEventHandler) eventContractSendRegisterSecret(event *mediatedtransfer.EventContractSendRegisterSecret) (err error) {
-	b, err := eh.atmosphere.Chain.SecretRegistryProxy.IsSecretRegistered(event.Secret)
-	if err != nil {
-		return err
-	}
-	if b {
-		log.Info(fmt.Sprintf("Secret %s already registered", utils.HPex(event.Secret)))
-		return
-	}
-	result := eh.atmosphere.Chain.SecretRegistryProxy.RegisterSecretAsync(event.Secret)
-	go func() {
-		var err error
-		err = <-result.Result
-		if err != nil {
-			log.Error(fmt.Sprintf("register secret on chain err %s,secret=%s you may lose your token because of this error",
-				err, event.Secret.String()))
-		}
-	}()
+	//同一个块中需要注册的密码在一个交易中提交
+	// secrets need to be registered in one block are submitted in one tx
+	eh.atmosphere.secretRegisterScheduler.add(event.Secret)
 	return nil
 }
 func (eh *stateMachineEventHandler) eventWithdrawFailed(e2 *mediatedtransfer.EventWithdrawFailed, manager *transfer.StateManager) (err error) {
@@ -298,6 +446,9 @@ func (eh *stateMachineEventHandler) eventUnlockFailed(e2 *mediatedtransfer.Event
 		return
 	}
 	log.Info(fmt.Sprintf("remove expired hashlock channel=%s,hashlock=%s ", utils.HPex(e2.ChannelIdentifier), utils.HPex(e2.LockSecretHash)))
+	if lock := ch.OurState.GetLock(e2.LockSecretHash); lock != nil {
+		eh.atmosphere.routingHistory.record(ch.TokenAddress, ch.PartnerState.Address, lock.Amount, false)
+	}
 	tr, err := ch.CreateRemoveExpiredHashLockTransfer(e2.LockSecretHash, eh.atmosphere.GetBlockNumber())
 	if err != nil {
 		log.Warn(fmt.Sprintf("Get Event UnlockFailed ,but hashlock cannot be removed err:%s", err))
@@ -310,9 +461,9 @@ func (eh *stateMachineEventHandler) eventUnlockFailed(e2 *mediatedtransfer.Event
 		return
 	}
 	eh.atmosphere.conditionQuit("EventRemoveExpiredHashlockTransferBefore")
-	err = eh.atmosphere.db.UpdateChannelNoTx(channel.NewChannelSerialization(ch))
+	err = eh.atmosphere.dao().UpdateChannelNoTx(channel.NewChannelSerialization(ch))
 	err = eh.atmosphere.sendAsync(ch.PartnerState.Address, tr)
-	eh.atmosphere.db.UpdateTransferStatus(ch.TokenAddress, e2.LockSecretHash, models.TransferStatusFailed, fmt.Sprintf("交易超时失败 err=%s", e2.Reason))
+	eh.atmosphere.dao().UpdateTransferStatus(ch.TokenAddress, e2.LockSecretHash, models.TransferStatusFailed, fmt.Sprintf("交易超时失败 err=%s", e2.Reason))
 	return
 }
 
@@ -347,6 +498,11 @@ func (eh *stateMachineEventHandler) OnEvent(event transfer.Event, stateManager *
 	case *mediatedtransfer.EventSendSecretRequest:
 		err = eh.eventSendSecretRequest(e2, stateManager)
 		eh.atmosphere.conditionQuit("EventSendSecretRequestAfter")
+	case *mediatedtransfer.EventTransferHeld:
+		err = eh.eventTransferHeld(e2, stateManager)
+	case *mediatedtransfer.EventHeldTransferCanceled:
+		eh.atmosphere.NotifyHandler.Notify(notify.LevelWarn, fmt.Sprintf("held transfer canceled because it's not settled before reveal timeout, token=%s lockSecretHash=%s amount=%s expiration=%d",
+			e2.Token.String(), e2.LockSecretHash.String(), e2.Amount, e2.Expiration))
 	case *mediatedtransfer.EventSendAnnounceDisposed:
 		err = eh.eventSendAnnouncedDisposed(e2, stateManager)
 		eh.atmosphere.conditionQuit("EventSendAnnouncedDisposedAfter")
@@ -359,7 +515,7 @@ func (eh *stateMachineEventHandler) OnEvent(event transfer.Event, stateManager *
 			err = fmt.Errorf("receive EventTransferSentSuccess,but channel not exist %s", utils.HPex(e2.ChannelIdentifier))
 			return
 		}
-		err = eh.atmosphere.db.UpdateChannelNoTx(channel.NewChannelSerialization(ch))
+		err = eh.atmosphere.dao().UpdateChannelNoTx(channel.NewChannelSerialization(ch))
 		if err != nil {
 			log.Error(fmt.Sprintf("UpdateChannelNoTx err %s", err))
 		}
@@ -367,7 +523,7 @@ func (eh *stateMachineEventHandler) OnEvent(event transfer.Event, stateManager *
 		eh.atmosphere.NotifyHandler.NotifySentTransfer(st)
 		eh.finishOneTransfer(event)
 	case *transfer.EventTransferSentFailed:
-		eh.atmosphere.db.UpdateTransferStatus(e2.Token, e2.LockSecretHash, models.TransferStatusFailed, fmt.Sprintf("交易失败 err=%s", e2.Reason))
+		eh.atmosphere.dao().UpdateTransferStatus(e2.Token, e2.LockSecretHash, models.TransferStatusFailed, fmt.Sprintf("交易失败 err=%s", e2.Reason))
 		eh.finishOneTransfer(event)
 	case *transfer.EventTransferReceivedSuccess:
 		ch, err = eh.atmosphere.findChannelByIdentifier(e2.ChannelIdentifier)
@@ -375,7 +531,7 @@ func (eh *stateMachineEventHandler) OnEvent(event transfer.Event, stateManager *
 			err = fmt.Errorf("receive EventTransferReceivedSuccess,but channel not exist %s", utils.HPex(e2.ChannelIdentifier))
 			return
 		}
-		err = eh.atmosphere.db.UpdateChannelNoTx(channel.NewChannelSerialization(ch))
+		err = eh.atmosphere.dao().UpdateChannelNoTx(channel.NewChannelSerialization(ch))
 		if err != nil {
 			log.Error(fmt.Sprintf("UpdateChannelNoTx err %s", err))
 		}
@@ -400,7 +556,7 @@ func (eh *stateMachineEventHandler) OnEvent(event transfer.Event, stateManager *
 	case *mediatedtransfer.EventContractSendRegisterSecret:
 		err = eh.eventContractSendRegisterSecret(e2)
 	case *mediatedtransfer.EventRemoveStateManager:
-		delete(eh.atmosphere.Transfer2StateManager, e2.Key)
+		eh.removeStateManager(e2.Key, stateManager)
 	case *mediatedtransfer.EventSaveFeeChargeRecord:
 		err = eh.eventSaveFeeChargeRecord(e2)
 	default:
@@ -410,6 +566,31 @@ func (eh *stateMachineEventHandler) OnEvent(event transfer.Event, stateManager *
 	return
 }
 
+/*
+给自己的交易中,发起方和接收方的 StateManager 在同一个节点上, key 不同,
+所以要删除的是发出这个事件的 StateManager, 而不是简单按照 key 删除.
+*/
+/*
+ *	removeStateManager : remove the state manager which emits EventRemoveStateManager.
+ *
+ *	Note that for transfers to ourselves, initiator and target state managers live on the same node with different keys,
+ *	so we cannot simply remove by key.
+ */
+func (eh *stateMachineEventHandler) removeStateManager(key common.Hash, stateManager *transfer.StateManager) {
+	if stateManager == nil || eh.atmosphere.Transfer2StateManager[key] == stateManager {
+		eh.atmosphere.removeStoredStateManager(eh.atmosphere.Transfer2StateManager[key])
+		delete(eh.atmosphere.Transfer2StateManager, key)
+		return
+	}
+	for k, mgr := range eh.atmosphere.Transfer2StateManager {
+		if mgr == stateManager {
+			eh.atmosphere.removeStoredStateManager(mgr)
+			delete(eh.atmosphere.Transfer2StateManager, k)
+			return
+		}
+	}
+}
+
 //remove the successful transfer's state manager
 func (eh *stateMachineEventHandler) finishOneTransfer(ev transfer.Event) {
 	var err error
@@ -448,6 +629,8 @@ func (eh *stateMachineEventHandler) handleTokenAdded(tokenAddress common.Address
 		return err
 	}
 	g := graph.NewChannelGraph(eh.atmosphere.NodeAddress, tokenAddress, nil)
+	g.History = eh.atmosphere.routingHistory
+	g.Announcements = eh.atmosphere.channelGossip
 	eh.atmosphere.TokenAddressMap[tokenAddress] = true
 	eh.atmosphere.Token2ChannelGraph[tokenAddress] = g
 	return nil
@@ -534,6 +717,8 @@ func (eh *stateMachineEventHandler) handleClosed(st *mediatedtransfer.ContractCl
 		log.Error(fmt.Sprintf("handleBalance ChannelStateTransition err=%s", err))
 	}
 	err = eh.atmosphere.db.UpdateChannelState(channel.NewChannelSerialization(ch))
+	eh.atmosphere.disputeResolver.onChannelClosed(ch, st.ClosingAddress)
+	eh.atmosphere.autoSettleScheduler.onChannelClosed(ch)
 	return err
 }
 
@@ -650,17 +835,7 @@ func (eh *stateMachineEventHandler) handleUnlockOnChain(st *mediatedtransfer.Con
 	//对方解锁我发出去的交易,考虑可否惩罚
 	// my partner unlock transfer I sent, consider punish him?
 	if eh.atmosphere.NodeAddress == st.Participant {
-		ad := eh.atmosphere.db.GetReceiviedAnnounceDisposed(st.LockHash, ch.ChannelIdentifier.ChannelIdentifier)
-		if ad != nil {
-			result := ch.ExternState.PunishObsoleteUnlock(ch.TokenAddress, common.BytesToHash(ad.LockHash), ad.AdditionalHash, ad.Signature)
-			go func() {
-				var err2 error
-				err2 = <-result.Result
-				if err2 != nil {
-					log.Error(fmt.Sprintf("PunishObsoleteUnlock %s ,err2 %s", utils.BPex(ad.LockHash), err2))
-				}
-			}()
-		}
+		eh.atmosphere.disputeResolver.onPartnerUnlock(ch, st.LockHash)
 	}
 	err = eh.atmosphere.db.UpdateChannelState(channel.NewChannelSerialization(ch))
 	return err
@@ -700,7 +875,16 @@ func (eh *stateMachineEventHandler) handleSecretRegisteredOnChain(st *mediatedtr
 }
 
 func (eh *stateMachineEventHandler) handleBlockStateChange(st *transfer.BlockStateChange) error {
+	eh.atmosphere.revealMargin.onBlock(st.BlockNumber)
+	st.RevealMargin = eh.atmosphere.revealMargin.margin()
 	eh.dispatchToAllTasks(st)
+	eh.atmosphere.autoRebalance(st.BlockNumber)
+	eh.atmosphere.runAutopilot(st.BlockNumber)
+	eh.atmosphere.secretRegisterScheduler.onBlock(st.BlockNumber)
+	eh.atmosphere.channelGossip.onBlock(st.BlockNumber)
+	eh.atmosphere.disputeResolver.onBlock(st.BlockNumber)
+	eh.atmosphere.autoSettleScheduler.onBlock(st.BlockNumber)
+	eh.atmosphere.settleOperations.onBlock(st.BlockNumber)
 	//for _, cg := range eh.atmosphere.Token2ChannelGraph {
 	//	for _, c := range cg.ChannelIdentifier2Channel {
 	//		err := eh.ChannelStateTransition(c, st)
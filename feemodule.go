@@ -97,32 +97,23 @@ func (fm *FeeModule) SubmitFeePolicyToPFS() (err error) {
 
 //GetNodeChargeFee : impl of FeeCharge
 func (fm *FeeModule) GetNodeChargeFee(nodeAddress, tokenAddress common.Address, amount *big.Int) *big.Int {
-	var feeSetting *models.FeeSetting
-	var ok bool
-	// 优先channel
+	var channelIdentifier common.Hash
 	c, err := fm.db.GetChannel(tokenAddress, nodeAddress)
 	if c != nil && err == nil {
-		feeSetting, ok = fm.feePolicy.ChannelFeeMap[c.ChannelIdentifier.ChannelIdentifier]
-		if ok {
-			return calculateFee(feeSetting, amount)
-		}
-	}
-	// 其次token
-	feeSetting, ok = fm.feePolicy.TokenFeeMap[tokenAddress]
-	if ok {
-		return calculateFee(feeSetting, amount)
+		channelIdentifier = c.ChannelIdentifier.ChannelIdentifier
 	}
-	// 最后account
-	return calculateFee(fm.feePolicy.AccountFee, amount)
+	return fm.channelFeeSetting(tokenAddress, channelIdentifier).CalculateFee(amount)
 }
 
-func calculateFee(feeSetting *models.FeeSetting, amount *big.Int) *big.Int {
-	fee := big.NewInt(0)
-	if feeSetting.FeePercent > 0 {
-		fee = fee.Div(amount, big.NewInt(feeSetting.FeePercent))
+//channelFeeSetting fee setting used on the channel, 优先channel,其次token,最后account
+func (fm *FeeModule) channelFeeSetting(tokenAddress common.Address, channelIdentifier common.Hash) *models.FeeSetting {
+	feeSetting, ok := fm.feePolicy.ChannelFeeMap[channelIdentifier]
+	if ok {
+		return feeSetting
 	}
-	if feeSetting.FeeConstant.Cmp(big.NewInt(0)) > 0 {
-		fee = fee.Add(fee, feeSetting.FeeConstant)
+	feeSetting, ok = fm.feePolicy.TokenFeeMap[tokenAddress]
+	if ok {
+		return feeSetting
 	}
-	return fee
+	return fm.feePolicy.AccountFee
 }
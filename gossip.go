@@ -0,0 +1,285 @@
+package atmosphere
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/SmartMeshFoundation/Atmosphere/blockchain"
+	"github.com/SmartMeshFoundation/Atmosphere/channel/channeltype"
+	"github.com/SmartMeshFoundation/Atmosphere/encoding"
+	"github.com/SmartMeshFoundation/Atmosphere/log"
+	"github.com/SmartMeshFoundation/Atmosphere/models"
+	"github.com/SmartMeshFoundation/Atmosphere/network/graph"
+	"github.com/SmartMeshFoundation/Atmosphere/params"
+	"github.com/SmartMeshFoundation/Atmosphere/utils"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+//gossipMaxClockSkew announcements from the future more than this are dropped
+const gossipMaxClockSkew = time.Minute
+
+type announcementKey struct {
+	channelIdentifier common.Hash
+	announcer         common.Address
+}
+
+//gossipRate messages received from one neighbour in current minute
+type gossipRate struct {
+	start time.Time
+	count int
+}
+
+/*
+channelGossip 定期向邻居公布我们每个通道的手续费和大致容量, 并转发收到的其他节点的公布.
+同一个节点同一个通道的公布只接受更新的, 并且一分钟内最多一次, 每个邻居每分钟发来的消息数也有上限, 这样洪泛一定会结束.
+路由时 ChannelGraph 用这些公布计算其他节点的手续费, 避开容量肯定不够的通道.
+*/
+/*
+ *	channelGossip : it announces fee and coarse capacity of our channels to neighbours periodically,
+ *	and forwards announcements of other nodes received.
+ *	For one channel of one announcer only newer announcements are accepted, at most once a minute,
+ *	and messages from one neighbour in a minute are limited too, so flooding always stops.
+ *	ChannelGraph uses them to calculate fees of other nodes and avoid channels surely without enough capacity when routing.
+ */
+type channelGossip struct {
+	ourAddress       common.Address
+	privateKey       *ecdsa.PrivateKey
+	enabled          bool
+	announceInterval time.Duration
+	graphs           func() map[common.Address]*graph.ChannelGraph
+	feeSetting       func(tokenAddress common.Address, channelIdentifier common.Hash) *models.FeeSetting
+	//channelExists returns true if the channel is known to be open on chain
+	channelExists func(tokenAddress common.Address, channelIdentifier common.Hash, participant1, participant2 common.Address) bool
+	send          func(recipient common.Address, msg encoding.SignedMessager) error
+	isOnline      func(addr common.Address) bool
+	now           func() time.Time
+	lock          sync.Mutex
+	received      map[announcementKey]*encoding.ChannelAnnouncement
+	sent          map[common.Hash]*encoding.ChannelAnnouncement
+	rates         map[common.Address]*gossipRate
+}
+
+func newChannelGossip(rs *Service) *channelGossip {
+	return &channelGossip{
+		ourAddress:       rs.NodeAddress,
+		privateKey:       rs.PrivateKey,
+		enabled:          rs.Config.EnableChannelGossip,
+		announceInterval: rs.Config.ChannelAnnounceInterval,
+		graphs: func() map[common.Address]*graph.ChannelGraph {
+			return rs.Token2ChannelGraph
+		},
+		feeSetting: func(tokenAddress common.Address, channelIdentifier common.Hash) *models.FeeSetting {
+			if fm, ok := rs.FeePolicy.(*FeeModule); ok {
+				return fm.channelFeeSetting(tokenAddress, channelIdentifier)
+			}
+			return &models.FeeSetting{FeeConstant: big.NewInt(0)}
+		},
+		channelExists: func(tokenAddress common.Address, channelIdentifier common.Hash, participant1, participant2 common.Address) bool {
+			token, _, p1, p2, err := rs.db.GetNonParticipantChannelByID(channelIdentifier)
+			if err != nil || token != tokenAddress {
+				return false
+			}
+			return (p1 == participant1 && p2 == participant2) || (p1 == participant2 && p2 == participant1)
+		},
+		send: rs.sendAsync,
+		isOnline: func(addr common.Address) bool {
+			_, isOnline := rs.Protocol.GetNetworkStatus(addr)
+			return isOnline
+		},
+		now:      time.Now,
+		received: make(map[announcementKey]*encoding.ChannelAnnouncement),
+		sent:     make(map[common.Hash]*encoding.ChannelAnnouncement),
+		rates:    make(map[common.Address]*gossipRate),
+	}
+}
+
+//onBlock drop expired announcements and announce our channels which changed or haven't been announced for a while
+func (g *channelGossip) onBlock(blockNumber int64) {
+	if !g.enabled {
+		return
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	now := g.now()
+	for key, m := range g.received {
+		if m.Expired(now) {
+			delete(g.received, key)
+		}
+	}
+	for key, r := range g.rates {
+		if now.Sub(r.start) >= time.Minute {
+			delete(g.rates, key)
+		}
+	}
+	opened := make(map[common.Hash]bool)
+	for _, cg := range g.graphs() {
+		for _, ch := range cg.ChannelIdentifier2Channel {
+			if ch.State != channeltype.StateOpened {
+				continue
+			}
+			channelIdentifier := ch.ChannelIdentifier.ChannelIdentifier
+			opened[channelIdentifier] = true
+			fs := g.feeSetting(cg.TokenAddress, channelIdentifier)
+			bucket := encoding.CapacityBucket(ch.Distributable())
+			last := g.sent[channelIdentifier]
+			if last != nil {
+				elapsed := now.Sub(time.Unix(last.Timestamp, 0))
+				changed := last.FeeConstant.Cmp(fs.FeeConstant) != 0 || last.FeePercent != fs.FeePercent || last.CapacityBucket != bucket
+				if elapsed < g.announceInterval && !(changed && elapsed >= params.ChannelAnnounceMinInterval) {
+					continue
+				}
+			}
+			timestamp := now.Unix()
+			if last != nil && timestamp <= last.Timestamp {
+				timestamp = last.Timestamp + 1
+			}
+			m := encoding.NewChannelAnnouncement(cg.TokenAddress, channelIdentifier, ch.PartnerState.Address, timestamp, fs.FeeConstant, fs.FeePercent, bucket)
+			m.Features = encoding.FeatureOnion
+			err := m.SignAnnouncement(g.privateKey)
+			if err != nil {
+				log.Error(fmt.Sprintf("sign ChannelAnnouncement err %s", err))
+				continue
+			}
+			g.sent[channelIdentifier] = m
+			g.flood(cg, m, utils.EmptyAddress)
+		}
+	}
+	for channelIdentifier := range g.sent {
+		if !opened[channelIdentifier] {
+			delete(g.sent, channelIdentifier)
+		}
+	}
+}
+
+//flood sends m signed by us to all online partners of the token network except `from` and the announcer
+func (g *channelGossip) flood(cg *graph.ChannelGraph, m *encoding.ChannelAnnouncement, from common.Address) {
+	m = m.Forward()
+	err := m.Sign(g.privateKey, m)
+	if err != nil {
+		log.Error(fmt.Sprintf("sign ChannelAnnouncement err %s", err))
+		return
+	}
+	for partner := range cg.PartenerAddress2Channel {
+		if partner == from || partner == m.Announcer || !g.isOnline(partner) {
+			continue
+		}
+		err = g.send(partner, m)
+		if err != nil {
+			log.Error(fmt.Sprintf("send %s to %s err %s", m, utils.APex2(partner), err))
+		}
+	}
+}
+
+/*
+onAnnouncement 收到的公布如果合法并且比已知的新就保存下来, 然后转发给其他邻居.
+不合法或者重复的公布直接丢弃, 不返回错误, 否则发送者会一直重发.
+*/
+/*
+ *	onAnnouncement : an announcement received is saved if it's valid and newer than the known one, then it's forwarded to other neighbours.
+ *	Invalid or duplicate announcements are dropped silently, otherwise the sender would retry again and again.
+ */
+func (g *channelGossip) onAnnouncement(m *encoding.ChannelAnnouncement) {
+	if !g.enabled || m.Announcer == g.ourAddress {
+		return
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	now := g.now()
+	r := g.rates[m.Sender]
+	if r == nil || now.Sub(r.start) >= time.Minute {
+		r = &gossipRate{start: now}
+		g.rates[m.Sender] = r
+	}
+	r.count++
+	if r.count > params.GossipMaxMessagesPerMinute {
+		log.Trace(fmt.Sprintf("too many announcements from %s, drop %s", utils.APex2(m.Sender), m))
+		return
+	}
+	if m.Expired(now) || time.Unix(m.Timestamp, 0).Sub(now) > gossipMaxClockSkew {
+		log.Trace(fmt.Sprintf("drop expired or future announcement %s", m))
+		return
+	}
+	key := announcementKey{m.ChannelIdentifier, m.Announcer}
+	last := g.received[key]
+	if last != nil && m.Timestamp < last.Timestamp+int64(params.ChannelAnnounceMinInterval/time.Second) {
+		return
+	}
+	cg := g.graphs()[m.TokenAddress]
+	if cg == nil || m.Announcer == m.Partner ||
+		blockchain.CalcChannelID(m.TokenAddress, m.Announcer, m.Partner) != m.ChannelIdentifier ||
+		!g.channelExists(m.TokenAddress, m.ChannelIdentifier, m.Announcer, m.Partner) {
+		log.Info(fmt.Sprintf("drop announcement of unknown channel %s", m))
+		return
+	}
+	g.received[key] = m
+	g.flood(cg, m, m.Sender)
+}
+
+//announcement returns the valid announcement of node on its channel with next
+func (g *channelGossip) announcement(tokenAddress, node, next common.Address) *encoding.ChannelAnnouncement {
+	if !g.enabled {
+		return nil
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	m := g.received[announcementKey{blockchain.CalcChannelID(tokenAddress, node, next), node}]
+	if m == nil || m.TokenAddress != tokenAddress || m.Expired(g.now()) {
+		return nil
+	}
+	return m
+}
+
+//ChannelFee implements graph.ChannelAnnouncements
+func (g *channelGossip) ChannelFee(tokenAddress, node, next common.Address, amount *big.Int) *big.Int {
+	m := g.announcement(tokenAddress, node, next)
+	if m == nil {
+		return nil
+	}
+	fs := &models.FeeSetting{
+		FeeConstant: m.FeeConstant,
+		FeePercent:  m.FeePercent,
+	}
+	return fs.CalculateFee(amount)
+}
+
+/*
+OnionKey 如果 node 在最新的公布中声明支持洋葱路由, 返回它的公钥, 否则返回 nil.
+*/
+/*
+ *	OnionKey : returns public key of node if it declared support of onion routing in its latest announcement, otherwise nil.
+ */
+func (g *channelGossip) OnionKey(node common.Address) *ecdsa.PublicKey {
+	if !g.enabled {
+		return nil
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	now := g.now()
+	var latest *encoding.ChannelAnnouncement
+	for key, m := range g.received {
+		if key.announcer == node && !m.Expired(now) && (latest == nil || m.Timestamp > latest.Timestamp) {
+			latest = m
+		}
+	}
+	if latest == nil || latest.Features&encoding.FeatureOnion == 0 {
+		return nil
+	}
+	pub, err := latest.AnnouncerPublicKey()
+	if err != nil {
+		log.Error(fmt.Sprintf("announcer public key of %s err %s", latest, err))
+		return nil
+	}
+	return pub
+}
+
+//MayHaveCapacity implements graph.ChannelAnnouncements
+func (g *channelGossip) MayHaveCapacity(tokenAddress, node, next common.Address, amount *big.Int) bool {
+	m := g.announcement(tokenAddress, node, next)
+	if m == nil {
+		return true
+	}
+	return m.MayHaveCapacity(amount)
+}
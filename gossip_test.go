@@ -0,0 +1,209 @@
+package atmosphere
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/SmartMeshFoundation/Atmosphere/blockchain"
+	"github.com/SmartMeshFoundation/Atmosphere/channel"
+	"github.com/SmartMeshFoundation/Atmosphere/channel/channeltype"
+	"github.com/SmartMeshFoundation/Atmosphere/encoding"
+	"github.com/SmartMeshFoundation/Atmosphere/models"
+	"github.com/SmartMeshFoundation/Atmosphere/network/graph"
+	"github.com/SmartMeshFoundation/Atmosphere/params"
+	"github.com/SmartMeshFoundation/Atmosphere/utils"
+	"github.com/SmartMeshFoundation/Atmosphere/utils/utest"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+type sentAnnouncement struct {
+	recipient common.Address
+	msg       *encoding.ChannelAnnouncement
+}
+
+//newTestAnnouncement x announces its channel with y
+func newTestAnnouncement(t *testing.T, token common.Address, timestamp int64, feeConstant int64, capacity int64) (m *encoding.ChannelAnnouncement, x, y common.Address) {
+	key, _ := crypto.GenerateKey()
+	x, y = crypto.PubkeyToAddress(key.PublicKey), utils.NewRandomAddress()
+	m = encoding.NewChannelAnnouncement(token, blockchain.CalcChannelID(token, x, y), y, timestamp, big.NewInt(feeConstant), 0, encoding.CapacityBucket(big.NewInt(capacity)))
+	if err := m.SignAnnouncement(key); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+//receive m forwarded by the key
+func forwardTestAnnouncement(t *testing.T, m *encoding.ChannelAnnouncement) *encoding.ChannelAnnouncement {
+	key, _ := crypto.GenerateKey()
+	m = m.Forward()
+	if err := m.Sign(key, m); err != nil {
+		t.Fatal(err)
+	}
+	m2 := new(encoding.ChannelAnnouncement)
+	if err := m2.UnPack(m.Pack()); err != nil {
+		t.Fatal(err)
+	}
+	return m2
+}
+
+func TestChannelGossip(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	ourAddress := crypto.PubkeyToAddress(key.PublicKey)
+	p1, p2 := utils.NewRandomAddress(), utils.NewRandomAddress()
+	ch1 := utest.MakeRoute(p1, big.NewInt(100), utest.UnitSettleTimeout, utest.UnitRevealTimeout, 0, utils.NewRandomHash()).Channel()
+	ch2 := utest.MakeRoute(p2, big.NewInt(100), utest.UnitSettleTimeout, utest.UnitRevealTimeout, 0, utils.NewRandomHash()).Channel()
+	token := ch1.TokenAddress
+	ch2.TokenAddress = token
+	g := graph.NewChannelGraph(ourAddress, token, nil)
+	for _, ch := range []*channel.Channel{ch1, ch2} {
+		ch.OurState.Address = ourAddress
+		ch.State = channeltype.StateOpened
+		if err := g.AddChannel(ch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Unix(100000, 0)
+	feeSetting := &models.FeeSetting{FeeConstant: big.NewInt(3)}
+	knownChannels := make(map[common.Hash]bool)
+	online := map[common.Address]bool{p1: true, p2: true}
+	var sent []sentAnnouncement
+	gossip := &channelGossip{
+		ourAddress:       ourAddress,
+		privateKey:       key,
+		enabled:          true,
+		announceInterval: params.DefaultChannelAnnounceInterval,
+		graphs: func() map[common.Address]*graph.ChannelGraph {
+			return map[common.Address]*graph.ChannelGraph{token: g}
+		},
+		feeSetting: func(tokenAddress common.Address, channelIdentifier common.Hash) *models.FeeSetting {
+			return feeSetting
+		},
+		channelExists: func(tokenAddress common.Address, channelIdentifier common.Hash, participant1, participant2 common.Address) bool {
+			return knownChannels[channelIdentifier]
+		},
+		send: func(recipient common.Address, msg encoding.SignedMessager) error {
+			sent = append(sent, sentAnnouncement{recipient, msg.(*encoding.ChannelAnnouncement)})
+			return nil
+		},
+		isOnline: func(addr common.Address) bool { return online[addr] },
+		now:      func() time.Time { return now },
+		received: make(map[announcementKey]*encoding.ChannelAnnouncement),
+		sent:     make(map[common.Hash]*encoding.ChannelAnnouncement),
+		rates:    make(map[common.Address]*gossipRate),
+	}
+
+	//both channels are announced to both partners
+	gossip.onBlock(1)
+	if len(sent) != 4 {
+		t.Fatalf("expect 4 announcements sent,got %d", len(sent))
+	}
+	for _, s := range sent {
+		m := new(encoding.ChannelAnnouncement)
+		if err := m.UnPack(s.msg.Pack()); err != nil {
+			t.Fatal(err)
+		}
+		if m.Announcer != ourAddress || m.Sender != ourAddress || m.FeeConstant.Int64() != 3 || m.CapacityBucket != encoding.CapacityBucket(big.NewInt(100)) {
+			t.Fatalf("wrong announcement %s", m)
+		}
+	}
+	//nothing changes, not announced again
+	sent = nil
+	now = now.Add(time.Second * 30)
+	gossip.onBlock(2)
+	if len(sent) != 0 {
+		t.Fatalf("expect nothing sent,got %d", len(sent))
+	}
+	//fee changes, announced again after min interval
+	feeSetting = &models.FeeSetting{FeeConstant: big.NewInt(5)}
+	gossip.onBlock(3)
+	if len(sent) != 0 {
+		t.Fatalf("expect nothing sent before min interval,got %d", len(sent))
+	}
+	now = now.Add(params.ChannelAnnounceMinInterval)
+	online[p2] = false
+	gossip.onBlock(4)
+	if len(sent) != 2 || sent[0].recipient != p1 || sent[0].msg.FeeConstant.Int64() != 5 {
+		t.Fatalf("expect new fee sent to online partner only,got %d", len(sent))
+	}
+	//announced again after interval even if nothing changes
+	sent = nil
+	now = now.Add(params.DefaultChannelAnnounceInterval)
+	gossip.onBlock(5)
+	if len(sent) != 2 {
+		t.Fatalf("expect announced again,got %d", len(sent))
+	}
+
+	//announcement of other nodes
+	sent = nil
+	m, x, y := newTestAnnouncement(t, token, now.Unix(), 7, 50)
+	fromP1 := forwardTestAnnouncement(t, m)
+	fromP1.Sender = p1
+	gossip.onAnnouncement(fromP1)
+	if len(sent) != 0 || gossip.ChannelFee(token, x, y, big.NewInt(10)) != nil {
+		t.Fatal("announcement of unknown channel should be dropped")
+	}
+	knownChannels[m.ChannelIdentifier] = true
+	online[p2] = true
+	gossip.onAnnouncement(fromP1)
+	if len(sent) != 1 || sent[0].recipient != p2 || sent[0].msg.Announcer != x {
+		t.Fatalf("expect forwarded to p2 only,got %d", len(sent))
+	}
+	m2 := new(encoding.ChannelAnnouncement)
+	if err := m2.UnPack(sent[0].msg.Pack()); err != nil || m2.Sender != ourAddress {
+		t.Fatalf("forwarded announcement should be signed by us,err %v", err)
+	}
+	if f := gossip.ChannelFee(token, x, y, big.NewInt(10)); f == nil || f.Int64() != 7 {
+		t.Fatalf("expect fee 7,got %s", f)
+	}
+	if gossip.ChannelFee(token, y, x, big.NewInt(10)) != nil {
+		t.Fatal("y has announced nothing")
+	}
+	if !gossip.MayHaveCapacity(token, x, y, big.NewInt(60)) || gossip.MayHaveCapacity(token, x, y, big.NewInt(100)) {
+		t.Fatal("capacity of x is between 32 and 63")
+	}
+	if !gossip.MayHaveCapacity(token, y, x, big.NewInt(100)) {
+		t.Fatal("y has announced nothing")
+	}
+	//duplicate is not forwarded again
+	sent = nil
+	gossip.onAnnouncement(fromP1)
+	if len(sent) != 0 {
+		t.Fatalf("duplicate should be dropped,got %d", len(sent))
+	}
+	//expired announcement is not used or forwarded
+	now = now.Add(params.ChannelAnnouncementExpiration + time.Second)
+	if gossip.ChannelFee(token, x, y, big.NewInt(10)) != nil {
+		t.Fatal("expired announcement should not be used")
+	}
+	gossip.onBlock(6)
+	sent = nil
+	gossip.onAnnouncement(fromP1)
+	if len(sent) != 0 || len(gossip.received) != 0 {
+		t.Fatal("expired announcement should be dropped")
+	}
+
+	//too many announcements from one neighbour
+	received := 0
+	for i := 0; i < params.GossipMaxMessagesPerMinute+10; i++ {
+		m, _, _ := newTestAnnouncement(t, token, now.Unix(), 1, 1)
+		knownChannels[m.ChannelIdentifier] = true
+		m = forwardTestAnnouncement(t, m)
+		m.Sender = p2
+		gossip.onAnnouncement(m)
+		received = len(gossip.received)
+	}
+	if received != params.GossipMaxMessagesPerMinute {
+		t.Fatalf("expect %d announcements accepted,got %d", params.GossipMaxMessagesPerMinute, received)
+	}
+
+	//disabled gossip does nothing
+	sent = nil
+	gossip.enabled = false
+	now = now.Add(params.DefaultChannelAnnounceInterval)
+	gossip.onBlock(7)
+	if len(sent) != 0 || gossip.ChannelFee(token, x, y, big.NewInt(10)) != nil {
+		t.Fatal("disabled gossip should do nothing")
+	}
+}
@@ -0,0 +1,73 @@
+package atmosphere
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/SmartMeshFoundation/Atmosphere/channel"
+	"github.com/SmartMeshFoundation/Atmosphere/log"
+	"github.com/SmartMeshFoundation/Atmosphere/models"
+	"github.com/SmartMeshFoundation/Atmosphere/utils"
+)
+
+/*
+checkMediationLimit 检查一笔金额为 amount 的交易是否超过了限制, channels 是这个限制涉及的和上家的通道,
+新的锁已经在通道中了.
+*/
+/*
+ *	checkMediationLimit : check whether a transfer of amount exceeds the limit, channels are channels with payers the limit covers,
+ *	and the new lock is already registered in them.
+ */
+func checkMediationLimit(l *models.MediationLimit, channels []*channel.Channel, amount *big.Int) error {
+	if l.MaxTransferAmount != nil && l.MaxTransferAmount.Sign() > 0 && amount.Cmp(l.MaxTransferAmount) > 0 {
+		return fmt.Errorf("transfer amount %s exceeds limit %s", amount, l.MaxTransferAmount)
+	}
+	locks := 0
+	locked := big.NewInt(0)
+	for _, ch := range channels {
+		locks += len(ch.PartnerState.Lock2PendingLocks) + len(ch.PartnerState.Lock2UnclaimedLocks)
+		locked.Add(locked, ch.Outstanding())
+	}
+	if l.MaxPendingLocks > 0 && locks > l.MaxPendingLocks {
+		return fmt.Errorf("%d pending locks exceeds limit %d", locks, l.MaxPendingLocks)
+	}
+	if l.MaxLockedAmount != nil && l.MaxLockedAmount.Sign() > 0 && locked.Cmp(l.MaxLockedAmount) > 0 {
+		return fmt.Errorf("locked amount %s exceeds limit %s", locked, l.MaxLockedAmount)
+	}
+	return nil
+}
+
+/*
+checkMediationLimits 检查从 ch 收到的交易是否超过了这个上家的限制以及整个 token 的限制.
+*/
+// checkMediationLimits : check whether transfer received from ch exceeds limit of this partner and limit of the whole token.
+func (rs *Service) checkMediationLimits(ch *channel.Channel, amount *big.Int) error {
+	l, err := rs.db.GetMediationLimit(ch.TokenAddress, ch.PartnerState.Address)
+	if err != nil {
+		log.Error(fmt.Sprintf("GetMediationLimit err %s", err))
+	}
+	if l != nil {
+		err = checkMediationLimit(l, []*channel.Channel{ch}, amount)
+		if err != nil {
+			return fmt.Errorf("partner %s: %s", utils.APex2(ch.PartnerState.Address), err)
+		}
+	}
+	l, err = rs.db.GetMediationLimit(ch.TokenAddress, utils.EmptyAddress)
+	if err != nil {
+		log.Error(fmt.Sprintf("GetMediationLimit err %s", err))
+	}
+	if l != nil {
+		var channels []*channel.Channel
+		g := rs.getToken2ChannelGraph(ch.TokenAddress)
+		if g != nil {
+			for _, c := range g.ChannelIdentifier2Channel {
+				channels = append(channels, c)
+			}
+		}
+		err = checkMediationLimit(l, channels, amount)
+		if err != nil {
+			return fmt.Errorf("token %s: %s", utils.APex2(ch.TokenAddress), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package atmosphere
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/SmartMeshFoundation/Atmosphere/channel"
+	"github.com/SmartMeshFoundation/Atmosphere/channel/channeltype"
+	"github.com/SmartMeshFoundation/Atmosphere/models"
+	"github.com/SmartMeshFoundation/Atmosphere/transfer/mtree"
+	"github.com/SmartMeshFoundation/Atmosphere/utils"
+	"github.com/SmartMeshFoundation/Atmosphere/utils/utest"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestCheckMediationLimit(t *testing.T) {
+	newChannel := func(partner common.Address, amounts ...int64) *channel.Channel {
+		ch := utest.MakeRoute(partner, big.NewInt(100), utest.UnitSettleTimeout, utest.UnitRevealTimeout, 0, utils.NewRandomHash()).Channel()
+		ch.PartnerState.Lock2PendingLocks = make(map[common.Hash]channeltype.PendingLock)
+		for _, amount := range amounts {
+			lock := &mtree.Lock{Expiration: 100, Amount: big.NewInt(amount), LockSecretHash: utils.NewRandomHash()}
+			ch.PartnerState.Lock2PendingLocks[lock.LockSecretHash] = channeltype.PendingLock{Lock: lock, LockHash: lock.Hash()}
+		}
+		return ch
+	}
+	//the new lock of 10 is already registered
+	ch1 := newChannel(utest.HOP1, 20, 10)
+	ch2 := newChannel(utest.HOP2, 30, 30, 30)
+
+	cases := []struct {
+		name     string
+		limit    *models.MediationLimit
+		channels []*channel.Channel
+		ok       bool
+	}{
+		{"no limit", &models.MediationLimit{}, []*channel.Channel{ch1}, true},
+		{"transfer amount", &models.MediationLimit{MaxTransferAmount: big.NewInt(9)}, []*channel.Channel{ch1}, false},
+		{"transfer amount ok", &models.MediationLimit{MaxTransferAmount: big.NewInt(10)}, []*channel.Channel{ch1}, true},
+		{"partner locked amount", &models.MediationLimit{MaxLockedAmount: big.NewInt(29)}, []*channel.Channel{ch1}, false},
+		{"partner locked amount ok", &models.MediationLimit{MaxLockedAmount: big.NewInt(30)}, []*channel.Channel{ch1}, true},
+		{"partner pending locks", &models.MediationLimit{MaxPendingLocks: 1}, []*channel.Channel{ch1}, false},
+		{"partner pending locks ok", &models.MediationLimit{MaxPendingLocks: 2}, []*channel.Channel{ch1}, true},
+		{"token locked amount", &models.MediationLimit{MaxLockedAmount: big.NewInt(100)}, []*channel.Channel{ch1, ch2}, false},
+		{"token locked amount ok", &models.MediationLimit{MaxLockedAmount: big.NewInt(120)}, []*channel.Channel{ch1, ch2}, true},
+		{"token pending locks", &models.MediationLimit{MaxPendingLocks: 4}, []*channel.Channel{ch1, ch2}, false},
+	}
+	for _, c := range cases {
+		err := checkMediationLimit(c.limit, c.channels, big.NewInt(10))
+		if (err == nil) != c.ok {
+			t.Errorf("%s: expect ok=%v,got err=%v", c.name, c.ok, err)
+		}
+	}
+}
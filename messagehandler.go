@@ -45,6 +45,10 @@ func newPhotonMessageHandler(photon *Service) *photonMessageHandler {
  Handles `message` and sends an ACK on success.
 */
 func (mh *photonMessageHandler) onMessage(msg encoding.SignedMessager, hash common.Hash) (err error) {
+	//处理一个消息引起的所有数据库修改在同一个事务中提交, 提交成功以后才会发送 ack
+	// all db modifications caused by one message are committed in one transaction, ack is sent only after that
+	commit := mh.atmosphere.beginUnitOfWork()
+	defer commit()
 	msg.SetTag(&transfer.MessageTag{
 		EchoHash: hash,
 	})
@@ -95,6 +99,8 @@ func (mh *photonMessageHandler) onMessage(msg encoding.SignedMessager, hash comm
 		err = mh.messageWithdrawRequest(m2)
 	case *encoding.WithdrawResponse:
 		err = mh.messageWithdrawResponse(m2)
+	case *encoding.ChannelAnnouncement:
+		mh.atmosphere.channelGossip.onAnnouncement(m2)
 	default:
 		log.Error(fmt.Sprintf("photonMessageHandler unknown msg:%s", utils.StringInterface1(msg)))
 		return fmt.Errorf("unhandled message cmdid:%d", msg.Cmd())
@@ -114,9 +120,9 @@ func (mh *photonMessageHandler) balanceProof(msg *encoding.UnLock) {
 }
 
 /*
- todo 收到密码,可能会影响到好多StateManager, 这些 StateManager 我如何做到原子保存呢?
+收到密码,可能会影响到好多StateManager, 这些 StateManager 的快照以及相关通道的修改都在 onMessage 的 unit of work 中原子保存.
 */
-// todo receive secret may impact manay StateManager, how should I do atomic store for these StateManager?
+// receive secret may impact many StateManager, snapshots of them and modifications of related channels are stored atomically in the unit of work of onMessage.
 func (mh *photonMessageHandler) messageRevealSecret(msg *encoding.RevealSecret) error {
 	secret := msg.LockSecret
 	sender := msg.Sender
@@ -125,7 +131,7 @@ func (mh *photonMessageHandler) messageRevealSecret(msg *encoding.RevealSecret)
 	// save log to db
 	channels := mh.atmosphere.findAllChannelsByLockSecretHash(msg.LockSecretHash())
 	for _, c := range channels {
-		mh.atmosphere.db.UpdateTransferStatusMessage(c.TokenAddress, msg.LockSecretHash(), fmt.Sprintf("收到 RevealSecret, from=%s", utils.APex2(msg.Sender)))
+		mh.atmosphere.dao().UpdateTransferStatusMessage(c.TokenAddress, msg.LockSecretHash(), fmt.Sprintf("收到 RevealSecret, from=%s", utils.APex2(msg.Sender)))
 	}
 	mh.atmosphere.StateMachineEventHandler.dispatchBySecretHash(msg.LockSecretHash(), stateChange)
 	return nil
@@ -155,7 +161,7 @@ func (mh *photonMessageHandler) messageSecretRequest(msg *encoding.SecretRequest
 	// save log to db
 	channels := mh.atmosphere.findAllChannelsByLockSecretHash(msg.LockSecretHash)
 	for _, c := range channels {
-		mh.atmosphere.db.UpdateTransferStatusMessage(c.TokenAddress, stateChange.LockSecretHash, fmt.Sprintf("收到 SecretRequest, from=%s", utils.APex2(msg.Sender)))
+		mh.atmosphere.dao().UpdateTransferStatusMessage(c.TokenAddress, stateChange.LockSecretHash, fmt.Sprintf("收到 SecretRequest, from=%s", utils.APex2(msg.Sender)))
 	}
 	mh.atmosphere.StateMachineEventHandler.dispatchBySecretHash(stateChange.LockSecretHash, stateChange)
 	return nil
@@ -305,6 +311,8 @@ func (mh *photonMessageHandler) messageAnnounceDisposed(msg *encoding.AnnounceDi
 	if err != nil {
 		return
 	}
+	//payee cannot go on with the transfer
+	mh.atmosphere.routingHistory.record(ch.TokenAddress, msg.Sender, msg.Lock.Amount, false)
 	punish := models.NewReceivedAnnounceDisposed(msg.Lock.Hash(), msg.ChannelIdentifier, msg.GetAdditionalHash(), msg.OpenBlockNumber, msg.Signature)
 	err = mh.atmosphere.db.MarkLockHashCanPunish(punish)
 	if err != nil {
@@ -318,7 +326,7 @@ func (mh *photonMessageHandler) messageAnnounceDisposed(msg *encoding.AnnounceDi
 		Message: msg,
 	}
 	mh.atmosphere.StateMachineEventHandler.dispatchBySecretHash(msg.Lock.LockSecretHash, stateChange)
-	mh.atmosphere.db.UpdateTransferStatusMessage(ch.TokenAddress, msg.Lock.LockSecretHash, fmt.Sprintf("收到AnnounceDisposed from=%s", utils.APex2(msg.Sender)))
+	mh.atmosphere.dao().UpdateTransferStatusMessage(ch.TokenAddress, msg.Lock.LockSecretHash, fmt.Sprintf("收到AnnounceDisposed from=%s", utils.APex2(msg.Sender)))
 	return nil
 }
 
@@ -328,7 +336,7 @@ func (mh *photonMessageHandler) messageAnnounceDisposed(msg *encoding.AnnounceDi
 相应的 StateManager 无需关心这个事件.
 1. InitiatorStateManager 不可能收到,一定是个错误
 2. MediatedStateManager 无需处理
-3. TargetStateManager 不可能收到(目前是这样的,暂不允许接收方拒绝收款).
+3. TargetStateManager 只有在拒绝 hold 住的交易以后才会收到,这时候 StateManager 已经结束了.
 4. CrashStateManager 无需处理,等锁自动过期即可,因为这种情况,我是不会知道密码的.
 因此适宜直接更新通道,并保存ack
 */
@@ -339,7 +347,7 @@ func (mh *photonMessageHandler) messageAnnounceDisposed(msg *encoding.AnnounceDi
  *	When receiving normal AnnounceDisposedResponse :
  *	1. InitiatorStateManager : Cannot receive this event, faults occur.
  *	2. MediatedStateManager : No need to handle.
- *	3. TargetStateManager : impossible to receive this event.
+ *	3. TargetStateManager : only receives it after canceling a held transfer, StateManager has been removed then.
  * 	4. CrashStateManager : No need to handle, just wait for expiration.
  *	Reasonable to update payment channel and store ACK.
  */
@@ -458,7 +466,15 @@ func (mh *photonMessageHandler) messageMediatedTransfer(msg *encoding.MediatedTr
 		return rerr.ErrStopCreateNewTransfer
 	}
 	token := mh.atmosphere.getTokenForChannelIdentifier(msg.ChannelIdentifier)
-	if mh.atmosphere.Config.IgnoreMediatedNodeRequest && msg.Target != mh.atmosphere.NodeAddress {
+	/*
+		洋葱路由的交易, 中间节点只知道下一跳, 接收方从洋葱中得到发起方
+	*/
+	// for an onion routed transfer, a mediator only knows the next hop, and the target gets the initiator from the onion.
+	onionHop, initiator, target, err := mh.atmosphere.peelOnion(msg)
+	if err != nil {
+		return fmt.Errorf("invalid onion of %s, err %s", msg, err)
+	}
+	if mh.atmosphere.Config.IgnoreMediatedNodeRequest && target != mh.atmosphere.NodeAddress {
 		//todo what about return a AnnounceDisposed Message ?
 		/*
 			需要考虑恶意攻击的情况,比如发送一个我已经知道密码,但是尚未 unlock 的锁
@@ -483,7 +499,7 @@ func (mh *photonMessageHandler) messageMediatedTransfer(msg *encoding.MediatedTr
 	if !ch.CanTransfer() {
 		return rerr.TransferWhenClosed(fmt.Sprintf("Mediated transfer received but the channel is  can not accept any transfer %s", ch.ChannelIdentifier.String()))
 	}
-	err := ch.RegisterTransfer(mh.atmosphere.GetBlockNumber(), msg)
+	err = ch.RegisterTransfer(mh.atmosphere.GetBlockNumber(), msg)
 	if err != nil {
 		return err
 	}
@@ -513,10 +529,10 @@ func (mh *photonMessageHandler) messageMediatedTransfer(msg *encoding.MediatedTr
 	buf, err := json.MarshalIndent(dataForDebug, "", "\t")
 	log.Trace(string(buf))
 	//mh.updateChannelAndSaveAck(ch, msg.Tag())
-	if msg.Target == mh.atmosphere.NodeAddress {
-		mh.atmosphere.targetMediatedTransfer(msg, ch)
+	if target == mh.atmosphere.NodeAddress {
+		mh.atmosphere.targetMediatedTransfer(msg, ch, initiator)
 	} else {
-		mh.atmosphere.mediateMediatedTransfer(msg, ch)
+		mh.atmosphere.mediateMediatedTransfer(msg, ch, onionHop)
 	}
 	/*
 		start  taker's tokenswap ,only if receive a valid mediated transfer
@@ -527,7 +543,7 @@ func (mh *photonMessageHandler) messageMediatedTransfer(msg *encoding.MediatedTr
 		FromAmount:     msg.PaymentAmount.String(),
 	}
 	if tokenswap, ok := mh.atmosphere.SwapKey2TokenSwap[key]; ok {
-		remove := mh.atmosphere.messageTokenSwapTaker(msg, tokenswap)
+		remove := mh.atmosphere.messageTokenSwapTaker(msg, initiator, target, tokenswap)
 		if remove { //once the swap start,remove mh key immediately. otherwise,maker may repeat mh tokenswap operation.
 			delete(mh.atmosphere.SwapKey2TokenSwap, key)
 		}
@@ -631,12 +647,14 @@ func (mh *photonMessageHandler) messageSettleResponse(msg *encoding.SettleRespon
 		return err
 	}
 	mh.atmosphere.updateChannelAndSaveAck(ch, msg.Tag())
+	mh.atmosphere.settleOperations.onSettleResponse(msg.ChannelIdentifier)
 	result := ch.CooperativeSettleChannel(msg)
 	go func() {
 		err = <-result.Result
 		if err != nil {
 			log.Error(fmt.Sprintf("CooperativeSettleChannel %s failed, so we can only close/settle this channel, err = %s", utils.HPex(msg.ChannelIdentifier), err.Error()))
 			mh.atmosphere.NotifyHandler.Notify(notify.LevelWarn, fmt.Sprintf("CooperateSettle通道失败,建议强制close/settle通道,ChannelIdentifier=%s", msg.ChannelIdentifier.String()))
+			mh.atmosphere.settleOperations.onCooperativeSettleFailed(msg.ChannelIdentifier, err)
 		}
 	}()
 	return nil
@@ -12,6 +12,7 @@ import (
 	"strings"
 
 	"github.com/SmartMeshFoundation/Atmosphere"
+	"github.com/SmartMeshFoundation/Atmosphere/encoding"
 	"github.com/SmartMeshFoundation/Atmosphere/internal/rpanic"
 	"github.com/SmartMeshFoundation/Atmosphere/log"
 	"github.com/SmartMeshFoundation/Atmosphere/network"
@@ -604,9 +605,27 @@ transfer:
 the caller should call GetTransferStatus periodically to query this transfer's latest status.
 */
 func (a *API) Transfers(tokenAddress, targetAddress string, amountstr string, feestr string, secretStr string, isDirect bool) (transfer string, err error) {
+	return a.TransfersWithRouteHints(tokenAddress, targetAddress, amountstr, feestr, secretStr, isDirect, "")
+}
+
+/*
+TransfersWithRouteHints is the same as Transfers, but with route hints provided by the target,
+so the target can receive tokens even if it is a phone behind a mesh box or hub.
+routeHintsStr is a json array of route hints, empty means none, for example:
+[
+    {
+        "node": "0x292650fee408320D888e06ed89D938294Ea42f99",
+        "channel_identifier": "0x5e86d58579cfbc77901a457d7f63e8ec6e47efc5848761f51e63729e7848a01d",
+        "fee_constant": 0,
+        "fee_percent": 10000
+    }
+]
+node forwards the transfer to the target, or to node of the next route hint, through channel channel_identifier.
+*/
+func (a *API) TransfersWithRouteHints(tokenAddress, targetAddress string, amountstr string, feestr string, secretStr string, isDirect bool, routeHintsStr string) (transfer string, err error) {
 	defer func() {
-		log.Trace(fmt.Sprintf("Api Transfers tokenAddress=%s,targetAddress=%s,amountstr=%s,feestr=%s,secretStr=%s, isDirect=%v,\nout transfer=\n%s,err=%v",
-			tokenAddress, targetAddress, amountstr, feestr, secretStr, isDirect, transfer, err,
+		log.Trace(fmt.Sprintf("Api Transfers tokenAddress=%s,targetAddress=%s,amountstr=%s,feestr=%s,secretStr=%s, isDirect=%v,routeHints=%s,\nout transfer=\n%s,err=%v",
+			tokenAddress, targetAddress, amountstr, feestr, secretStr, isDirect, routeHintsStr, transfer, err,
 		))
 	}()
 	tokenAddr, err := utils.HexToAddressWithoutValidation(tokenAddress)
@@ -628,7 +647,14 @@ func (a *API) Transfers(tokenAddress, targetAddress string, amountstr string, fe
 		err = errors.New("amount should be positive")
 		return
 	}
-	result, err := a.api.TransferAsync(tokenAddr, amount, fee, targetAddr, secret, isDirect)
+	var hints []*encoding.RouteHint
+	if len(routeHintsStr) > 0 {
+		err = json.Unmarshal([]byte(routeHintsStr), &hints)
+		if err != nil {
+			return
+		}
+	}
+	result, err := a.api.TransferAsync(tokenAddr, amount, fee, targetAddr, secret, isDirect, nil, hints)
 	if err != nil {
 		log.Error(err.Error())
 		return
@@ -641,6 +667,7 @@ func (a *API) Transfers(tokenAddress, targetAddress string, amountstr string, fe
 	req.Amount = amount
 	req.Secret = secretStr
 	req.Fee = fee
+	req.RouteHints = hints
 	return marshal(req)
 }
 
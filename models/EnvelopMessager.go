@@ -26,6 +26,11 @@ type SentEnvelopMessager struct {
 
 //NewSentEnvelopMessager create a sending EnvelopMessager in db
 func (model *ModelDB) NewSentEnvelopMessager(msg encoding.EnvelopMessager, receiver common.Address) {
+	model.direct().NewSentEnvelopMessager(msg, receiver)
+}
+
+//NewSentEnvelopMessager create a sending EnvelopMessager in db when the unit of work is committed
+func (uow *UnitOfWork) NewSentEnvelopMessager(msg encoding.EnvelopMessager, receiver common.Address) {
 	echohash := utils.Sha3(msg.Pack(), receiver[:])
 	tr := &SentEnvelopMessager{
 		Message:  msg,
@@ -34,7 +39,9 @@ func (model *ModelDB) NewSentEnvelopMessager(msg encoding.EnvelopMessager, recei
 		EchoHash: echohash[:],
 	}
 	log.Trace(fmt.Sprintf("NewSentEnvelopMessager %s", utils.BPex(tr.EchoHash)))
-	err := model.db.Save(tr)
+	err := uow.update(func(tx storm.Node) error {
+		return tx.Save(tr)
+	})
 	if err != nil {
 		log.Error(fmt.Sprintf("NewSentEnvelopMessager err=%s", err))
 	}
@@ -42,14 +49,26 @@ func (model *ModelDB) NewSentEnvelopMessager(msg encoding.EnvelopMessager, recei
 
 //DeleteEnvelopMessager  delete a sending message from db
 func (model *ModelDB) DeleteEnvelopMessager(echohash common.Hash) {
+	model.direct().DeleteEnvelopMessager(echohash)
+}
+
+//DeleteEnvelopMessager delete a sending message from db when the unit of work is committed
+func (uow *UnitOfWork) DeleteEnvelopMessager(echohash common.Hash) {
 	sss := &SentEnvelopMessager{
 		EchoHash: echohash[:],
 	}
-	err := model.db.DeleteStruct(sss)
+	err := uow.update(func(tx storm.Node) error {
+		err := tx.DeleteStruct(sss)
+		if err == storm.ErrNotFound {
+			//可能这个消息完全不存在
+			// this messsage might not exist.
+			log.Warn(fmt.Sprintf("try to remove envelop message %s,but err= %s", utils.HPex(echohash), err))
+			return nil
+		}
+		return err
+	})
 	if err != nil {
-		//可能这个消息完全不存在
-		// this messsage might not exist.
-		log.Warn(fmt.Sprintf("try to remove envelop message %s,but err= %s", utils.HPex(echohash), err))
+		log.Error(fmt.Sprintf("DeleteEnvelopMessager err %s", err))
 	}
 }
 
@@ -33,7 +33,14 @@ func (model *ModelDB) SaveAck(echohash common.Hash, ack []byte, tx storm.Node) {
 
 //SaveAckNoTx save a ack to db
 func (model *ModelDB) SaveAckNoTx(echohash common.Hash, ack []byte) {
-	err := model.db.Set(bucketAck, echohash[:], ack)
+	model.direct().SaveAckNoTx(echohash, ack)
+}
+
+//SaveAckNoTx save a ack to db when the unit of work is committed
+func (uow *UnitOfWork) SaveAckNoTx(echohash common.Hash, ack []byte) {
+	err := uow.update(func(tx storm.Node) error {
+		return tx.Set(bucketAck, echohash[:], ack)
+	})
 	if err != nil {
 		log.Error(fmt.Sprintf("save ack to db err %s", err))
 	}
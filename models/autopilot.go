@@ -0,0 +1,117 @@
+package models
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/SmartMeshFoundation/Atmosphere/log"
+	"github.com/asdine/storm"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// AutopilotPolicy :
+// autopilot 在某个 token 上自动管理通道的策略,每个 token 一条
+// 其中 Budget 为 autopilot 在这个 token 上所有通道中我的存款总额上限,
+// MaxIdleBlocks 为通道多少块没有交易就关闭,设置为0即从不关闭
+type AutopilotPolicy struct {
+	Key                []byte         `storm:"id" json:"-"`
+	TokenAddress       common.Address `json:"token_address"`
+	Enable             bool           `json:"enable"`
+	DryRun             bool           `json:"dry_run"` // only log and report decisions, never act
+	Budget             *big.Int       `json:"budget"`
+	TargetChannels     int            `json:"target_channels"`
+	ChannelDeposit     *big.Int       `json:"channel_deposit"`
+	SettleTimeout      int            `json:"settle_timeout"`
+	MaxIdleBlocks      int64          `json:"max_idle_blocks"`
+	MinPartnerChannels int            `json:"min_partner_channels"` // candidates must have at least this many channels
+}
+
+// SaveAutopilotPolicy :
+func (model *ModelDB) SaveAutopilotPolicy(p *AutopilotPolicy) (err error) {
+	p.Key = p.TokenAddress[:]
+	err = model.db.Save(p)
+	return
+}
+
+// GetAutopilotPolicy : returns nil if no policy for this token
+func (model *ModelDB) GetAutopilotPolicy(tokenAddress common.Address) (p *AutopilotPolicy, err error) {
+	p = &AutopilotPolicy{}
+	err = model.db.One("Key", tokenAddress[:], p)
+	if err == storm.ErrNotFound {
+		return nil, nil
+	}
+	return
+}
+
+// GetAllAutopilotPolicies :
+func (model *ModelDB) GetAllAutopilotPolicies() (ps []*AutopilotPolicy) {
+	err := model.db.All(&ps)
+	if err != nil && err != storm.ErrNotFound {
+		log.Error(fmt.Sprintf("GetAllAutopilotPolicies err %s", err))
+	}
+	return
+}
+
+// AutopilotChannel :
+// autopilot 建立的通道,只有这些通道才会因为空闲被 autopilot 关闭,运营者手工建立的通道从不会被关闭.
+// 发起建立请求时保存, OpenBlockNumber 在通道出现以后才设置, 同一个 partner 以后重新建立的通道不是 autopilot 的.
+type AutopilotChannel struct {
+	Key             []byte         `storm:"id"`
+	TokenAddress    common.Address `json:"token_address"`
+	Partner         common.Address `json:"partner_address"`
+	OpenBlockNumber int64          `json:"open_block_number"`
+}
+
+func autopilotChannelKey(tokenAddress, partner common.Address) []byte {
+	return append(tokenAddress.Bytes(), partner[:]...)
+}
+
+// SaveAutopilotChannel :
+func (model *ModelDB) SaveAutopilotChannel(c *AutopilotChannel) (err error) {
+	c.Key = autopilotChannelKey(c.TokenAddress, c.Partner)
+	err = model.db.Save(c)
+	return
+}
+
+// GetAutopilotChannel : returns nil if autopilot never opens channel with partner on this token
+func (model *ModelDB) GetAutopilotChannel(tokenAddress, partner common.Address) (c *AutopilotChannel, err error) {
+	c = &AutopilotChannel{}
+	err = model.db.One("Key", autopilotChannelKey(tokenAddress, partner), c)
+	if err == storm.ErrNotFound {
+		return nil, nil
+	}
+	return
+}
+
+// RemoveAutopilotChannel :
+func (model *ModelDB) RemoveAutopilotChannel(tokenAddress, partner common.Address) (err error) {
+	err = model.db.DeleteStruct(&AutopilotChannel{Key: autopilotChannelKey(tokenAddress, partner)})
+	if err == storm.ErrNotFound {
+		err = nil
+	}
+	return
+}
+
+// ChannelActivity :
+// 通道双方 nonce 之和最后一次变化的块,用来判断通道空闲了多久,重启以后不会重置.
+type ChannelActivity struct {
+	ChannelIdentifier common.Hash `storm:"id"`
+	Nonce             uint64
+	BlockNumber       int64
+}
+
+// SaveChannelActivity :
+func (model *ModelDB) SaveChannelActivity(a *ChannelActivity) (err error) {
+	err = model.db.Save(a)
+	return
+}
+
+// GetChannelActivity : returns nil if never saved
+func (model *ModelDB) GetChannelActivity(channelIdentifier common.Hash) (a *ChannelActivity, err error) {
+	a = &ChannelActivity{}
+	err = model.db.One("ChannelIdentifier", channelIdentifier, a)
+	if err == storm.ErrNotFound {
+		return nil, nil
+	}
+	return
+}
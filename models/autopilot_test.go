@@ -0,0 +1,74 @@
+package models
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/SmartMeshFoundation/Atmosphere/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModelDB_AutopilotPolicy(t *testing.T) {
+	m := setupDb(t)
+	tokenAddress := utils.NewRandomAddress()
+	p, err := m.GetAutopilotPolicy(tokenAddress)
+	assert.Empty(t, err)
+	assert.Nil(t, p)
+
+	p = &AutopilotPolicy{
+		TokenAddress:   tokenAddress,
+		Enable:         true,
+		DryRun:         true,
+		Budget:         big.NewInt(1000),
+		TargetChannels: 3,
+		ChannelDeposit: big.NewInt(100),
+		SettleTimeout:  600,
+		MaxIdleBlocks:  5000,
+	}
+	err = m.SaveAutopilotPolicy(p)
+	assert.Empty(t, err)
+	p2, err := m.GetAutopilotPolicy(tokenAddress)
+	assert.Empty(t, err)
+	assert.EqualValues(t, p, p2)
+
+	p.DryRun = false
+	err = m.SaveAutopilotPolicy(p)
+	assert.Empty(t, err)
+	err = m.SaveAutopilotPolicy(&AutopilotPolicy{TokenAddress: utils.NewRandomAddress(), Budget: big.NewInt(1), ChannelDeposit: big.NewInt(1)})
+	assert.Empty(t, err)
+	ps := m.GetAllAutopilotPolicies()
+	assert.EqualValues(t, 2, len(ps))
+	p2, err = m.GetAutopilotPolicy(tokenAddress)
+	assert.Empty(t, err)
+	assert.EqualValues(t, false, p2.DryRun)
+}
+
+func TestModelDB_AutopilotChannel(t *testing.T) {
+	m := setupDb(t)
+	token, partner := utils.NewRandomAddress(), utils.NewRandomAddress()
+	c, err := m.GetAutopilotChannel(token, partner)
+	assert.Empty(t, err)
+	assert.Nil(t, c)
+	err = m.SaveAutopilotChannel(&AutopilotChannel{TokenAddress: token, Partner: partner, OpenBlockNumber: 3})
+	assert.Empty(t, err)
+	c, err = m.GetAutopilotChannel(token, partner)
+	assert.Empty(t, err)
+	assert.EqualValues(t, 3, c.OpenBlockNumber)
+	c, err = m.GetAutopilotChannel(partner, token)
+	assert.Empty(t, err)
+	assert.Nil(t, c)
+	assert.Empty(t, m.RemoveAutopilotChannel(token, partner))
+	assert.Empty(t, m.RemoveAutopilotChannel(token, partner))
+	c, err = m.GetAutopilotChannel(token, partner)
+	assert.Empty(t, err)
+	assert.Nil(t, c)
+
+	ch := utils.NewRandomHash()
+	a, err := m.GetChannelActivity(ch)
+	assert.Empty(t, err)
+	assert.Nil(t, a)
+	assert.Empty(t, m.SaveChannelActivity(&ChannelActivity{ChannelIdentifier: ch, Nonce: 2, BlockNumber: 10}))
+	a, err = m.GetChannelActivity(ch)
+	assert.Empty(t, err)
+	assert.EqualValues(t, 10, a.BlockNumber)
+}
@@ -0,0 +1,105 @@
+package models
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/SmartMeshFoundation/Atmosphere/log"
+	"github.com/SmartMeshFoundation/Atmosphere/utils"
+	"github.com/asdine/storm"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+//AutoSettleStatus status of settling a channel automatically
+type AutoSettleStatus string
+
+const (
+	//AutoSettlePending waiting for settle window to end or retry
+	AutoSettlePending AutoSettleStatus = "pending"
+	//AutoSettleSettled channel is settled, by me or by partner
+	AutoSettleSettled AutoSettleStatus = "settled"
+	//AutoSettleFailed give up after too many failures, user should settle it manually
+	AutoSettleFailed AutoSettleStatus = "failed"
+)
+
+/*
+AutoSettle 通道关闭以后, 在 settle 窗口结束时自动 settle 的计划.
+保存在数据库中, 重启以后继续执行.
+*/
+/*
+ *	AutoSettle : plan to settle a closed channel automatically when settle window ends.
+ *	It's saved in db and continues after restart.
+ */
+type AutoSettle struct {
+	ChannelIdentifier common.Hash      `json:"channel_identifier" storm:"id"`
+	OpenBlockNumber   int64            `json:"open_block_number"`
+	TokenAddress      common.Address   `json:"token_address"`
+	PartnerAddress    common.Address   `json:"partner_address"`
+	SettleBlock       int64            `json:"settle_block"` //channel can be settled after this block
+	Status            AutoSettleStatus `json:"status"`
+	Attempts          int              `json:"attempts"`
+	LastError         string           `json:"last_error"`
+	CreateTime        int64            `json:"create_time"`
+	UpdateTime        int64            `json:"update_time"`
+}
+
+//NewAutoSettle save a new pending plan, returns false if this channel is already planned
+func (model *ModelDB) NewAutoSettle(a *AutoSettle) (created bool, err error) {
+	var old AutoSettle
+	err = model.db.One("ChannelIdentifier", a.ChannelIdentifier, &old)
+	if err == nil && old.OpenBlockNumber == a.OpenBlockNumber {
+		return false, nil
+	}
+	if err != nil && err != storm.ErrNotFound {
+		err = fmt.Errorf("NewAutoSettle err %s", err)
+		return
+	}
+	a.Status = AutoSettlePending
+	a.CreateTime = time.Now().Unix()
+	a.UpdateTime = a.CreateTime
+	err = model.db.Save(a)
+	if err != nil {
+		err = fmt.Errorf("NewAutoSettle err %s", err)
+		return
+	}
+	log.Trace(fmt.Sprintf("channel %s will be settled automatically after block %d", utils.HPex(a.ChannelIdentifier), a.SettleBlock))
+	return true, nil
+}
+
+//UpdateAutoSettle save status of plan
+func (model *ModelDB) UpdateAutoSettle(a *AutoSettle) (err error) {
+	a.UpdateTime = time.Now().Unix()
+	err = model.db.Save(a)
+	if err != nil {
+		err = fmt.Errorf("UpdateAutoSettle err %s", err)
+	}
+	return
+}
+
+//GetAllAutoSettles returns all plans, ordered by create time
+func (model *ModelDB) GetAllAutoSettles() (settles []*AutoSettle, err error) {
+	err = model.db.All(&settles)
+	if err != nil {
+		err = fmt.Errorf("GetAllAutoSettles err %s", err)
+		return
+	}
+	sort.SliceStable(settles, func(i, j int) bool {
+		return settles[i].CreateTime < settles[j].CreateTime
+	})
+	return
+}
+
+//GetPendingAutoSettles returns all plans not finished
+func (model *ModelDB) GetPendingAutoSettles() (settles []*AutoSettle, err error) {
+	all, err := model.GetAllAutoSettles()
+	if err != nil {
+		return
+	}
+	for _, a := range all {
+		if a.Status == AutoSettlePending {
+			settles = append(settles, a)
+		}
+	}
+	return
+}
@@ -0,0 +1,52 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/SmartMeshFoundation/Atmosphere/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModelDB_AutoSettle(t *testing.T) {
+	m := setupDb(t)
+	defer m.CloseDB()
+	channelIdentifier := utils.NewRandomHash()
+	a := &AutoSettle{
+		ChannelIdentifier: channelIdentifier,
+		OpenBlockNumber:   3,
+		SettleBlock:       100,
+	}
+	created, err := m.NewAutoSettle(a)
+	assert.Empty(t, err)
+	assert.EqualValues(t, true, created)
+	created, err = m.NewAutoSettle(&AutoSettle{
+		ChannelIdentifier: channelIdentifier,
+		OpenBlockNumber:   3,
+		SettleBlock:       200,
+	})
+	assert.Empty(t, err)
+	assert.EqualValues(t, false, created)
+	pending, err := m.GetPendingAutoSettles()
+	assert.Empty(t, err)
+	assert.EqualValues(t, 1, len(pending))
+	assert.EqualValues(t, 100, pending[0].SettleBlock)
+
+	a.Status = AutoSettleSettled
+	err = m.UpdateAutoSettle(a)
+	assert.Empty(t, err)
+	pending, err = m.GetPendingAutoSettles()
+	assert.Empty(t, err)
+	assert.Empty(t, pending)
+	//channel reopened with the same identifier
+	created, err = m.NewAutoSettle(&AutoSettle{
+		ChannelIdentifier: channelIdentifier,
+		OpenBlockNumber:   300,
+		SettleBlock:       500,
+	})
+	assert.Empty(t, err)
+	assert.EqualValues(t, true, created)
+	all, err := m.GetAllAutoSettles()
+	assert.Empty(t, err)
+	assert.EqualValues(t, 1, len(all))
+	assert.EqualValues(t, AutoSettlePending, all[0].Status)
+}
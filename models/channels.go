@@ -27,8 +27,15 @@ func (model *ModelDB) NewChannel(c *channeltype.Serialization) error {
 
 //UpdateChannelNoTx update channel status without a Tx
 func (model *ModelDB) UpdateChannelNoTx(c *channeltype.Serialization) error {
+	return model.direct().UpdateChannelNoTx(c)
+}
+
+//UpdateChannelNoTx update channel status when the unit of work is committed
+func (uow *UnitOfWork) UpdateChannelNoTx(c *channeltype.Serialization) error {
 	//log.Trace(fmt.Sprintf("save channel %s", utils.StringInterface(c, 2)))
-	err := model.db.Save(c)
+	err := uow.update(func(tx storm.Node) error {
+		return tx.Save(c)
+	})
 	if err != nil {
 		log.Error(fmt.Sprintf("UpdateChannelNoTx err:%s", err))
 	}
@@ -37,20 +44,19 @@ func (model *ModelDB) UpdateChannelNoTx(c *channeltype.Serialization) error {
 
 //UpdateChannelAndSaveAck update channel and save ack, must atomic
 func (model *ModelDB) UpdateChannelAndSaveAck(c *channeltype.Serialization, echohash common.Hash, ack []byte) (err error) {
-	tx := model.StartTx()
-	defer func() {
+	return model.direct().UpdateChannelAndSaveAck(c, echohash, ack)
+}
+
+//UpdateChannelAndSaveAck update channel and save ack when the unit of work is committed
+func (uow *UnitOfWork) UpdateChannelAndSaveAck(c *channeltype.Serialization, echohash common.Hash, ack []byte) (err error) {
+	return uow.update(func(tx storm.Node) error {
+		err := uow.model.UpdateChannel(c, tx)
 		if err != nil {
-			err = tx.Rollback()
+			return err
 		}
-	}()
-	err = model.UpdateChannel(c, tx)
-	if err != nil {
-		log.Error(fmt.Sprintf("UpdateChannel err %s", err))
-		return
-	}
-	model.SaveAck(echohash, ack, tx)
-	err = tx.Commit()
-	return
+		uow.model.SaveAck(echohash, ack, tx)
+		return nil
+	})
 }
 func (model *ModelDB) handleChannelCallback(m map[*cb.ChannelCb]bool, c *channeltype.Serialization) {
 	var cbs []*cb.ChannelCb
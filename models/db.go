@@ -29,6 +29,7 @@ type ModelDB struct {
 	channelStateCallbacks   map[*cb.ChannelCb]bool
 	channelSettledCallbacks map[*cb.ChannelCb]bool
 	mlock                   sync.Mutex
+	readOnly                bool
 	Name                    string
 }
 
@@ -95,6 +96,42 @@ func OpenDb(dbPath string) (model *ModelDB, err error) {
 	return
 }
 
+/*
+OpenDbReadOnly 以只读方式打开一个已经存在的数据库, 用于离线检查节点的数据, 节点可以不运行.
+所有的修改都会失败, 关闭的时候也不会修改 close 标志.
+*/
+/*
+ *	OpenDbReadOnly : open an existing db read-only, for inspecting data of a node offline, node doesn't need to be running.
+ *	All modifications will fail, and close flag is not changed when closed.
+ */
+func OpenDbReadOnly(dbPath string) (model *ModelDB, err error) {
+	if !common.FileExist(dbPath) {
+		err = fmt.Errorf("db %s not exist", dbPath)
+		return
+	}
+	model = newModelDB()
+	model.readOnly = true
+	model.db, err = storm.Open(dbPath, storm.BoltOptions(os.ModePerm, &bolt.Options{Timeout: 1 * time.Second, ReadOnly: true}), storm.Codec(gobcodec.Codec))
+	if err != nil {
+		err = fmt.Errorf("cannot open db:%s read-only err:%v", dbPath, err)
+		return
+	}
+	model.Name = dbPath
+	var ver int
+	err = model.db.Get(bucketMeta, "version", &ver)
+	if err != nil {
+		err = fmt.Errorf("wrong db file format %s", err)
+		model.db.Close()
+		return
+	}
+	if ver != dbVersion {
+		err = fmt.Errorf("db version not match,expect %d,got %d", dbVersion, ver)
+		model.db.Close()
+		return
+	}
+	return
+}
+
 //StartTx start a new tx of db
 func (model *ModelDB) StartTx() (tx storm.Node) {
 	var err error
@@ -131,7 +168,10 @@ func (model *ModelDB) IsDbCrashedLastTime() bool {
 //CloseDB close db
 func (model *ModelDB) CloseDB() {
 	model.lock.Lock()
-	err := model.db.Set(bucketMeta, "close", true)
+	var err error
+	if !model.readOnly {
+		err = model.db.Set(bucketMeta, "close", true)
+	}
 	err = model.db.Close()
 	if err != nil {
 		log.Error(fmt.Sprintf("db err %s", err))
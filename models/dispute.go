@@ -0,0 +1,121 @@
+package models
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/SmartMeshFoundation/Atmosphere/log"
+	"github.com/SmartMeshFoundation/Atmosphere/utils"
+	"github.com/asdine/storm"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+//DisputeActionType type of on-chain action to respond a closed channel
+type DisputeActionType string
+
+const (
+	//DisputeUpdateBalanceProof submit balance proof of partner after partner closed channel
+	DisputeUpdateBalanceProof DisputeActionType = "update_balance_proof"
+	//DisputeUnlock unlock a lock partner sent me whose secret I know
+	DisputeUnlock DisputeActionType = "unlock"
+	//DisputePunish punish partner who unlocked a lock he has announced disposed
+	DisputePunish DisputeActionType = "punish"
+)
+
+//DisputeStatus status of a dispute action
+type DisputeStatus string
+
+const (
+	//DisputePending waiting to be sent or retried
+	DisputePending DisputeStatus = "pending"
+	//DisputeSuccess tx of this action succeed
+	DisputeSuccess DisputeStatus = "success"
+	//DisputeExpired action cannot be done before settle timeout or channel is gone
+	DisputeExpired DisputeStatus = "expired"
+)
+
+/*
+DisputeAction 通道关闭以后需要在链上执行的一个操作, 必须在 settle timeout 之前完成.
+失败的操作会一直重试, 直到成功或者过了 Deadline.
+*/
+/*
+ *	DisputeAction : an on-chain action needed after channel is closed, it must be done before settle timeout.
+ *	Failed action is retried until success or Deadline passed.
+ */
+type DisputeAction struct {
+	Key               []byte            `json:"-" storm:"id"`
+	ChannelIdentifier common.Hash       `json:"channel_identifier"`
+	OpenBlockNumber   int64             `json:"open_block_number"`
+	Type              DisputeActionType `json:"type"`
+	LockHash          common.Hash       `json:"lock_hash"` //lock secret hash for unlock, hash of lock for punish, empty for update balance proof
+	Deadline          int64             `json:"deadline"`  //block number of settle timeout
+	Status            DisputeStatus     `json:"status"`
+	Attempts          int               `json:"attempts"`
+	LastError         string            `json:"last_error"`
+	DoneBlock         int64             `json:"done_block"` //block number when success or expired
+	CreateTime        int64             `json:"create_time"`
+	UpdateTime        int64             `json:"update_time"`
+}
+
+//NewDisputeAction save a new pending action, returns false if the same action already exists
+func (model *ModelDB) NewDisputeAction(a *DisputeAction) (created bool, err error) {
+	a.Key = utils.Sha3(a.ChannelIdentifier[:], []byte(a.Type), a.LockHash[:]).Bytes()
+	var old DisputeAction
+	err = model.db.One("Key", a.Key, &old)
+	if err == nil {
+		return false, nil
+	}
+	if err != storm.ErrNotFound {
+		err = fmt.Errorf("NewDisputeAction err %s", err)
+		return
+	}
+	a.Status = DisputePending
+	a.CreateTime = time.Now().Unix()
+	a.UpdateTime = a.CreateTime
+	err = model.db.Save(a)
+	if err != nil {
+		err = fmt.Errorf("NewDisputeAction err %s", err)
+		return
+	}
+	log.Trace(fmt.Sprintf("new dispute action %s on channel %s,lock=%s,deadline=%d",
+		a.Type, utils.HPex(a.ChannelIdentifier), utils.HPex(a.LockHash), a.Deadline))
+	return true, nil
+}
+
+//UpdateDisputeAction save status of action
+func (model *ModelDB) UpdateDisputeAction(a *DisputeAction) (err error) {
+	a.UpdateTime = time.Now().Unix()
+	err = model.db.Save(a)
+	if err != nil {
+		err = fmt.Errorf("UpdateDisputeAction err %s", err)
+	}
+	return
+}
+
+//GetAllDisputeActions returns all dispute actions, ordered by create time
+func (model *ModelDB) GetAllDisputeActions() (actions []*DisputeAction, err error) {
+	err = model.db.All(&actions)
+	if err != nil {
+		err = fmt.Errorf("GetAllDisputeActions err %s", err)
+		return
+	}
+	sort.SliceStable(actions, func(i, j int) bool {
+		return actions[i].CreateTime < actions[j].CreateTime
+	})
+	return
+}
+
+//GetPendingDisputeActions returns all actions not finished
+func (model *ModelDB) GetPendingDisputeActions() (actions []*DisputeAction, err error) {
+	all, err := model.GetAllDisputeActions()
+	if err != nil {
+		return
+	}
+	for _, a := range all {
+		if a.Status == DisputePending {
+			actions = append(actions, a)
+		}
+	}
+	return
+}
@@ -0,0 +1,52 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/SmartMeshFoundation/Atmosphere/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModelDB_DisputeAction(t *testing.T) {
+	m := setupDb(t)
+	defer m.CloseDB()
+	channelIdentifier := utils.NewRandomHash()
+	a := &DisputeAction{
+		ChannelIdentifier: channelIdentifier,
+		Type:              DisputeUpdateBalanceProof,
+		Deadline:          100,
+	}
+	created, err := m.NewDisputeAction(a)
+	assert.Empty(t, err)
+	assert.EqualValues(t, true, created)
+	a2 := &DisputeAction{
+		ChannelIdentifier: channelIdentifier,
+		Type:              DisputeUnlock,
+		LockHash:          utils.NewRandomHash(),
+		Deadline:          100,
+	}
+	created, err = m.NewDisputeAction(a2)
+	assert.Empty(t, err)
+	assert.EqualValues(t, true, created)
+	//same action is created only once
+	created, err = m.NewDisputeAction(&DisputeAction{
+		ChannelIdentifier: channelIdentifier,
+		Type:              DisputeUpdateBalanceProof,
+		Deadline:          200,
+	})
+	assert.Empty(t, err)
+	assert.EqualValues(t, false, created)
+
+	a.Status = DisputeSuccess
+	a.Attempts = 1
+	err = m.UpdateDisputeAction(a)
+	assert.Empty(t, err)
+	all, err := m.GetAllDisputeActions()
+	assert.Empty(t, err)
+	assert.EqualValues(t, 2, len(all))
+	pending, err := m.GetPendingDisputeActions()
+	assert.Empty(t, err)
+	assert.EqualValues(t, 1, len(pending))
+	assert.EqualValues(t, DisputeUnlock, pending[0].Type)
+	assert.EqualValues(t, a2.LockHash, pending[0].LockHash)
+}
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"errors"
 	"fmt"
 	"math/big"
 
@@ -25,7 +26,19 @@ type FeeSetting struct {
 	Signature   []byte   `json:"signature"` // used when set fee policy to pfs
 }
 
-func (fs *FeeSetting) sign(key *ecdsa.PrivateKey) []byte {
+// CalculateFee : fee for transfer amount tokens, FeeConstant + amount/FeePercent
+func (fs *FeeSetting) CalculateFee(amount *big.Int) *big.Int {
+	fee := big.NewInt(0)
+	if fs.FeePercent > 0 {
+		fee = fee.Div(amount, big.NewInt(fs.FeePercent))
+	}
+	if fs.FeeConstant.Cmp(big.NewInt(0)) > 0 {
+		fee = fee.Add(fee, fs.FeeConstant)
+	}
+	return fee
+}
+
+func (fs *FeeSetting) signData() []byte {
 	var err error
 	buf := new(bytes.Buffer)
 	err = binary.Write(buf, binary.BigEndian, fs.FeePercent)
@@ -33,7 +46,12 @@ func (fs *FeeSetting) sign(key *ecdsa.PrivateKey) []byte {
 	if err != nil {
 		log.Error(fmt.Sprintf("signData err %s", err))
 	}
-	fs.Signature, err = utils.SignData(key, buf.Bytes())
+	return buf.Bytes()
+}
+
+func (fs *FeeSetting) sign(key *ecdsa.PrivateKey) []byte {
+	var err error
+	fs.Signature, err = utils.SignData(key, fs.signData())
 	if err != nil {
 		log.Crit(fmt.Sprintf("signDataFor FeeSetting err %s", err))
 	}
@@ -59,6 +77,42 @@ func (fp *FeePolicy) Sign(key *ecdsa.PrivateKey) {
 	}
 }
 
+//verifySignature returns error if fs is not signed by signer
+func (fs *FeeSetting) verifySignature(signer common.Address) error {
+	if fs == nil || fs.FeeConstant == nil {
+		return errors.New("empty fee setting")
+	}
+	addr, err := utils.Ecrecover(utils.Sha3(fs.signData()), fs.Signature)
+	if err != nil {
+		return err
+	}
+	if addr != signer {
+		return fmt.Errorf("fee setting signed by %s, expect %s", addr.String(), signer.String())
+	}
+	return nil
+}
+
+// VerifySignature : pfs checks every fee setting is signed by signer
+func (fp *FeePolicy) VerifySignature(signer common.Address) (err error) {
+	err = fp.AccountFee.verifySignature(signer)
+	if err != nil {
+		return
+	}
+	for _, fs := range fp.TokenFeeMap {
+		err = fs.verifySignature(signer)
+		if err != nil {
+			return
+		}
+	}
+	for _, fs := range fp.ChannelFeeMap {
+		err = fs.verifySignature(signer)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
 const defaultKey string = "feePolicy"
 
 // SaveFeePolicy :
@@ -0,0 +1,51 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/SmartMeshFoundation/Atmosphere/utils"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+/*
+HoldRequest 收款人的应用要求 hold 的交易,收到这个 LockSecretHash 的锁以后,在应用 settle 或者 cancel 之前既不索要密码,也不披露密码.
+是否 hold 完全由收款人决定,不会出现在发送的消息中.
+*/
+/*
+ *	HoldRequest : a transfer the application of the target asks to hold, after the lock with this LockSecretHash is received,
+ *	neither secret is requested nor revealed until the application settles or cancels it.
+ *	It's up to the target only, and never appears in messages sent.
+ */
+type HoldRequest struct {
+	Key            []byte         `storm:"id" json:"-"`
+	TokenAddress   common.Address `json:"token_address"`
+	LockSecretHash common.Hash    `json:"lock_secret_hash"`
+	CreateTime     int64          `json:"create_time"`
+}
+
+func holdRequestKey(tokenAddress common.Address, lockSecretHash common.Hash) []byte {
+	return utils.Sha3(tokenAddress[:], lockSecretHash[:]).Bytes()
+}
+
+//NewHoldRequest hold the transfer of this token and lockSecretHash when it's received
+func (model *ModelDB) NewHoldRequest(tokenAddress common.Address, lockSecretHash common.Hash) (err error) {
+	r := &HoldRequest{
+		Key:            holdRequestKey(tokenAddress, lockSecretHash),
+		TokenAddress:   tokenAddress,
+		LockSecretHash: lockSecretHash,
+		CreateTime:     time.Now().Unix(),
+	}
+	err = model.db.Save(r)
+	if err != nil {
+		err = fmt.Errorf("NewHoldRequest err %s", err)
+	}
+	return
+}
+
+//IsHoldRequested returns true if the transfer of this token and lockSecretHash should be held
+func (model *ModelDB) IsHoldRequested(tokenAddress common.Address, lockSecretHash common.Hash) bool {
+	r := new(HoldRequest)
+	err := model.db.One("Key", holdRequestKey(tokenAddress, lockSecretHash), r)
+	return err == nil
+}
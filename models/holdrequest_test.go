@@ -0,0 +1,23 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/SmartMeshFoundation/Atmosphere/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModelDB_HoldRequest(t *testing.T) {
+	m := setupDb(t)
+	tokenAddress := utils.NewRandomAddress()
+	lockSecretHash := utils.NewRandomHash()
+	assert.False(t, m.IsHoldRequested(tokenAddress, lockSecretHash))
+	err := m.NewHoldRequest(tokenAddress, lockSecretHash)
+	assert.Empty(t, err)
+	assert.True(t, m.IsHoldRequested(tokenAddress, lockSecretHash))
+	//the same lock of another token is not held
+	assert.False(t, m.IsHoldRequested(utils.NewRandomAddress(), lockSecretHash))
+	//hold again is ok
+	err = m.NewHoldRequest(tokenAddress, lockSecretHash)
+	assert.Empty(t, err)
+}
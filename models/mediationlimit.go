@@ -0,0 +1,72 @@
+package models
+
+import (
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/SmartMeshFoundation/Atmosphere/log"
+	"github.com/SmartMeshFoundation/Atmosphere/utils"
+	"github.com/asdine/storm"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// MediationLimit :
+// 作为中间节点转发交易时的风险限制, 按 token 和上家设置,
+// PartnerAddress 为空时是整个 token 的限制, 所有上家的交易合在一起计算.
+// 限制为 nil 或者 0 表示不限制
+type MediationLimit struct {
+	Key               []byte         `storm:"id" json:"-"`
+	TokenAddress      common.Address `json:"token_address"`
+	PartnerAddress    common.Address `json:"partner_address"`     // empty address means limit of the whole token
+	MaxLockedAmount   *big.Int       `json:"max_locked_amount"`   // max total amount of locks partner sent me at once
+	MaxTransferAmount *big.Int       `json:"max_transfer_amount"` // max amount of a single transfer
+	MaxPendingLocks   int            `json:"max_pending_locks"`   // max number of locks partner sent me at once
+	UpdateTime        int64          `json:"update_time"`
+}
+
+func mediationLimitKey(tokenAddress, partnerAddress common.Address) []byte {
+	return utils.Sha3(tokenAddress[:], partnerAddress[:]).Bytes()
+}
+
+// SaveMediationLimit : replace the limit of this token and partner
+func (model *ModelDB) SaveMediationLimit(l *MediationLimit) (err error) {
+	l.Key = mediationLimitKey(l.TokenAddress, l.PartnerAddress)
+	l.UpdateTime = time.Now().Unix()
+	err = model.db.Save(l)
+	if err != nil {
+		err = fmt.Errorf("SaveMediationLimit err %s", err)
+	}
+	return
+}
+
+// GetMediationLimit : returns nil if no limit for this token and partner
+func (model *ModelDB) GetMediationLimit(tokenAddress, partnerAddress common.Address) (l *MediationLimit, err error) {
+	l = &MediationLimit{}
+	err = model.db.One("Key", mediationLimitKey(tokenAddress, partnerAddress), l)
+	if err == storm.ErrNotFound {
+		return nil, nil
+	}
+	return
+}
+
+// RemoveMediationLimit :
+func (model *ModelDB) RemoveMediationLimit(tokenAddress, partnerAddress common.Address) (err error) {
+	l, err := model.GetMediationLimit(tokenAddress, partnerAddress)
+	if err != nil {
+		return
+	}
+	if l == nil {
+		return storm.ErrNotFound
+	}
+	return model.db.DeleteStruct(l)
+}
+
+// GetAllMediationLimits :
+func (model *ModelDB) GetAllMediationLimits() (ls []*MediationLimit) {
+	err := model.db.All(&ls)
+	if err != nil && err != storm.ErrNotFound {
+		log.Error(fmt.Sprintf("GetAllMediationLimits err %s", err))
+	}
+	return
+}
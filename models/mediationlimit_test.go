@@ -0,0 +1,52 @@
+package models
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/SmartMeshFoundation/Atmosphere/utils"
+	"github.com/asdine/storm"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModelDB_MediationLimit(t *testing.T) {
+	m := setupDb(t)
+	tokenAddress := utils.NewRandomAddress()
+	partnerAddress := utils.NewRandomAddress()
+	l, err := m.GetMediationLimit(tokenAddress, partnerAddress)
+	assert.Empty(t, err)
+	assert.Nil(t, l)
+
+	l = &MediationLimit{
+		TokenAddress:      tokenAddress,
+		PartnerAddress:    partnerAddress,
+		MaxLockedAmount:   big.NewInt(1000),
+		MaxTransferAmount: big.NewInt(100),
+		MaxPendingLocks:   3,
+	}
+	err = m.SaveMediationLimit(l)
+	assert.Empty(t, err)
+	l2, err := m.GetMediationLimit(tokenAddress, partnerAddress)
+	assert.Empty(t, err)
+	assert.EqualValues(t, l, l2)
+
+	//limit of the whole token is another one
+	err = m.SaveMediationLimit(&MediationLimit{TokenAddress: tokenAddress, MaxPendingLocks: 10})
+	assert.Empty(t, err)
+	l.MaxPendingLocks = 5
+	err = m.SaveMediationLimit(l)
+	assert.Empty(t, err)
+	assert.EqualValues(t, 2, len(m.GetAllMediationLimits()))
+	l2, err = m.GetMediationLimit(tokenAddress, utils.EmptyAddress)
+	assert.Empty(t, err)
+	assert.EqualValues(t, 10, l2.MaxPendingLocks)
+	l2, err = m.GetMediationLimit(tokenAddress, partnerAddress)
+	assert.Empty(t, err)
+	assert.EqualValues(t, 5, l2.MaxPendingLocks)
+
+	err = m.RemoveMediationLimit(tokenAddress, partnerAddress)
+	assert.Empty(t, err)
+	err = m.RemoveMediationLimit(tokenAddress, partnerAddress)
+	assert.EqualValues(t, storm.ErrNotFound, err)
+	assert.EqualValues(t, 1, len(m.GetAllMediationLimits()))
+}
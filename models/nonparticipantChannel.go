@@ -54,7 +54,7 @@ func (model *ModelDB) GetNonParticipantChannelByID(channelIdentifierForQuery com
 	tokenAddress = common.BytesToAddress(channel.TokenAddressBytes)
 	channelIdentifier = channelIdentifierForQuery
 	participant1 = common.BytesToAddress(channel.Participant1Bytes)
-	participant1 = common.BytesToAddress(channel.Participant2Bytes)
+	participant2 = common.BytesToAddress(channel.Participant2Bytes)
 	return
 }
 
@@ -0,0 +1,153 @@
+package models
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"time"
+
+	"github.com/SmartMeshFoundation/Atmosphere/log"
+	"github.com/SmartMeshFoundation/Atmosphere/params"
+	"github.com/SmartMeshFoundation/Atmosphere/utils"
+	"github.com/asdine/storm"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// RoutingEvent :
+// 经过某个通道转发交易的一次结果
+type RoutingEvent struct {
+	Amount  *big.Int `json:"amount"`
+	Success bool     `json:"success"`
+	Time    int64    `json:"time"`
+}
+
+// RoutingHistory :
+// 经过我和 PartnerAddress 之间的通道转发交易的成功失败记录, 只保留最近的 params.RoutingHistoryEvents 条.
+// 用来估计下次经过这个通道的交易成功的概率, 路由时避开刚刚失败过的通道.
+type RoutingHistory struct {
+	Key            []byte          `storm:"id" json:"-"`
+	TokenAddress   common.Address  `json:"token_address"`
+	PartnerAddress common.Address  `json:"partner_address"`
+	Events         []*RoutingEvent `json:"events"`
+	UpdateTime     int64           `json:"update_time"`
+}
+
+func routingHistoryKey(tokenAddress, partnerAddress common.Address) []byte {
+	return utils.Sha3(tokenAddress[:], partnerAddress[:]).Bytes()
+}
+
+/*
+SuccessProbability 估计经过这个通道转发 amount 的交易成功的概率.
+每条记录的权重每过 halfLife 减半; 比 amount 小的交易失败了, 或者比 amount 大的交易成功了, 对 amount 更有说服力,
+反过来则按金额比例降低权重. 没有记录时是 1.
+*/
+/*
+ *	SuccessProbability : estimate how likely a transfer of amount via this channel succeeds.
+ *	Weight of every event halves every halfLife, and a failure with larger amount or a success with smaller amount
+ *	tells less about amount, so their weight is scaled by the ratio of the amounts. It's 1 if there is no event.
+ */
+func (h *RoutingHistory) SuccessProbability(amount *big.Int, now time.Time, halfLife time.Duration) float64 {
+	var successes, failures float64
+	x, _ := new(big.Float).SetInt(amount).Float64()
+	for _, e := range h.Events {
+		w := 1.0
+		if age := now.Sub(time.Unix(e.Time, 0)); age > 0 && halfLife > 0 {
+			w = math.Pow(0.5, float64(age)/float64(halfLife))
+		}
+		a, _ := new(big.Float).SetInt(e.Amount).Float64()
+		if e.Success {
+			if x > a && x > 0 {
+				w *= a / x
+			}
+			successes += w
+		} else {
+			if x < a && a > 0 {
+				w *= x / a
+			}
+			failures += w
+		}
+	}
+	return (1 + successes) / (1 + successes + failures)
+}
+
+// AddRoutingEvent : record a result of transfer via channel with partnerAddress
+func (model *ModelDB) AddRoutingEvent(tokenAddress, partnerAddress common.Address, e *RoutingEvent) (err error) {
+	return model.direct().AddRoutingEvent(tokenAddress, partnerAddress, e)
+}
+
+/*
+AddRoutingEvent 和处理事件引起的其他修改一起提交, 这样 StateChange 只有在第一次真正处理的时候才会记录结果,
+崩溃以后重放没有标记为 Applied 的 StateChange 不会重复记录, 因为上次的记录并没有提交.
+*/
+/*
+ *	AddRoutingEvent : the result is committed together with other modifications caused by events,
+ *	so it's recorded only when the StateChange is applied for the first time,
+ *	replaying a StateChange not marked Applied after crash doesn't record it twice, because the last one was not committed.
+ */
+func (uow *UnitOfWork) AddRoutingEvent(tokenAddress, partnerAddress common.Address, e *RoutingEvent) error {
+	return uow.update(func(tx storm.Node) error {
+		h := &RoutingHistory{}
+		err := tx.One("Key", routingHistoryKey(tokenAddress, partnerAddress), h)
+		if err == storm.ErrNotFound {
+			h = &RoutingHistory{
+				Key:            routingHistoryKey(tokenAddress, partnerAddress),
+				TokenAddress:   tokenAddress,
+				PartnerAddress: partnerAddress,
+			}
+		} else if err != nil {
+			return fmt.Errorf("AddRoutingEvent err %s", err)
+		}
+		h.Events = append(h.Events, e)
+		if len(h.Events) > params.RoutingHistoryEvents {
+			h.Events = h.Events[len(h.Events)-params.RoutingHistoryEvents:]
+		}
+		h.UpdateTime = time.Now().Unix()
+		err = tx.Save(h)
+		if err != nil {
+			return fmt.Errorf("AddRoutingEvent err %s", err)
+		}
+		return nil
+	})
+}
+
+// GetRoutingHistory : returns nil if there is no history of this channel
+func (model *ModelDB) GetRoutingHistory(tokenAddress, partnerAddress common.Address) (h *RoutingHistory, err error) {
+	h = &RoutingHistory{}
+	err = model.db.One("Key", routingHistoryKey(tokenAddress, partnerAddress), h)
+	if err == storm.ErrNotFound {
+		return nil, nil
+	}
+	return
+}
+
+// GetAllRoutingHistory :
+func (model *ModelDB) GetAllRoutingHistory() (hs []*RoutingHistory) {
+	err := model.db.All(&hs)
+	if err != nil && err != storm.ErrNotFound {
+		log.Error(fmt.Sprintf("GetAllRoutingHistory err %s", err))
+	}
+	return
+}
+
+// RemoveRoutingHistory : forget history of channel with partnerAddress
+func (model *ModelDB) RemoveRoutingHistory(tokenAddress, partnerAddress common.Address) (err error) {
+	h, err := model.GetRoutingHistory(tokenAddress, partnerAddress)
+	if err != nil {
+		return
+	}
+	if h == nil {
+		return storm.ErrNotFound
+	}
+	return model.db.DeleteStruct(h)
+}
+
+// RemoveAllRoutingHistory : forget all history
+func (model *ModelDB) RemoveAllRoutingHistory() (err error) {
+	for _, h := range model.GetAllRoutingHistory() {
+		err = model.db.DeleteStruct(h)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
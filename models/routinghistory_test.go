@@ -0,0 +1,83 @@
+package models
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/SmartMeshFoundation/Atmosphere/params"
+	"github.com/SmartMeshFoundation/Atmosphere/utils"
+	"github.com/asdine/storm"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModelDB_RoutingHistory(t *testing.T) {
+	m := setupDb(t)
+	tokenAddress := utils.NewRandomAddress()
+	partnerAddress := utils.NewRandomAddress()
+	h, err := m.GetRoutingHistory(tokenAddress, partnerAddress)
+	assert.Empty(t, err)
+	assert.Nil(t, h)
+
+	now := time.Now().Unix()
+	for i := 0; i < params.RoutingHistoryEvents+5; i++ {
+		err = m.AddRoutingEvent(tokenAddress, partnerAddress, &RoutingEvent{big.NewInt(int64(i)), i%2 == 0, now})
+		assert.Empty(t, err)
+	}
+	h, err = m.GetRoutingHistory(tokenAddress, partnerAddress)
+	assert.Empty(t, err)
+	assert.EqualValues(t, params.RoutingHistoryEvents, len(h.Events))
+	//only recent events are kept
+	assert.EqualValues(t, big.NewInt(params.RoutingHistoryEvents+4), h.Events[len(h.Events)-1].Amount)
+
+	err = m.AddRoutingEvent(utils.NewRandomAddress(), partnerAddress, &RoutingEvent{big.NewInt(1), true, now})
+	assert.Empty(t, err)
+	assert.EqualValues(t, 2, len(m.GetAllRoutingHistory()))
+	err = m.RemoveRoutingHistory(tokenAddress, partnerAddress)
+	assert.Empty(t, err)
+	err = m.RemoveRoutingHistory(tokenAddress, partnerAddress)
+	assert.EqualValues(t, storm.ErrNotFound, err)
+	assert.EqualValues(t, 1, len(m.GetAllRoutingHistory()))
+	err = m.RemoveAllRoutingHistory()
+	assert.Empty(t, err)
+	assert.EqualValues(t, 0, len(m.GetAllRoutingHistory()))
+}
+
+func TestUnitOfWork_AddRoutingEvent(t *testing.T) {
+	m := setupDb(t)
+	defer m.CloseDB()
+	tokenAddress := utils.NewRandomAddress()
+	partnerAddress := utils.NewRandomAddress()
+	now := time.Now().Unix()
+	uow := m.BeginUnitOfWork()
+	err := uow.AddRoutingEvent(tokenAddress, partnerAddress, &RoutingEvent{big.NewInt(1), false, now})
+	assert.Empty(t, err)
+	err = uow.AddRoutingEvent(tokenAddress, partnerAddress, &RoutingEvent{big.NewInt(2), true, now})
+	assert.Empty(t, err)
+	//not saved if the unit of work is not committed, such as crash before the StateChange is marked applied
+	h, err := m.GetRoutingHistory(tokenAddress, partnerAddress)
+	assert.Empty(t, err)
+	assert.Nil(t, h)
+	err = uow.Commit()
+	assert.Empty(t, err)
+	h, err = m.GetRoutingHistory(tokenAddress, partnerAddress)
+	assert.Empty(t, err)
+	assert.EqualValues(t, 2, len(h.Events))
+	assert.EqualValues(t, big.NewInt(2), h.Events[1].Amount)
+}
+
+func TestRoutingHistory_SuccessProbability(t *testing.T) {
+	now := time.Unix(10000, 0)
+	h := &RoutingHistory{}
+	assert.EqualValues(t, 1, h.SuccessProbability(big.NewInt(100), now, time.Hour))
+	h.Events = []*RoutingEvent{{big.NewInt(100), false, now.Unix()}}
+	assert.EqualValues(t, 0.5, h.SuccessProbability(big.NewInt(100), now, time.Hour))
+	//a smaller transfer is more likely to pass
+	assert.EqualValues(t, 1/1.5, h.SuccessProbability(big.NewInt(50), now, time.Hour))
+	//the failure is forgotten gradually
+	assert.EqualValues(t, 1/1.5, h.SuccessProbability(big.NewInt(100), now.Add(time.Hour), time.Hour))
+	h.Events = append(h.Events, &RoutingEvent{big.NewInt(100), true, now.Unix()})
+	assert.EqualValues(t, 2.0/3, h.SuccessProbability(big.NewInt(100), now, time.Hour))
+	//success of a smaller transfer tells less
+	assert.EqualValues(t, 1.5/2.5, h.SuccessProbability(big.NewInt(200), now, time.Hour))
+}
@@ -0,0 +1,58 @@
+package models
+
+import (
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/SmartMeshFoundation/Atmosphere/log"
+	"github.com/SmartMeshFoundation/Atmosphere/utils"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+/*
+SecretRegisterCost 在链上注册一个密码的花费.
+一个交易可能注册了多个密码, 交易的 gas 费用由这些密码平摊, 每个密码的费用再由它对应的锁平摊.
+失败的交易同样需要付费, 也会记录下来.
+*/
+/*
+ *	SecretRegisterCost : cost of registering a secret on chain.
+ *	A tx may register many secrets, gas fee of the tx is shared by these secrets, and cost of a secret is shared by its locks.
+ *	Failed tx costs too, it's recorded as well.
+ */
+type SecretRegisterCost struct {
+	Key            []byte      `json:"-" storm:"id"`
+	LockSecretHash common.Hash `json:"lock_secret_hash"`
+	TxHash         common.Hash `json:"tx_hash"`
+	BatchSize      int         `json:"batch_size"` //number of secrets registered in this tx
+	Locks          int         `json:"locks"`      //number of locks of this secret
+	GasPrice       *big.Int    `json:"gas_price"`
+	Cost           *big.Int    `json:"cost"` //share of this secret in gas fee of tx
+	CostPerLock    *big.Int    `json:"cost_per_lock"`
+	Success        bool        `json:"success"`
+	Timestamp      int64       `json:"timestamp"`
+}
+
+//SaveSecretRegisterCost save cost of registering a secret in tx
+func (model *ModelDB) SaveSecretRegisterCost(c *SecretRegisterCost) (err error) {
+	c.Key = utils.Sha3(c.TxHash[:], c.LockSecretHash[:]).Bytes()
+	if c.Timestamp <= 0 {
+		c.Timestamp = time.Now().Unix()
+	}
+	err = model.db.Save(c)
+	if err != nil {
+		err = fmt.Errorf("SaveSecretRegisterCost err %s", err)
+		return
+	}
+	log.Trace(fmt.Sprintf("register secret %s cost %s,%s per lock", utils.HPex(c.LockSecretHash), c.Cost, c.CostPerLock))
+	return
+}
+
+//GetAllSecretRegisterCost returns cost of all secrets registered on chain
+func (model *ModelDB) GetAllSecretRegisterCost() (costs []*SecretRegisterCost, err error) {
+	err = model.db.All(&costs)
+	if err != nil {
+		err = fmt.Errorf("GetAllSecretRegisterCost err %s", err)
+	}
+	return
+}
@@ -0,0 +1,35 @@
+package models
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/SmartMeshFoundation/Atmosphere/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModelDB_SecretRegisterCost(t *testing.T) {
+	m := setupDb(t)
+	defer m.CloseDB()
+	costs, err := m.GetAllSecretRegisterCost()
+	assert.Empty(t, err)
+	assert.Empty(t, costs)
+	txHash := utils.NewRandomHash()
+	for i := 0; i < 2; i++ {
+		err = m.SaveSecretRegisterCost(&SecretRegisterCost{
+			LockSecretHash: utils.NewRandomHash(),
+			TxHash:         txHash,
+			BatchSize:      2,
+			Locks:          1,
+			Cost:           big.NewInt(10),
+			CostPerLock:    big.NewInt(10),
+			Success:        true,
+		})
+		assert.Empty(t, err)
+	}
+	costs, err = m.GetAllSecretRegisterCost()
+	assert.Empty(t, err)
+	assert.EqualValues(t, 2, len(costs))
+	assert.EqualValues(t, big.NewInt(10), costs[0].Cost)
+	assert.NotEqual(t, int64(0), costs[0].Timestamp)
+}
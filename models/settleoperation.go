@@ -0,0 +1,77 @@
+package models
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/SmartMeshFoundation/Atmosphere/log"
+	"github.com/SmartMeshFoundation/Atmosphere/utils"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+//SettlePhase phase of a settle operation
+type SettlePhase string
+
+const (
+	//SettlePhasePreparing no new transfers, waiting for locks to be cleared and partner to be online
+	SettlePhasePreparing SettlePhase = "preparing"
+	//SettlePhaseRequested SettleRequest is sent, waiting for partner to answer
+	SettlePhaseRequested SettlePhase = "requested"
+	//SettlePhaseCooperative partner agreed, cooperative settle tx is sent
+	SettlePhaseCooperative SettlePhase = "cooperative_settling"
+	//SettlePhaseClosing fall back to close, close tx is sent
+	SettlePhaseClosing SettlePhase = "closing"
+	//SettlePhaseClosed channel is closed, it will be settled automatically when settle window ends
+	SettlePhaseClosed SettlePhase = "closed"
+	//SettlePhaseSettled channel is settled
+	SettlePhaseSettled SettlePhase = "settled"
+)
+
+/*
+SettleOperation 合作关闭一个通道的进度, 不成功的时候改为 close.
+保存在数据库中, 重启以后继续执行.
+*/
+/*
+ *	SettleOperation : progress of settling a channel, cooperatively if possible.
+ *	It's saved in db and continues after restart.
+ */
+type SettleOperation struct {
+	ChannelIdentifier common.Hash `json:"channel_identifier" storm:"id"`
+	OpenBlockNumber   int64       `json:"open_block_number"`
+	Phase             SettlePhase `json:"phase"`
+	StartBlock        int64       `json:"start_block"`
+	Timeout           int64       `json:"timeout"` //blocks to wait for cooperative settle
+	FallbackReason    string      `json:"fallback_reason,omitempty"`
+	LastError         string      `json:"last_error,omitempty"`
+	UpdateTime        int64       `json:"update_time"`
+}
+
+//SetPhase move the operation to phase
+func (op *SettleOperation) SetPhase(phase SettlePhase) {
+	log.Info(fmt.Sprintf("settle operation of channel %s %s -> %s", utils.HPex(op.ChannelIdentifier), op.Phase, phase))
+	op.Phase = phase
+	op.UpdateTime = time.Now().Unix()
+}
+
+//SaveSettleOperation save progress of the operation, the old one of the same channel is replaced
+func (model *ModelDB) SaveSettleOperation(op *SettleOperation) (err error) {
+	err = model.db.Save(op)
+	if err != nil {
+		err = fmt.Errorf("SaveSettleOperation err %s", err)
+	}
+	return
+}
+
+//GetAllSettleOperations returns all operations, ordered by start block
+func (model *ModelDB) GetAllSettleOperations() (ops []*SettleOperation, err error) {
+	err = model.db.All(&ops)
+	if err != nil {
+		err = fmt.Errorf("GetAllSettleOperations err %s", err)
+		return
+	}
+	sort.SliceStable(ops, func(i, j int) bool {
+		return ops[i].StartBlock < ops[j].StartBlock
+	})
+	return
+}
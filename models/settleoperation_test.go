@@ -0,0 +1,40 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/SmartMeshFoundation/Atmosphere/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModelDB_SettleOperation(t *testing.T) {
+	m := setupDb(t)
+	defer m.CloseDB()
+	ops, err := m.GetAllSettleOperations()
+	assert.Empty(t, err)
+	assert.Empty(t, ops)
+	op1 := &SettleOperation{
+		ChannelIdentifier: utils.NewRandomHash(),
+		OpenBlockNumber:   3,
+		StartBlock:        100,
+		Timeout:           10,
+	}
+	op1.SetPhase(SettlePhasePreparing)
+	op2 := &SettleOperation{
+		ChannelIdentifier: utils.NewRandomHash(),
+		OpenBlockNumber:   5,
+		StartBlock:        50,
+		Timeout:           10,
+	}
+	op2.SetPhase(SettlePhasePreparing)
+	assert.Empty(t, m.SaveSettleOperation(op1))
+	assert.Empty(t, m.SaveSettleOperation(op2))
+	op1.SetPhase(SettlePhaseClosing)
+	op1.FallbackReason = "partner is offline"
+	assert.Empty(t, m.SaveSettleOperation(op1))
+	ops, err = m.GetAllSettleOperations()
+	assert.Empty(t, err)
+	assert.EqualValues(t, 2, len(ops))
+	assert.EqualValues(t, op2.ChannelIdentifier, ops[0].ChannelIdentifier)
+	assert.EqualValues(t, *op1, *ops[1])
+}
@@ -0,0 +1,265 @@
+package models
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"sort"
+
+	"github.com/SmartMeshFoundation/Atmosphere/log"
+	"github.com/SmartMeshFoundation/Atmosphere/transfer"
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+)
+
+/*
+StateChangeLog 发给 StateManager 的 StateChange, 在状态机处理之前写入, 崩溃重启以后按照 ID 的顺序重放.
+StateManager 保存快照以后, 快照之前的记录就删除了.
+Applied 和处理事件引起的修改在同一个事务中保存, 为 true 的记录重放的时候不会再处理一次事件.
+*/
+/*
+ *	StateChangeLog : StateChange dispatched to a StateManager, it is written before the state machine handles it,
+ *	and replayed in order of ID after crash.
+ *	Logs before a snapshot of the StateManager are removed once the snapshot is saved.
+ *	Applied is saved in the same transaction as modifications caused by handling events,
+ *	events of a log with Applied true are not handled again when replayed.
+ */
+type StateChangeLog struct {
+	ID             int64 `storm:"id,increment"`
+	StateManagerID int64 `storm:"index"`
+	StateChange    transfer.StateChange
+	Applied        bool //events produced by this StateChange have been handled
+}
+
+/*
+StateChangeAudit 和 StateChangeLog 的内容完全一样, 但是不会因为保存快照而删除, 只有 StateManager 被移除的时候才删除,
+所以可以从头重放一个 StateManager 收到的所有 StateChange, 比如用 dbinspect 重现卡住的交易.
+没有产生事件的 BlockStateChange 只会推进块号, 紧接着的下一个 BlockStateChange 会替换掉它,
+这样审计记录的数量只和真正的 StateChange 有关, 而不会每个块都增加一条.
+*/
+/*
+ *	StateChangeAudit : the same as StateChangeLog, but it's not removed by snapshot, only removed with its StateManager,
+ *	so all StateChanges dispatched to a StateManager can be replayed from the beginning, such as reproducing a stuck transfer by dbinspect.
+ *	A BlockStateChange producing no event only advances block number, it is replaced by the next BlockStateChange right after it,
+ *	so number of audits depends on real StateChanges only, instead of growing every block.
+ */
+type StateChangeAudit StateChangeLog
+
+func init() {
+	gob.Register(&StateChangeLog{})
+	gob.Register(&StateChangeAudit{})
+}
+
+//saveStateChangeLog save l and its audit with the same id in tx
+func saveStateChangeLog(tx storm.Node, l *StateChangeLog) error {
+	err := tx.Save(l)
+	if err != nil {
+		return err
+	}
+	if _, ok := l.StateChange.(*transfer.BlockStateChange); ok {
+		err = removeIdleBlockAudit(tx, l.StateManagerID)
+		if err != nil {
+			return err
+		}
+	}
+	audit := StateChangeAudit(*l)
+	return tx.Save(&audit)
+}
+
+//removeIdleBlockAudit remove the last audit of StateManager with mgrID if it's a BlockStateChange producing no event
+func removeIdleBlockAudit(tx storm.Node, mgrID int64) error {
+	last := new(StateChangeAudit)
+	err := tx.Select(q.Eq("StateManagerID", mgrID)).OrderBy("ID").Reverse().First(last)
+	if err == storm.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, ok := last.StateChange.(*transfer.BlockStateChange); !ok || last.Applied {
+		return nil
+	}
+	return tx.DeleteStruct(last)
+}
+
+//AddStateManager save a new StateManager, ID of mgr is assigned by db
+func (model *ModelDB) AddStateManager(mgr *transfer.StateManager) error {
+	return model.db.Save(mgr)
+}
+
+//LogStateChange append a StateChange dispatched to mgr, returns id of the log
+func (model *ModelDB) LogStateChange(mgr *transfer.StateManager, stateChange transfer.StateChange) (id int64, err error) {
+	l := &StateChangeLog{
+		StateManagerID: mgr.ID,
+		StateChange:    stateChange,
+	}
+	err = model.runInTx(func(tx storm.Node) error {
+		return saveStateChangeLog(tx, l)
+	})
+	return l.ID, err
+}
+
+/*
+LogStateChanges 把同一个 StateChange 作为发给 mgrs 中每一个 StateManager 的记录在一个事务中写入, 比如 BlockStateChange.
+返回的 id 和 mgrs 一一对应, 没有保存在数据库中的 StateManager 对应的 id 是0.
+*/
+/*
+ *	LogStateChanges : append the same StateChange dispatched to every StateManager of mgrs in one transaction, such as BlockStateChange.
+ *	ids returned are in the same order as mgrs, id is 0 for StateManager not saved in db.
+ */
+func (model *ModelDB) LogStateChanges(mgrs []*transfer.StateManager, stateChange transfer.StateChange) (ids []int64, err error) {
+	ids = make([]int64, len(mgrs))
+	err = model.runInTx(func(tx storm.Node) error {
+		for i, mgr := range mgrs {
+			if mgr.ID == 0 {
+				continue
+			}
+			l := &StateChangeLog{
+				StateManagerID: mgr.ID,
+				StateChange:    stateChange,
+			}
+			err := saveStateChangeLog(tx, l)
+			if err != nil {
+				return err
+			}
+			ids[i] = l.ID
+		}
+		return nil
+	})
+	return
+}
+
+/*
+MarkStateChangeApplied 标记 id 对应的 StateChange 产生的事件已经处理完了.
+必须通过处理这些事件的 UnitOfWork 调用, 否则崩溃以后重放可能重复发送消息或者一个消息都不发.
+*/
+/*
+ *	MarkStateChangeApplied : mark that events produced by StateChange with id have been handled.
+ *	It must be called through the UnitOfWork handling these events,
+ *	otherwise replay after crash may send messages twice or send none of them.
+ */
+func (model *ModelDB) MarkStateChangeApplied(id int64) error {
+	return model.direct().MarkStateChangeApplied(id)
+}
+
+//MarkStateChangeApplied mark that events produced by StateChange with id have been handled when the unit of work is committed
+func (uow *UnitOfWork) MarkStateChangeApplied(id int64) error {
+	return uow.update(func(tx storm.Node) error {
+		err := tx.UpdateField(&StateChangeLog{ID: id}, "Applied", true)
+		if err != nil && err != storm.ErrNotFound {
+			return err
+		}
+		err = tx.UpdateField(&StateChangeAudit{ID: id}, "Applied", true)
+		if err == storm.ErrNotFound {
+			return nil
+		}
+		return err
+	})
+}
+
+/*
+SnapshotStateManager 保存 mgr 的 CurrentState, 其中已经包含了 lastStateChangeID 以及之前的所有 StateChange,
+同时删除这些 StateChange 的记录.
+通过 UnitOfWork 调用的时候, 保存的是调用时 mgr 的一份拷贝, 提交时才写入.
+*/
+/*
+ *	SnapshotStateManager : save CurrentState of mgr, which already includes StateChanges up to lastStateChangeID,
+ *	logs of these StateChanges are removed at the same time.
+ *	When called through a UnitOfWork, a copy of mgr at the time of call is written when it's committed.
+ */
+func (model *ModelDB) SnapshotStateManager(mgr *transfer.StateManager, lastStateChangeID int64) (err error) {
+	return model.direct().SnapshotStateManager(mgr, lastStateChangeID)
+}
+
+//SnapshotStateManager save CurrentState of mgr when the unit of work is committed
+func (uow *UnitOfWork) SnapshotStateManager(mgr *transfer.StateManager, lastStateChangeID int64) (err error) {
+	mgr.LastStateChangeID = lastStateChangeID
+	snapshot, err := copyStateManager(mgr)
+	if err != nil {
+		return
+	}
+	return uow.update(func(tx storm.Node) error {
+		err := tx.Save(snapshot)
+		if err != nil {
+			return err
+		}
+		err = tx.Select(q.Eq("StateManagerID", snapshot.ID), q.Lte("ID", lastStateChangeID)).Delete(&StateChangeLog{})
+		if err != nil && err != storm.ErrNotFound {
+			return err
+		}
+		return nil
+	})
+}
+
+//copyStateManager deep copy mgr, so that later changes of mgr are not included in a deferred snapshot
+func copyStateManager(mgr *transfer.StateManager) (*transfer.StateManager, error) {
+	buf := new(bytes.Buffer)
+	err := gob.NewEncoder(buf).Encode(mgr)
+	if err != nil {
+		return nil, err
+	}
+	m := new(transfer.StateManager)
+	err = gob.NewDecoder(buf).Decode(m)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+//RemoveStateManager remove mgr and all its logs and audits from db
+func (model *ModelDB) RemoveStateManager(mgr *transfer.StateManager) (err error) {
+	return model.direct().RemoveStateManager(mgr)
+}
+
+//RemoveStateManager remove mgr and all its logs and audits from db when the unit of work is committed
+func (uow *UnitOfWork) RemoveStateManager(mgr *transfer.StateManager) (err error) {
+	id := mgr.ID
+	return uow.update(func(tx storm.Node) error {
+		err := tx.DeleteStruct(&transfer.StateManager{ID: id})
+		if err != nil && err != storm.ErrNotFound {
+			return err
+		}
+		err = tx.Select(q.Eq("StateManagerID", id)).Delete(&StateChangeLog{})
+		if err != nil && err != storm.ErrNotFound {
+			return err
+		}
+		err = tx.Select(q.Eq("StateManagerID", id)).Delete(&StateChangeAudit{})
+		if err != nil && err != storm.ErrNotFound {
+			return err
+		}
+		return nil
+	})
+}
+
+//GetAllStateManagers returns all StateManagers saved, FuncStateTransition of them is nil
+func (model *ModelDB) GetAllStateManagers() (mgrs []*transfer.StateManager) {
+	err := model.db.All(&mgrs)
+	if err != nil && err != storm.ErrNotFound {
+		log.Error(fmt.Sprintf("GetAllStateManagers err %s", err))
+	}
+	return
+}
+
+//GetStateChangeAudits returns all StateChanges dispatched to StateManager with mgrID, ordered by ID
+func (model *ModelDB) GetStateChangeAudits(mgrID int64) (audits []*StateChangeAudit) {
+	err := model.db.Find("StateManagerID", mgrID, &audits)
+	if err != nil && err != storm.ErrNotFound {
+		log.Error(fmt.Sprintf("GetStateChangeAudits err %s", err))
+	}
+	sort.Slice(audits, func(i, j int) bool {
+		return audits[i].ID < audits[j].ID
+	})
+	return
+}
+
+//GetAllStateChangeLogs returns all StateChanges not included in any snapshot, ordered by ID
+func (model *ModelDB) GetAllStateChangeLogs() (logs []*StateChangeLog) {
+	err := model.db.All(&logs)
+	if err != nil && err != storm.ErrNotFound {
+		log.Error(fmt.Sprintf("GetAllStateChangeLogs err %s", err))
+	}
+	sort.Slice(logs, func(i, j int) bool {
+		return logs[i].ID < logs[j].ID
+	})
+	return
+}
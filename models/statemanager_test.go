@@ -0,0 +1,112 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/SmartMeshFoundation/Atmosphere/transfer"
+	"github.com/SmartMeshFoundation/Atmosphere/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModelDB_StateChangeLog(t *testing.T) {
+	m := setupDb(t)
+	defer m.CloseDB()
+	mgr := transfer.NewStateManager(nil, nil, "test", utils.NewRandomHash(), utils.NewRandomAddress())
+	err := m.AddStateManager(mgr)
+	assert.Empty(t, err)
+	assert.NotEqual(t, int64(0), mgr.ID)
+	id1, err := m.LogStateChange(mgr, &transfer.BlockStateChange{BlockNumber: 1})
+	assert.Empty(t, err)
+	//block 1 produces events, so its audit is kept
+	err = m.MarkStateChangeApplied(id1)
+	assert.Empty(t, err)
+	id2, err := m.LogStateChange(mgr, &transfer.BlockStateChange{BlockNumber: 2})
+	assert.Empty(t, err)
+	assert.EqualValues(t, true, id2 > id1)
+	logs := m.GetAllStateChangeLogs()
+	assert.EqualValues(t, 2, len(logs))
+	assert.EqualValues(t, int64(2), logs[1].StateChange.(*transfer.BlockStateChange).BlockNumber)
+
+	//logs included in snapshot are removed
+	err = m.SnapshotStateManager(mgr, id1)
+	assert.Empty(t, err)
+	logs = m.GetAllStateChangeLogs()
+	assert.EqualValues(t, 1, len(logs))
+	assert.EqualValues(t, id2, logs[0].ID)
+	mgrs := m.GetAllStateManagers()
+	assert.EqualValues(t, 1, len(mgrs))
+	assert.EqualValues(t, id1, mgrs[0].LastStateChangeID)
+	//audits are not removed by snapshot
+	audits := m.GetStateChangeAudits(mgr.ID)
+	assert.EqualValues(t, 2, len(audits))
+	assert.EqualValues(t, id1, audits[0].ID)
+	assert.EqualValues(t, int64(1), audits[0].StateChange.(*transfer.BlockStateChange).BlockNumber)
+
+	//applied mark
+	err = m.MarkStateChangeApplied(id2)
+	assert.Empty(t, err)
+	logs = m.GetAllStateChangeLogs()
+	assert.EqualValues(t, true, logs[0].Applied)
+
+	//one transaction for many StateManagers
+	mgr2 := transfer.NewStateManager(nil, nil, "test", utils.NewRandomHash(), utils.NewRandomAddress())
+	err = m.AddStateManager(mgr2)
+	assert.Empty(t, err)
+	crashnode := transfer.NewStateManager(nil, nil, "test", utils.NewRandomHash(), utils.NewRandomAddress())
+	ids, err := m.LogStateChanges([]*transfer.StateManager{mgr, crashnode, mgr2}, &transfer.BlockStateChange{BlockNumber: 3})
+	assert.Empty(t, err)
+	assert.EqualValues(t, 3, len(ids))
+	assert.EqualValues(t, true, ids[0] > id2)
+	assert.EqualValues(t, int64(0), ids[1])
+	assert.EqualValues(t, true, ids[2] > ids[0])
+	logs = m.GetAllStateChangeLogs()
+	assert.EqualValues(t, 3, len(logs))
+	assert.EqualValues(t, mgr2.ID, logs[2].StateManagerID)
+	assert.EqualValues(t, false, logs[2].Applied)
+	assert.EqualValues(t, 3, len(m.GetStateChangeAudits(mgr.ID)))
+	assert.EqualValues(t, ids[2], m.GetStateChangeAudits(mgr2.ID)[0].ID)
+
+	//block producing no event is replaced by the next one
+	id4, err := m.LogStateChange(mgr2, &transfer.BlockStateChange{BlockNumber: 4})
+	assert.Empty(t, err)
+	audits = m.GetStateChangeAudits(mgr2.ID)
+	assert.EqualValues(t, 1, len(audits))
+	assert.EqualValues(t, id4, audits[0].ID)
+	//but not other StateChanges
+	id5, err := m.LogStateChange(mgr2, &transfer.ActionCancelTransferStateChange{LockSecretHash: utils.NewRandomHash()})
+	assert.Empty(t, err)
+	_, err = m.LogStateChange(mgr2, &transfer.BlockStateChange{BlockNumber: 5})
+	assert.Empty(t, err)
+	audits = m.GetStateChangeAudits(mgr2.ID)
+	assert.EqualValues(t, 3, len(audits))
+	assert.EqualValues(t, id5, audits[1].ID)
+
+	err = m.RemoveStateManager(mgr)
+	assert.Empty(t, err)
+	err = m.RemoveStateManager(mgr2)
+	assert.Empty(t, err)
+	assert.Empty(t, m.GetAllStateManagers())
+	assert.Empty(t, m.GetAllStateChangeLogs())
+	assert.Empty(t, m.GetStateChangeAudits(mgr.ID))
+	assert.Empty(t, m.GetStateChangeAudits(mgr2.ID))
+}
+
+func TestOpenDbReadOnly(t *testing.T) {
+	m := setupDb(t)
+	mgr := transfer.NewStateManager(nil, nil, "test", utils.NewRandomHash(), utils.NewRandomAddress())
+	err := m.AddStateManager(mgr)
+	assert.Empty(t, err)
+	m.CloseDB()
+
+	m, err = OpenDbReadOnly(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.EqualValues(t, 1, len(m.GetAllStateManagers()))
+	_, err = m.LogStateChange(mgr, &transfer.BlockStateChange{BlockNumber: 1})
+	assert.NotEmpty(t, err)
+	m.CloseDB()
+
+	_, err = OpenDbReadOnly(dbPath + ".notexist")
+	assert.NotEmpty(t, err)
+}
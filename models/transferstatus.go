@@ -49,6 +49,11 @@ type TransferStatus struct {
 
 // NewTransferStatus :
 func (model *ModelDB) NewTransferStatus(tokenAddress common.Address, lockSecretHash common.Hash) {
+	model.direct().NewTransferStatus(tokenAddress, lockSecretHash)
+}
+
+// NewTransferStatus : save the new status when the unit of work is committed
+func (uow *UnitOfWork) NewTransferStatus(tokenAddress common.Address, lockSecretHash common.Hash) {
 	ts := &TransferStatus{
 		Key:            utils.Sha3(tokenAddress[:], lockSecretHash[:]),
 		LockSecretHash: lockSecretHash,
@@ -56,7 +61,9 @@ func (model *ModelDB) NewTransferStatus(tokenAddress common.Address, lockSecretH
 		Status:         TransferStatusInit,
 		StatusMessage:  "",
 	}
-	err := model.db.Save(ts)
+	err := uow.update(func(tx storm.Node) error {
+		return tx.Save(ts)
+	})
 	if err != nil {
 		log.Error(fmt.Sprintf("NewTransferStatus err %s", err))
 		return
@@ -65,40 +72,42 @@ func (model *ModelDB) NewTransferStatus(tokenAddress common.Address, lockSecretH
 
 // UpdateTransferStatus :
 func (model *ModelDB) UpdateTransferStatus(tokenAddress common.Address, lockSecretHash common.Hash, status TransferStatusCode, statusMessage string) {
-	var ts TransferStatus
-	key := utils.Sha3(tokenAddress[:], lockSecretHash[:])
-	err := model.db.One("Key", key, &ts)
-	if err == storm.ErrNotFound {
-		return
-	}
-	if err != nil {
-		log.Error(fmt.Sprintf("UpdateTransferStatus err %s", err))
-		return
-	}
-	ts.Status = status
-	ts.StatusMessage = fmt.Sprintf("%s%s\n", ts.StatusMessage, statusMessage)
-	err = model.db.Save(&ts)
-	if err != nil {
-		log.Error(fmt.Sprintf("UpdateTransferStatus err %s", err))
-		return
-	}
-	log.Trace(fmt.Sprintf("transfer lockSecretHash=%s %s", lockSecretHash.String(), statusMessage))
+	model.direct().updateTransferStatus(tokenAddress, lockSecretHash, &status, statusMessage)
 }
 
 // UpdateTransferStatusMessage :
 func (model *ModelDB) UpdateTransferStatusMessage(tokenAddress common.Address, lockSecretHash common.Hash, statusMessage string) {
-	var ts TransferStatus
+	model.direct().updateTransferStatus(tokenAddress, lockSecretHash, nil, statusMessage)
+}
+
+// UpdateTransferStatus : update status when the unit of work is committed
+func (uow *UnitOfWork) UpdateTransferStatus(tokenAddress common.Address, lockSecretHash common.Hash, status TransferStatusCode, statusMessage string) {
+	uow.updateTransferStatus(tokenAddress, lockSecretHash, &status, statusMessage)
+}
+
+// UpdateTransferStatusMessage : update status message when the unit of work is committed
+func (uow *UnitOfWork) UpdateTransferStatusMessage(tokenAddress common.Address, lockSecretHash common.Hash, statusMessage string) {
+	uow.updateTransferStatus(tokenAddress, lockSecretHash, nil, statusMessage)
+}
+
+//updateTransferStatus append statusMessage and change status if it's not nil
+func (uow *UnitOfWork) updateTransferStatus(tokenAddress common.Address, lockSecretHash common.Hash, status *TransferStatusCode, statusMessage string) {
 	key := utils.Sha3(tokenAddress[:], lockSecretHash[:])
-	err := model.db.One("Key", key, &ts)
-	if err == storm.ErrNotFound {
-		return
-	}
-	if err != nil {
-		log.Error(fmt.Sprintf("UpdateTransferStatus err %s", err))
-		return
-	}
-	ts.StatusMessage = fmt.Sprintf("%s%s\n", ts.StatusMessage, statusMessage)
-	err = model.db.Save(&ts)
+	err := uow.update(func(tx storm.Node) error {
+		var ts TransferStatus
+		err := tx.One("Key", key, &ts)
+		if err == storm.ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if status != nil {
+			ts.Status = *status
+		}
+		ts.StatusMessage = fmt.Sprintf("%s%s\n", ts.StatusMessage, statusMessage)
+		return tx.Save(&ts)
+	})
 	if err != nil {
 		log.Error(fmt.Sprintf("UpdateTransferStatus err %s", err))
 		return
@@ -0,0 +1,140 @@
+package models
+
+import (
+	"fmt"
+
+	"github.com/SmartMeshFoundation/Atmosphere/channel/channeltype"
+	"github.com/SmartMeshFoundation/Atmosphere/encoding"
+	"github.com/SmartMeshFoundation/Atmosphere/log"
+	"github.com/SmartMeshFoundation/Atmosphere/transfer"
+	"github.com/asdine/storm"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+/*
+Dao 可以推迟到 unit of work 中提交的修改, ModelDB 立即在单独的事务中完成, UnitOfWork 在 Commit 的时候一起完成.
+*/
+/*
+ *	Dao : modifications which can be deferred to a unit of work,
+ *	ModelDB does them right now in their own transactions, while UnitOfWork does them together when committed.
+ */
+type Dao interface {
+	UpdateChannelNoTx(c *channeltype.Serialization) error
+	UpdateChannelAndSaveAck(c *channeltype.Serialization, echohash common.Hash, ack []byte) error
+	SaveAckNoTx(echohash common.Hash, ack []byte)
+	NewTransferStatus(tokenAddress common.Address, lockSecretHash common.Hash)
+	UpdateTransferStatus(tokenAddress common.Address, lockSecretHash common.Hash, status TransferStatusCode, statusMessage string)
+	UpdateTransferStatusMessage(tokenAddress common.Address, lockSecretHash common.Hash, statusMessage string)
+	NewSentEnvelopMessager(msg encoding.EnvelopMessager, receiver common.Address)
+	DeleteEnvelopMessager(echohash common.Hash)
+	SnapshotStateManager(mgr *transfer.StateManager, lastStateChangeID int64) error
+	RemoveStateManager(mgr *transfer.StateManager) error
+	MarkStateChangeApplied(id int64) error
+	AddRoutingEvent(tokenAddress, partnerAddress common.Address, e *RoutingEvent) error
+	AfterCommit(f func())
+}
+
+/*
+UnitOfWork 处理一个收到的消息的过程中, 对通道, ack, 交易状态, 待发送消息以及 StateManager 快照的修改都先记录下来,
+处理完以后在同一个事务中提交. 崩溃的时候这些修改要么全部保存了, 要么全部没有保存, 不会出现只更新了一部分通道的情况.
+提交之前, 这些修改对读数据库的人都是不可见的.
+只有通过这个 UnitOfWork 做的修改才会推迟, 其他人通过 ModelDB 做的修改, 比如其他 goroutine 保存的 ack, 仍然立即保存.
+UnitOfWork 不是线程安全的, 只能在调用 BeginUnitOfWork 的 goroutine 中使用.
+*/
+/*
+ *	UnitOfWork : while handling one received message, modifications on channels, acks, transfer status,
+ *	messages to send and snapshots of StateManager are recorded first, and committed in one transaction after it's handled.
+ *	When crash, either all of them are saved or none is, it's impossible that only part of channels are updated.
+ *	These modifications are invisible to readers of db until committed.
+ *	Only modifications done through this UnitOfWork are deferred, modifications done by others through ModelDB,
+ *	such as acks saved by other goroutines, are still saved right now.
+ *	UnitOfWork is not thread safe, it must be used in the goroutine calling BeginUnitOfWork only.
+ */
+type UnitOfWork struct {
+	model       *ModelDB
+	immediate   bool //run every modification in its own transaction right now, used by ModelDB itself
+	ops         []func(tx storm.Node) error
+	afterCommit []func()
+}
+
+//BeginUnitOfWork begin a unit of work, modifications done through it are deferred until Commit and done in one transaction.
+func (model *ModelDB) BeginUnitOfWork() *UnitOfWork {
+	return &UnitOfWork{model: model}
+}
+
+//direct returns a UnitOfWork which does every modification right now
+func (model *ModelDB) direct() *UnitOfWork {
+	return &UnitOfWork{model: model, immediate: true}
+}
+
+/*
+Commit 在一个事务中完成所有的修改, 成功以后依次调用 AfterCommit 注册的函数.
+出错的时候什么都没有保存, AfterCommit 注册的函数也不会调用, 而内存中的状态已经改变了,
+调用者不能再继续运行.
+*/
+/*
+ *	Commit : do all modifications in one transaction, and call functions registered by AfterCommit in order on success.
+ *	On error nothing is saved and none of functions registered by AfterCommit is called,
+ *	while states in memory have already changed, so the caller must not go on.
+ */
+func (uow *UnitOfWork) Commit() (err error) {
+	if len(uow.ops) > 0 {
+		err = uow.model.runInTx(uow.ops...)
+		if err != nil {
+			log.Error(fmt.Sprintf("commit unit of work err %s", err))
+			return
+		}
+	}
+	for _, f := range uow.afterCommit {
+		f()
+	}
+	return
+}
+
+/*
+AfterCommit f 在这个 unit of work 成功提交以后才执行.
+比如发送消息, 必须保证相关的修改已经保存了, 才能让对方看到.
+*/
+/*
+ *	AfterCommit : f is called after this unit of work is committed successfully.
+ *	Sending a message for example, the partner must not see it until related modifications are saved.
+ */
+func (uow *UnitOfWork) AfterCommit(f func()) {
+	if uow.immediate {
+		f()
+		return
+	}
+	uow.afterCommit = append(uow.afterCommit, f)
+}
+
+//AfterCommit there is no unit of work, f is called right now
+func (model *ModelDB) AfterCommit(f func()) {
+	f()
+}
+
+// update : add op to the unit of work, or run op in its own transaction right now if it's immediate.
+func (uow *UnitOfWork) update(op func(tx storm.Node) error) error {
+	if uow.immediate {
+		return uow.model.runInTx(op)
+	}
+	uow.ops = append(uow.ops, op)
+	return nil
+}
+
+func (model *ModelDB) runInTx(ops ...func(tx storm.Node) error) (err error) {
+	tx, err := model.db.Begin(true)
+	if err != nil {
+		return
+	}
+	for _, op := range ops {
+		err = op(tx)
+		if err != nil {
+			err2 := tx.Rollback()
+			if err2 != nil {
+				log.Error(fmt.Sprintf("rollback err %s", err2))
+			}
+			return
+		}
+	}
+	return tx.Commit()
+}
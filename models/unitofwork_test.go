@@ -0,0 +1,87 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/SmartMeshFoundation/Atmosphere/transfer"
+	"github.com/SmartMeshFoundation/Atmosphere/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModelDB_UnitOfWork(t *testing.T) {
+	m := setupDb(t)
+	defer m.CloseDB()
+	token := utils.NewRandomAddress()
+	lockSecretHash := utils.NewRandomHash()
+	echohash := utils.NewRandomHash()
+	mgr := transfer.NewStateManager(nil, nil, "test", lockSecretHash, token)
+	err := m.AddStateManager(mgr)
+	assert.Empty(t, err)
+	id, err := m.LogStateChange(mgr, &transfer.BlockStateChange{BlockNumber: 1})
+	assert.Empty(t, err)
+
+	sent := false
+	uow := m.BeginUnitOfWork()
+	uow.NewTransferStatus(token, lockSecretHash)
+	uow.UpdateTransferStatus(token, lockSecretHash, TransferStatusCanCancel, "a")
+	uow.SaveAckNoTx(echohash, []byte{1})
+	err = uow.SnapshotStateManager(mgr, id)
+	assert.Empty(t, err)
+	uow.AfterCommit(func() {
+		sent = true
+	})
+	//changes after snapshot must not be saved
+	mgr.Name = "changed"
+	//modifications done through ModelDB by others are not pulled in, and are saved right now
+	echohash2 := utils.NewRandomHash()
+	m.SaveAckNoTx(echohash2, []byte{2})
+	assert.EqualValues(t, []byte{2}, m.GetAck(echohash2))
+	called := false
+	m.AfterCommit(func() {
+		called = true
+	})
+	assert.EqualValues(t, true, called)
+
+	//nothing is visible before commit
+	assert.Empty(t, m.GetAck(echohash))
+	_, err = m.GetTransferStatus(token, lockSecretHash)
+	assert.NotEmpty(t, err)
+	assert.EqualValues(t, 1, len(m.GetAllStateChangeLogs()))
+	assert.EqualValues(t, false, sent)
+
+	err = uow.Commit()
+	assert.Empty(t, err)
+	assert.EqualValues(t, []byte{1}, m.GetAck(echohash))
+	ts, err := m.GetTransferStatus(token, lockSecretHash)
+	assert.Empty(t, err)
+	assert.EqualValues(t, TransferStatusCanCancel, ts.Status)
+	assert.Empty(t, m.GetAllStateChangeLogs())
+	mgrs := m.GetAllStateManagers()
+	assert.EqualValues(t, 1, len(mgrs))
+	assert.EqualValues(t, "test", mgrs[0].Name)
+	assert.EqualValues(t, id, mgrs[0].LastStateChangeID)
+	assert.EqualValues(t, true, sent)
+}
+
+func TestModelDB_UnitOfWorkCommitFail(t *testing.T) {
+	m := setupDb(t)
+	mgr := transfer.NewStateManager(nil, nil, "test", utils.NewRandomHash(), utils.NewRandomAddress())
+	err := m.AddStateManager(mgr)
+	assert.Empty(t, err)
+	m.CloseDB()
+	m, err = OpenDbReadOnly(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.CloseDB()
+	//nothing after commit is called when commit fails
+	sent := false
+	uow := m.BeginUnitOfWork()
+	err = uow.SnapshotStateManager(mgr, 1)
+	assert.Empty(t, err)
+	uow.AfterCommit(func() {
+		sent = true
+	})
+	assert.NotEmpty(t, uow.Commit())
+	assert.EqualValues(t, false, sent)
+}
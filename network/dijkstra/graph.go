@@ -33,10 +33,12 @@ func (g *Graph) CloneGraph() *Graph {
 	}
 	for _, v := range g.Verticies {
 		newv := v
-		new.Verticies = append(new.Verticies, newv)
+		//arcs must not be shared with g
+		newv.arcs = make(map[int]int64, len(v.arcs))
 		for k2, v2 := range v.arcs {
 			newv.arcs[k2] = v2
 		}
+		new.Verticies = append(new.Verticies, newv)
 	}
 	return new
 }
@@ -63,3 +63,19 @@ func newBadGraph() Graph {
 	g.Verticies[0].AddArc(9999, 1)
 	return g
 }
+
+func TestCloneGraph(t *testing.T) {
+	g := NewGraph()
+	g.AddVertex(0)
+	g.AddVertex(1)
+	g.AddArc(0, 1, 5)
+	c := g.CloneGraph()
+	c.DeleteArc(0, 1)
+	c.Verticies[1].AddArc(0, 3)
+	if d, ok := g.Verticies[0].GetArc(1); !ok || d != 5 {
+		t.Error("arc of the original graph changed by clone")
+	}
+	if _, ok := g.Verticies[1].GetArc(0); ok {
+		t.Error("arc added to clone appears in the original graph")
+	}
+}
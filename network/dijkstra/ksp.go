@@ -0,0 +1,178 @@
+package dijkstra
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+)
+
+type arcKey struct {
+	from, to int
+}
+
+//searchFilter vertices and arcs a search must not use
+type searchFilter struct {
+	vertices map[int]bool
+	arcs     map[arcKey]bool
+}
+
+/*
+shortestFiltered is a plain heap based dijkstra search which skips filtered vertices and arcs,
+it never changes state of the graph, so searches for k paths can be done one by one.
+*/
+func (g *Graph) shortestFiltered(src, dest int, f *searchFilter) (BestPath, bool) {
+	distances := make([]int64, len(g.Verticies))
+	prev := make([]int, len(g.Verticies))
+	for i := range distances {
+		distances[i] = Infinity
+		prev[i] = -1
+	}
+	distances[src] = 0
+	h := &distanceHeap{{src, 0}}
+	for h.Len() > 0 {
+		current := heap.Pop(h).(distanceItem)
+		if current.distance > distances[current.id] {
+			continue
+		}
+		if current.id == dest {
+			break
+		}
+		for to, distance := range g.Verticies[current.id].arcs {
+			if to >= len(distances) || f.vertices[to] || f.arcs[arcKey{current.id, to}] {
+				continue
+			}
+			d := current.distance + distance
+			if d < distances[to] {
+				distances[to] = d
+				prev[to] = current.id
+				heap.Push(h, distanceItem{to, d})
+			}
+		}
+	}
+	if distances[dest] == Infinity {
+		return BestPath{}, false
+	}
+	var path []int
+	for v := dest; v != src; v = prev[v] {
+		path = append(path, v)
+	}
+	path = append(path, src)
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return BestPath{distances[dest], path}, true
+}
+
+func (g *Graph) checkSrcDest(src, dest int) error {
+	if src < 0 || src >= len(g.Verticies) {
+		return errors.New("Source not found")
+	}
+	if dest < 0 || dest >= len(g.Verticies) {
+		return errors.New("Destination not found")
+	}
+	if src == dest {
+		return errors.New("Source is the destination")
+	}
+	return nil
+}
+
+func pathKey(path []int) string {
+	return fmt.Sprint(path)
+}
+
+/*
+KShortest finds at most k loopless paths from src to dest with Yen's algorithm, ordered by distance,
+paths with the same distance are ordered by hops.
+ErrNoPath is returned if dest cannot be reached.
+*/
+func (g *Graph) KShortest(src, dest, k int) (paths []BestPath, err error) {
+	if err = g.checkSrcDest(src, dest); err != nil {
+		return
+	}
+	first, ok := g.shortestFiltered(src, dest, &searchFilter{})
+	if !ok {
+		return nil, ErrNoPath
+	}
+	paths = append(paths, first)
+	found := map[string]bool{pathKey(first.Path): true}
+	var candidates []BestPath
+	for len(paths) < k {
+		last := paths[len(paths)-1].Path
+		var rootDistance int64
+		for i := 0; i < len(last)-1; i++ {
+			spur := last[i]
+			root := last[:i+1]
+			f := &searchFilter{
+				vertices: make(map[int]bool),
+				arcs:     make(map[arcKey]bool),
+			}
+			//the spur path must leave the root differently from all paths found sharing the same root
+			for _, p := range paths {
+				if len(p.Path) > i+1 && pathKey(p.Path[:i+1]) == pathKey(root) {
+					f.arcs[arcKey{p.Path[i], p.Path[i+1]}] = true
+				}
+			}
+			//and it must not go back to the root,so there is no loop
+			for _, v := range root[:i] {
+				f.vertices[v] = true
+			}
+			if spurPath, ok := g.shortestFiltered(spur, dest, f); ok {
+				path := append(append([]int{}, root[:i]...), spurPath.Path...)
+				if key := pathKey(path); !found[key] {
+					found[key] = true
+					candidates = append(candidates, BestPath{rootDistance + spurPath.Distance, path})
+				}
+			}
+			rootDistance += g.Verticies[last[i]].arcs[last[i+1]]
+		}
+		if len(candidates) == 0 {
+			break
+		}
+		best := 0
+		for i, c := range candidates {
+			if c.Distance < candidates[best].Distance ||
+				(c.Distance == candidates[best].Distance && len(c.Path) < len(candidates[best].Path)) {
+				best = i
+			}
+		}
+		paths = append(paths, candidates[best])
+		candidates = append(candidates[:best], candidates[best+1:]...)
+	}
+	return
+}
+
+/*
+DisjointPaths finds at most k paths from src to dest which don't share any edge,
+arcs of both directions between two vertices are the same edge, like a payment channel.
+if nodeDisjoint is true, they don't share any vertex except src and dest either.
+Paths are found greedily: the shortest path first, then the shortest path without arcs(vertices) already used and so on,
+so there may be more disjoint paths than found in some graphs.
+ErrNoPath is returned if dest cannot be reached.
+*/
+func (g *Graph) DisjointPaths(src, dest, k int, nodeDisjoint bool) (paths []BestPath, err error) {
+	if err = g.checkSrcDest(src, dest); err != nil {
+		return
+	}
+	f := &searchFilter{
+		vertices: make(map[int]bool),
+		arcs:     make(map[arcKey]bool),
+	}
+	for len(paths) < k {
+		p, ok := g.shortestFiltered(src, dest, f)
+		if !ok {
+			break
+		}
+		paths = append(paths, p)
+		for i := 0; i < len(p.Path)-1; i++ {
+			f.arcs[arcKey{p.Path[i], p.Path[i+1]}] = true
+			f.arcs[arcKey{p.Path[i+1], p.Path[i]}] = true
+			if nodeDisjoint && i > 0 {
+				f.vertices[p.Path[i]] = true
+			}
+		}
+	}
+	if len(paths) == 0 {
+		return nil, ErrNoPath
+	}
+	return
+}
@@ -0,0 +1,179 @@
+package dijkstra
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+//allSimplePaths distances of all loopless paths from src to dest, sorted
+func allSimplePaths(g *Graph, src, dest int) (distances []int64) {
+	visited := make([]bool, len(g.Verticies))
+	var walk func(v int, d int64)
+	walk = func(v int, d int64) {
+		if v == dest {
+			distances = append(distances, d)
+			return
+		}
+		visited[v] = true
+		for to, w := range g.Verticies[v].arcs {
+			if !visited[to] {
+				walk(to, d+w)
+			}
+		}
+		visited[v] = false
+	}
+	walk(src, 0)
+	sort.Slice(distances, func(i, j int) bool { return distances[i] < distances[j] })
+	return
+}
+
+func checkPath(t *testing.T, g *Graph, p BestPath, src, dest int) {
+	if p.Path[0] != src || p.Path[len(p.Path)-1] != dest {
+		t.Fatalf("path %v is not from %d to %d", p.Path, src, dest)
+	}
+	visited := make(map[int]bool)
+	var d int64
+	for i, v := range p.Path {
+		if visited[v] {
+			t.Fatalf("path %v has loop", p.Path)
+		}
+		visited[v] = true
+		if i > 0 {
+			w, ok := g.Verticies[p.Path[i-1]].GetArc(v)
+			if !ok {
+				t.Fatalf("path %v has no arc %d-%d", p.Path, p.Path[i-1], v)
+			}
+			d += w
+		}
+	}
+	if d != p.Distance {
+		t.Fatalf("path %v distance expect %d,got %d", p.Path, d, p.Distance)
+	}
+}
+
+func TestKShortest(t *testing.T) {
+	graph, err := Import("testdata/K.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths, err := graph.KShortest(0, 4, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []int64{2, 11, 12, 21, 21, 31}
+	if len(paths) != len(expect) {
+		t.Fatalf("expect %d paths,got %d", len(expect), len(paths))
+	}
+	for i, p := range paths {
+		checkPath(t, &graph, p, 0, 4)
+		if p.Distance != expect[i] {
+			t.Fatalf("path %d expect distance %d,got %d", i, expect[i], p.Distance)
+		}
+	}
+	paths, err = graph.KShortest(0, 4, 2)
+	if err != nil || len(paths) != 2 {
+		t.Fatalf("expect 2 paths,got %d err %v", len(paths), err)
+	}
+	if _, err = graph.KShortest(4, 0, 3); err != ErrNoPath {
+		t.Fatalf("expect ErrNoPath,got %v", err)
+	}
+	if _, err = graph.KShortest(0, 0, 3); err == nil {
+		t.Fatal("source is the destination")
+	}
+
+	r := rand.New(rand.NewSource(3))
+	for round := 0; round < 10; round++ {
+		g := sparseGraph(12, 3, r)
+		src, dest := r.Intn(12), r.Intn(12)
+		if src == dest {
+			continue
+		}
+		all := allSimplePaths(g, src, dest)
+		paths, err = g.KShortest(src, dest, 8)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(paths) != 8 && len(paths) != len(all) {
+			t.Fatalf("expect %d paths,got %d", len(all), len(paths))
+		}
+		for i, p := range paths {
+			checkPath(t, g, p, src, dest)
+			if p.Distance != all[i] {
+				t.Fatalf("round %d path %d expect distance %d,got %d", round, i, all[i], p.Distance)
+			}
+		}
+	}
+}
+
+func TestDisjointPaths(t *testing.T) {
+	graph, err := Import("testdata/K.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths, err := graph.DisjointPaths(0, 4, 5, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 2 || paths[0].Distance != 2 || paths[1].Distance != 11 {
+		t.Fatalf("wrong disjoint paths %v", paths)
+	}
+	if _, err = graph.DisjointPaths(4, 0, 3, false); err != ErrNoPath {
+		t.Fatalf("expect ErrNoPath,got %v", err)
+	}
+
+	r := rand.New(rand.NewSource(4))
+	for round := 0; round < 10; round++ {
+		g := sparseGraph(100, 6, r)
+		src, dest := r.Intn(100), r.Intn(100)
+		if src == dest {
+			continue
+		}
+		for _, nodeDisjoint := range []bool{false, true} {
+			paths, err = g.DisjointPaths(src, dest, 4, nodeDisjoint)
+			if err != nil {
+				t.Fatal(err)
+			}
+			arcs := make(map[arcKey]bool)
+			vertices := make(map[int]bool)
+			for i, p := range paths {
+				checkPath(t, g, p, src, dest)
+				if i > 0 && p.Distance < paths[i-1].Distance {
+					t.Fatalf("disjoint paths should be ordered by distance")
+				}
+				for j := 1; j < len(p.Path); j++ {
+					a := arcKey{p.Path[j-1], p.Path[j]}
+					if arcs[a] {
+						t.Fatalf("edge %v is used twice", a)
+					}
+					arcs[a] = true
+					arcs[arcKey{a.to, a.from}] = true
+					if nodeDisjoint && j < len(p.Path)-1 {
+						if vertices[p.Path[j]] {
+							t.Fatalf("vertex %d is used twice", p.Path[j])
+						}
+						vertices[p.Path[j]] = true
+					}
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkKShortest(b *testing.B) {
+	r := rand.New(rand.NewSource(1))
+	g := sparseGraph(benchmarkNodes, 4, r)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		g.KShortest(1, 0, 5)
+	}
+}
+
+func BenchmarkDisjointPaths(b *testing.B) {
+	r := rand.New(rand.NewSource(1))
+	g := sparseGraph(benchmarkNodes, 4, r)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		g.DisjointPaths(1, 0, 5, true)
+	}
+}
@@ -0,0 +1,96 @@
+package dijkstra
+
+import (
+	"container/heap"
+	"errors"
+	"math"
+)
+
+//Infinity is the distance of a vertex which cannot reach the destination
+const Infinity = int64(math.MaxInt64)
+
+type distanceItem struct {
+	id       int
+	distance int64
+}
+
+type distanceHeap []distanceItem
+
+func (h distanceHeap) Len() int            { return len(h) }
+func (h distanceHeap) Less(i, j int) bool  { return h[i].distance < h[j].distance }
+func (h distanceHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *distanceHeap) Push(x interface{}) { *h = append(*h, x.(distanceItem)) }
+func (h *distanceHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+/*
+DistancesTo calculates the shortest distance from every vertex to dest in one search,
+it searches backwards from dest along reversed arcs, so it's much cheaper than calling Shortest for every source.
+Distance of vertex which cannot reach dest is Infinity.
+*/
+func (g *Graph) DistancesTo(dest int) ([]int64, error) {
+	distances, _, err := g.ShortestTreeTo(dest)
+	return distances, err
+}
+
+/*
+ShortestTreeTo is the same as DistancesTo, and it returns the next vertex on the shortest path from every vertex to dest too.
+next of dest and vertex which cannot reach dest is -1.
+*/
+func (g *Graph) ShortestTreeTo(dest int) (distances []int64, next []int, err error) {
+	if dest < 0 || dest >= len(g.Verticies) {
+		return nil, nil, errors.New("Destination not found")
+	}
+	type arc struct {
+		from     int
+		distance int64
+	}
+	reversed := make([][]arc, len(g.Verticies))
+	for i := range g.Verticies {
+		for to, distance := range g.Verticies[i].arcs {
+			if to < len(reversed) {
+				reversed[to] = append(reversed[to], arc{i, distance})
+			}
+		}
+	}
+	distances = make([]int64, len(g.Verticies))
+	next = make([]int, len(g.Verticies))
+	for i := range distances {
+		distances[i] = Infinity
+		next[i] = -1
+	}
+	distances[dest] = 0
+	h := &distanceHeap{{dest, 0}}
+	for h.Len() > 0 {
+		current := heap.Pop(h).(distanceItem)
+		if current.distance > distances[current.id] {
+			//stale item, a shorter one has been handled
+			continue
+		}
+		for _, a := range reversed[current.id] {
+			d := current.distance + a.distance
+			if d < distances[a.from] {
+				distances[a.from] = d
+				next[a.from] = current.id
+				heap.Push(h, distanceItem{a.from, d})
+			}
+		}
+	}
+	return distances, next, nil
+}
+
+//PathTo returns vertices on the path from source to dest according to next returned by ShortestTreeTo, source and dest included.
+func PathTo(next []int, source, dest int) (path []int) {
+	for v := source; v != dest; v = next[v] {
+		if v < 0 || len(path) >= len(next) {
+			return nil
+		}
+		path = append(path, v)
+	}
+	return append(path, dest)
+}
@@ -0,0 +1,129 @@
+package dijkstra
+
+import (
+	"math/rand"
+	"testing"
+)
+
+//sparseGraph generates a random connected graph like a channel network, every node has about degree arcs
+func sparseGraph(nodes, degree int, r *rand.Rand) *Graph {
+	g := NewGraph()
+	for i := 0; i < nodes; i++ {
+		g.AddVertex(i)
+	}
+	for i := 1; i < nodes; i++ {
+		j := r.Intn(i)
+		w := r.Int63n(10) + 1
+		g.AddArc(i, j, w)
+		g.AddArc(j, i, w)
+	}
+	for k := 0; k < nodes*(degree-2)/2; k++ {
+		i, j := r.Intn(nodes), r.Intn(nodes)
+		if i == j {
+			continue
+		}
+		g.AddArc(i, j, r.Int63n(10)+1)
+		g.AddArc(j, i, r.Int63n(10)+1)
+	}
+	return g
+}
+
+func TestDistancesTo(t *testing.T) {
+	graph, err := Import("testdata/B.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	distances, err := graph.DistancesTo(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if distances[0] != getBSol().Distance {
+		t.Fatalf("expect %d,got %d", getBSol().Distance, distances[0])
+	}
+	//3 is the only vertex 5 can reach, so 0 cannot be reached from 5
+	distances, err = graph.DistancesTo(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if distances[0] != 0 || distances[5] != Infinity {
+		t.Fatalf("wrong distances %v", distances)
+	}
+	_, err = graph.DistancesTo(6)
+	if err == nil {
+		t.Fatal("destination not exist")
+	}
+
+	r := rand.New(rand.NewSource(1))
+	for round := 0; round < 5; round++ {
+		g := sparseGraph(200, 4, r)
+		dest := r.Intn(200)
+		distances, err = g.DistancesTo(dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for src := range g.Verticies {
+			if src == dest {
+				continue
+			}
+			path, err := g.Shortest(src, dest)
+			if err != nil {
+				//Shortest may report a loop, skip it
+				continue
+			}
+			if path.Distance != distances[src] {
+				t.Fatalf("distance from %d to %d,expect %d,got %d", src, dest, path.Distance, distances[src])
+			}
+		}
+	}
+}
+
+func TestShortestTreeTo(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	g := sparseGraph(200, 4, r)
+	distances, next, err := g.ShortestTreeTo(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next[0] != -1 {
+		t.Fatalf("dest has no next vertex,got %d", next[0])
+	}
+	for src := 1; src < 200; src++ {
+		path := PathTo(next, src, 0)
+		if len(path) < 2 || path[0] != src || path[len(path)-1] != 0 {
+			t.Fatalf("wrong path from %d: %v", src, path)
+		}
+		var d int64
+		for i := 0; i < len(path)-1; i++ {
+			d += g.Verticies[path[i]].arcs[path[i+1]]
+		}
+		if d != distances[src] {
+			t.Fatalf("path from %d has distance %d, expect %d", src, d, distances[src])
+		}
+	}
+	if path := PathTo([]int{-1, -1}, 1, 0); path != nil {
+		t.Fatalf("unreachable vertex has no path,got %v", path)
+	}
+}
+
+const benchmarkNodes = 10000
+const benchmarkSources = 50
+
+func BenchmarkShortestPerSource(b *testing.B) {
+	r := rand.New(rand.NewSource(1))
+	g := sparseGraph(benchmarkNodes, 4, r)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for src := 1; src <= benchmarkSources; src++ {
+			g.Shortest(src, 0)
+		}
+	}
+}
+
+func BenchmarkDistancesTo(b *testing.B) {
+	r := rand.New(rand.NewSource(1))
+	g := sparseGraph(benchmarkNodes, 4, r)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		g.DistancesTo(0)
+	}
+}
@@ -5,6 +5,8 @@ import (
 
 	"fmt"
 
+	"math"
+
 	"sort"
 
 	"strings"
@@ -12,6 +14,7 @@ import (
 	"math/big"
 
 	"github.com/SmartMeshFoundation/Atmosphere/channel"
+	"github.com/SmartMeshFoundation/Atmosphere/encoding"
 	"github.com/SmartMeshFoundation/Atmosphere/log"
 	"github.com/SmartMeshFoundation/Atmosphere/network/dijkstra"
 	"github.com/SmartMeshFoundation/Atmosphere/network/rpc/fee"
@@ -45,6 +48,26 @@ type NodesStatusGetter interface {
 	GetNetworkStatus(addr common.Address) (deviceType string, isOnline bool)
 }
 
+/*
+RoutingHistory 根据以前经过某个通道转发交易的成功失败记录, 估计下次成功的概率.
+*/
+// RoutingHistory : estimates how likely a transfer via our channel with partner succeeds, from results of transfers before.
+type RoutingHistory interface {
+	//SuccessProbability returns a probability in (0,1]
+	SuccessProbability(tokenAddress, partnerAddress common.Address, amount *big.Int) float64
+}
+
+/*
+ChannelAnnouncements 其他节点通过 gossip 公布的通道手续费和大致容量.
+*/
+// ChannelAnnouncements : fees and coarse capacities of channels announced by other nodes through gossip.
+type ChannelAnnouncements interface {
+	//ChannelFee returns fee node charges for sending amount tokens to next, nil if not announced
+	ChannelFee(tokenAddress, node, next common.Address, amount *big.Int) *big.Int
+	//MayHaveCapacity returns false only if node has announced that it cannot send amount tokens to next
+	MayHaveCapacity(tokenAddress, node, next common.Address, amount *big.Int) bool
+}
+
 //ChannelGraph is a Graph based on the channels and can find path between participants.
 //整个 ChannelGraph 只能单线程访问
 // The whole ChannelGraph can only be accessed by a single process.
@@ -56,6 +79,8 @@ type ChannelGraph struct {
 	ChannelIdentifier2Channel map[common.Hash]*channel.Channel
 	address2index             map[common.Address]int
 	index2address             map[int]common.Address
+	History                   RoutingHistory       //nil means all channels are the same
+	Announcements             ChannelAnnouncements //nil means fees and capacities of other nodes' channels are unknown
 }
 
 /*
@@ -108,6 +133,13 @@ func (cg *ChannelGraph) makeGraph(edges []common.Address) {
 
 //AddPath Add a new edge into the network.
 func (cg *ChannelGraph) AddPath(source, target common.Address) {
+	cg.AddDirectedPath(source, target)
+	cg.AddDirectedPath(target, source)
+}
+
+//AddDirectedPath add an arc from source to target only, when tokens can be sent in one direction,
+//for example the other side has no balance.
+func (cg *ChannelGraph) AddDirectedPath(source, target common.Address) {
 	addr1 := source
 	addr2 := target
 	if index1, ok := cg.address2index[addr1]; !ok {
@@ -132,15 +164,10 @@ func (cg *ChannelGraph) AddPath(source, target common.Address) {
 		cg.g.AddVertex(index2)
 	}
 	//todo int64 cannot store too much tokens only about 18 tokens. we should divide 1000 or 1000000,
-	err = cg.g.AddArc(index1, index2, 1)
+	err = cg.g.AddArc(index1, index2, 1) //now our graph is the least fee first.
 	if err != nil {
 		log.Error(fmt.Sprintf("add path err%s", err))
 	}
-	err = cg.g.AddArc(index2, index1, 1) //now our graph is the least fee first.
-	if err != nil {
-		log.Error(fmt.Sprintf("add path err%s", err))
-	}
-	//cg.printGraph()
 }
 
 /*
@@ -198,25 +225,88 @@ func (cg *ChannelGraph) ShortestPath(source, target common.Address, amount *big.
 	if sourceIndex == targetIndex {
 		return 0, nil
 	}
-	var g2 *dijkstra.Graph
-	if false { //make sure only be called in one thread.
-		g2 = cg.g.CloneGraph()
-	} else {
-		g2 = cg.g
-	}
-	for _, v := range g2.Verticies {
-		w := feeCharger.GetNodeChargeFee(cg.index2address[v.ID], cg.TokenAddress, amount).Int64()
-		if w > 0 { //for no fee policy, all nodes charge 0 ,so use the shortest path first.
-			v.SetWeight(w) // from v's fee is w.
-		}
-	}
-	path, err := g2.Shortest(sourceIndex, targetIndex)
+	cg.setFeeWeights(amount, feeCharger)
+	path, err := cg.g.Shortest(sourceIndex, targetIndex)
 	if err != nil {
 		return
 	}
 	return path.Distance, nil
 }
 
+/*
+setFeeWeights weight of arcs from a node is the fee it charges. make sure only be called in one thread.
+weight is only used to order paths, fee which doesn't fit is limited so that the sum of weights never overflows int64,
+exact fee is calculated by fee.PathCost.
+如果节点公布了它在某个通道上的手续费, 这条边的权重就是公布的手续费;
+如果它公布的容量不够, 这条边的权重是最大值, 只有没有其他路径时才会使用.
+*/
+/*
+ *	If a node has announced its fee on a channel, weight of the arc is the announced fee,
+ *	and if its announced capacity is not enough, weight of the arc is the max, so it's used only when there is no other way.
+ */
+func (cg *ChannelGraph) setFeeWeights(amount *big.Int, feeCharger fee.Charger) {
+	maxWeight := int64(math.MaxInt64) / int64(len(cg.g.Verticies)+1)
+	for i := range cg.g.Verticies {
+		v := &cg.g.Verticies[i]
+		node := cg.index2address[v.ID]
+		v.SetWeight(feeWeight(feeCharger.GetNodeChargeFee(node, cg.TokenAddress, amount), maxWeight)) // from v's fee
+		if cg.Announcements == nil || node == cg.OurAddress {
+			continue
+		}
+		neighbors, err := cg.g.GetAllNeighbors(v.ID)
+		if err != nil {
+			continue
+		}
+		for _, n := range neighbors {
+			next := cg.index2address[n]
+			if !cg.Announcements.MayHaveCapacity(cg.TokenAddress, node, next, amount) {
+				v.AddArc(n, maxWeight)
+			} else if f := cg.Announcements.ChannelFee(cg.TokenAddress, node, next, amount); f != nil {
+				v.AddArc(n, feeWeight(f, maxWeight))
+			}
+		}
+	}
+}
+
+func feeWeight(f *big.Int, maxWeight int64) int64 {
+	w := maxWeight
+	if f.IsInt64() && f.Int64() < maxWeight {
+		w = f.Int64()
+	}
+	if w <= 0 { //for no fee policy, all nodes charge 0 ,so use the shortest path first.
+		w = 1 //weight of arcs may be changed by last search
+	}
+	return w
+}
+
+//announcedCharger every mediator on the path charges by the fee it announced on the channel to next hop, charger is used as an estimate if not announced.
+type announcedCharger struct {
+	announcements ChannelAnnouncements
+	next          map[common.Address]common.Address
+	charger       fee.Charger
+}
+
+func (c *announcedCharger) GetNodeChargeFee(nodeAddress, tokenAddress common.Address, amount *big.Int) *big.Int {
+	if next, ok := c.next[nodeAddress]; ok {
+		if f := c.announcements.ChannelFee(tokenAddress, nodeAddress, next, amount); f != nil {
+			return f
+		}
+	}
+	return c.charger.GetNodeChargeFee(nodeAddress, tokenAddress, amount)
+}
+
+//pathCharger returns charger for mediators on path
+func (cg *ChannelGraph) pathCharger(path []common.Address, feeCharger fee.Charger) fee.Charger {
+	if cg.Announcements == nil {
+		return feeCharger
+	}
+	c := &announcedCharger{cg.Announcements, make(map[common.Address]common.Address), feeCharger}
+	for i := 0; i+1 < len(path); i++ {
+		c.next[path[i]] = path[i+1]
+	}
+	return c
+}
+
 //RemoveChannel remove a channel from graph,and i'm a participant of this channel
 func (cg *ChannelGraph) RemoveChannel(ch *channel.Channel) {
 	delete(cg.ChannelIdentifier2Channel, ch.ChannelIdentifier.ChannelIdentifier)
@@ -266,8 +356,39 @@ func (cg *ChannelGraph) getNeighbours() []common.Address {
 }
 
 type neighborWeight struct {
-	neighbor common.Address
-	weight   int64 //nerghbor to target's hops
+	neighbor    common.Address
+	weight      int64            //nerghbor to target's hops
+	path        []common.Address //from neighbor to target, both included
+	probability float64          //how likely transfer via neighbor succeeds
+}
+
+//minSuccessProbability a channel is never considered hopeless, or weights overflow
+const minSuccessProbability = 0.01
+
+/*
+expectedCost 失败以后要换路由重试, 成功概率为 p 时期望花费是 cost/p.
+加 1 是为了没有手续费的路由之间也能按概率排序.
+*/
+// expectedCost : transfer is retried on another route after failure, the expected cost is cost/p when success probability is p.
+// 1 is added so that routes without fee are ordered by probability too.
+func expectedCost(cost *big.Int, p float64) *big.Float {
+	c := new(big.Float).SetInt(cost)
+	c.Add(c, big.NewFloat(1))
+	return c.Quo(c, big.NewFloat(p))
+}
+
+func (cg *ChannelGraph) successProbability(partner common.Address, amount *big.Int) float64 {
+	if cg.History == nil {
+		return 1
+	}
+	p := cg.History.SuccessProbability(cg.TokenAddress, partner, amount)
+	if p < minSuccessProbability {
+		p = minSuccessProbability
+	}
+	if p > 1 {
+		p = 1
+	}
+	return p
 }
 type neighborWeightList []*neighborWeight
 
@@ -287,19 +408,41 @@ func (nw neighborWeightList) Swap(i, j int) {
 /*
 all the neighbors that can reach target
 they are ordered by hops to the target
+从 target 反向搜索一次就得到了所有节点到 target 的距离, 不用对每个邻居都搜索一次.
 */
+/*
+ *	all the neighbors that can reach target, they are ordered by weight to the target.
+ *	One backward search from target gets weights of all nodes to target, instead of one search for every neighbor.
+ */
 func (cg *ChannelGraph) orderedNeighbours(ourAddress, targetAddress common.Address, amount *big.Int, charger fee.Charger) neighborWeightList {
-
-	neighbors := cg.getNeighbours()
+	targetIndex, ok := cg.address2index[targetAddress]
+	if !ok {
+		return nil
+	}
+	cg.setFeeWeights(amount, charger)
+	distances, next, err := cg.g.ShortestTreeTo(targetIndex)
+	if err != nil {
+		return nil
+	}
 	var nws neighborWeightList
-	for _, n := range neighbors {
-		w, err := cg.ShortestPath(n, targetAddress, amount, charger)
-		if err != nil {
+	for _, n := range cg.getNeighbours() {
+		index := cg.address2index[n]
+		w := distances[index]
+		if w == dijkstra.Infinity {
 			continue
 		}
-		nws = append(nws, &neighborWeight{n, w})
+		var path []common.Address
+		for _, i := range dijkstra.PathTo(next, index, targetIndex) {
+			path = append(path, cg.index2address[i])
+		}
+		p := cg.successProbability(n, amount)
+		if p < 1 {
+			cost, _ := expectedCost(big.NewInt(w), p).Int64()
+			w = cost - 1
+		}
+		nws = append(nws, &neighborWeight{n, w, path, p})
 	}
-	sort.Sort(nws)
+	sort.Stable(nws)
 	return nws
 }
 
@@ -307,15 +450,49 @@ func (cg *ChannelGraph) orderedNeighbours(ourAddress, targetAddress common.Addre
 GetBestRoutes returns all neighbor nodes order by weight from it to target.
 我们现在的路由算法应该是有历史记忆的最短路径/最小费用算法.
 跳过所有已经走过的路径.
+每条路由的 TotalFee 是从 targetAmount 倒推, 逐跳累积计算出的准确手续费, Fee 是我按照转给邻居的金额(包括后面节点的手续费)收取的手续费.
+没有收到某个中间节点通过 gossip 公布的手续费时, 只能用 feeCharger 估计它的手续费, 而本地的 feeCharger 返回的是我自己的手续费设置,
+和最短路径搜索使用的权重一样, 所以这时的 TotalFee 只是估计值, 实际以中间节点自己的设置为准.
 */
 /*
  *	GetBestRoutes :function to return all neighbor nodes order by weight from it to target.
  *
  *	Note that the routing algorithm we currently use should be the shortest-path/minimized-fee algorithm with history record,
  *	which circumvents all routes that have been iterated.
+ *	TotalFee of every route is the exact fee compounded hop by hop backwards from targetAmount,
+ *	Fee is what we charge on the amount we send to neighbor, fee of later mediators included.
+ *	Fee of a mediator whose fee is not announced by gossip can only be estimated by feeCharger,
+ *	while the local feeCharger returns our own fee setting, the same as weights used by shortest path search,
+ *	so TotalFee is only an estimate then, mediators charge by their own settings.
  */
 func (cg *ChannelGraph) GetBestRoutes(nodesStatus NodesStatusGetter, ourAddress common.Address,
 	targetAdress common.Address, amount *big.Int, targetAmount *big.Int, excludeAddresses map[common.Address]bool, feeCharger fee.Charger) (onlineNodes []*route.State) {
+	return cg.getBestRoutes(nodesStatus, ourAddress, targetAdress, amount, targetAmount, excludeAddresses, feeCharger, nil, nil)
+}
+
+/*
+GetBestRoutesWithHints 和 GetBestRoutes 一样, 不过先把收款人提供的最后几跳加入到图的副本中, 只对这一次查找有效.
+hints 中的节点即使是手机也可以作为下一跳, 它们在 hints 中的手续费优先于其他手续费, 无效的 hints 被忽略.
+*/
+/*
+ *	GetBestRoutesWithHints : the same as GetBestRoutes, but the last hops provided by the target are merged into a copy of the graph for this search only.
+ *	Nodes in hints can be the next hop even if they are mobile, their fees in hints take precedence over other fees, invalid hints are ignored.
+ */
+func (cg *ChannelGraph) GetBestRoutesWithHints(nodesStatus NodesStatusGetter, ourAddress common.Address,
+	targetAdress common.Address, amount *big.Int, targetAmount *big.Int, excludeAddresses map[common.Address]bool, feeCharger fee.Charger,
+	hints []*encoding.RouteHint) (onlineNodes []*route.State) {
+	search, hinted := cg.mergeRouteHints(targetAdress, hints)
+	return search.getBestRoutes(nodesStatus, ourAddress, targetAdress, amount, targetAmount, excludeAddresses, feeCharger, nil, hinted)
+}
+
+/*
+getBestRoutes tailMediators are nodes after target which still mediate the transfer,
+for example inPartner of circular routes, they are charged for TotalFee too.
+hinted are nodes in route hints, they are used as next hop even if they are mobile.
+*/
+func (cg *ChannelGraph) getBestRoutes(nodesStatus NodesStatusGetter, ourAddress common.Address,
+	targetAdress common.Address, amount *big.Int, targetAmount *big.Int, excludeAddresses map[common.Address]bool, feeCharger fee.Charger,
+	tailMediators []common.Address, hinted map[common.Address]bool) (onlineNodes []*route.State) {
 	/*
 
 	   XXX: consider using multiple channels for a single transfer. Useful
@@ -332,6 +509,7 @@ func (cg *ChannelGraph) GetBestRoutes(nodesStatus NodesStatusGetter, ourAddress
 		log.Warn(fmt.Sprintf("no routes avaiable from %s to %s", utils.APex(ourAddress), utils.APex(targetAdress)))
 		return
 	}
+	var costs []*big.Float
 	for _, nw := range nws {
 		c := cg.GetPartenerAddress2Channel(nw.neighbor)
 		//don't send the message backwards
@@ -347,21 +525,205 @@ func (cg *ChannelGraph) GetBestRoutes(nodesStatus NodesStatusGetter, ourAddress
 			continue
 		}
 		deviceType, isOnline := nodesStatus.GetNetworkStatus(nw.neighbor)
-		if !isOnline || (deviceType == xmpptransport.TypeMobile && nw.neighbor != targetAdress) {
+		if !isOnline || (deviceType == xmpptransport.TypeMobile && nw.neighbor != targetAdress && !hinted[nw.neighbor]) {
 			log.Debug(fmt.Sprintf("partener %s network ignored.. isOnline:%v,deviceType:%s", utils.APex(nw.neighbor), isOnline, deviceType))
 			continue
 		}
-		routeState := Channel2RouteState(c, nw.neighbor, targetAmount, feeCharger)
-		if routeState.Fee.Cmp(utils.BigInt0) > 0 {
-			routeState.TotalFee = big.NewInt(int64(nw.weight))
-		} else { //no fee policy,
-			routeState.TotalFee = utils.BigInt0
+		charger := cg.pathCharger(nw.path, feeCharger)
+		mediators := append(nw.path[:len(nw.path)-1:len(nw.path)-1], tailMediators...)
+		sendAmount, fees := fee.PathCost(charger, cg.TokenAddress, mediators, targetAmount)
+		//the same as PathCost, we charge on the amount we send to neighbor, fee of later mediators included
+		routeState := Channel2RouteState(c, nw.neighbor, sendAmount, feeCharger)
+		routeState.TotalFee = new(big.Int).Sub(sendAmount, targetAmount)
+		if len(tailMediators) == 0 {
+			routeState.Path = append([]common.Address{}, nw.path...)
+			routeState.PathFees = fees
 		}
-
 		onlineNodes = append(onlineNodes, routeState)
+		costs = append(costs, expectedCost(routeState.TotalFee, nw.probability))
+	}
+	/*
+		权重只是近似的手续费, 按准确的手续费(考虑了成功概率)排序, 相同的保持最短路径的顺序
+	*/
+	// weight is only an approximation of fee, order by the exact fee(success probability considered), and keep order of shortest path when they are equal.
+	sort.Stable(routesByCost{onlineNodes, costs})
+	return
+}
+
+type routesByCost struct {
+	routes []*route.State
+	costs  []*big.Float
+}
+
+func (r routesByCost) Len() int           { return len(r.routes) }
+func (r routesByCost) Less(i, j int) bool { return r.costs[i].Cmp(r.costs[j]) < 0 }
+func (r routesByCost) Swap(i, j int) {
+	r.routes[i], r.routes[j] = r.routes[j], r.routes[i]
+	r.costs[i], r.costs[j] = r.costs[j], r.costs[i]
+}
+/*
+copyForSearch 返回 cg 的一个副本, 查找时可以修改它的边和节点而不影响 cg, 通道,历史记录和 Announcements 是共享的.
+*/
+/*
+ *	copyForSearch : returns a copy of cg, arcs and vertices of it can be changed by one search without affecting cg,
+ *	channels, history and announcements are shared.
+ */
+func (cg *ChannelGraph) copyForSearch() *ChannelGraph {
+	c := *cg
+	c.g = cg.g.CloneGraph()
+	c.address2index = make(map[common.Address]int, len(cg.address2index))
+	for addr, index := range cg.address2index {
+		c.address2index[addr] = index
+	}
+	c.index2address = make(map[int]common.Address, len(cg.index2address))
+	for index, addr := range cg.index2address {
+		c.index2address[index] = addr
+	}
+	return &c
+}
+
+/*
+GetCircularRoutes 返回从我出发,经过其他节点,最终从 inPartner 所在通道回到我的环形路由,用于 rebalance.
+在图的副本上断开所有指向我的边再查找,保证路径不会中途经过我自己,也不会改变其他查找依赖的图.
+路由是由各中间节点自己选择的,所以发起方必须用 TransferConstraints.LastHop 要求交易从 inPartner 回到我,否则接收方会拒绝.
+转出以后可用余额(扣除 amount 和手续费)会低于 minRemaining 的通道不作为第一跳, 否则这个通道马上又需要 rebalance,
+自动 rebalance 会在两个通道之间来回转账, 每次都白白支付手续费. minRemaining 为 nil 表示没有限制.
+*/
+/*
+ *	GetCircularRoutes : function to return routes which leave us through one of our channels and come back
+ *	to us through the channel with `inPartner`, they are used by rebalance.
+ *
+ *	Note that all arcs pointing to us are detached in a copy of the graph before searching, so the path never passes through ourselves,
+ *	and the graph other searches depend on is not changed.
+ *	Mediated nodes choose their own next hop, so the initiator must require the transfer to come back via `inPartner`
+ *	by TransferConstraints.LastHop, otherwise the target refuses it.
+ *	Channels whose distributable would drop below `minRemaining` after sending amount and fee are not used as the first hop,
+ *	otherwise they would need rebalance right away, and auto rebalance would move tokens back and forth between two channels,
+ *	paying fee for nothing every time. nil `minRemaining` means no limit.
+ */
+func (cg *ChannelGraph) GetCircularRoutes(nodesStatus NodesStatusGetter, inPartner common.Address, amount *big.Int,
+	excludeAddresses map[common.Address]bool, feeCharger fee.Charger, minRemaining *big.Int) (routes []*route.State) {
+	inChannel := cg.GetPartenerAddress2Channel(inPartner)
+	if inChannel == nil || !inChannel.CanTransfer() {
+		log.Warn(fmt.Sprintf("no usable channel with %s on token %s", utils.APex2(inPartner), utils.APex2(cg.TokenAddress)))
+		return
+	}
+	if amount.Cmp(inChannel.PartnerState.Distributable(inChannel.OurState)) > 0 {
+		log.Warn(fmt.Sprintf("partner %s doesn't have enough funds[%s] to send back", utils.APex2(inPartner), amount))
+		return
+	}
+	search := cg.copyForSearch()
+	ourIndex := search.address2index[search.OurAddress]
+	neighbours, err := search.g.GetAllNeighbors(ourIndex)
+	if err != nil {
+		return
+	}
+	for _, n := range neighbours {
+		err = search.g.DeleteArc(n, ourIndex)
+		if err != nil {
+			log.Error(fmt.Sprintf("detach arc %d-%d err %s", n, ourIndex, err))
+		}
+	}
+	exclude := MakeExclude(inPartner)
+	for addr := range excludeAddresses {
+		exclude[addr] = true
+	}
+	/*
+		inPartner 把钱转给我的时候也会收取费用
+	*/
+	// inPartner charges fee too when it sends the tokens back to us.
+	for _, r := range search.getBestRoutes(nodesStatus, search.OurAddress, inPartner, amount, amount, exclude, feeCharger, []common.Address{inPartner}, nil) {
+		if minRemaining != nil {
+			remaining := new(big.Int).Sub(r.Channel().Distributable(), amount)
+			if remaining.Sub(remaining, r.TotalFee).Cmp(minRemaining) < 0 {
+				log.Debug(fmt.Sprintf("circular route via %s ignored, distributable would drop below %s", utils.APex2(r.HopNode()), minRemaining))
+				continue
+			}
+		}
+		routes = append(routes, r)
+	}
+	return
+}
+
+//Path is a path in the channel graph
+type Path struct {
+	Hops     []common.Address `json:"hops"`      //from source to target, both included
+	Weight   int64            `json:"weight"`    //weight used to order paths
+	TotalFee *big.Int         `json:"total_fee"` //exact fee of all mediators on the path
+}
+
+func (cg *ChannelGraph) toPaths(bps []dijkstra.BestPath, amount *big.Int, feeCharger fee.Charger) (paths []*Path) {
+	for _, bp := range bps {
+		p := &Path{Weight: bp.Distance}
+		for _, i := range bp.Path {
+			p.Hops = append(p.Hops, cg.index2address[i])
+		}
+		p.TotalFee = fee.TotalFee(cg.pathCharger(p.Hops, feeCharger), cg.TokenAddress, p.Hops[1:len(p.Hops)-1], amount)
+		paths = append(paths, p)
 	}
 	return
 }
+
+func (cg *ChannelGraph) pathIndexes(source, target common.Address) (sourceIndex, targetIndex int, err error) {
+	var ok bool
+	sourceIndex, ok = cg.address2index[source]
+	if !ok {
+		err = errors.New("source not found")
+		return
+	}
+	targetIndex, ok = cg.address2index[target]
+	if !ok {
+		err = errors.New("target not found")
+	}
+	return
+}
+
+/*
+KShortestPaths 返回从 source 到 target 最多 k 条不同的路径, 按权重排序, pfs 用它返回多条候选路径.
+节点自己发起交易时仍然每个邻居只有一条路由, 因为对方不会在已经 AnnounceDisposed 的通道上再接受同一个锁,
+经过同一个邻居的其他路径没法用来重试, 见 initiator 的 tryNewRoute.
+*/
+/*
+ *	KShortestPaths : returns at most k different paths from source to target ordered by weight,
+ *	pfs uses it to return several candidate paths.
+ *	The initiator still has only one route per neighbor, the partner doesn't accept the same lock again
+ *	on a channel it's disposed, so other paths via the same neighbor cannot be used to retry, see tryNewRoute of initiator.
+ */
+func (cg *ChannelGraph) KShortestPaths(source, target common.Address, k int, amount *big.Int, feeCharger fee.Charger) (paths []*Path, err error) {
+	sourceIndex, targetIndex, err := cg.pathIndexes(source, target)
+	if err != nil {
+		return
+	}
+	cg.setFeeWeights(amount, feeCharger)
+	bps, err := cg.g.KShortest(sourceIndex, targetIndex, k)
+	if err != nil {
+		return
+	}
+	return cg.toPaths(bps, amount, feeCharger), nil
+}
+
+/*
+DisjointPaths 返回从 source 到 target 最多 k 条互不共用通道的路径, nodeDisjoint 为 true 时中间节点也不共用.
+现在还不支持把一笔交易拆分到多条路径上, 这里只是提供查找, 节点自己发起交易时不会用到.
+*/
+/*
+ *	DisjointPaths : returns at most k paths from source to target which don't share any channel,
+ *	if nodeDisjoint is true, they don't share any mediator either.
+ *	Splitting a transfer into parts is not supported yet, it's only a search and the initiator doesn't use it.
+ */
+func (cg *ChannelGraph) DisjointPaths(source, target common.Address, k int, nodeDisjoint bool, amount *big.Int, feeCharger fee.Charger) (paths []*Path, err error) {
+	sourceIndex, targetIndex, err := cg.pathIndexes(source, target)
+	if err != nil {
+		return
+	}
+	cg.setFeeWeights(amount, feeCharger)
+	bps, err := cg.g.DisjointPaths(sourceIndex, targetIndex, k, nodeDisjoint)
+	if err != nil {
+		return
+	}
+	return cg.toPaths(bps, amount, feeCharger), nil
+}
+
 func (cg *ChannelGraph) haveNodes() bool {
 	return len(cg.g.Verticies) > 0
 }
@@ -374,6 +736,19 @@ func (cg *ChannelGraph) AllNodes() (nodes []common.Address) {
 	return nodes
 }
 
+//NodesChannelNumber returns how many channels each node has on this token
+func (cg *ChannelGraph) NodesChannelNumber() map[common.Address]int {
+	m := make(map[common.Address]int)
+	for index, addr := range cg.index2address {
+		neighbors, err := cg.g.GetAllNeighbors(index)
+		if err != nil {
+			continue
+		}
+		m[addr] = len(neighbors)
+	}
+	return m
+}
+
 //GetPartenerAddress2Channel returns a channel between me and address
 func (cg *ChannelGraph) GetPartenerAddress2Channel(address common.Address) (c *channel.Channel) {
 	c = cg.PartenerAddress2Channel[address]
@@ -0,0 +1,432 @@
+package graph
+
+import (
+	"math/big"
+	"math/rand"
+	"testing"
+
+	"github.com/SmartMeshFoundation/Atmosphere/blockchain"
+	"github.com/SmartMeshFoundation/Atmosphere/encoding"
+	"github.com/SmartMeshFoundation/Atmosphere/network/rpc/fee"
+	"github.com/SmartMeshFoundation/Atmosphere/network/xmpptransport"
+	"github.com/SmartMeshFoundation/Atmosphere/utils"
+	"github.com/SmartMeshFoundation/Atmosphere/utils/utest"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+//byteCharger every node charges the last byte of its address modulo 5
+type byteCharger struct{}
+
+func (byteCharger) GetNodeChargeFee(nodeAddress, tokenAddress common.Address, amount *big.Int) *big.Int {
+	return big.NewInt(int64(nodeAddress[len(nodeAddress)-1] % 5))
+}
+
+//makeSyntheticGraph nodes random channels plus neighbors channels of our node
+func makeSyntheticGraph(nodes, degree, neighbors int, r *rand.Rand) (cg *ChannelGraph, addrs []common.Address) {
+	for i := 0; i < nodes; i++ {
+		addrs = append(addrs, utils.NewRandomAddress())
+	}
+	var edges []common.Address
+	for i := 0; i < nodes; i++ {
+		for j := 0; j < degree/2; j++ {
+			k := r.Intn(nodes)
+			if k != i {
+				edges = append(edges, addrs[i], addrs[k])
+			}
+		}
+	}
+	for i := 1; i <= neighbors; i++ {
+		edges = append(edges, addrs[0], addrs[r.Intn(nodes-1)+1])
+	}
+	return NewChannelGraph(addrs[0], utils.NewRandomAddress(), edges), addrs
+}
+
+//oldOrderedNeighbours search once for every neighbor
+func oldOrderedNeighbours(cg *ChannelGraph, target common.Address, amount *big.Int) map[common.Address]int64 {
+	m := make(map[common.Address]int64)
+	for _, n := range cg.getNeighbours() {
+		w, err := cg.ShortestPath(n, target, amount, byteCharger{})
+		if err != nil {
+			continue
+		}
+		m[n] = w
+	}
+	return m
+}
+
+func TestOrderedNeighbours(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	amount := big.NewInt(10)
+	for round := 0; round < 10; round++ {
+		cg, addrs := makeSyntheticGraph(300, 3, 20, r)
+		target := addrs[r.Intn(len(addrs)-1)+1]
+		expect := oldOrderedNeighbours(cg, target, amount)
+		nws := cg.orderedNeighbours(cg.OurAddress, target, amount, byteCharger{})
+		if len(nws) != len(expect) {
+			t.Fatalf("round %d expect %d neighbors,got %d", round, len(expect), len(nws))
+		}
+		for i, nw := range nws {
+			if w, ok := expect[nw.neighbor]; !ok || w != nw.weight {
+				t.Fatalf("round %d neighbor %s expect weight %d,got %d", round, utils.APex(nw.neighbor), w, nw.weight)
+			}
+			if i > 0 && nws[i-1].weight > nw.weight {
+				t.Fatalf("round %d neighbors not ordered", round)
+			}
+		}
+	}
+	cg, _ := makeSyntheticGraph(10, 2, 3, r)
+	if nws := cg.orderedNeighbours(cg.OurAddress, utils.NewRandomAddress(), amount, byteCharger{}); len(nws) != 0 {
+		t.Fatalf("unknown target should have no neighbors")
+	}
+}
+
+//settingCharger every node charges constant + amount/percent
+type settingCharger map[common.Address][2]int64
+
+func (c settingCharger) GetNodeChargeFee(nodeAddress, tokenAddress common.Address, amount *big.Int) *big.Int {
+	s := c[nodeAddress]
+	f := new(big.Int)
+	if s[1] > 0 {
+		f.Div(amount, big.NewInt(s[1]))
+	}
+	return f.Add(f, big.NewInt(s[0]))
+}
+
+type fakeHistory map[common.Address]float64
+
+func (h fakeHistory) SuccessProbability(tokenAddress, partnerAddress common.Address, amount *big.Int) float64 {
+	if p, ok := h[partnerAddress]; ok {
+		return p
+	}
+	return 1
+}
+
+type allOnline struct{}
+
+func (allOnline) GetNetworkStatus(addr common.Address) (deviceType string, isOnline bool) {
+	return "", true
+}
+
+func TestGetBestRoutesExactFee(t *testing.T) {
+	a, b, c, target := utils.NewRandomAddress(), utils.NewRandomAddress(), utils.NewRandomAddress(), utils.NewRandomAddress()
+	//our->a->target,our->b->c->target
+	balance, _ := new(big.Int).SetString("1000000000000000000000", 0)
+	chA := utest.MakeRoute(a, balance, utest.UnitSettleTimeout, utest.UnitRevealTimeout, 0, utils.NewRandomHash()).Channel()
+	chB := utest.MakeRoute(b, balance, utest.UnitSettleTimeout, utest.UnitRevealTimeout, 0, utils.NewRandomHash()).Channel()
+	chB.OurState.Address = chA.OurState.Address
+	cg := NewChannelGraph(chA.OurState.Address, chA.TokenAddress, []common.Address{a, target, b, c, c, target})
+	if err := cg.AddChannel(chA); err != nil {
+		t.Fatal(err)
+	}
+	if err := cg.AddChannel(chB); err != nil {
+		t.Fatal(err)
+	}
+	charger := settingCharger{
+		a: {0, 50},
+		b: {1, 1000},
+		c: {0, 100},
+	}
+	//100 tokens with 18 decimals, fees don't fit in int64
+	targetAmount, _ := new(big.Int).SetString("100000000000000000000", 0)
+	routes := cg.GetBestRoutes(allOnline{}, cg.OurAddress, target, targetAmount, targetAmount, EmptyExlude, charger)
+	if len(routes) != 2 {
+		t.Fatalf("expect 2 routes,got %d", len(routes))
+	}
+	feeC := new(big.Int).Div(targetAmount, big.NewInt(100))
+	feeB := new(big.Int).Add(new(big.Int).Div(new(big.Int).Add(targetAmount, feeC), big.NewInt(1000)), big.NewInt(1))
+	viaB := new(big.Int).Add(feeB, feeC)
+	viaA := new(big.Int).Div(targetAmount, big.NewInt(50))
+	if routes[0].HopNode() != b || routes[0].TotalFee.Cmp(viaB) != 0 {
+		t.Fatalf("expect route via b with fee %s first,got %s with fee %s", viaB, utils.APex(routes[0].HopNode()), routes[0].TotalFee)
+	}
+	if routes[1].HopNode() != a || routes[1].TotalFee.Cmp(viaA) != 0 {
+		t.Fatalf("expect route via a with fee %s,got %s with fee %s", viaA, utils.APex(routes[1].HopNode()), routes[1].TotalFee)
+	}
+	//transfers via b failed recently, a is better though it charges more
+	cg.History = fakeHistory{b: 0.4}
+	routes = cg.GetBestRoutes(allOnline{}, cg.OurAddress, target, targetAmount, targetAmount, EmptyExlude, charger)
+	if len(routes) != 2 || routes[0].HopNode() != a || routes[1].TotalFee.Cmp(viaB) != 0 {
+		t.Fatalf("expect route via a first when b often fails")
+	}
+	cg.History = fakeHistory{b: 0.6}
+	routes = cg.GetBestRoutes(allOnline{}, cg.OurAddress, target, targetAmount, targetAmount, EmptyExlude, charger)
+	if len(routes) != 2 || routes[0].HopNode() != b {
+		t.Fatalf("expect route via b first when it fails seldom")
+	}
+	cg.History = nil
+	//rebalance: our->b->c->target->a->our, a charges for sending back too
+	chA.PartnerState.ContractBalance = balance
+	routes = cg.GetCircularRoutes(allOnline{}, a, targetAmount, EmptyExlude, charger, nil)
+	feeA := new(big.Int).Div(targetAmount, big.NewInt(50))
+	if expect := fee.TotalFee(charger, cg.TokenAddress, []common.Address{b, c, target, a}, targetAmount); len(routes) != 1 || routes[0].TotalFee.Cmp(expect) != 0 || expect.Cmp(new(big.Int).Add(viaB, feeA)) <= 0 {
+		t.Fatalf("circular route expect fee %s", expect)
+	}
+	//the search doesn't change the graph
+	if !cg.hasArc(a, cg.OurAddress) || !cg.hasArc(b, cg.OurAddress) {
+		t.Fatalf("arcs to us must be kept")
+	}
+	//no fee policy
+	routes = cg.GetBestRoutes(allOnline{}, cg.OurAddress, target, targetAmount, targetAmount, EmptyExlude, settingCharger{})
+	if len(routes) != 2 || routes[0].HopNode() != a || routes[0].TotalFee.Sign() != 0 {
+		t.Fatalf("no fee,expect shortest route via a first")
+	}
+}
+
+func TestCircularRoutesKeepThreshold(t *testing.T) {
+	a, b := utils.NewRandomAddress(), utils.NewRandomAddress()
+	//our->b->a->our, both channels are below threshold 100
+	chA := utest.MakeRoute(a, big.NewInt(10), utest.UnitSettleTimeout, utest.UnitRevealTimeout, 0, utils.NewRandomHash()).Channel()
+	chB := utest.MakeRoute(b, big.NewInt(150), utest.UnitSettleTimeout, utest.UnitRevealTimeout, 0, utils.NewRandomHash()).Channel()
+	chB.OurState.Address = chA.OurState.Address
+	chA.PartnerState.ContractBalance = big.NewInt(1000)
+	cg := NewChannelGraph(chA.OurState.Address, chA.TokenAddress, []common.Address{b, a})
+	if err := cg.AddChannel(chA); err != nil {
+		t.Fatal(err)
+	}
+	if err := cg.AddChannel(chB); err != nil {
+		t.Fatal(err)
+	}
+	threshold := big.NewInt(100)
+	amount := new(big.Int).Sub(threshold, chA.Distributable())
+	charger := settingCharger{b: {1, 0}, a: {1, 0}}
+	if routes := cg.GetCircularRoutes(allOnline{}, a, amount, EmptyExlude, charger, nil); len(routes) != 1 || routes[0].HopNode() != b {
+		t.Fatalf("expect circular route via b without limit")
+	}
+	//b would drop to 150-90-2, it would be rebalanced back by a at the next check
+	if routes := cg.GetCircularRoutes(allOnline{}, a, amount, EmptyExlude, charger, threshold); len(routes) != 0 {
+		t.Fatalf("b must not drop below threshold")
+	}
+	chB.OurState.ContractBalance = big.NewInt(192)
+	if routes := cg.GetCircularRoutes(allOnline{}, a, amount, EmptyExlude, charger, threshold); len(routes) != 1 {
+		t.Fatalf("b keeps exactly threshold")
+	}
+	chB.OurState.ContractBalance = big.NewInt(191)
+	if routes := cg.GetCircularRoutes(allOnline{}, a, amount, EmptyExlude, charger, threshold); len(routes) != 0 {
+		t.Fatalf("b drops 1 below threshold")
+	}
+}
+
+func benchmarkGraph() (*ChannelGraph, common.Address) {
+	r := rand.New(rand.NewSource(1))
+	cg, addrs := makeSyntheticGraph(10000, 4, 50, r)
+	return cg, addrs[len(addrs)-1]
+}
+
+func BenchmarkOrderedNeighboursPerNeighbor(b *testing.B) {
+	cg, target := benchmarkGraph()
+	amount := big.NewInt(10)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		oldOrderedNeighbours(cg, target, amount)
+	}
+}
+
+func BenchmarkOrderedNeighbours(b *testing.B) {
+	cg, target := benchmarkGraph()
+	amount := big.NewInt(10)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cg.orderedNeighbours(cg.OurAddress, target, amount, byteCharger{})
+	}
+}
+
+func TestKShortestAndDisjointPaths(t *testing.T) {
+	our, a, b, c, d, target := utils.NewRandomAddress(), utils.NewRandomAddress(), utils.NewRandomAddress(), utils.NewRandomAddress(), utils.NewRandomAddress(), utils.NewRandomAddress()
+	//our->a->target,our->b->c->target,our->b->d->target
+	cg := NewChannelGraph(our, utils.NewRandomAddress(), []common.Address{our, a, a, target, our, b, b, c, c, target, b, d, d, target})
+	amount := big.NewInt(10000)
+	charger := settingCharger{b: {1, 100}, c: {2, 0}, d: {3, 0}}
+	paths, err := cg.KShortestPaths(our, target, 5, amount, charger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 3 || len(paths[0].Hops) != 3 || paths[0].Hops[1] != a || paths[0].TotalFee.Sign() != 0 {
+		t.Fatalf("expect 3 paths and the free one via a first,got %d", len(paths))
+	}
+	//b charges on 10000 + c's fee
+	if paths[1].Hops[2] != c || paths[1].TotalFee.Cmp(big.NewInt(2+1+10002/100)) != 0 {
+		t.Fatalf("second path expect via c with fee 103,got %s", paths[1].TotalFee)
+	}
+	paths, err = cg.DisjointPaths(our, target, 5, true, amount, charger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 2 {
+		t.Fatalf("b is shared,expect 2 node disjoint paths,got %d", len(paths))
+	}
+	paths, err = cg.DisjointPaths(our, target, 5, false, amount, charger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 2 {
+		t.Fatalf("channel our-b is shared,expect 2 disjoint paths,got %d", len(paths))
+	}
+	if _, err = cg.KShortestPaths(our, utils.NewRandomAddress(), 5, amount, charger); err == nil {
+		t.Fatal("unknown target")
+	}
+}
+
+func TestAddDirectedPath(t *testing.T) {
+	our, a, target := utils.NewRandomAddress(), utils.NewRandomAddress(), utils.NewRandomAddress()
+	cg := NewChannelGraph(our, utils.NewRandomAddress(), nil)
+	cg.AddDirectedPath(our, a)
+	cg.AddDirectedPath(target, a)
+	cg.AddDirectedPath(a, target)
+	if _, err := cg.KShortestPaths(our, target, 1, big.NewInt(1), settingCharger{}); err != nil {
+		t.Fatalf("expect path our->a->target,got %s", err)
+	}
+	if _, err := cg.KShortestPaths(target, our, 1, big.NewInt(1), settingCharger{}); err == nil {
+		t.Fatal("there is no arc a->our")
+	}
+}
+
+type fakeAnnouncement struct {
+	fee      int64
+	capacity int64
+}
+
+//fakeAnnouncements node -> next -> announcement
+type fakeAnnouncements map[common.Address]map[common.Address]fakeAnnouncement
+
+func (f fakeAnnouncements) ChannelFee(tokenAddress, node, next common.Address, amount *big.Int) *big.Int {
+	if a, ok := f[node][next]; ok {
+		return big.NewInt(a.fee)
+	}
+	return nil
+}
+
+func (f fakeAnnouncements) MayHaveCapacity(tokenAddress, node, next common.Address, amount *big.Int) bool {
+	if a, ok := f[node][next]; ok {
+		return amount.Cmp(big.NewInt(a.capacity)) <= 0
+	}
+	return true
+}
+
+func TestAnnouncedFeeAndCapacity(t *testing.T) {
+	a, b, c, target := utils.NewRandomAddress(), utils.NewRandomAddress(), utils.NewRandomAddress(), utils.NewRandomAddress()
+	//our->a->target,our->b->c->target
+	balance := big.NewInt(1000)
+	chA := utest.MakeRoute(a, balance, utest.UnitSettleTimeout, utest.UnitRevealTimeout, 0, utils.NewRandomHash()).Channel()
+	chB := utest.MakeRoute(b, balance, utest.UnitSettleTimeout, utest.UnitRevealTimeout, 0, utils.NewRandomHash()).Channel()
+	chB.OurState.Address = chA.OurState.Address
+	cg := NewChannelGraph(chA.OurState.Address, chA.TokenAddress, []common.Address{a, target, b, c, c, target})
+	if err := cg.AddChannel(chA); err != nil {
+		t.Fatal(err)
+	}
+	if err := cg.AddChannel(chB); err != nil {
+		t.Fatal(err)
+	}
+	//without announcements every node charges 5 by our own policy
+	charger := settingCharger{a: {5, 0}, b: {5, 0}, c: {5, 0}}
+	amount := big.NewInt(100)
+	routes := cg.GetBestRoutes(allOnline{}, cg.OurAddress, target, amount, amount, EmptyExlude, charger)
+	if len(routes) != 2 || routes[0].HopNode() != a || routes[0].TotalFee.Int64() != 5 {
+		t.Fatalf("expect route via a first")
+	}
+	announcements := fakeAnnouncements{
+		a: {target: {4, 1000}},
+		b: {c: {1, 1000}},
+		c: {target: {2, 1000}},
+	}
+	cg.Announcements = announcements
+	routes = cg.GetBestRoutes(allOnline{}, cg.OurAddress, target, amount, amount, EmptyExlude, charger)
+	if len(routes) != 2 || routes[0].HopNode() != b || routes[0].TotalFee.Int64() != 3 {
+		t.Fatalf("expect route via b with announced fee 3 first")
+	}
+	//Fee is what we charge by our own policy, not the fee announced by b
+	if routes[0].Fee.Int64() != 5 {
+		t.Fatalf("expect our own fee 5 on channel with b,got %s", routes[0].Fee)
+	}
+	if routes[1].TotalFee.Int64() != 4 {
+		t.Fatalf("expect route via a with announced fee 4,got %s", routes[1].TotalFee)
+	}
+	paths, err := cg.KShortestPaths(cg.OurAddress, target, 2, amount, charger)
+	if err != nil || len(paths) != 2 || paths[0].Hops[1] != b || paths[0].TotalFee.Int64() != 3 {
+		t.Fatalf("expect path via b with announced fee 3 first")
+	}
+	//c cannot send 100 tokens to target now, it's used only when there is no other way
+	announcements[c][target] = fakeAnnouncement{2, 50}
+	routes = cg.GetBestRoutes(allOnline{}, cg.OurAddress, target, amount, amount, EmptyExlude, charger)
+	if len(routes) != 2 || routes[0].HopNode() != a {
+		t.Fatalf("expect route via a first when c has no capacity")
+	}
+	routes = cg.GetBestRoutes(allOnline{}, cg.OurAddress, target, big.NewInt(50), big.NewInt(50), EmptyExlude, charger)
+	if len(routes) != 2 || routes[0].HopNode() != b {
+		t.Fatalf("expect route via b first for small amount")
+	}
+}
+
+//mobileNodes nodes in it are mobile, all nodes are online
+type mobileNodes map[common.Address]bool
+
+func (m mobileNodes) GetNetworkStatus(addr common.Address) (deviceType string, isOnline bool) {
+	if m[addr] {
+		return xmpptransport.TypeMobile, true
+	}
+	return "", true
+}
+
+func TestGetBestRoutesWithHints(t *testing.T) {
+	box, phone := utils.NewRandomAddress(), utils.NewRandomAddress()
+	balance := big.NewInt(1000)
+	ch := utest.MakeRoute(box, balance, utest.UnitSettleTimeout, utest.UnitRevealTimeout, 0, utils.NewRandomHash()).Channel()
+	//channel box-phone is unknown to us
+	cg := NewChannelGraph(ch.OurState.Address, ch.TokenAddress, nil)
+	if err := cg.AddChannel(ch); err != nil {
+		t.Fatal(err)
+	}
+	status := mobileNodes{box: true, phone: true}
+	charger := settingCharger{box: {5, 0}}
+	amount := big.NewInt(100)
+	if routes := cg.GetBestRoutes(status, cg.OurAddress, phone, amount, amount, EmptyExlude, charger); len(routes) != 0 {
+		t.Fatal("phone should be unreachable without hints")
+	}
+	hints := []*encoding.RouteHint{{
+		Node:              box,
+		ChannelIdentifier: blockchain.CalcChannelID(cg.TokenAddress, box, phone),
+		FeeConstant:       big.NewInt(1),
+		FeePercent:        50,
+	}}
+	routes := cg.GetBestRoutesWithHints(status, cg.OurAddress, phone, amount, amount, EmptyExlude, charger, hints)
+	if len(routes) != 1 || routes[0].HopNode() != box || routes[0].TotalFee.Int64() != 3 {
+		t.Fatalf("expect route via mobile box with fee in hint")
+	}
+	if len(routes[0].Path) != 2 || routes[0].Path[1] != phone {
+		t.Fatalf("path should end with phone")
+	}
+	//hints are for that search only, the graph doesn't grow
+	if _, ok := cg.address2index[phone]; ok || cg.hasArc(box, phone) || cg.Announcements != nil {
+		t.Fatal("hints should not be added to the graph")
+	}
+	if routes = cg.GetBestRoutes(status, cg.OurAddress, phone, amount, amount, EmptyExlude, charger); len(routes) != 0 {
+		t.Fatal("phone should be unreachable after the search with hints")
+	}
+	//known channel of a mobile node, hinted fee takes precedence over the announced one
+	cg.AddPath(box, phone)
+	cg.Announcements = fakeAnnouncements{box: {phone: {4, 1000}}}
+	if routes = cg.GetBestRoutes(status, cg.OurAddress, phone, amount, amount, EmptyExlude, charger); len(routes) != 0 {
+		t.Fatal("mobile box should not mediate without hints")
+	}
+	routes = cg.GetBestRoutesWithHints(status, cg.OurAddress, phone, amount, amount, EmptyExlude, charger, hints)
+	if len(routes) != 1 || routes[0].TotalFee.Int64() != 3 {
+		t.Fatalf("expect route via mobile box with fee in hint")
+	}
+	if !cg.hasArc(box, phone) {
+		t.Fatal("known channel should not be removed")
+	}
+	//invalid hints are ignored
+	hints[0].ChannelIdentifier = utils.NewRandomHash()
+	if CheckRouteHints(cg.TokenAddress, phone, hints) == nil {
+		t.Fatal("channel of hint mismatch")
+	}
+	if routes = cg.GetBestRoutesWithHints(status, cg.OurAddress, phone, amount, amount, EmptyExlude, charger, hints); len(routes) != 0 {
+		t.Fatal("invalid hints should be ignored")
+	}
+	hints[0].ChannelIdentifier = blockchain.CalcChannelID(cg.TokenAddress, box, phone)
+	if CheckRouteHints(cg.TokenAddress, phone, append(hints, hints[0])) == nil {
+		t.Fatal("repeated node in hints")
+	}
+	if CheckRouteHints(cg.TokenAddress, box, hints) == nil {
+		t.Fatal("hints don't end with target")
+	}
+}
@@ -0,0 +1,142 @@
+package graph
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/SmartMeshFoundation/Atmosphere/blockchain"
+	"github.com/SmartMeshFoundation/Atmosphere/encoding"
+	"github.com/SmartMeshFoundation/Atmosphere/log"
+	"github.com/SmartMeshFoundation/Atmosphere/params"
+	"github.com/SmartMeshFoundation/Atmosphere/utils"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+/*
+CheckRouteHints 检查 hints 是否是一条到达 target 的路径, 每个通道的 id 必须和两端的地址以及 token 对应.
+*/
+/*
+ *	CheckRouteHints : check hints is a path to target, id of every channel must match addresses of both sides and the token.
+ */
+func CheckRouteHints(tokenAddress, target common.Address, hints []*encoding.RouteHint) error {
+	if len(hints) > params.MaxRouteHints {
+		return fmt.Errorf("too many route hints, max %d", params.MaxRouteHints)
+	}
+	nodes := MakeExclude(target)
+	for i, h := range hints {
+		if h == nil {
+			return errors.New("empty route hint")
+		}
+		next := target
+		if i+1 < len(hints) && hints[i+1] != nil {
+			next = hints[i+1].Node
+		}
+		if h.Node == utils.EmptyAddress || nodes[h.Node] {
+			return fmt.Errorf("route hint %s repeats node", h)
+		}
+		nodes[h.Node] = true
+		if h.FeeConstant == nil || h.FeeConstant.Sign() < 0 || h.FeePercent < 0 {
+			return fmt.Errorf("route hint %s has invalid fee", h)
+		}
+		if h.ChannelIdentifier != blockchain.CalcChannelID(tokenAddress, h.Node, next) {
+			return fmt.Errorf("channel of route hint %s is not between %s and %s", h, utils.APex2(h.Node), utils.APex2(next))
+		}
+	}
+	return nil
+}
+
+//hintFee fee h charges for sending amount tokens, FeeConstant + amount/FeePercent
+func hintFee(h *encoding.RouteHint, amount *big.Int) *big.Int {
+	f := new(big.Int)
+	if h.FeePercent > 0 {
+		f.Div(amount, big.NewInt(h.FeePercent))
+	}
+	return f.Add(f, h.FeeConstant)
+}
+
+//hintAnnouncements fees in route hints take precedence over announced ones
+type hintAnnouncements struct {
+	hints         map[common.Address]*encoding.RouteHint
+	next          map[common.Address]common.Address
+	announcements ChannelAnnouncements //nil if the graph has no announcements
+}
+
+//ChannelFee implements ChannelAnnouncements
+func (a *hintAnnouncements) ChannelFee(tokenAddress, node, next common.Address, amount *big.Int) *big.Int {
+	if h, ok := a.hints[node]; ok && a.next[node] == next {
+		return hintFee(h, amount)
+	}
+	if a.announcements == nil {
+		return nil
+	}
+	return a.announcements.ChannelFee(tokenAddress, node, next, amount)
+}
+
+//MayHaveCapacity implements ChannelAnnouncements
+func (a *hintAnnouncements) MayHaveCapacity(tokenAddress, node, next common.Address, amount *big.Int) bool {
+	if _, ok := a.hints[node]; ok && a.next[node] == next {
+		return true
+	}
+	if a.announcements == nil {
+		return true
+	}
+	return a.announcements.MayHaveCapacity(tokenAddress, node, next, amount)
+}
+
+func (cg *ChannelGraph) hasArc(source, target common.Address) bool {
+	sourceIndex, targetIndex, err := cg.pathIndexes(source, target)
+	if err != nil {
+		return false
+	}
+	v, err := cg.g.GetVertex(sourceIndex)
+	if err != nil {
+		return false
+	}
+	_, ok := v.GetArc(targetIndex)
+	return ok
+}
+
+/*
+mergeRouteHints 把 hints 中的通道加入到图的副本中, 只用于这一次查找, 原来的图不会改变, 也不会因为 hints 中的节点越来越大.
+我们自己的通道不需要 hints, 忽略掉. 没有 hints 或者 hints 无效的时候直接返回原来的图.
+*/
+/*
+ *	mergeRouteHints : channels in hints are added to a copy of the graph for this search only,
+ *	the graph itself is not changed, so it doesn't grow with nodes in hints.
+ *	Our own channels need no hints, they are ignored. The graph itself is returned if there is no valid hint.
+ */
+func (cg *ChannelGraph) mergeRouteHints(target common.Address, hints []*encoding.RouteHint) (search *ChannelGraph, hinted map[common.Address]bool) {
+	search = cg
+	if len(hints) == 0 {
+		return
+	}
+	if err := CheckRouteHints(cg.TokenAddress, target, hints); err != nil {
+		log.Warn(fmt.Sprintf("ignore route hints to %s, err %s", utils.APex2(target), err))
+		return
+	}
+	a := &hintAnnouncements{
+		hints:         make(map[common.Address]*encoding.RouteHint),
+		next:          make(map[common.Address]common.Address),
+		announcements: cg.Announcements,
+	}
+	search = cg.copyForSearch()
+	search.Announcements = a
+	hinted = make(map[common.Address]bool)
+	for i, h := range hints {
+		next := target
+		if i+1 < len(hints) {
+			next = hints[i+1].Node
+		}
+		if h.Node == cg.OurAddress {
+			continue
+		}
+		hinted[h.Node] = true
+		a.hints[h.Node] = h
+		a.next[h.Node] = next
+		if !search.hasArc(h.Node, next) {
+			search.AddDirectedPath(h.Node, next)
+		}
+	}
+	return
+}
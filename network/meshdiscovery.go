@@ -0,0 +1,326 @@
+package network
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/SmartMeshFoundation/Atmosphere/internal/rpanic"
+	"github.com/SmartMeshFoundation/Atmosphere/log"
+	"github.com/SmartMeshFoundation/Atmosphere/params"
+	"github.com/SmartMeshFoundation/Atmosphere/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+//meshBeaconMagic beacons start with it, other packets in the group are ignored
+var meshBeaconMagic = []byte("ATMB")
+
+const (
+	meshBeaconVersion = 0
+	maxDeviceTypeLen  = 32
+	//magic,version,address,ip,port,timestamp,length of device type
+	meshBeaconHeaderLength = 4 + 1 + 20 + 16 + 2 + 8 + 1
+)
+
+var errInvalidBeacon = errors.New("invalid mesh beacon")
+
+/*
+meshBeacon 节点在局域网中定时发送的信标, 公布自己的地址, 监听的 host 和 port 以及设备类型, 用自己的私钥签名.
+Timestamp 只用于丢弃重放的旧信标, 同一个节点的信标 Timestamp 必须递增, 而且不能比收到的时候早 params.MeshDiscoveryExpiration,
+所以局域网中节点的时钟应该大致一致.
+*/
+/*
+ *	meshBeacon : beacon a node sends in the LAN periodically, announces its address, host and port it listens on, and device type, signed by its key.
+ *	Timestamp is only used to drop old beacons replayed, Timestamp of beacons from one node must increase,
+ *	and must not be params.MeshDiscoveryExpiration earlier than when it's received, so clocks of nodes in the LAN should roughly agree.
+ */
+type meshBeacon struct {
+	Address    common.Address
+	IP         net.IP
+	Port       int
+	Timestamp  int64 //unix nano
+	DeviceType string
+	Signature  []byte
+}
+
+func (b *meshBeacon) signData() []byte {
+	buf := new(bytes.Buffer)
+	buf.Write(meshBeaconMagic)
+	buf.WriteByte(meshBeaconVersion)
+	buf.Write(b.Address[:])
+	ip := b.IP.To16()
+	if ip == nil {
+		ip = net.IPv6unspecified
+	}
+	buf.Write(ip)
+	binary.Write(buf, binary.BigEndian, uint16(b.Port))
+	binary.Write(buf, binary.BigEndian, b.Timestamp)
+	buf.WriteByte(byte(len(b.DeviceType)))
+	buf.WriteString(b.DeviceType)
+	return buf.Bytes()
+}
+
+func (b *meshBeacon) sign(key *ecdsa.PrivateKey) (data []byte, err error) {
+	if len(b.DeviceType) > maxDeviceTypeLen {
+		return nil, fmt.Errorf("device type %s too long", b.DeviceType)
+	}
+	data = b.signData()
+	b.Signature, err = utils.SignData(key, data)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, b.Signature...), nil
+}
+
+//unpackMeshBeacon decode data and verify it's signed by the announced address
+func unpackMeshBeacon(data []byte) (b *meshBeacon, err error) {
+	if len(data) < meshBeaconHeaderLength+65 || !bytes.Equal(data[:4], meshBeaconMagic) || data[4] != meshBeaconVersion {
+		return nil, errInvalidBeacon
+	}
+	deviceTypeLen := int(data[meshBeaconHeaderLength-1])
+	if deviceTypeLen > maxDeviceTypeLen || len(data) != meshBeaconHeaderLength+deviceTypeLen+65 {
+		return nil, errInvalidBeacon
+	}
+	b = &meshBeacon{
+		IP:         net.IP(append([]byte{}, data[25:41]...)),
+		Port:       int(binary.BigEndian.Uint16(data[41:43])),
+		Timestamp:  int64(binary.BigEndian.Uint64(data[43:51])),
+		DeviceType: string(data[meshBeaconHeaderLength : meshBeaconHeaderLength+deviceTypeLen]),
+		Signature:  append([]byte{}, data[len(data)-65:]...),
+	}
+	copy(b.Address[:], data[5:25])
+	signer, err := utils.Ecrecover(utils.Sha3(data[:len(data)-65]), b.Signature)
+	if err != nil {
+		return nil, err
+	}
+	if signer != b.Address {
+		return nil, fmt.Errorf("beacon of %s signed by %s", utils.APex2(b.Address), utils.APex2(signer))
+	}
+	if b.Port <= 0 {
+		return nil, errInvalidBeacon
+	}
+	return
+}
+
+/*
+MeshDiscovery 在局域网中通过组播或者广播发送签名的信标, 收到其他节点的信标后把它们的 host 和 port 交给 UDPTransport,
+一段时间没有收到信标的节点会被删除. 这样 meshbox 和手机在没有互联网的情况下也能找到彼此, 不用手工调用 UpdateMeshNetworkNodes.
+*/
+/*
+ *	MeshDiscovery : sends signed beacons by multicast or broadcast in the LAN, host and port in beacons received from other nodes are given to UDPTransport,
+ *	and nodes whose beacons are not received for a while are removed.
+ *	So meshboxes and phones find each other without internet, and there is no need to call UpdateMeshNetworkNodes manually.
+ */
+type MeshDiscovery struct {
+	key        *ecdsa.PrivateKey
+	address    common.Address
+	deviceType string
+	udp        *UDPTransport
+	group      *net.UDPAddr
+	conn       *net.UDPConn
+	now        func() time.Time
+	localIP    func() (net.IP, error) //ip announced in our beacons
+	lock       sync.Mutex
+	timestamps map[common.Address]int64 //timestamp of the latest beacon accepted from every node
+	quit       chan struct{}
+	log        log.Logger
+}
+
+//NewMeshDiscovery create MeshDiscovery, group is a multicast group or broadcast address with port
+func NewMeshDiscovery(key *ecdsa.PrivateKey, deviceType string, udp *UDPTransport, group string) (d *MeshDiscovery, err error) {
+	ua, err := net.ResolveUDPAddr("udp4", group)
+	if err != nil {
+		return
+	}
+	address := crypto.PubkeyToAddress(key.PublicKey)
+	d = &MeshDiscovery{
+		key:        key,
+		address:    address,
+		deviceType: deviceType,
+		udp:        udp,
+		group:      ua,
+		now:        time.Now,
+		timestamps: make(map[common.Address]int64),
+		quit:       make(chan struct{}),
+		log:        log.New("name", utils.APex2(address)),
+	}
+	d.localIP = d.interfaceIP
+	return
+}
+
+//Start listen beacons and send ours periodically
+func (d *MeshDiscovery) Start() (err error) {
+	if d.group.IP.IsMulticast() {
+		d.conn, err = net.ListenMulticastUDP("udp4", nil, d.group)
+	} else {
+		d.conn, err = net.ListenUDP("udp4", &net.UDPAddr{Port: d.group.Port})
+	}
+	if err != nil {
+		return
+	}
+	d.log.Info(fmt.Sprintf("mesh discovery on %s", d.group))
+	go d.receiveLoop()
+	go d.beaconLoop()
+	return
+}
+
+//Stop sending and receiving beacons
+func (d *MeshDiscovery) Stop() {
+	close(d.quit)
+	if d.conn != nil {
+		err := d.conn.Close()
+		if err != nil {
+			d.log.Warn(fmt.Sprintf("close mesh discovery err %s", err))
+		}
+	}
+}
+
+func (d *MeshDiscovery) receiveLoop() {
+	defer rpanic.PanicRecover("mesh discovery receive")
+	data := make([]byte, 512)
+	for {
+		n, from, err := d.conn.ReadFromUDP(data)
+		if err != nil {
+			select {
+			case <-d.quit:
+				return
+			default:
+			}
+			d.log.Error(fmt.Sprintf("mesh discovery read err %s", err))
+			time.Sleep(time.Second)
+			continue
+		}
+		err = d.handleBeacon(data[:n])
+		if err != nil {
+			d.log.Trace(fmt.Sprintf("ignore beacon from %s, err %s", from, err))
+		}
+	}
+}
+
+func (d *MeshDiscovery) beaconLoop() {
+	defer rpanic.PanicRecover("mesh discovery beacon")
+	ticker := time.NewTicker(params.MeshDiscoveryInterval)
+	defer ticker.Stop()
+	for {
+		err := d.sendBeacon()
+		if err != nil {
+			d.log.Warn(fmt.Sprintf("send mesh beacon err %s", err))
+		}
+		d.expire()
+		select {
+		case <-d.quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+/*
+interfaceIP 信标中公布的 ip, 监听 0.0.0.0 的时候使用发送信标的网卡的 ip.
+*/
+// interfaceIP : ip announced in our beacons, ip of the interface beacons are sent from is used when listening on 0.0.0.0.
+func (d *MeshDiscovery) interfaceIP() (net.IP, error) {
+	ip := d.udp.UAddr.IP
+	if ip != nil && !ip.IsUnspecified() {
+		return ip, nil
+	}
+	//不会发送任何数据, 只是找到去往 group 的路由
+	// nothing is sent, it only finds the route to the group
+	conn, err := net.DialUDP("udp4", nil, d.group)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	ip = conn.LocalAddr().(*net.UDPAddr).IP
+	if ip.IsUnspecified() {
+		return nil, fmt.Errorf("no interface to %s", d.group)
+	}
+	return ip, nil
+}
+
+func (d *MeshDiscovery) newBeacon() ([]byte, error) {
+	ip, err := d.localIP()
+	if err != nil {
+		return nil, err
+	}
+	b := &meshBeacon{
+		Address:    d.address,
+		IP:         ip,
+		Port:       d.udp.UAddr.Port,
+		Timestamp:  d.now().UnixNano(),
+		DeviceType: d.deviceType,
+	}
+	return b.sign(d.key)
+}
+
+func (d *MeshDiscovery) sendBeacon() error {
+	data, err := d.newBeacon()
+	if err != nil {
+		return err
+	}
+	_, err = d.conn.WriteToUDP(data, d.group)
+	return err
+}
+
+/*
+handleBeacon 验证收到的信标, 只使用签名中的 ip, 发送者的 ip 可以伪造, 不可信.
+太旧的信标以及不比上一个新的信标都被认为是重放的.
+*/
+/*
+ *	handleBeacon : verify the beacon received, only the ip signed is used, ip of the sender can be spoofed and isn't trusted.
+ *	Beacons too old or not newer than the last one are taken as replayed.
+ */
+func (d *MeshDiscovery) handleBeacon(data []byte) error {
+	b, err := unpackMeshBeacon(data)
+	if err != nil {
+		return err
+	}
+	if b.Address == d.address {
+		return nil
+	}
+	if b.IP.IsUnspecified() {
+		return errInvalidBeacon
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if b.Timestamp <= d.timestamps[b.Address] || b.Timestamp < d.now().Add(-params.MeshDiscoveryExpiration).UnixNano() {
+		return fmt.Errorf("beacon of %s replayed", utils.APex2(b.Address))
+	}
+	d.timestamps[b.Address] = b.Timestamp
+	ua := &net.UDPAddr{IP: b.IP, Port: b.Port}
+	if _, err = d.udp.getHostPort(b.Address); err != nil {
+		d.log.Info(fmt.Sprintf("mesh discovery found %s at %s, device type %s", utils.APex2(b.Address), ua, b.DeviceType))
+	}
+	d.udp.setDiscoveredHostPort(b.Address, ua, b.DeviceType, d.now())
+	return nil
+}
+
+/*
+expire 删除 params.MeshDiscoveryExpiration 内没有收到信标的节点.
+节点删除以后仍然保留它的 timestamp, 否则重放它最后的信标就可以再次加入, 只有已经太旧的 timestamp 才会删除.
+*/
+/*
+ *	expire : remove nodes without beacons for params.MeshDiscoveryExpiration.
+ *	Timestamp of a node removed is kept, otherwise it's added again by replaying its last beacon, only timestamps too old are deleted.
+ */
+func (d *MeshDiscovery) expire() {
+	deadline := d.now().Add(-params.MeshDiscoveryExpiration)
+	expired := d.udp.expireDiscoveredNodes(deadline)
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for _, addr := range expired {
+		d.log.Info(fmt.Sprintf("mesh discovery lost %s", utils.APex2(addr)))
+	}
+	for addr, timestamp := range d.timestamps {
+		//beacons not newer than it are too old to be accepted
+		if timestamp < deadline.UnixNano() {
+			delete(d.timestamps, addr)
+		}
+	}
+}
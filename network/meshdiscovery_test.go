@@ -0,0 +1,180 @@
+package network
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/SmartMeshFoundation/Atmosphere/params"
+	"github.com/SmartMeshFoundation/Atmosphere/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestMeshDiscovery(t *testing.T, now *time.Time) *MeshDiscovery {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	udp := MakeTestUDPTransport(utils.RandomString(10), randomPort())
+	d, err := NewMeshDiscovery(key, DeviceTypeOther, udp, params.DefaultMeshDiscoveryAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.now = func() time.Time {
+		return *now
+	}
+	return d
+}
+
+func TestMeshBeacon(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	b := &meshBeacon{
+		Address:    crypto.PubkeyToAddress(key.PublicKey),
+		IP:         net.ParseIP("192.168.1.10"),
+		Port:       40001,
+		Timestamp:  time.Now().UnixNano(),
+		DeviceType: DeviceTypeMobile,
+	}
+	data, err := b.sign(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b2, err := unpackMeshBeacon(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.EqualValues(t, b.Address, b2.Address)
+	assert.True(t, b.IP.Equal(b2.IP))
+	assert.EqualValues(t, b.Port, b2.Port)
+	assert.EqualValues(t, b.Timestamp, b2.Timestamp)
+	assert.EqualValues(t, b.DeviceType, b2.DeviceType)
+	//tampered
+	data[41]++
+	_, err = unpackMeshBeacon(data)
+	assert.NotNil(t, err)
+	//signed by others
+	key2, _ := crypto.GenerateKey()
+	data, err = b.sign(key2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = unpackMeshBeacon(data)
+	assert.NotNil(t, err)
+	_, err = unpackMeshBeacon([]byte("ATMB"))
+	assert.Equal(t, errInvalidBeacon, err)
+}
+
+func TestMeshDiscoveryHandleBeacon(t *testing.T) {
+	now := time.Now()
+	d1 := newTestMeshDiscovery(t, &now)
+	d2 := newTestMeshDiscovery(t, &now)
+	defer d1.udp.Stop()
+	defer d2.udp.Stop()
+	ip := net.ParseIP("192.168.1.10")
+	d2.localIP = func() (net.IP, error) {
+		return ip, nil
+	}
+	data, err := d2.newBeacon()
+	if err != nil {
+		t.Fatal(err)
+	}
+	//our own beacon
+	err = d2.handleBeacon(data)
+	assert.Nil(t, err)
+	_, err = d2.udp.getHostPort(d2.address)
+	assert.NotNil(t, err)
+	//the ip signed is used
+	err = d1.handleBeacon(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ua, err := d1.udp.getHostPort(d2.address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, ua.IP.Equal(ip))
+	assert.EqualValues(t, d2.udp.UAddr.Port, ua.Port)
+	deviceType, online := d1.udp.NodeStatus(d2.address)
+	assert.True(t, online)
+	assert.EqualValues(t, DeviceTypeOther, deviceType)
+	//replayed
+	err = d1.handleBeacon(data)
+	assert.NotNil(t, err)
+	//too old
+	d3 := newTestMeshDiscovery(t, &now)
+	defer d3.udp.Stop()
+	old := now
+	now = now.Add(-params.MeshDiscoveryExpiration - time.Second)
+	data, err = d3.newBeacon()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now = old
+	err = d1.handleBeacon(data)
+	assert.NotNil(t, err)
+	//unspecified ip
+	d3.localIP = func() (net.IP, error) {
+		return net.IPv4zero, nil
+	}
+	data, err = d3.newBeacon()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d1.handleBeacon(data)
+	assert.Equal(t, errInvalidBeacon, err)
+	//nodes set manually take precedence
+	manual := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+	d1.udp.setHostPort(map[common.Address]*net.UDPAddr{d2.address: manual})
+	now = now.Add(time.Second)
+	data, err = d2.newBeacon()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d1.handleBeacon(data)
+	assert.Nil(t, err)
+	ua, err = d1.udp.getHostPort(d2.address)
+	assert.Nil(t, err)
+	assert.EqualValues(t, manual, ua)
+}
+
+func TestMeshDiscoveryExpire(t *testing.T) {
+	now := time.Now()
+	d1 := newTestMeshDiscovery(t, &now)
+	d2 := newTestMeshDiscovery(t, &now)
+	defer d1.udp.Stop()
+	defer d2.udp.Stop()
+	data, err := d2.newBeacon()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d1.handleBeacon(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(params.MeshDiscoveryExpiration / 2)
+	d1.expire()
+	_, err = d1.udp.getHostPort(d2.address)
+	assert.Nil(t, err)
+	now = now.Add(params.MeshDiscoveryExpiration)
+	d1.expire()
+	_, err = d1.udp.getHostPort(d2.address)
+	assert.NotNil(t, err)
+	_, online := d1.udp.NodeStatus(d2.address)
+	assert.False(t, online)
+	//its last beacon replayed
+	err = d1.handleBeacon(data)
+	assert.NotNil(t, err)
+	//found again by a new beacon
+	data, err = d2.newBeacon()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d1.handleBeacon(data)
+	assert.Nil(t, err)
+	//timestamps too old are deleted
+	now = now.Add(params.MeshDiscoveryExpiration * 2)
+	d1.expire()
+	assert.Empty(t, d1.timestamps)
+}
@@ -142,7 +142,9 @@ type PhotonProtocol struct {
 	quitChan chan struct{}
 	//receive data
 	receiveChan chan []byte
-	log         log.Logger
+	//nil if mesh discovery is not started
+	meshDiscovery *MeshDiscovery
+	log           log.Logger
 }
 
 // NewPhotonProtocol create PhotonProtocol
@@ -232,6 +234,10 @@ func (p *PhotonProtocol) messageCanBeSent(msg encoding.Messager, channelIdentifi
 			return false
 		}
 	}
+	if m, ok := msg.(*encoding.ChannelAnnouncement); ok && m.Expired(time.Now()) {
+		p.log.Trace(fmt.Sprintf("%s cannot be send because it's expired", m))
+		return false
+	}
 	return true
 }
 
@@ -527,6 +533,9 @@ func (p *PhotonProtocol) StopAndWait() {
 	p.log.Info("PhotonProtocol stop...")
 	p.onStop = true
 	close(p.quitChan)
+	if p.meshDiscovery != nil {
+		p.meshDiscovery.Stop()
+	}
 	p.Transport.StopAccepting()
 	//what about the outgoing packets, maybe lost
 	p.Transport.Stop()
@@ -566,12 +575,46 @@ func (p *PhotonProtocol) UpdateMeshNetworkNodes(nodes []*NodeInfo) error {
 		}
 		nodesmap[addr] = ua
 	}
-	if transport, ok := p.Transport.(*MixTransport); ok {
-		transport.udp.setHostPort(nodesmap)
-	} else if transport, ok := p.Transport.(*UDPTransport); ok {
-		transport.setHostPort(nodesmap)
-	} else {
+	udp := p.udpTransport()
+	if udp == nil {
 		return errors.New("no need to register nodes while udp doesn't work")
 	}
+	udp.setHostPort(nodesmap)
+	return nil
+}
+
+//udpTransport returns the UDPTransport used by protocol, nil if udp doesn't work
+func (p *PhotonProtocol) udpTransport() *UDPTransport {
+	switch transport := p.Transport.(type) {
+	case *MixTransport:
+		return transport.udp
+	case *MatrixMixTransport:
+		return transport.udp
+	case *UDPTransport:
+		return transport
+	}
+	return nil
+}
+
+/*
+StartMeshDiscovery 在局域网中发送我们的信标, 并且自动发现其他节点, group 是组播组或者广播地址.
+*/
+/*
+ *	StartMeshDiscovery : send our beacons in the LAN and find other nodes automatically, group is a multicast group or broadcast address.
+ */
+func (p *PhotonProtocol) StartMeshDiscovery(group string, deviceType string) error {
+	udp := p.udpTransport()
+	if udp == nil {
+		return errors.New("mesh discovery needs udp")
+	}
+	d, err := NewMeshDiscovery(p.privKey, deviceType, udp, group)
+	if err != nil {
+		return err
+	}
+	err = d.Start()
+	if err != nil {
+		return err
+	}
+	p.meshDiscovery = d
 	return nil
 }
@@ -56,6 +56,10 @@ type BlockChainService struct {
 	addressChannels map[common.Address]*TokenNetworkProxy
 	//Auth needs by call on blockchain todo remove this
 	Auth *bind.TransactOpts
+	//nonceLock 保证同时发送的交易不会用同一个 nonce
+	// nonceLock makes sure txs sent concurrently never share a nonce
+	nonceLock sync.Mutex
+	nextNonce uint64 //nonce of the next tx, 0 if unknown
 }
 
 //NewBlockChainService create BlockChainService
@@ -166,6 +170,52 @@ func (bcs *BlockChainService) blockNumber() (num *big.Int, err error) {
 func (bcs *BlockChainService) nonce(account common.Address) (uint64, error) {
 	return bcs.Client.PendingNonceAt(context.Background(), account)
 }
+
+/*
+sendTx 给这个交易分配下一个 nonce 并发送, 所有的交易都应该通过这里发送.
+节点的 pending nonce 可能还不包含刚刚发出的交易, 所以取它和上一个分配的 nonce+1 中较大的一个.
+发送的时候一直持有锁, 发送失败的 nonce 会分配给下一个交易, 中间不会出现空洞.
+gasPrice 为 nil 时使用默认的 gas price.
+*/
+/*
+ *	sendTx : allocate the next nonce for this tx and send it, all txs should be sent here.
+ *	Pending nonce of the node may not include txs just sent, so the larger one of it and the last allocated nonce+1 is used.
+ *	The lock is held while sending, nonce of a tx failed to send is allocated to the next one, so there is no gap.
+ *	Default gas price is used if gasPrice is nil.
+ */
+func (bcs *BlockChainService) sendTx(gasPrice *big.Int, send func(auth *bind.TransactOpts) (*types.Transaction, error)) (tx *types.Transaction, err error) {
+	bcs.nonceLock.Lock()
+	defer bcs.nonceLock.Unlock()
+	nonce, err := bcs.nonce(bcs.NodeAddress)
+	if err != nil {
+		return
+	}
+	if nonce < bcs.nextNonce {
+		nonce = bcs.nextNonce
+	}
+	auth := *bcs.Auth
+	auth.Nonce = new(big.Int).SetUint64(nonce)
+	if gasPrice != nil {
+		auth.GasPrice = gasPrice
+	}
+	tx, err = send(&auth)
+	if err != nil {
+		//有可能是别的程序用这个账户发送了交易, 下次以节点的为准
+		// maybe txs are sent by other programs with this account, trust the node next time
+		bcs.nextNonce = 0
+		return
+	}
+	bcs.nextNonce = nonce + 1
+	return
+}
+
+//replaceTx send a tx replacing the one sent with this nonce, it doesn't allocate a new nonce
+func (bcs *BlockChainService) replaceTx(nonce uint64, gasPrice *big.Int, send func(auth *bind.TransactOpts) (*types.Transaction, error)) (tx *types.Transaction, err error) {
+	auth := *bcs.Auth
+	auth.Nonce = new(big.Int).SetUint64(nonce)
+	auth.GasPrice = gasPrice
+	return send(&auth)
+}
 func (bcs *BlockChainService) balance(account common.Address) (*big.Int, error) {
 	return bcs.Client.PendingBalanceAt(context.Background(), account)
 }
@@ -0,0 +1,41 @@
+package fee
+
+import (
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+/*
+PathCost 从 target 收到的金额开始, 倒着计算路径上每个中间节点的手续费.
+每个中间节点按照它要转出的金额收费(固定费用+比例费用, 由 charger 根据该节点的 FeeSetting 计算),
+它收到的金额就是转出金额加上手续费, 所以越靠前的节点收费基数越大.
+返回发起方需要发出的准确金额以及每个中间节点的手续费.
+*/
+/*
+ *	PathCost : calculate fee of every mediator on the path backwards from the amount target receives.
+ *	Every mediator charges on the amount it sends on(constant fee + percent fee of its FeeSetting, calculated by charger),
+ *	so it receives the amount it sends plus its fee, and fee of earlier mediators is compounded.
+ *	It returns the exact amount the initiator must send and fee of every mediator.
+ *
+ *	mediators are ordered from initiator to target, neither the initiator nor the target is included.
+ */
+func PathCost(charger Charger, tokenAddress common.Address, mediators []common.Address, targetAmount *big.Int) (amount *big.Int, fees []*big.Int) {
+	amount = new(big.Int).Set(targetAmount)
+	fees = make([]*big.Int, len(mediators))
+	for i := len(mediators) - 1; i >= 0; i-- {
+		fee := charger.GetNodeChargeFee(mediators[i], tokenAddress, amount)
+		if fee == nil || fee.Sign() < 0 {
+			fee = new(big.Int)
+		}
+		fees[i] = new(big.Int).Set(fee)
+		amount.Add(amount, fee)
+	}
+	return
+}
+
+//TotalFee returns the sum of all mediators fee on the path, it's the amount initiator sends minus targetAmount.
+func TotalFee(charger Charger, tokenAddress common.Address, mediators []common.Address, targetAmount *big.Int) *big.Int {
+	amount, _ := PathCost(charger, tokenAddress, mediators, targetAmount)
+	return amount.Sub(amount, targetAmount)
+}
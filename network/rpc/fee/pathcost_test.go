@@ -0,0 +1,59 @@
+package fee
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+//settingCharger every node charges constant + amount/percent
+type settingCharger map[common.Address][2]int64
+
+func (c settingCharger) GetNodeChargeFee(nodeAddress, tokenAddress common.Address, amount *big.Int) *big.Int {
+	s := c[nodeAddress]
+	fee := new(big.Int)
+	if s[1] > 0 {
+		fee.Div(amount, big.NewInt(s[1]))
+	}
+	return fee.Add(fee, big.NewInt(s[0]))
+}
+
+func TestPathCost(t *testing.T) {
+	a, b, c := common.Address{1}, common.Address{2}, common.Address{3}
+	charger := settingCharger{
+		a: {1, 1000},
+		b: {0, 100},
+		c: {5, 0},
+	}
+	//100 tokens with 18 decimals, doesn't fit in int64
+	targetAmount, _ := new(big.Int).SetString("100000000000000000000", 0)
+	amount, fees := PathCost(charger, common.Address{}, []common.Address{a, b, c}, targetAmount)
+	//c charges on 100e18, b charges on what c receives, a charges on what b receives
+	feeC := big.NewInt(5)
+	amountC := new(big.Int).Add(targetAmount, feeC)
+	feeB := new(big.Int).Div(amountC, big.NewInt(100))
+	amountB := new(big.Int).Add(amountC, feeB)
+	feeA := new(big.Int).Add(new(big.Int).Div(amountB, big.NewInt(1000)), big.NewInt(1))
+	amountA := new(big.Int).Add(amountB, feeA)
+	if amount.Cmp(amountA) != 0 {
+		t.Fatalf("expect amount %s,got %s", amountA, amount)
+	}
+	for i, f := range []*big.Int{feeA, feeB, feeC} {
+		if fees[i].Cmp(f) != 0 {
+			t.Fatalf("fee of hop %d expect %s,got %s", i, f, fees[i])
+		}
+	}
+	total := TotalFee(charger, common.Address{}, []common.Address{a, b, c}, targetAmount)
+	if total.Cmp(new(big.Int).Sub(amountA, targetAmount)) != 0 {
+		t.Fatalf("wrong total fee %s", total)
+	}
+	if targetAmount.String() != "100000000000000000000" {
+		t.Fatalf("targetAmount should not be changed")
+	}
+	//direct transfer,no fee
+	amount, fees = PathCost(charger, common.Address{}, nil, targetAmount)
+	if amount.Cmp(targetAmount) != 0 || len(fees) != 0 {
+		t.Fatalf("no mediators,expect no fee,got %s", amount)
+	}
+}
@@ -3,7 +3,9 @@ package rpc
 import (
 	"errors"
 	"fmt"
+	"math/big"
 	"sync"
+	"time"
 
 	"github.com/SmartMeshFoundation/Atmosphere/contracts"
 	"github.com/SmartMeshFoundation/Atmosphere/log"
@@ -21,6 +23,25 @@ type SecretRegistryProxy struct {
 	contract        *contracts.SecretRegistry
 	lock            sync.Mutex
 	registryLockMap map[common.Hash]*sync.Mutex
+	batchChecked    bool
+	batchSupported  bool
+}
+
+//SecretRegisterResult result of one tx registering secrets on chain
+type SecretRegisterResult struct {
+	Secrets  []common.Hash
+	TxHash   common.Hash
+	GasUsed  uint64
+	GasPrice *big.Int
+	Err      error
+}
+
+//Cost returns gas fee paid for this tx
+func (r *SecretRegisterResult) Cost() *big.Int {
+	if r.GasPrice == nil {
+		return big.NewInt(0)
+	}
+	return new(big.Int).Mul(r.GasPrice, new(big.Int).SetUint64(r.GasUsed))
 }
 
 //RegisterSecret register secret on chain 有可能被重复调用,但是保证不会并发注册同一个密码
@@ -43,7 +64,9 @@ func (s *SecretRegistryProxy) RegisterSecret(secret common.Hash) (err error) {
 		err = fmt.Errorf("ContractCall -> secret %s,secret hash=%s  already registered", secret.String(), utils.ShaSecret(secret[:]).String())
 		return
 	}
-	tx, err := s.contract.RegisterSecret(s.bcs.Auth, secret)
+	tx, err := s.bcs.sendTx(nil, func(auth *bind.TransactOpts) (*types.Transaction, error) {
+		return s.contract.RegisterSecret(auth, secret)
+	})
 	if err != nil {
 		return err
 	}
@@ -60,6 +83,217 @@ func (s *SecretRegistryProxy) RegisterSecret(secret common.Hash) (err error) {
 	return nil
 }
 
+/*
+SupportBatch 合约是否支持在一个交易中注册多个密码, 通过调用一次空的 registerSecretBatch 来判断, 结果会缓存下来.
+已经部署的旧合约没有这个方法.
+*/
+// SupportBatch : whether contract supports registering many secrets in one tx, it's checked by calling registerSecretBatch with nothing and cached.
+// Old contracts deployed don't have this method.
+func (s *SecretRegistryProxy) SupportBatch() bool {
+	s.lock.Lock()
+	checked, supported := s.batchChecked, s.batchSupported
+	s.lock.Unlock()
+	if checked {
+		return supported
+	}
+	//检查的时候不能持有 s.lock, 否则 RegisterSecret 也要等这个 rpc 调用
+	// s.lock must not be held while checking, otherwise RegisterSecret has to wait for this rpc call too
+	c := &contracts.SecretRegistryCallerRaw{Contract: &s.contract.SecretRegistryCaller}
+	var ok bool
+	err := c.Call(&bind.CallOpts{From: s.bcs.NodeAddress}, &ok, "registerSecretBatch", [][32]byte{})
+	if err != nil {
+		log.Info(fmt.Sprintf("secret registry %s doesn't support registerSecretBatch, err %s", s.Address.String(), err))
+		//连接错误的时候下次再检查
+		// check again next time if it's a connection error
+		connected := s.bcs.IsConnected()
+		s.lock.Lock()
+		s.batchChecked = connected
+		s.lock.Unlock()
+		return false
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.batchChecked = true
+	s.batchSupported = true
+	return true
+}
+
+/*
+SecretRegisterTx 一个已经发送的注册密码的交易, 在打包之前可以用同样的 nonce 和更高的 gas price 替换.
+*/
+/*
+ *	SecretRegisterTx : a tx registering secrets sent to chain,
+ *	it can be replaced by a tx with the same nonce and a higher gas price before mined.
+ */
+type SecretRegisterTx struct {
+	Secrets []common.Hash
+	Nonce   uint64
+	batch   bool
+	lock    sync.Mutex
+	sent    map[common.Hash]*big.Int //every tx sent with this nonce -> its gas price
+	latest  common.Hash
+}
+
+//Latest returns hash and gas price of the latest tx sent with this nonce
+func (t *SecretRegisterTx) Latest() (txHash common.Hash, gasPrice *big.Int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.latest, t.sent[t.latest]
+}
+
+func (t *SecretRegisterTx) addSent(tx *types.Transaction) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.sent[tx.Hash()] = tx.GasPrice()
+	t.latest = tx.Hash()
+}
+
+func (t *SecretRegisterTx) allSent() map[common.Hash]*big.Int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	m := make(map[common.Hash]*big.Int)
+	for h, p := range t.sent {
+		m[h] = p
+	}
+	return m
+}
+
+/*
+SendSecrets 使用指定的 gas price 发送注册密码的交易, 已经注册过的密码会被跳过.
+合约支持的话在一个交易中全部注册, 否则每个密码一个交易, 这些交易一起发出, 而不是等一个打包以后再发下一个.
+某个交易发送失败以后, 后面的密码都不再发送, 节点多半也会拒绝它们.
+返回发送成功的交易, 以及没有发送成功的密码的结果.
+*/
+/*
+ *	SendSecrets : send txs registering secrets with gasPrice, secrets already registered are skipped.
+ *	All of them are registered in one tx if contract supports, otherwise one tx for every secret,
+ *	these txs are sent together instead of waiting for one mined before sending the next.
+ *	Once a tx fails to send, secrets after it are not sent either, the node is likely to refuse them too.
+ *	Txs sent and results of secrets not sent are returned.
+ */
+func (s *SecretRegistryProxy) SendSecrets(secrets []common.Hash, gasPrice *big.Int) (txs []*SecretRegisterTx, failed []*SecretRegisterResult) {
+	var toRegister []common.Hash
+	for _, secret := range secrets {
+		registered, err := s.IsSecretRegistered(secret)
+		if err == nil && registered {
+			log.Info(fmt.Sprintf("secret %s already registered", utils.HPex(secret)))
+			continue
+		}
+		toRegister = append(toRegister, secret)
+	}
+	if len(toRegister) == 0 {
+		return
+	}
+	var groups [][]common.Hash
+	batch := len(toRegister) > 1 && s.SupportBatch()
+	if batch {
+		groups = append(groups, toRegister)
+	} else {
+		for _, secret := range toRegister {
+			groups = append(groups, []common.Hash{secret})
+		}
+	}
+	for i, group := range groups {
+		t := &SecretRegisterTx{
+			Secrets: group,
+			batch:   batch,
+			sent:    make(map[common.Hash]*big.Int),
+		}
+		err := s.sendSecretRegisterTx(t, gasPrice)
+		if err != nil {
+			var rest []common.Hash
+			for _, g := range groups[i:] {
+				rest = append(rest, g...)
+			}
+			failed = append(failed, &SecretRegisterResult{Secrets: rest, GasPrice: gasPrice, Err: err})
+			return
+		}
+		txs = append(txs, t)
+	}
+	return
+}
+
+/*
+ReplaceSecretRegisterTx 用同样的 nonce 和更高的 gas price 重新发送这个交易, 让它更快被打包.
+原来的交易已经打包的时候会失败, 这时候继续等待就可以了.
+*/
+/*
+ *	ReplaceSecretRegisterTx : send this tx again with the same nonce and a higher gas price, so that it's mined sooner.
+ *	It fails when the former one has been mined, just go on waiting then.
+ */
+func (s *SecretRegistryProxy) ReplaceSecretRegisterTx(t *SecretRegisterTx, gasPrice *big.Int) error {
+	tx, err := s.bcs.replaceTx(t.Nonce, gasPrice, func(auth *bind.TransactOpts) (*types.Transaction, error) {
+		return s.registerSecrets(auth, t)
+	})
+	if err != nil {
+		return err
+	}
+	t.addSent(tx)
+	return nil
+}
+
+//sendSecretRegisterTx send t the first time with the next nonce
+func (s *SecretRegistryProxy) sendSecretRegisterTx(t *SecretRegisterTx, gasPrice *big.Int) error {
+	tx, err := s.bcs.sendTx(gasPrice, func(auth *bind.TransactOpts) (*types.Transaction, error) {
+		t.Nonce = auth.Nonce.Uint64()
+		return s.registerSecrets(auth, t)
+	})
+	if err != nil {
+		return err
+	}
+	t.addSent(tx)
+	return nil
+}
+
+func (s *SecretRegistryProxy) registerSecrets(auth *bind.TransactOpts, t *SecretRegisterTx) (*types.Transaction, error) {
+	if t.batch {
+		var ss [][32]byte
+		for _, secret := range t.Secrets {
+			ss = append(ss, secret)
+		}
+		log.Trace(fmt.Sprintf("ContractCall -> RegisterSecretBatch %d secrets on chain,nonce=%d,gasPrice=%s", len(ss), t.Nonce, auth.GasPrice))
+		return s.contract.RegisterSecretBatch(auth, ss)
+	}
+	log.Trace(fmt.Sprintf("ContractCall -> RegisterSecret %s on chain,nonce=%d,gasPrice=%s", utils.HPex(t.Secrets[0]), t.Nonce, auth.GasPrice))
+	return s.contract.RegisterSecret(auth, t.Secrets[0])
+}
+
+/*
+WaitSecretRegisterTx 等待这个 nonce 上发送的任何一个交易被打包, 返回被打包的那个交易的花费.
+*/
+// WaitSecretRegisterTx : wait until any tx sent with this nonce is mined, cost of the mined one is returned.
+func (s *SecretRegistryProxy) WaitSecretRegisterTx(t *SecretRegisterTx) (r *SecretRegisterResult) {
+	r = &SecretRegisterResult{Secrets: t.Secrets}
+	ctx := GetCallContext()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		for hash, gasPrice := range t.allSent() {
+			receipt, err := s.bcs.Client.TransactionReceipt(ctx, hash)
+			if err != nil || receipt == nil {
+				continue
+			}
+			r.TxHash = hash
+			r.GasPrice = gasPrice
+			r.GasUsed = receipt.GasUsed
+			if receipt.Status != types.ReceiptStatusSuccessful {
+				log.Info(fmt.Sprintf("ContractCall -> RegisterSecret failed tx=%s,receipt=%s", hash.String(), receipt))
+				r.Err = errors.New("ContractCall -> RegisterSecret tx execution failed")
+				return
+			}
+			log.Info(fmt.Sprintf("ContractCall -> RegisterSecret success tx=%s", hash.String()))
+			return
+		}
+		select {
+		case <-ctx.Done():
+			r.TxHash, r.GasPrice = t.Latest()
+			r.Err = ctx.Err()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
 //RegisterSecretAsync 异步注册一个密码
 // RegisterSecretAsync : function to register a secret asynchronously.
 func (s *SecretRegistryProxy) RegisterSecretAsync(secret common.Hash) (result *utils.AsyncResult) {
@@ -52,7 +52,9 @@ func (t *TokenNetworkProxy) depositByApprove(tokenProxy *TokenProxy, participant
 	if err != nil {
 		return
 	}
-	tx, err := t.contract.Deposit(t.bcs.Auth, tokenProxy.Address, participant, partner, amount, uint64(settleTimeout))
+	tx, err := t.bcs.sendTx(nil, func(auth *bind.TransactOpts) (*types.Transaction, error) {
+		return t.contract.Deposit(auth, tokenProxy.Address, participant, partner, amount, uint64(settleTimeout))
+	})
 	if err != nil {
 		return
 	}
@@ -118,7 +120,9 @@ func (t *TokenNetworkProxy) GetChannelParticipantInfo(tokenAddress, participant,
 
 //CloseChannel close channel
 func (t *TokenNetworkProxy) CloseChannel(tokenAddress, partnerAddr common.Address, transferAmount *big.Int, locksRoot common.Hash, nonce uint64, extraHash common.Hash, signature []byte) (err error) {
-	tx, err := t.contract.PrepareSettle(t.bcs.Auth, tokenAddress, partnerAddr, transferAmount, locksRoot, uint64(nonce), extraHash, signature)
+	tx, err := t.bcs.sendTx(nil, func(auth *bind.TransactOpts) (*types.Transaction, error) {
+		return t.contract.PrepareSettle(auth, tokenAddress, partnerAddr, transferAmount, locksRoot, uint64(nonce), extraHash, signature)
+	})
 	if err != nil {
 		return
 	}
@@ -147,7 +151,9 @@ func (t *TokenNetworkProxy) CloseChannelAsync(tokenAddress, partnerAddr common.A
 
 //UpdateBalanceProof update balance proof of partner
 func (t *TokenNetworkProxy) UpdateBalanceProof(tokenAddress, partnerAddr common.Address, transferAmount *big.Int, locksRoot common.Hash, nonce uint64, extraHash common.Hash, signature []byte) (err error) {
-	tx, err := t.contract.UpdateBalanceProof(t.bcs.Auth, tokenAddress, partnerAddr, transferAmount, locksRoot, nonce, extraHash, signature)
+	tx, err := t.bcs.sendTx(nil, func(auth *bind.TransactOpts) (*types.Transaction, error) {
+		return t.contract.UpdateBalanceProof(auth, tokenAddress, partnerAddr, transferAmount, locksRoot, nonce, extraHash, signature)
+	})
 	if err != nil {
 		return
 	}
@@ -177,7 +183,9 @@ func (t *TokenNetworkProxy) UpdateBalanceProofAsync(tokenAddress, partnerAddr co
 
 //Unlock a partner's lock
 func (t *TokenNetworkProxy) Unlock(tokenAddress, partnerAddr common.Address, transferAmount *big.Int, lock *mtree.Lock, proof []byte) (err error) {
-	tx, err := t.contract.Unlock(t.bcs.Auth, tokenAddress, partnerAddr, transferAmount, big.NewInt(lock.Expiration), lock.Amount, lock.LockSecretHash, proof)
+	tx, err := t.bcs.sendTx(nil, func(auth *bind.TransactOpts) (*types.Transaction, error) {
+		return t.contract.Unlock(auth, tokenAddress, partnerAddr, transferAmount, big.NewInt(lock.Expiration), lock.Amount, lock.LockSecretHash, proof)
+	})
 	if err != nil {
 		return
 	}
@@ -206,7 +214,9 @@ func (t *TokenNetworkProxy) UnlockAsync(tokenAddress, partnerAddr common.Address
 
 //SettleChannel settle a channel
 func (t *TokenNetworkProxy) SettleChannel(tokenAddress, p1Addr, p2Addr common.Address, p1Amount, p2Amount *big.Int, p1Locksroot, p2Locksroot common.Hash) (err error) {
-	tx, err := t.contract.Settle(t.bcs.Auth, tokenAddress, p1Addr, p1Amount, p1Locksroot, p2Addr, p2Amount, p2Locksroot)
+	tx, err := t.bcs.sendTx(nil, func(auth *bind.TransactOpts) (*types.Transaction, error) {
+		return t.contract.Settle(auth, tokenAddress, p1Addr, p1Amount, p1Locksroot, p2Addr, p2Amount, p2Locksroot)
+	})
 	if err != nil {
 		return
 	}
@@ -236,9 +246,11 @@ func (t *TokenNetworkProxy) SettleChannelAsync(tokenAddress, p1Addr, p2Addr comm
 //Withdraw  to  a channel
 func (t *TokenNetworkProxy) Withdraw(tokenAddress, p1Addr, p2Addr common.Address, p1Balance,
 	p1Withdraw *big.Int, p1Signature, p2Signature []byte) (err error) {
-	tx, err := t.contract.WithDraw(t.bcs.Auth, tokenAddress, p1Addr, p2Addr, p1Balance, p1Withdraw,
-		p1Signature, p2Signature,
-	)
+	tx, err := t.bcs.sendTx(nil, func(auth *bind.TransactOpts) (*types.Transaction, error) {
+		return t.contract.WithDraw(auth, tokenAddress, p1Addr, p2Addr, p1Balance, p1Withdraw,
+			p1Signature, p2Signature,
+		)
+	})
 	if err != nil {
 		return
 	}
@@ -268,7 +280,9 @@ func (t *TokenNetworkProxy) WithdrawAsync(tokenAddress, p1Addr, p2Addr common.Ad
 
 //PunishObsoleteUnlock  to  a channel
 func (t *TokenNetworkProxy) PunishObsoleteUnlock(tokenAddress, beneficiary, cheater common.Address, lockhash, extraHash common.Hash, cheaterSignature []byte) (err error) {
-	tx, err := t.contract.PunishObsoleteUnlock(t.bcs.Auth, tokenAddress, beneficiary, cheater, lockhash, extraHash, cheaterSignature)
+	tx, err := t.bcs.sendTx(nil, func(auth *bind.TransactOpts) (*types.Transaction, error) {
+		return t.contract.PunishObsoleteUnlock(auth, tokenAddress, beneficiary, cheater, lockhash, extraHash, cheaterSignature)
+	})
 	if err != nil {
 		return
 	}
@@ -297,7 +311,9 @@ func (t *TokenNetworkProxy) PunishObsoleteUnlockAsync(tokenAddress, beneficiary,
 
 //CooperativeSettle  settle  a channel
 func (t *TokenNetworkProxy) CooperativeSettle(tokenAddress, p1Addr, p2Addr common.Address, p1Balance, p2Balance *big.Int, p1Signature, p2Signatue []byte) (err error) {
-	tx, err := t.contract.CooperativeSettle(t.bcs.Auth, tokenAddress, p1Addr, p1Balance, p2Addr, p2Balance, p1Signature, p2Signatue)
+	tx, err := t.bcs.sendTx(nil, func(auth *bind.TransactOpts) (*types.Transaction, error) {
+		return t.contract.CooperativeSettle(auth, tokenAddress, p1Addr, p1Balance, p2Addr, p2Balance, p1Signature, p2Signatue)
+	})
 	if err != nil {
 		return
 	}
@@ -52,7 +52,9 @@ func (t *TokenProxy) Allowance(owner, spender common.Address) (int64, error) {
 // @param _spender The address of the account able to transfer the tokens
 // @param _value The amount of wei to be approved for transfer
 func (t *TokenProxy) Approve(spender common.Address, value *big.Int) (err error) {
-	tx, err := t.contract.Approve(t.bcs.Auth, spender, value)
+	tx, err := t.bcs.sendTx(nil, func(auth *bind.TransactOpts) (*types.Transaction, error) {
+		return t.contract.Approve(auth, spender, value)
+	})
 	if err != nil {
 		return err
 	}
@@ -79,7 +81,9 @@ func (t *TokenProxy) Transfer(spender common.Address, value *big.Int) (err error
 	if err != nil {
 		return
 	}
-	tx, err := t.contract.TransferFrom(t.bcs.Auth, t.bcs.Auth.From, spender, value)
+	tx, err := t.bcs.sendTx(nil, func(auth *bind.TransactOpts) (*types.Transaction, error) {
+		return t.contract.TransferFrom(auth, t.bcs.Auth.From, spender, value)
+	})
 	if err != nil {
 		return err
 	}
@@ -107,7 +111,9 @@ func (t *TokenProxy) TransferAsync(spender common.Address, value *big.Int) (resu
 
 //TransferWithFallback ERC223 TokenFallback
 func (t *TokenProxy) TransferWithFallback(to common.Address, value *big.Int, extraData []byte) (err error) {
-	tx, err := t.contract.Transfer(t.bcs.Auth, to, value, extraData)
+	tx, err := t.bcs.sendTx(nil, func(auth *bind.TransactOpts) (*types.Transaction, error) {
+		return t.contract.Transfer(auth, to, value, extraData)
+	})
 	if err != nil {
 		return err
 	}
@@ -125,7 +131,9 @@ func (t *TokenProxy) TransferWithFallback(to common.Address, value *big.Int, ext
 
 //ApproveAndCall ERC20 extend
 func (t *TokenProxy) ApproveAndCall(spender common.Address, value *big.Int, extraData []byte) (err error) {
-	tx, err := t.contract.ApproveAndCall(t.bcs.Auth, spender, value, extraData)
+	tx, err := t.bcs.sendTx(nil, func(auth *bind.TransactOpts) (*types.Transaction, error) {
+		return t.contract.ApproveAndCall(auth, spender, value, extraData)
+	})
 	if err != nil {
 		return err
 	}
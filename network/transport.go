@@ -131,9 +131,21 @@ type UDPTransport struct {
 	stopped       bool
 	stopReceiving bool //todo use atomic to replace
 	intranetNodes map[common.Address]*net.UDPAddr
-	lock          sync.RWMutex
-	name          string
-	log           log.Logger
+	/*
+		局域网中通过信标自动发现的节点, 手工设置的 intranetNodes 优先.
+	*/
+	// nodes found by beacons in the LAN, intranetNodes set manually take precedence.
+	discoveredNodes map[common.Address]*discoveredNode
+	lock            sync.RWMutex
+	name            string
+	log             log.Logger
+}
+
+//discoveredNode a node found by mesh discovery
+type discoveredNode struct {
+	UAddr      *net.UDPAddr
+	DeviceType string
+	LastSeen   time.Time
 }
 
 //NewUDPTransport create UDPTransport
@@ -143,10 +155,11 @@ func NewUDPTransport(name, host string, port int, protocol ProtocolReceiver, pol
 			IP:   net.ParseIP(host),
 			Port: port,
 		},
-		protocol:      protocol,
-		policy:        policy,
-		log:           log.New("name", name),
-		intranetNodes: make(map[common.Address]*net.UDPAddr),
+		protocol:        protocol,
+		policy:          policy,
+		log:             log.New("name", name),
+		intranetNodes:   make(map[common.Address]*net.UDPAddr),
+		discoveredNodes: make(map[common.Address]*discoveredNode),
 	}
 	return
 }
@@ -236,6 +249,9 @@ func (ut *UDPTransport) getHostPort(addr common.Address) (ua *net.UDPAddr, err e
 	if ok {
 		return
 	}
+	if n, ok := ut.discoveredNodes[addr]; ok {
+		return n.UAddr, nil
+	}
 	err = fmt.Errorf("%s host port not found", utils.APex(addr))
 	return
 }
@@ -245,6 +261,30 @@ func (ut *UDPTransport) setHostPort(nodes map[common.Address]*net.UDPAddr) {
 	ut.intranetNodes = nodes
 }
 
+//setDiscoveredHostPort add or refresh a node found by mesh discovery
+func (ut *UDPTransport) setDiscoveredHostPort(addr common.Address, ua *net.UDPAddr, deviceType string, lastSeen time.Time) {
+	ut.lock.Lock()
+	defer ut.lock.Unlock()
+	ut.discoveredNodes[addr] = &discoveredNode{
+		UAddr:      ua,
+		DeviceType: deviceType,
+		LastSeen:   lastSeen,
+	}
+}
+
+//expireDiscoveredNodes remove discovered nodes not seen after before
+func (ut *UDPTransport) expireDiscoveredNodes(before time.Time) (expired []common.Address) {
+	ut.lock.Lock()
+	defer ut.lock.Unlock()
+	for addr, n := range ut.discoveredNodes {
+		if n.LastSeen.Before(before) {
+			delete(ut.discoveredNodes, addr)
+			expired = append(expired, addr)
+		}
+	}
+	return
+}
+
 //RegisterProtocol register receiver
 func (ut *UDPTransport) RegisterProtocol(proto ProtocolReceiver) {
 	ut.protocol = proto
@@ -254,7 +294,10 @@ func (ut *UDPTransport) RegisterProtocol(proto ProtocolReceiver) {
 func (ut *UDPTransport) Stop() {
 	ut.stopReceiving = true
 	ut.stopped = true
+	ut.lock.Lock()
 	ut.intranetNodes = make(map[common.Address]*net.UDPAddr)
+	ut.discoveredNodes = make(map[common.Address]*discoveredNode)
+	ut.lock.Unlock()
 	if ut.conn != nil {
 		err := ut.conn.Close()
 		if err != nil {
@@ -275,5 +318,8 @@ func (ut *UDPTransport) NodeStatus(addr common.Address) (deviceType string, isOn
 	if _, ok := ut.intranetNodes[addr]; ok {
 		return DeviceTypeOther, true
 	}
+	if n, ok := ut.discoveredNodes[addr]; ok {
+		return n.DeviceType, true
+	}
 	return DeviceTypeOther, false
 }
@@ -0,0 +1,124 @@
+package atmosphere
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"math/big"
+
+	"github.com/SmartMeshFoundation/Atmosphere/encoding"
+	"github.com/SmartMeshFoundation/Atmosphere/encoding/onion"
+	"github.com/SmartMeshFoundation/Atmosphere/log"
+	"github.com/SmartMeshFoundation/Atmosphere/params"
+	"github.com/SmartMeshFoundation/Atmosphere/transfer/mediatedtransfer"
+	"github.com/SmartMeshFoundation/Atmosphere/utils"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+/*
+newOnion 发起方为 event 构造洋葱, 每个中间节点只知道上下家, 要转发的金额和锁的过期块.
+只有路径上的每个节点都公布了支持洋葱路由, 并且手续费是按路径计算出来的时候才使用洋葱, 否则返回 nil, 仍然使用明文的交易.
+*/
+/*
+ *	newOnion : the initiator builds the onion for event, so every mediator only knows its neighbours, the amount to forward and expiration of the lock.
+ *	The onion is used only if every node on the path has announced onion support and the fee is calculated on the path,
+ *	otherwise nil is returned and the cleartext transfer is used.
+ */
+func (rs *Service) newOnion(event *mediatedtransfer.EventSendMediatedTransfer) []byte {
+	path := event.Path
+	//nothing to hide if the receiver is the target
+	if !rs.Config.EnableOnionRouting || len(path) < 2 || len(path) > onion.MaxHops || len(event.PathFees) != len(path)-1 ||
+		path[0] != event.Receiver || path[len(path)-1] != event.Target {
+		return nil
+	}
+	//token swap matches transfers by initiator and target in the message, keep them cleartext
+	if len(rs.SentMediatedTransferListenerMap) > 0 {
+		return nil
+	}
+	for key := range rs.SwapKey2TokenSwap {
+		if key.LockSecretHash == event.LockSecretHash {
+			return nil
+		}
+	}
+	totalFee := new(big.Int)
+	for _, f := range event.PathFees {
+		totalFee.Add(totalFee, f)
+	}
+	if totalFee.Cmp(event.Fee) != 0 {
+		log.Info(fmt.Sprintf("fee of %s is not calculated on the path, use cleartext transfer", utils.HPex(event.LockSecretHash)))
+		return nil
+	}
+	expiration := event.Expiration - int64(len(path)-1)*params.OnionExpirationDelta
+	if expiration-rs.GetBlockNumber() <= int64(params.RevealTimeout) {
+		log.Info(fmt.Sprintf("expiration %d of %s is too short for onion routing, use cleartext transfer", event.Expiration, utils.HPex(event.LockSecretHash)))
+		return nil
+	}
+	route := make([]*ecdsa.PublicKey, len(path))
+	for i, node := range path {
+		route[i] = rs.channelGossip.OnionKey(node)
+		if route[i] == nil {
+			log.Info(fmt.Sprintf("%s doesn't support onion routing, use cleartext transfer", utils.APex2(node)))
+			return nil
+		}
+	}
+	hops := make([]*onion.Hop, len(path))
+	amount := new(big.Int).Set(event.Amount)
+	expiration = event.Expiration
+	for i := range path {
+		if i == len(path)-1 {
+			hops[i] = &onion.Hop{
+				Initiator:  event.Initiator,
+				Amount:     amount,
+				Expiration: expiration,
+			}
+			break
+		}
+		amount = new(big.Int).Sub(amount, event.PathFees[i])
+		expiration -= params.OnionExpirationDelta
+		hops[i] = &onion.Hop{
+			NextHop:    path[i+1],
+			Amount:     amount,
+			Expiration: expiration,
+		}
+	}
+	packet, err := onion.NewPacket(route, hops, event.LockSecretHash[:])
+	if err != nil {
+		log.Error(fmt.Sprintf("build onion for %s err %s", utils.HPex(event.LockSecretHash), err))
+		return nil
+	}
+	return packet
+}
+
+/*
+peelOnion 解开收到的洋葱, 返回我们知道的发起方和接收方.
+如果我们是中间节点, 发起方和接收方都为空, hop 是洋葱指定的下一跳; 如果我们是接收方, hop 为 nil.
+明文的交易直接返回消息中的发起方和接收方.
+*/
+/*
+ *	peelOnion : peel the onion received, returns initiator and target we know.
+ *	If we are a mediator, both of them are empty, and hop is the next hop specified by the onion, hop is nil if we are the target.
+ *	For a cleartext transfer, initiator and target in the message are returned.
+ */
+func (rs *Service) peelOnion(msg *encoding.MediatedTransfer) (hop *mediatedtransfer.OnionHop, initiator, target common.Address, err error) {
+	if !msg.IsOnion() {
+		return nil, msg.Initiator, msg.Target, nil
+	}
+	h, next, err := onion.Peel(rs.PrivateKey, msg.Onion, msg.LockSecretHash[:])
+	if err != nil {
+		return
+	}
+	if h.IsFinal() {
+		if msg.PaymentAmount.Cmp(h.Amount) < 0 || msg.Expiration != h.Expiration {
+			err = fmt.Errorf("onion transfer mismatch, expect amount=%s,expiration=%d,got amount=%s,expiration=%d",
+				h.Amount, h.Expiration, msg.PaymentAmount, msg.Expiration)
+			return
+		}
+		return nil, h.Initiator, rs.NodeAddress, nil
+	}
+	hop = &mediatedtransfer.OnionHop{
+		NextHop:    h.NextHop,
+		Amount:     h.Amount,
+		Expiration: h.Expiration,
+		Onion:      next,
+	}
+	return
+}
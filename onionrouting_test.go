@@ -0,0 +1,158 @@
+package atmosphere
+
+import (
+	"crypto/ecdsa"
+	"math/big"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/SmartMeshFoundation/Atmosphere/encoding"
+	"github.com/SmartMeshFoundation/Atmosphere/params"
+	"github.com/SmartMeshFoundation/Atmosphere/transfer/mediatedtransfer"
+	"github.com/SmartMeshFoundation/Atmosphere/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func newTestOnionService(key *ecdsa.PrivateKey, gossip *channelGossip) *Service {
+	rs := &Service{
+		PrivateKey:        key,
+		NodeAddress:       crypto.PubkeyToAddress(key.PublicKey),
+		Config:            &params.Config{EnableOnionRouting: true},
+		BlockNumber:       new(atomic.Value),
+		SwapKey2TokenSwap: make(map[swapKey]*TokenSwap),
+		channelGossip:     gossip,
+	}
+	rs.BlockNumber.Store(int64(100))
+	return rs
+}
+
+func TestOnionRouting(t *testing.T) {
+	now := time.Now()
+	token := utils.NewRandomAddress()
+	gossip := &channelGossip{
+		enabled:  true,
+		now:      func() time.Time { return now },
+		received: make(map[announcementKey]*encoding.ChannelAnnouncement),
+	}
+	ourKey, _ := crypto.GenerateKey()
+	rs := newTestOnionService(ourKey, gossip)
+	var keys []*ecdsa.PrivateKey
+	var path []common.Address
+	for i := 0; i < 3; i++ {
+		key, _ := crypto.GenerateKey()
+		keys = append(keys, key)
+		path = append(path, crypto.PubkeyToAddress(key.PublicKey))
+	}
+	announce := func(key *ecdsa.PrivateKey, features uint8) {
+		m := encoding.NewChannelAnnouncement(token, utils.NewRandomHash(), utils.NewRandomAddress(), now.Unix(), big.NewInt(1), 0, 10)
+		m.Features = features
+		if err := m.SignAnnouncement(key); err != nil {
+			t.Fatal(err)
+		}
+		gossip.received[announcementKey{m.ChannelIdentifier, m.Announcer}] = m
+	}
+	lockSecretHash := utils.NewRandomHash()
+	event := &mediatedtransfer.EventSendMediatedTransfer{
+		Token:          token,
+		Amount:         big.NewInt(103),
+		LockSecretHash: lockSecretHash,
+		Initiator:      rs.NodeAddress,
+		Target:         path[2],
+		Expiration:     500,
+		Receiver:       path[0],
+		Fee:            big.NewInt(3),
+		Path:           path,
+		PathFees:       []*big.Int{big.NewInt(2), big.NewInt(1)},
+	}
+	//target doesn't support onion routing
+	announce(keys[0], encoding.FeatureOnion)
+	announce(keys[1], encoding.FeatureOnion)
+	announce(keys[2], 0)
+	if rs.newOnion(event) != nil {
+		t.Fatal("target doesn't support onion routing")
+	}
+	now = now.Add(time.Second)
+	announce(keys[2], encoding.FeatureOnion)
+	packet := rs.newOnion(event)
+	if packet == nil {
+		t.Fatal("onion expected")
+	}
+
+	//every node peels its layer
+	msg := &encoding.MediatedTransfer{
+		Expiration:     500,
+		LockSecretHash: lockSecretHash,
+		PaymentAmount:  big.NewInt(103),
+		Fee:            big.NewInt(0),
+		Onion:          packet,
+	}
+	expects := []struct {
+		next       common.Address
+		amount     int64
+		expiration int64
+	}{
+		{path[1], 101, 500 - params.OnionExpirationDelta},
+		{path[2], 100, 500 - params.OnionExpirationDelta*2},
+	}
+	for i, e := range expects {
+		hop, initiator, target, err := newTestOnionService(keys[i], nil).peelOnion(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hop == nil || hop.NextHop != e.next || hop.Amount.Int64() != e.amount || hop.Expiration != e.expiration {
+			t.Fatalf("hop %d wrong %v", i, hop)
+		}
+		if initiator != utils.EmptyAddress || target != utils.EmptyAddress {
+			t.Fatalf("hop %d should not know initiator and target", i)
+		}
+		msg = &encoding.MediatedTransfer{
+			Expiration:     hop.Expiration,
+			LockSecretHash: lockSecretHash,
+			PaymentAmount:  hop.Amount,
+			Fee:            big.NewInt(0),
+			Onion:          hop.Onion,
+		}
+	}
+	targetService := newTestOnionService(keys[2], nil)
+	hop, initiator, target, err := targetService.peelOnion(msg)
+	if err != nil || hop != nil || initiator != rs.NodeAddress || target != path[2] {
+		t.Fatalf("target should know the initiator, err %v", err)
+	}
+	msg.Expiration--
+	if _, _, _, err = targetService.peelOnion(msg); err == nil {
+		t.Fatal("target should reject wrong expiration")
+	}
+	msg.Expiration++
+	msg.PaymentAmount = big.NewInt(99)
+	if _, _, _, err = targetService.peelOnion(msg); err == nil {
+		t.Fatal("target should reject less amount")
+	}
+	if _, _, _, err = newTestOnionService(keys[0], nil).peelOnion(msg); err == nil {
+		t.Fatal("wrong node cannot peel the onion")
+	}
+
+	//fee specified by user
+	event.Fee = big.NewInt(5)
+	if rs.newOnion(event) != nil {
+		t.Fatal("fee is not calculated on the path")
+	}
+	event.Fee = big.NewInt(3)
+	//nothing to hide from the target
+	event2 := *event
+	event2.Path, event2.PathFees, event2.Target, event2.Receiver = path[:1], nil, path[0], path[0]
+	if rs.newOnion(&event2) != nil {
+		t.Fatal("no onion for direct transfer")
+	}
+	//lock expires too soon
+	event.Expiration = rs.GetBlockNumber() + int64(params.OnionExpirationDelta*2+params.RevealTimeout)
+	if rs.newOnion(event) != nil {
+		t.Fatal("expiration too short")
+	}
+	event.Expiration = 500
+	rs.Config.EnableOnionRouting = false
+	if rs.newOnion(event) != nil {
+		t.Fatal("onion routing disabled")
+	}
+}
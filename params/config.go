@@ -2,6 +2,7 @@ package params
 
 import (
 	"crypto/ecdsa"
+	"math/big"
 
 	"time"
 
@@ -61,9 +62,99 @@ type Config struct {
 	IgnoreMediatedNodeRequest bool // true: this node will ignore any mediated transfer who's target is not me.
 	EnableHealthCheck         bool //send ping periodically?
 	XMPPServer                string
-	IsMeshNetwork             bool   //is mesh now?
-	PfsHost                   string // pathfinder server host
+	IsMeshNetwork             bool     //is mesh now?
+	PfsHosts                  []string // pathfinder server hosts, used in order
 	EnableForkConfirm         bool
+	RebalanceThreshold        *big.Int // rebalance a channel automatically when its distributable drops below it, nil means disabled
+	RebalanceMaxFee           *big.Int // max fee we are willing to pay for one rebalance
+	SecretRegisterGasPolicy   GasPricePolicy
+	AutoSettle                bool // true: settle closed channels automatically when settle window ends
+	RevealMarginPolicy        RevealMarginPolicy
+	RoutingHistoryHalfLife    time.Duration // weight of a routing success or failure halves after this duration
+	EnableChannelGossip       bool          // announce fees and capacities of channels to neighbours and use announcements of others when routing
+	ChannelAnnounceInterval   time.Duration // our channels are announced again after this duration even if nothing changes
+	EnableOnionRouting        bool          // hide initiator and target from mediators when all nodes on the route support onion routing
+	EnableMeshDiscovery       bool          // find nodes in the LAN by signed beacons, instead of updating mesh network nodes manually
+	MeshDiscoveryAddress      string        // multicast group or broadcast address of beacons
+}
+
+/*
+GasPricePolicy 在链上注册密码时使用的 gas price.
+锁过期之前 EscalateBlocks 块以外使用 BaseGasPrice, 进入这个范围以后线性增长, 到过期时达到 MaxGasPrice.
+*/
+/*
+ *	GasPricePolicy : gas price used to register secrets on chain.
+ *	BaseGasPrice is used until EscalateBlocks blocks before lock expiration, then it increases linearly and reaches MaxGasPrice at expiration.
+ */
+type GasPricePolicy struct {
+	BaseGasPrice   *big.Int
+	MaxGasPrice    *big.Int
+	EscalateBlocks int64
+}
+
+//GasPrice returns gas price to use when the lock expires after blocksLeft blocks
+func (p *GasPricePolicy) GasPrice(blocksLeft int64) *big.Int {
+	base := p.BaseGasPrice
+	if base == nil {
+		base = big.NewInt(DefaultGasPrice)
+	}
+	if p.MaxGasPrice == nil || p.MaxGasPrice.Cmp(base) <= 0 || p.EscalateBlocks <= 0 || blocksLeft >= p.EscalateBlocks {
+		return new(big.Int).Set(base)
+	}
+	if blocksLeft <= 0 {
+		return new(big.Int).Set(p.MaxGasPrice)
+	}
+	//base + (max-base)*(EscalateBlocks-blocksLeft)/EscalateBlocks
+	x := new(big.Int).Sub(p.MaxGasPrice, base)
+	x.Mul(x, big.NewInt(p.EscalateBlocks-blocksLeft))
+	x.Div(x, big.NewInt(p.EscalateBlocks))
+	return x.Add(x, base)
+}
+
+/*
+RevealMarginPolicy 根据链上状况调整中间节点要求的锁剩余时间.
+出块太慢, 最近和公链的连接断开过, 或者 gas price 太高说明交易拥堵, 都说明在链上注册密码可能会比较慢,
+每出现一种情况就在 RevealTimeout 的基础上多要求 RevealTimeout/2 个块, 最多多要求 MaxExtraBlocks 个块.
+*/
+/*
+ *	RevealMarginPolicy : adjust lock time mediators require according to chain conditions.
+ *	Slow blocks, recent disconnection from eth rpc server, or high gas price caused by congestion indicate registering secret on chain may be slow,
+ *	every condition adds RevealTimeout/2 blocks to RevealTimeout, at most MaxExtraBlocks are added.
+ */
+type RevealMarginPolicy struct {
+	BlockPeriod       time.Duration // expected time between two blocks, blocks are slow if average period is more than twice of it
+	DisconnectWindow  time.Duration // disconnections from eth rpc server in this duration are considered
+	CongestedGasPrice *big.Int      // chain is congested if suggested gas price is higher than it
+	MaxExtraBlocks    int
+}
+
+//ChainConditions recent chain conditions used to decide reveal margin
+type ChainConditions struct {
+	AvgBlockPeriod time.Duration `json:"avg_block_period"` //0 if unknown
+	Disconnects    int           `json:"disconnects"`      //disconnections in DisconnectWindow
+	GasPrice       *big.Int      `json:"gas_price"`        //suggested gas price, nil if unknown
+}
+
+//Margin returns blocks a lock must have before expiration to be forwarded safely, it's never less than revealTimeout
+func (p *RevealMarginPolicy) Margin(revealTimeout int, c *ChainConditions) int {
+	step := revealTimeout / 2
+	if step < 1 {
+		step = 1
+	}
+	extra := 0
+	if p.BlockPeriod > 0 && c.AvgBlockPeriod > 2*p.BlockPeriod {
+		extra += step
+	}
+	if c.Disconnects > 0 {
+		extra += step
+	}
+	if p.CongestedGasPrice != nil && c.GasPrice != nil && c.GasPrice.Cmp(p.CongestedGasPrice) > 0 {
+		extra += step
+	}
+	if extra > p.MaxExtraBlocks {
+		extra = p.MaxExtraBlocks
+	}
+	return revealTimeout + extra
 }
 
 //DefaultConfig default config
@@ -82,6 +173,20 @@ var DefaultConfig = Config{
 	MsgTimeout:        100 * time.Second,
 	EnableHealthCheck: false,
 	XMPPServer:        DefaultXMPPServer,
+	SecretRegisterGasPolicy: GasPricePolicy{
+		BaseGasPrice:   big.NewInt(DefaultGasPrice),
+		MaxGasPrice:    new(big.Int).Mul(big.NewInt(DefaultGasPrice), big.NewInt(DefaultSecretRegisterMaxGasPriceTimes)),
+		EscalateBlocks: DefaultRevealTimeout,
+	},
+	RevealMarginPolicy: RevealMarginPolicy{
+		BlockPeriod:       DefaultBlockPeriod,
+		DisconnectWindow:  DefaultRevealMarginDisconnectWindow,
+		CongestedGasPrice: new(big.Int).Mul(big.NewInt(DefaultGasPrice), big.NewInt(DefaultSecretRegisterMaxGasPriceTimes)),
+		MaxExtraBlocks:    DefaultRevealTimeout,
+	},
+	RoutingHistoryHalfLife:  DefaultRoutingHistoryHalfLife,
+	ChannelAnnounceInterval: DefaultChannelAnnounceInterval,
+	MeshDiscoveryAddress:    DefaultMeshDiscoveryAddress,
 }
 
 //ConditionQuit is for test
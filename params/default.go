@@ -136,6 +136,69 @@ const DefaultPollTimeout = 180 * time.Second
 //DefaultChannelSettleTimeoutMin min settle timeout
 const DefaultChannelSettleTimeoutMin = 6
 
+//DefaultSecretRegisterMaxGasPriceTimes max gas price of registering secret is this times of DefaultGasPrice by default
+const DefaultSecretRegisterMaxGasPriceTimes = 5
+
+//DefaultBlockPeriod expected time between two blocks
+const DefaultBlockPeriod = 15 * time.Second
+
+//DefaultRevealMarginDisconnectWindow disconnections from eth rpc server in this duration make mediators require more lock time
+const DefaultRevealMarginDisconnectWindow = 10 * time.Minute
+
+//RevealMarginBlockSamples number of recent blocks used to compute average block period
+const RevealMarginBlockSamples = 20
+
+//DefaultRoutingHistoryHalfLife weight of a routing success or failure halves after this duration
+const DefaultRoutingHistoryHalfLife = time.Hour
+
+//RoutingHistoryEvents number of recent routing results kept for every channel
+const RoutingHistoryEvents = 20
+
+//DefaultChannelAnnounceInterval our channels are announced again after this duration even if nothing changes
+const DefaultChannelAnnounceInterval = 10 * time.Minute
+
+//ChannelAnnounceMinInterval announcements of one channel are sent or accepted at most once in this duration
+const ChannelAnnounceMinInterval = time.Minute
+
+//ChannelAnnouncementExpiration announcements older than this are neither used nor forwarded
+const ChannelAnnouncementExpiration = 30 * time.Minute
+
+//GossipMaxMessagesPerMinute announcements more than this from one neighbour in a minute are dropped
+const GossipMaxMessagesPerMinute = 600
+
+//OnionExpirationDelta expiration of an onion routed transfer decreases by this number of blocks at each mediator
+const OnionExpirationDelta = DefaultRevealTimeout
+
+//MaxRouteHints max number of route hints a MediatedTransfer can carry
+const MaxRouteHints = 3
+
+//DefaultMeshDiscoveryAddress multicast group where nodes in a LAN send their beacons
+const DefaultMeshDiscoveryAddress = "239.255.42.42:40042"
+
+//MeshDiscoveryInterval our beacon is sent once in this duration
+const MeshDiscoveryInterval = 5 * time.Second
+
+//MeshDiscoveryExpiration a discovered node is removed if no beacon of it is received in this duration
+const MeshDiscoveryExpiration = 30 * time.Second
+
+//DefaultCooperativeSettleTimeout blocks to wait for partner to settle cooperatively before falling back to close
+const DefaultCooperativeSettleTimeout = 20
+
+//PunishBlockNumber blocks after settle timeout reserved for punishment, same as punish_block_number of TokenNetwork
+const PunishBlockNumber = 5
+
+//AutoSettleMaxAttempts give up settling a channel automatically after this many failures
+const AutoSettleMaxAttempts = 5
+
+//DefaultRebalanceCheckInterval blocks between two checks of auto rebalance
+const DefaultRebalanceCheckInterval = 10
+
+//DefaultAutopilotInterval blocks between two runs of autopilot
+const DefaultAutopilotInterval = 20
+
+//StateManagerSnapshotInterval snapshot of a StateManager is saved at least every this number of logged state changes
+const StateManagerSnapshotInterval = 100
+
 /*
 DefaultChannelSettleTimeoutMax The maximum settle timeout is chosen as something above
  1 year with the assumption of very fast block times of 12 seconds.
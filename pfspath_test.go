@@ -0,0 +1,72 @@
+package atmosphere
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/SmartMeshFoundation/Atmosphere/blockchain"
+	"github.com/SmartMeshFoundation/Atmosphere/channel/channeltype"
+	"github.com/SmartMeshFoundation/Atmosphere/network/graph"
+	"github.com/SmartMeshFoundation/Atmosphere/pfsproxy"
+	"github.com/SmartMeshFoundation/Atmosphere/utils"
+	"github.com/SmartMeshFoundation/Atmosphere/utils/utest"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestVerifyPfsPath(t *testing.T) {
+	db, err := newTestDb()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.CloseDB()
+	b, c, d, e := utils.NewRandomAddress(), utils.NewRandomAddress(), utils.NewRandomAddress(), utils.NewRandomAddress()
+	ch := utest.MakeRoute(b, big.NewInt(100), utest.UnitSettleTimeout, utest.UnitRevealTimeout, 0, utils.NewRandomHash()).Channel()
+	token := ch.TokenAddress
+	ch.State = channeltype.StateOpened
+	g := graph.NewChannelGraph(ch.OurState.Address, token, nil)
+	err = g.AddChannel(ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := &Service{
+		db:                 db,
+		NodeAddress:        ch.OurState.Address,
+		Token2ChannelGraph: map[common.Address]*graph.ChannelGraph{token: g},
+	}
+	err = db.NewNonParticipantChannel(token, blockchain.CalcChannelID(token, b, d), d, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name  string
+		path  *pfsproxy.FindPathResponse
+		valid bool
+	}{
+		{"with target", &pfsproxy.FindPathResponse{PathHop: 1, Fee: big.NewInt(1), Result: []string{b.String(), d.String()}}, true},
+		{"mediators only", &pfsproxy.FindPathResponse{PathHop: 1, Fee: big.NewInt(1), Result: []string{b.String()}}, true},
+		{"empty", &pfsproxy.FindPathResponse{PathHop: 0, Fee: big.NewInt(0)}, false},
+		{"no fee", &pfsproxy.FindPathResponse{PathHop: 1, Result: []string{b.String(), d.String()}}, false},
+		{"negative fee", &pfsproxy.FindPathResponse{PathHop: 1, Fee: big.NewInt(-1), Result: []string{b.String(), d.String()}}, false},
+		{"wrong hop", &pfsproxy.FindPathResponse{PathHop: 2, Fee: big.NewInt(1), Result: []string{b.String(), d.String()}}, false},
+		{"not my channel", &pfsproxy.FindPathResponse{PathHop: 1, Fee: big.NewInt(1), Result: []string{c.String(), d.String()}}, false},
+		{"unknown channel", &pfsproxy.FindPathResponse{PathHop: 2, Fee: big.NewInt(1), Result: []string{b.String(), e.String(), d.String()}}, false},
+		{"invalid address", &pfsproxy.FindPathResponse{PathHop: 1, Fee: big.NewInt(1), Result: []string{"0x1234", d.String()}}, false},
+	}
+	for _, c := range cases {
+		err = rs.verifyPfsPath(rs.NodeAddress, d, token, big.NewInt(10), c.path)
+		if (err == nil) != c.valid {
+			t.Errorf("%s expect valid=%v, err=%v", c.name, c.valid, err)
+		}
+	}
+	//channel of another token is not used
+	err = rs.verifyPfsPath(rs.NodeAddress, d, utils.NewRandomAddress(), big.NewInt(10), cases[0].path)
+	if err == nil {
+		t.Error("path of another token should be invalid")
+	}
+	//closed channel is not used
+	ch.State = channeltype.StateClosed
+	err = rs.verifyPfsPath(rs.NodeAddress, d, token, big.NewInt(10), cases[0].path)
+	if err == nil {
+		t.Error("path through closed channel should be invalid")
+	}
+}
@@ -22,6 +22,11 @@ type PfsProxy interface {
 	*/
 	FindPath(peerFrom, peerTo, token common.Address, amount *big.Int) (resp []FindPathResponse, err error)
 
+	/*
+		get nodes of a token and how many channels each of them has
+	*/
+	GetNodes(tokenAddress common.Address) (resp []NodeChannelsResponse, err error)
+
 	/*
 		set fee rate by account
 	*/
@@ -22,6 +22,9 @@ import (
 // ErrNotInit :
 var ErrNotInit = errors.New("pfgClient not init")
 
+// ErrUnavailable : pfs cannot be reached or has an internal error, another pfs should be tried
+var ErrUnavailable = errors.New("pfs unavailable")
+
 /*
 pfsClient :
 */
@@ -73,7 +76,7 @@ type balanceProof struct {
 	Signature         []byte      `json:"signature"`
 }
 
-func (p *submitBalancePayload) sign(key *ecdsa.PrivateKey) []byte {
+func (p *submitBalancePayload) signData() []byte {
 	var err error
 	buf := new(bytes.Buffer)
 	err = binary.Write(buf, binary.BigEndian, p.BalanceProof.Nonce)
@@ -87,7 +90,12 @@ func (p *submitBalancePayload) sign(key *ecdsa.PrivateKey) []byte {
 	if err != nil {
 		log.Error(fmt.Sprintf("signData err %s", err))
 	}
-	p.BalanceSignature, err = utils.SignData(key, buf.Bytes())
+	return buf.Bytes()
+}
+
+func (p *submitBalancePayload) sign(key *ecdsa.PrivateKey) []byte {
+	var err error
+	p.BalanceSignature, err = utils.SignData(key, p.signData())
 	if err != nil {
 		log.Crit(fmt.Sprintf("signDataFor submitBalancePayload err %s", err))
 	}
@@ -120,15 +128,8 @@ func (pfg *pfsClient) SubmitBalance(nonce uint64, transferAmount, lockAmount *bi
 		Payload: marshal(payload),
 		Timeout: time.Second * 10,
 	}
-	statusCode, body, err := req.Invoke()
-	log.Debug(req.ToString())
+	_, err = pfg.invoke("SubmitBalance", req)
 	if err != nil {
-		log.Error("PfgAPI SubmitBalance %s err :%s", req.FullURL, err)
-		return
-	}
-	if statusCode != 200 {
-		err = fmt.Errorf("PfgAPI SubmitBalance %s err : http status=%d body=%s", req.FullURL, statusCode, string(body))
-		log.Error(err.Error())
 		return
 	}
 	return nil
@@ -145,7 +146,7 @@ type findPathPayload struct {
 	Signature    []byte         `json:"signature"`
 }
 
-func (p *findPathPayload) sign(key *ecdsa.PrivateKey) []byte {
+func (p *findPathPayload) signData() []byte {
 	var err error
 	buf := new(bytes.Buffer)
 	_, err = buf.Write(p.PeerFrom[:])
@@ -157,7 +158,12 @@ func (p *findPathPayload) sign(key *ecdsa.PrivateKey) []byte {
 	if err != nil {
 		log.Error(fmt.Sprintf("signData err %s", err))
 	}
-	p.Signature, err = utils.SignData(key, buf.Bytes())
+	return buf.Bytes()
+}
+
+func (p *findPathPayload) sign(key *ecdsa.PrivateKey) []byte {
+	var err error
+	p.Signature, err = utils.SignData(key, p.signData())
 	if err != nil {
 		log.Crit(fmt.Sprintf("signDataFor FindPathPayload err %s", err))
 	}
@@ -172,6 +178,37 @@ type FindPathResponse struct {
 	Result  []string `json:"result"`
 }
 
+// NodeChannelsResponse :
+type NodeChannelsResponse struct {
+	Address  common.Address `json:"address"`
+	Channels int            `json:"channels"`
+}
+
+/*
+GetNodes : nodes of a token and how many open channels each of them has
+*/
+func (pfg *pfsClient) GetNodes(tokenAddress common.Address) (resp []NodeChannelsResponse, err error) {
+	if pfg.host == "" || pfg.privateKey == nil {
+		err = ErrNotInit
+		return
+	}
+	req := &req{
+		FullURL: pfg.host + "/pfs/1/nodes/" + tokenAddress.String(),
+		Method:  http.MethodGet,
+		Timeout: time.Second * 10,
+	}
+	body, err := pfg.invoke("GetNodes", req)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(body, &resp)
+	if err != nil {
+		err = fmt.Errorf("PfgAPI unmarshal response %s err %s", string(body), err)
+		return
+	}
+	return
+}
+
 /*
 FindPath : find path
 */
@@ -195,20 +232,14 @@ func (pfg *pfsClient) FindPath(peerFrom, peerTo, token common.Address, amount *b
 		Payload: marshal(payload),
 		Timeout: time.Second * 10,
 	}
-	statusCode, body, err := req.Invoke()
-	log.Debug(req.ToString())
+	body, err := pfg.invoke("FindPath", req)
 	if err != nil {
-		log.Error("PfgAPI FindPath %s err :%s", req.FullURL, err)
-		return
-	}
-	if statusCode != 200 {
-		err = fmt.Errorf("PfgAPI FindPath %s err : http status=%d body=%s", req.FullURL, statusCode, string(body))
-		log.Error(err.Error())
 		return
 	}
 	err = json.Unmarshal(body, &resp)
 	if err != nil {
-		panic(err)
+		err = fmt.Errorf("PfgAPI unmarshal response %s err %s", string(body), err)
+		return
 	}
 	return
 }
@@ -220,7 +251,7 @@ type setFeePayload struct {
 	Signature   []byte   `json:"signature"`
 }
 
-func (p *setFeePayload) sign(key *ecdsa.PrivateKey) []byte {
+func (p *setFeePayload) signData() []byte {
 	var err error
 	buf := new(bytes.Buffer)
 	err = binary.Write(buf, binary.BigEndian, p.FeePercent)
@@ -228,7 +259,12 @@ func (p *setFeePayload) sign(key *ecdsa.PrivateKey) []byte {
 	if err != nil {
 		log.Error(fmt.Sprintf("signData err %s", err))
 	}
-	p.Signature, err = utils.SignData(key, buf.Bytes())
+	return buf.Bytes()
+}
+
+func (p *setFeePayload) sign(key *ecdsa.PrivateKey) []byte {
+	var err error
+	p.Signature, err = utils.SignData(key, p.signData())
 	if err != nil {
 		log.Crit(fmt.Sprintf("signDataFor SetFeeRatePayload err %s", err))
 	}
@@ -256,15 +292,8 @@ func (pfg *pfsClient) SetFeePolicy(fp *models.FeePolicy) (err error) {
 		Payload: marshal(fp),
 		Timeout: time.Second * 10,
 	}
-	statusCode, body, err := req.Invoke()
-	log.Debug(req.ToString())
+	_, err = pfg.invoke("SetFeePolicy", req)
 	if err != nil {
-		log.Error("PfgAPI SetFeePolicy %s err :%s", req.FullURL, err)
-		return
-	}
-	if statusCode != 200 {
-		err = fmt.Errorf("PfgAPI SetFeePolicy %s err : http status=%d body=%s", req.FullURL, statusCode, string(body))
-		log.Error(err.Error())
 		return
 	}
 	return nil
@@ -288,15 +317,8 @@ func (pfg *pfsClient) SetAccountFee(feeConstant *big.Int, feePercent int64) (err
 		Payload: marshal(payload),
 		Timeout: time.Second * 10,
 	}
-	statusCode, body, err := req.Invoke()
-	log.Debug(req.ToString())
+	_, err = pfg.invoke("SetAccountFeeRate", req)
 	if err != nil {
-		log.Error("PfgAPI SetAccountFeeRate %s err :%s", req.FullURL, err)
-		return
-	}
-	if statusCode != 200 {
-		err = fmt.Errorf("PfgAPI SetAccountFeeRate %s err : http status=%d body=%s", req.FullURL, statusCode, string(body))
-		log.Error(err.Error())
 		return
 	}
 	return nil
@@ -315,21 +337,15 @@ func (pfg *pfsClient) GetAccountFee() (feeConstant *big.Int, feePercent int64, e
 		Method:  http.MethodGet,
 		Timeout: time.Second * 10,
 	}
-	statusCode, body, err := req.Invoke()
-	log.Debug(req.ToString())
+	body, err := pfg.invoke("GetAccountFee", req)
 	if err != nil {
-		log.Error("PfgAPI GetAccountFee %s err :%s", req.FullURL, err)
-		return
-	}
-	if statusCode != 200 {
-		err = fmt.Errorf("PfgAPI GetAccountFee %s err : http status=%d body=%s", req.FullURL, statusCode, string(body))
-		log.Error(err.Error())
 		return
 	}
 	var resp getFeeResponse
 	err = json.Unmarshal(body, &resp)
 	if err != nil {
-		panic(err)
+		err = fmt.Errorf("PfgAPI unmarshal response %s err %s", string(body), err)
+		return
 	}
 	return resp.FeeConstant, resp.FeePercent, nil
 }
@@ -352,15 +368,8 @@ func (pfg *pfsClient) SetTokenFee(feeConstant *big.Int, feePercent int64, tokenA
 		Payload: marshal(payload),
 		Timeout: time.Second * 10,
 	}
-	statusCode, body, err := req.Invoke()
-	log.Debug(req.ToString())
+	_, err = pfg.invoke("SetTokenFee", req)
 	if err != nil {
-		log.Error("PfgAPI SetTokenFee %s err :%s", req.FullURL, err)
-		return
-	}
-	if statusCode != 200 {
-		err = fmt.Errorf("PfgAPI SetTokenFee %s err : http status=%d body=%s", req.FullURL, statusCode, string(body))
-		log.Error(err.Error())
 		return
 	}
 	return nil
@@ -379,21 +388,15 @@ func (pfg *pfsClient) GetTokenFee(tokenAddress common.Address) (feeConstant *big
 		Method:  http.MethodGet,
 		Timeout: time.Second * 10,
 	}
-	statusCode, body, err := req.Invoke()
-	log.Debug(req.ToString())
+	body, err := pfg.invoke("GetTokenFee", req)
 	if err != nil {
-		log.Error("PfgAPI GetTokenFee %s err :%s", req.FullURL, err)
-		return
-	}
-	if statusCode != 200 {
-		err = fmt.Errorf("PfgAPI GetTokenFee %s err : http status=%d body=%s", req.FullURL, statusCode, string(body))
-		log.Error(err.Error())
 		return
 	}
 	var resp getFeeResponse
 	err = json.Unmarshal(body, &resp)
 	if err != nil {
-		panic(err)
+		err = fmt.Errorf("PfgAPI unmarshal response %s err %s", string(body), err)
+		return
 	}
 	return resp.FeeConstant, resp.FeePercent, nil
 }
@@ -416,15 +419,8 @@ func (pfg *pfsClient) SetChannelFee(feeConstant *big.Int, feePercent int64, chan
 		Payload: marshal(payload),
 		Timeout: time.Second * 10,
 	}
-	statusCode, body, err := req.Invoke()
-	log.Debug(req.ToString())
+	_, err = pfg.invoke("SetChannelFee", req)
 	if err != nil {
-		log.Error("PfgAPI SetChannelFee %s err :%s", req.FullURL, err)
-		return
-	}
-	if statusCode != 200 {
-		err = fmt.Errorf("PfgAPI SetChannelFee %s err : http status=%d body=%s", req.FullURL, statusCode, string(body))
-		log.Error(err.Error())
 		return
 	}
 	return nil
@@ -443,25 +439,45 @@ func (pfg *pfsClient) GetChannelFee(channelIdentifier common.Hash) (feeConstant
 		Method:  http.MethodGet,
 		Timeout: time.Second * 10,
 	}
-	statusCode, body, err := req.Invoke()
-	log.Debug(req.ToString())
+	body, err := pfg.invoke("GetChannelFee", req)
 	if err != nil {
-		log.Error("PfgAPI GetChannelFee %s err :%s", req.FullURL, err)
-		return
-	}
-	if statusCode != 200 {
-		err = fmt.Errorf("PfgAPI GetChannelFee %s err : http status=%d body=%s", req.FullURL, statusCode, string(body))
-		log.Error(err.Error())
 		return
 	}
 	var resp getFeeResponse
 	err = json.Unmarshal(body, &resp)
 	if err != nil {
-		panic(err)
+		err = fmt.Errorf("PfgAPI unmarshal response %s err %s", string(body), err)
+		return
 	}
 	return resp.FeeConstant, resp.FeePercent, nil
 }
 
+/*
+invoke 发送请求, 网络错误和 5xx 返回 ErrUnavailable, 其他非 200 返回普通错误
+*/
+/*
+ *	invoke : send request, errors caused by network or 5xx are ErrUnavailable,
+ *	other status than 200 are normal errors, such as no path found.
+ */
+func (pfg *pfsClient) invoke(name string, r *req) (body []byte, err error) {
+	statusCode, body, err := r.Invoke()
+	log.Debug(r.ToString())
+	if err != nil {
+		log.Error(fmt.Sprintf("PfgAPI %s %s err :%s", name, r.FullURL, err))
+		err = errors.Wrap(ErrUnavailable, err.Error())
+		return
+	}
+	if statusCode != 200 {
+		err = fmt.Errorf("PfgAPI %s %s err : http status=%d body=%s", name, r.FullURL, statusCode, string(body))
+		log.Error(err.Error())
+		if statusCode >= 500 {
+			err = errors.Wrap(ErrUnavailable, err.Error())
+		}
+		return
+	}
+	return
+}
+
 func marshal(v interface{}) string {
 	p, err := json.Marshal(v)
 	if err != nil {
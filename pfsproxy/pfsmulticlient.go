@@ -0,0 +1,266 @@
+package pfsproxy
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/SmartMeshFoundation/Atmosphere/log"
+	"github.com/SmartMeshFoundation/Atmosphere/models"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/pkg/errors"
+)
+
+const (
+	//pfsRetryInterval 一个 pfs 不可用后多久再次尝试, 连续失败时加倍
+	pfsRetryInterval = time.Second * 10
+	//pfsMaxRetryInterval 最长多久再次尝试
+	pfsMaxRetryInterval = time.Minute * 5
+)
+
+//errNoAvailablePfs all pfs are unavailable now
+var errNoAvailablePfs = errors.Wrap(ErrUnavailable, "no available pfs")
+
+/*
+PathVerifier 使用 pfs 返回的路径之前进行检查, 未通过的路径会被丢弃.
+*/
+/*
+ *	PathVerifier : check a path returned by pfs before using it, paths not passed are dropped.
+ */
+type PathVerifier func(peerFrom, peerTo, token common.Address, amount *big.Int, path *FindPathResponse) error
+
+//pfsServer one pfs and its health
+type pfsServer struct {
+	client    *pfsClient
+	failures  int
+	retryTime time.Time
+}
+
+/*
+multiPfsClient 同时使用多个 pfs.
+查询类请求按配置顺序依次尝试健康的 pfs, 直到成功为止;
+提交类请求发给所有健康的 pfs, 有一个成功即可.
+pfs 无法连接或者返回 5xx 以后, 在一段时间内不再使用, 连续失败时这个时间加倍.
+*/
+/*
+ *	multiPfsClient : use more than one pfs.
+ *	Queries are sent to healthy pfs one by one in configured order until one succeeds,
+ *	submissions are sent to all healthy pfs, and succeed if any one succeeds.
+ *	A pfs which cannot be reached or returns 5xx is not used for a while, which doubles when it fails again.
+ */
+type multiPfsClient struct {
+	lock     sync.Mutex
+	servers  []*pfsServer
+	verifier PathVerifier
+}
+
+/*
+NewMultiPfsProxy :
+hosts are pfs used in order, verifier may be nil if paths are used without verifying.
+*/
+func NewMultiPfsProxy(hosts []string, privateKey *ecdsa.PrivateKey, verifier PathVerifier) (pfsProxy PfsProxy) {
+	c := &multiPfsClient{
+		verifier: verifier,
+	}
+	for _, host := range hosts {
+		c.servers = append(c.servers, &pfsServer{
+			client: &pfsClient{
+				host:       host,
+				privateKey: privateKey,
+			},
+		})
+	}
+	return c
+}
+
+//availableServers pfs which can be used now
+func (c *multiPfsClient) availableServers() (servers []*pfsServer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now()
+	for _, s := range c.servers {
+		if !now.Before(s.retryTime) {
+			servers = append(servers, s)
+		}
+	}
+	return
+}
+
+//report update health of s by the result of a request
+func (c *multiPfsClient) report(s *pfsServer, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if errors.Cause(err) != ErrUnavailable {
+		//pfs works even if it says no path
+		s.failures = 0
+		s.retryTime = time.Time{}
+		return
+	}
+	s.failures++
+	interval := pfsMaxRetryInterval
+	if s.failures < 10 {
+		interval = pfsRetryInterval << uint(s.failures-1)
+	}
+	if interval > pfsMaxRetryInterval {
+		interval = pfsMaxRetryInterval
+	}
+	s.retryTime = time.Now().Add(interval)
+	log.Warn(fmt.Sprintf("pfs %s unavailable %d times, retry after %s", s.client.host, s.failures, interval))
+}
+
+//query call fn with available pfs one by one until one succeeds
+func (c *multiPfsClient) query(fn func(pfg *pfsClient) error) (err error) {
+	err = errNoAvailablePfs
+	for _, s := range c.availableServers() {
+		err = fn(s.client)
+		c.report(s, err)
+		if err == nil {
+			return
+		}
+	}
+	return
+}
+
+//submit call fn with all available pfs, succeed if anyone succeeds
+func (c *multiPfsClient) submit(fn func(pfg *pfsClient) error) (err error) {
+	err = errNoAvailablePfs
+	ok := false
+	for _, s := range c.availableServers() {
+		err2 := fn(s.client)
+		c.report(s, err2)
+		if err2 == nil {
+			ok = true
+		} else {
+			err = err2
+		}
+	}
+	if ok {
+		return nil
+	}
+	return
+}
+
+/*
+SubmitBalance :
+*/
+func (c *multiPfsClient) SubmitBalance(nonce uint64, transferAmount, lockAmount *big.Int, openBlockNumber int64, locksroot, channelIdentifier, additionHash common.Hash, signature []byte) (err error) {
+	return c.submit(func(pfg *pfsClient) error {
+		return pfg.SubmitBalance(nonce, transferAmount, lockAmount, openBlockNumber, locksroot, channelIdentifier, additionHash, signature)
+	})
+}
+
+/*
+FindPath : 每个 pfs 返回的路径都要经过 verifier 检查, 没有合法路径时尝试下一个 pfs.
+*/
+/*
+ *	FindPath : paths returned by every pfs are checked by verifier, next pfs is tried when there is no valid path.
+ */
+func (c *multiPfsClient) FindPath(peerFrom, peerTo, token common.Address, amount *big.Int) (resp []FindPathResponse, err error) {
+	err = c.query(func(pfg *pfsClient) error {
+		paths, err := pfg.FindPath(peerFrom, peerTo, token, amount)
+		if err != nil {
+			return err
+		}
+		resp = nil
+		for i := range paths {
+			if c.verifier != nil {
+				err = c.verifier(peerFrom, peerTo, token, amount, &paths[i])
+				if err != nil {
+					log.Warn(fmt.Sprintf("pfs %s returns invalid path %s, err %s", pfg.host, marshal(paths[i]), err))
+					continue
+				}
+			}
+			resp = append(resp, paths[i])
+		}
+		if len(resp) == 0 {
+			return fmt.Errorf("pfs %s returns no valid path", pfg.host)
+		}
+		return nil
+	})
+	if err != nil {
+		resp = nil
+	}
+	return
+}
+
+/*
+GetNodes :
+*/
+func (c *multiPfsClient) GetNodes(tokenAddress common.Address) (resp []NodeChannelsResponse, err error) {
+	err = c.query(func(pfg *pfsClient) (err error) {
+		resp, err = pfg.GetNodes(tokenAddress)
+		return
+	})
+	return
+}
+
+/*
+SetFeePolicy :
+*/
+func (c *multiPfsClient) SetFeePolicy(fp *models.FeePolicy) (err error) {
+	return c.submit(func(pfg *pfsClient) error {
+		return pfg.SetFeePolicy(fp)
+	})
+}
+
+/*
+SetAccountFee :
+*/
+func (c *multiPfsClient) SetAccountFee(feeConstant *big.Int, feePercent int64) (err error) {
+	return c.submit(func(pfg *pfsClient) error {
+		return pfg.SetAccountFee(feeConstant, feePercent)
+	})
+}
+
+/*
+GetAccountFee :
+*/
+func (c *multiPfsClient) GetAccountFee() (feeConstant *big.Int, feePercent int64, err error) {
+	err = c.query(func(pfg *pfsClient) (err error) {
+		feeConstant, feePercent, err = pfg.GetAccountFee()
+		return
+	})
+	return
+}
+
+/*
+SetTokenFee :
+*/
+func (c *multiPfsClient) SetTokenFee(feeConstant *big.Int, feePercent int64, tokenAddress common.Address) (err error) {
+	return c.submit(func(pfg *pfsClient) error {
+		return pfg.SetTokenFee(feeConstant, feePercent, tokenAddress)
+	})
+}
+
+/*
+GetTokenFee :
+*/
+func (c *multiPfsClient) GetTokenFee(tokenAddress common.Address) (feeConstant *big.Int, feePercent int64, err error) {
+	err = c.query(func(pfg *pfsClient) (err error) {
+		feeConstant, feePercent, err = pfg.GetTokenFee(tokenAddress)
+		return
+	})
+	return
+}
+
+/*
+SetChannelFee :
+*/
+func (c *multiPfsClient) SetChannelFee(feeConstant *big.Int, feePercent int64, channelIdentifier common.Hash) (err error) {
+	return c.submit(func(pfg *pfsClient) error {
+		return pfg.SetChannelFee(feeConstant, feePercent, channelIdentifier)
+	})
+}
+
+/*
+GetChannelFee :
+*/
+func (c *multiPfsClient) GetChannelFee(channelIdentifier common.Hash) (feeConstant *big.Int, feePercent int64, err error) {
+	err = c.query(func(pfg *pfsClient) (err error) {
+		feeConstant, feePercent, err = pfg.GetChannelFee(channelIdentifier)
+		return
+	})
+	return
+}
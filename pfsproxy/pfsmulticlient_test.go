@@ -0,0 +1,78 @@
+package pfsproxy
+
+import (
+	"errors"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	pkgerrors "github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMultiPfsClient(t *testing.T) {
+	s1, ts1, dir1 := newTestPfsServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Stop()
+	s2, ts2, dir2 := newTestPfsServer(t)
+	defer os.RemoveAll(dir2)
+	defer s2.Stop()
+	dead := httptest.NewServer(nil)
+	dead.Close()
+	token := common.HexToAddress("0x1")
+	nodes := newTestNodes(4, ts1.URL)
+	a, b, c, d := nodes[0], nodes[1], nodes[2], nodes[3]
+	//s1 only knows a-c-d, s2 only knows a-b-d
+	openTestChannel(s1, token, a, c, 100)
+	openTestChannel(s1, token, c, d, 100)
+	openTestChannel(s2, token, a, b, 100)
+	openTestChannel(s2, token, b, d, 100)
+	//paths through c are invalid
+	verifier := func(peerFrom, peerTo, token common.Address, amount *big.Int, path *FindPathResponse) error {
+		if path.Result[0] == c.address.String() {
+			return errors.New("unknown channel")
+		}
+		return nil
+	}
+	proxy := NewMultiPfsProxy([]string{dead.URL, ts1.URL, ts2.URL}, a.key, verifier)
+	m := proxy.(*multiPfsClient)
+
+	paths, err := proxy.FindPath(a.address, d.address, token, big.NewInt(10))
+	assert.Nil(t, err)
+	assert.Len(t, paths, 1)
+	assert.EqualValues(t, b.address.String(), paths[0].Result[0])
+	//dead pfs is skipped for a while, pfs returning invalid path is still healthy
+	assert.EqualValues(t, 1, m.servers[0].failures)
+	assert.True(t, m.servers[0].retryTime.After(time.Now()))
+	assert.EqualValues(t, 0, m.servers[1].failures)
+	assert.Len(t, m.availableServers(), 2)
+
+	//fee is submitted to every available pfs
+	assert.Nil(t, proxy.SetAccountFee(big.NewInt(3), 0))
+	for _, ts := range []*httptest.Server{ts1, ts2} {
+		feeConstant, _, err := NewPfsProxy(ts.URL, a.key).GetAccountFee()
+		assert.Nil(t, err)
+		assert.EqualValues(t, 3, feeConstant.Int64())
+	}
+
+	//no valid path at all
+	_, err = proxy.FindPath(a.address, c.address, token, big.NewInt(10))
+	assert.NotNil(t, err)
+
+	//all pfs are down
+	ts1.Close()
+	ts2.Close()
+	_, err = proxy.FindPath(a.address, d.address, token, big.NewInt(10))
+	assert.Equal(t, ErrUnavailable, pkgerrors.Cause(err))
+	assert.Len(t, m.availableServers(), 0)
+	_, err = proxy.FindPath(a.address, d.address, token, big.NewInt(10))
+	assert.Equal(t, errNoAvailablePfs, err)
+	assert.NotNil(t, proxy.SetAccountFee(big.NewInt(3), 0))
+
+	//pfs is tried again after retry time
+	m.servers[0].retryTime = time.Now()
+	assert.Len(t, m.availableServers(), 1)
+}
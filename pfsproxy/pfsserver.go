@@ -0,0 +1,324 @@
+package pfsproxy
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+
+	"github.com/SmartMeshFoundation/Atmosphere/blockchain"
+	"github.com/SmartMeshFoundation/Atmosphere/log"
+	"github.com/SmartMeshFoundation/Atmosphere/models"
+	"github.com/SmartMeshFoundation/Atmosphere/network/helper"
+	"github.com/SmartMeshFoundation/Atmosphere/network/netshare"
+	"github.com/SmartMeshFoundation/Atmosphere/transfer"
+	"github.com/SmartMeshFoundation/Atmosphere/transfer/mediatedtransfer"
+	"github.com/SmartMeshFoundation/Atmosphere/utils"
+	"github.com/asdine/storm"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const (
+	bucketPfs          = "pfs"
+	keyLastBlockNumber = "lastBlockNumber"
+)
+
+// pfsParticipant : one side of a channel
+type pfsParticipant struct {
+	Address common.Address `json:"address"`
+	Deposit *big.Int       `json:"deposit"`
+	// Nonce, TransferAmount and LockAmount are from the latest balance proof signed by this participant,
+	// which is submitted by its partner.
+	Nonce          uint64   `json:"nonce"`
+	TransferAmount *big.Int `json:"transfer_amount"`
+	LockAmount     *big.Int `json:"lock_amount"`
+}
+
+func newPfsParticipant(address common.Address, deposit *big.Int) *pfsParticipant {
+	return &pfsParticipant{
+		Address:        address,
+		Deposit:        new(big.Int).Set(deposit),
+		TransferAmount: new(big.Int),
+		LockAmount:     new(big.Int),
+	}
+}
+
+/*
+pfsChannel 链上的一个通道, 押金来自链上事件, 双方的转账金额来自双方提交的对方的 BalanceProof.
+关闭和结算的通道并不删除, 重新处理旧的事件时不会把它们当作新通道.
+*/
+/*
+ *	pfsChannel : a channel on chain, deposits are from contract events,
+ *	and transfer amounts are from balance proofs submitted by participants.
+ *	Closed and settled channels are kept, so they are not opened again by old events handled twice.
+ */
+type pfsChannel struct {
+	Key               []byte             `storm:"id"`
+	ChannelIdentifier common.Hash        `json:"channel_identifier"`
+	OpenBlockNumber   int64              `json:"open_block_number"`
+	TokenAddress      common.Address     `json:"token_address"`
+	Participants      [2]*pfsParticipant `json:"participants"`
+	ClosedBlock       int64              `json:"closed_block"`
+	SettledBlock      int64              `json:"settled_block"`
+}
+
+func (c *pfsChannel) isOpen() bool {
+	return c.ClosedBlock == 0 && c.SettledBlock == 0
+}
+
+//participant returns participant with address and its partner, nil if address is not a participant
+func (c *pfsChannel) participant(address common.Address) (p, partner *pfsParticipant) {
+	if c.Participants[0].Address == address {
+		return c.Participants[0], c.Participants[1]
+	}
+	if c.Participants[1].Address == address {
+		return c.Participants[1], c.Participants[0]
+	}
+	return nil, nil
+}
+
+//capacity how many tokens from can send to its partner now
+func (c *pfsChannel) capacity(from common.Address) *big.Int {
+	p, partner := c.participant(from)
+	if p == nil {
+		return new(big.Int)
+	}
+	x := new(big.Int).Add(p.Deposit, partner.TransferAmount)
+	x.Sub(x, p.TransferAmount)
+	return x.Sub(x, p.LockAmount)
+}
+
+//tokenNetworkDependency only events of TokenNetwork are needed to build the graph
+type tokenNetworkDependency struct {
+	tokenNetworkAddress common.Address
+}
+
+func (d *tokenNetworkDependency) GetTokenNetworkAddress() common.Address {
+	return d.tokenNetworkAddress
+}
+
+func (d *tokenNetworkDependency) GetSecretRegistryAddress() common.Address {
+	return utils.EmptyAddress
+}
+
+/*
+PfsServer 实现了 pfsClient 调用的 path finding 服务.
+它根据 TokenNetwork 的链上事件构建通道网络, 根据节点提交的 BalanceProof 更新通道余额,
+根据节点提交的手续费设置给出手续费最少的路径.
+*/
+/*
+ *	PfsServer : path finding service implementing the api pfsClient calls.
+ *	The channel network is built from events of TokenNetwork, balances are updated by balance proofs nodes submit,
+ *	and paths with the least fee are found by fee policies nodes submit.
+ */
+type PfsServer struct {
+	db          *storm.DB
+	client      *helper.SafeEthClient
+	events      *blockchain.Events
+	httpServer  *http.Server
+	chainID     *big.Int
+	lock        sync.Mutex
+	channels    map[common.Hash]*pfsChannel
+	feePolicies map[common.Address]*models.FeePolicy
+	blockNumber int64
+	quitChan    chan struct{}
+}
+
+/*
+NewPfsServer :
+pfs data is saved in dbPath, events of TokenNetwork at tokenNetworkAddress are fetched by client,
+client may be nil when graph is not built from chain, for example in tests.
+*/
+func NewPfsServer(dbPath string, client *helper.SafeEthClient, tokenNetworkAddress common.Address) (s *PfsServer, err error) {
+	s = &PfsServer{
+		client:      client,
+		channels:    make(map[common.Hash]*pfsChannel),
+		feePolicies: make(map[common.Address]*models.FeePolicy),
+		quitChan:    make(chan struct{}),
+	}
+	s.db, err = storm.Open(dbPath)
+	if err != nil {
+		return
+	}
+	var channels []*pfsChannel
+	err = s.db.All(&channels)
+	if err != nil {
+		s.db.Close()
+		return
+	}
+	for _, c := range channels {
+		s.channels[c.ChannelIdentifier] = c
+	}
+	var fps []*models.FeePolicy
+	err = s.db.All(&fps)
+	if err != nil {
+		s.db.Close()
+		return
+	}
+	for _, fp := range fps {
+		s.feePolicies[common.HexToAddress(fp.Key)] = fp
+	}
+	err = s.db.Get(bucketPfs, keyLastBlockNumber, &s.blockNumber)
+	if err == storm.ErrNotFound {
+		err = nil
+	}
+	if err != nil {
+		s.db.Close()
+		return
+	}
+	if client != nil {
+		s.events = blockchain.NewBlockChainEvents(client, &tokenNetworkDependency{tokenNetworkAddress})
+	}
+	log.Info(fmt.Sprintf("pfs load %d channels and %d fee policies, last block %d", len(s.channels), len(s.feePolicies), s.blockNumber))
+	return
+}
+
+//Start listen on addr and handle events from chain
+func (s *PfsServer) Start(addr string) {
+	s.httpServer = &http.Server{
+		Addr:    addr,
+		Handler: s.Handler(),
+	}
+	go func() {
+		err := s.httpServer.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Crit(fmt.Sprintf("pfs listen on %s err %s", addr, err))
+		}
+	}()
+	if s.events != nil {
+		go s.loop()
+	}
+	log.Info(fmt.Sprintf("pfs started on %s", addr))
+}
+
+//Stop pfs and close db
+func (s *PfsServer) Stop() {
+	close(s.quitChan)
+	if s.httpServer != nil {
+		err := s.httpServer.Close()
+		if err != nil {
+			log.Error(fmt.Sprintf("pfs close http server err %s", err))
+		}
+	}
+	if s.events != nil {
+		s.events.Stop()
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	err := s.db.Close()
+	if err != nil {
+		log.Error(fmt.Sprintf("pfs close db err %s", err))
+	}
+}
+
+func (s *PfsServer) loop() {
+	for {
+		select {
+		case st, ok := <-s.events.StateChangeChannel:
+			if !ok {
+				log.Info("Events.StateChangeChannel closed")
+				return
+			}
+			s.handleStateChange(st)
+		case status := <-s.client.StatusChan:
+			if status == netshare.Connected {
+				s.handleEthRPCConnectionOK()
+			}
+		case <-s.quitChan:
+			return
+		}
+	}
+}
+
+func (s *PfsServer) handleEthRPCConnectionOK() {
+	if s.chainID == nil {
+		chainID, err := s.client.NetworkID(context.Background())
+		if err != nil {
+			log.Error(fmt.Sprintf("pfs get chain id err %s", err))
+			go s.client.RecoverDisconnect()
+			return
+		}
+		s.lock.Lock()
+		s.chainID = chainID
+		s.lock.Unlock()
+	}
+	s.events.Start(s.blockNumber)
+}
+
+//handleStateChange events may be handled more than once, so every handler must be idempotent.
+func (s *PfsServer) handleStateChange(st transfer.StateChange) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var c *pfsChannel
+	switch st2 := st.(type) {
+	case *transfer.BlockStateChange:
+		s.blockNumber = st2.BlockNumber
+		err := s.db.Set(bucketPfs, keyLastBlockNumber, s.blockNumber)
+		if err != nil {
+			log.Error(fmt.Sprintf("pfs save block number err %s", err))
+		}
+		return
+	case *mediatedtransfer.ContractNewChannelStateChange:
+		old := s.channels[st2.ChannelIdentifier.ChannelIdentifier]
+		if old != nil && old.OpenBlockNumber >= st2.ChannelIdentifier.OpenBlockNumber {
+			return
+		}
+		c = &pfsChannel{
+			Key:               st2.ChannelIdentifier.ChannelIdentifier[:],
+			ChannelIdentifier: st2.ChannelIdentifier.ChannelIdentifier,
+			OpenBlockNumber:   st2.ChannelIdentifier.OpenBlockNumber,
+			TokenAddress:      st2.TokenAddress,
+			Participants: [2]*pfsParticipant{
+				newPfsParticipant(st2.Participant1, utils.BigInt0),
+				newPfsParticipant(st2.Participant2, utils.BigInt0),
+			},
+		}
+		s.channels[c.ChannelIdentifier] = c
+	case *mediatedtransfer.ContractBalanceStateChange:
+		c = s.channels[st2.ChannelIdentifier]
+		if c == nil || !c.isOpen() || st2.BlockNumber < c.OpenBlockNumber {
+			return
+		}
+		p, _ := c.participant(st2.ParticipantAddress)
+		if p == nil {
+			return
+		}
+		p.Deposit = new(big.Int).Set(st2.Balance)
+	case *mediatedtransfer.ContractChannelWithdrawStateChange:
+		c = s.channels[st2.ChannelIdentifier.ChannelIdentifier]
+		if c == nil || c.OpenBlockNumber >= st2.ChannelIdentifier.OpenBlockNumber {
+			return
+		}
+		//a withdrawn channel is a new channel with the remaining balances
+		c.OpenBlockNumber = st2.ChannelIdentifier.OpenBlockNumber
+		c.Participants = [2]*pfsParticipant{
+			newPfsParticipant(st2.Participant1, st2.Participant1Balance),
+			newPfsParticipant(st2.Participant2, st2.Participant2Balance),
+		}
+	case *mediatedtransfer.ContractClosedStateChange:
+		c = s.channels[st2.ChannelIdentifier]
+		if c == nil || st2.ClosedBlock < c.OpenBlockNumber {
+			return
+		}
+		c.ClosedBlock = st2.ClosedBlock
+	case *mediatedtransfer.ContractSettledStateChange:
+		c = s.channels[st2.ChannelIdentifier]
+		if c == nil || st2.SettledBlock < c.OpenBlockNumber {
+			return
+		}
+		c.SettledBlock = st2.SettledBlock
+	case *mediatedtransfer.ContractCooperativeSettledStateChange:
+		c = s.channels[st2.ChannelIdentifier]
+		if c == nil || st2.SettledBlock < c.OpenBlockNumber {
+			return
+		}
+		c.SettledBlock = st2.SettledBlock
+	default:
+		return
+	}
+	err := s.db.Save(c)
+	if err != nil {
+		log.Error(fmt.Sprintf("pfs save channel %s err %s", utils.HPex(c.ChannelIdentifier), err))
+	}
+}
@@ -0,0 +1,187 @@
+package pfsproxy
+
+import (
+	"crypto/ecdsa"
+	"io/ioutil"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/SmartMeshFoundation/Atmosphere/blockchain"
+	"github.com/SmartMeshFoundation/Atmosphere/contracts"
+	"github.com/SmartMeshFoundation/Atmosphere/models"
+	"github.com/SmartMeshFoundation/Atmosphere/transfer"
+	"github.com/SmartMeshFoundation/Atmosphere/transfer/mediatedtransfer"
+	"github.com/SmartMeshFoundation/Atmosphere/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+type testNode struct {
+	key     *ecdsa.PrivateKey
+	address common.Address
+	client  PfsProxy
+}
+
+func newTestPfsServer(t *testing.T) (s *PfsServer, ts *httptest.Server, dir string) {
+	dir, err := ioutil.TempDir("", "pfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = NewPfsServer(filepath.Join(dir, "pfs.db"), nil, utils.EmptyAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.chainID = big.NewInt(8888)
+	ts = httptest.NewServer(s.Handler())
+	return
+}
+
+func newTestNodes(n int, host string) (nodes []*testNode) {
+	for i := 0; i < n; i++ {
+		key, _ := crypto.GenerateKey()
+		nodes = append(nodes, &testNode{
+			key:     key,
+			address: crypto.PubkeyToAddress(key.PublicKey),
+			client:  NewPfsProxy(host, key),
+		})
+	}
+	return
+}
+
+func openTestChannel(s *PfsServer, token common.Address, n1, n2 *testNode, deposit int64) common.Hash {
+	id := blockchain.CalcChannelID(token, n1.address, n2.address)
+	s.handleStateChange(&mediatedtransfer.ContractNewChannelStateChange{
+		ChannelIdentifier: &contracts.ChannelUniqueID{ChannelIdentifier: id, OpenBlockNumber: 3},
+		TokenAddress:      token,
+		Participant1:      n1.address,
+		Participant2:      n2.address,
+		BlockNumber:       3,
+	})
+	for _, n := range []*testNode{n1, n2} {
+		s.handleStateChange(&mediatedtransfer.ContractBalanceStateChange{
+			ChannelIdentifier:  id,
+			ParticipantAddress: n.address,
+			Balance:            big.NewInt(deposit),
+			BlockNumber:        4,
+		})
+	}
+	return id
+}
+
+// transfer from sends amount tokens to to, and to submits the balance proof
+func submitTestBalance(s *PfsServer, from, to *testNode, channel common.Hash, nonce uint64, amount int64) error {
+	bp := &balanceProof{
+		Nonce:             nonce,
+		TransferAmount:    big.NewInt(amount),
+		ChannelIdentifier: channel,
+		OpenBlockNumber:   3,
+		AdditionHash:      utils.Sha3([]byte("test")),
+	}
+	bp.Signature, _ = utils.SignData(from.key, balanceProofSignData(bp, s.chainID))
+	return to.client.SubmitBalance(bp.Nonce, bp.TransferAmount, big.NewInt(0), bp.OpenBlockNumber, bp.Locksroot, bp.ChannelIdentifier, bp.AdditionHash, bp.Signature)
+}
+
+func TestPfsServer(t *testing.T) {
+	s, ts, dir := newTestPfsServer(t)
+	defer os.RemoveAll(dir)
+	defer ts.Close()
+	token := utils.NewRandomAddress()
+	nodes := newTestNodes(4, ts.URL)
+	a, b, c, d := nodes[0], nodes[1], nodes[2], nodes[3]
+	//a-b-d and a-c-d, c charges more than b
+	openTestChannel(s, token, a, b, 100)
+	openTestChannel(s, token, b, d, 100)
+	ac := openTestChannel(s, token, a, c, 100)
+	openTestChannel(s, token, c, d, 100)
+	assert.Nil(t, b.client.SetAccountFee(big.NewInt(1), 0))
+	assert.Nil(t, c.client.SetFeePolicy(&models.FeePolicy{
+		AccountFee:    &models.FeeSetting{FeeConstant: big.NewInt(5), FeePercent: 0},
+		TokenFeeMap:   map[common.Address]*models.FeeSetting{},
+		ChannelFeeMap: map[common.Hash]*models.FeeSetting{},
+	}))
+	feeConstant, feePercent, err := b.client.GetAccountFee()
+	assert.Nil(t, err)
+	assert.EqualValues(t, 1, feeConstant.Int64())
+	assert.EqualValues(t, 0, feePercent)
+	_, _, err = b.client.GetTokenFee(token)
+	assert.NotNil(t, err)
+
+	paths, err := a.client.FindPath(a.address, d.address, token, big.NewInt(50))
+	assert.Nil(t, err)
+	assert.Len(t, paths, 1)
+	assert.EqualValues(t, []string{b.address.String(), d.address.String()}, paths[0].Result)
+	assert.EqualValues(t, 1, paths[0].PathHop)
+	assert.EqualValues(t, 1, paths[0].Fee.Int64())
+
+	//token fee is used before account fee
+	assert.Nil(t, b.client.SetTokenFee(big.NewInt(10), 0, token))
+	paths, err = a.client.FindPath(a.address, d.address, token, big.NewInt(50))
+	assert.Nil(t, err)
+	assert.EqualValues(t, c.address.String(), paths[0].Result[0])
+	assert.EqualValues(t, 5, paths[0].Fee.Int64())
+	//channel fee is used before token fee
+	assert.Nil(t, b.client.SetChannelFee(big.NewInt(2), 0, blockchain.CalcChannelID(token, b.address, d.address)))
+	paths, err = a.client.FindPath(a.address, d.address, token, big.NewInt(50))
+	assert.Nil(t, err)
+	assert.EqualValues(t, b.address.String(), paths[0].Result[0])
+	assert.EqualValues(t, 2, paths[0].Fee.Int64())
+
+	//a transfers to b, no balance left for 50 tokens
+	ab := blockchain.CalcChannelID(token, a.address, b.address)
+	assert.Nil(t, submitTestBalance(s, a, b, ab, 1, 60))
+	paths, err = a.client.FindPath(a.address, d.address, token, big.NewInt(50))
+	assert.Nil(t, err)
+	assert.EqualValues(t, c.address.String(), paths[0].Result[0])
+	//old balance proof changes nothing
+	assert.Nil(t, submitTestBalance(s, a, b, ab, 0, 0))
+	//fee must be paid too, 96 tokens can't pass c
+	_, err = a.client.FindPath(a.address, d.address, token, big.NewInt(96))
+	assert.NotNil(t, err)
+	//c pays a back, a can send 96 tokens now
+	assert.Nil(t, submitTestBalance(s, c, a, ac, 1, 10))
+	paths, err = a.client.FindPath(a.address, d.address, token, big.NewInt(96))
+	assert.Nil(t, err)
+	assert.EqualValues(t, 101, new(big.Int).Add(paths[0].Fee, big.NewInt(96)).Int64())
+
+	nodes2, err := a.client.GetNodes(token)
+	assert.Nil(t, err)
+	assert.Len(t, nodes2, 4)
+	for _, n := range nodes2 {
+		assert.EqualValues(t, 2, n.Channels)
+	}
+
+	//balance proof must be signed by partner
+	assert.NotNil(t, submitTestBalance(s, d, b, ab, 2, 60))
+	//only participant submits balance proof
+	assert.NotNil(t, submitTestBalance(s, a, d, ab, 2, 60))
+	//only the sender can find path
+	_, err = a.client.FindPath(b.address, d.address, token, big.NewInt(1))
+	assert.NotNil(t, err)
+
+	//closed channel is never used
+	s.handleStateChange(&mediatedtransfer.ContractClosedStateChange{ChannelIdentifier: ac, ClosedBlock: 10})
+	_, err = a.client.FindPath(a.address, d.address, token, big.NewInt(45))
+	assert.NotNil(t, err)
+	//old events handled again don't open it
+	openTestChannel(s, token, a, c, 100)
+	_, err = a.client.FindPath(a.address, d.address, token, big.NewInt(45))
+	assert.NotNil(t, err)
+
+	//everything is loaded after restart
+	s.handleStateChange(&transfer.BlockStateChange{BlockNumber: 20})
+	s.Stop()
+	s, err = NewPfsServer(filepath.Join(dir, "pfs.db"), nil, utils.EmptyAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	assert.EqualValues(t, 20, s.blockNumber)
+	assert.Len(t, s.channels, 4)
+	assert.Len(t, s.feePolicies, 2)
+	assert.EqualValues(t, 40, s.channels[ab].capacity(a.address).Int64())
+	assert.EqualValues(t, 160, s.channels[ab].capacity(b.address).Int64())
+}
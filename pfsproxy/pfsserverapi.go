@@ -0,0 +1,469 @@
+package pfsproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sort"
+
+	"github.com/SmartMeshFoundation/Atmosphere/blockchain"
+	"github.com/SmartMeshFoundation/Atmosphere/log"
+	"github.com/SmartMeshFoundation/Atmosphere/models"
+	"github.com/SmartMeshFoundation/Atmosphere/network/graph"
+	"github.com/SmartMeshFoundation/Atmosphere/network/rpc/fee"
+	"github.com/SmartMeshFoundation/Atmosphere/params"
+	"github.com/SmartMeshFoundation/Atmosphere/utils"
+	"github.com/ant0ine/go-json-rest/rest"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+//maxLimitPaths at most so many paths are returned by one FindPath
+const maxLimitPaths = 10
+
+//level of fee setting in getFeeResponse
+const (
+	feePolicyAccount int64 = iota
+	feePolicyToken
+	feePolicyChannel
+)
+
+var (
+	errChannelNotFound = errors.New("channel not found")
+	errFeeNotFound     = errors.New("fee not set")
+	errNoPath          = errors.New("no path")
+)
+
+//Handler http handler of all pfs api
+func (s *PfsServer) Handler() http.Handler {
+	api := rest.NewApi()
+	api.Use(rest.DefaultCommonStack...)
+	router, err := rest.MakeRouter(
+		rest.Put("/pfs/1/:addr/balance", s.submitBalance),
+		rest.Post("/pfs/1/paths", s.findPath),
+		rest.Get("/pfs/1/nodes/:token", s.getNodes),
+		rest.Put("/pfs/1/feerate/:addr", s.setFeePolicy),
+		rest.Put("/pfs/1/account_rate/:addr", s.setFee),
+		rest.Get("/pfs/1/account_rate/:addr", s.getFee),
+		rest.Put("/pfs/1/token_rate/:token/:addr", s.setFee),
+		rest.Get("/pfs/1/token_rate/:token/:addr", s.getFee),
+		rest.Put("/pfs/1/channel_rate/:channel/:addr", s.setFee),
+		rest.Get("/pfs/1/channel_rate/:channel/:addr", s.getFee),
+	)
+	if err != nil {
+		log.Crit(fmt.Sprintf("make router :%s", err))
+	}
+	api.SetApp(router)
+	return api.MakeHandler()
+}
+
+func checkSigner(data, signature []byte, signer common.Address) error {
+	addr, err := utils.Ecrecover(utils.Sha3(data), signature)
+	if err != nil {
+		return err
+	}
+	if addr != signer {
+		return fmt.Errorf("signed by %s, expect %s", addr.String(), signer.String())
+	}
+	return nil
+}
+
+//balanceProofSignData data partner signs for the balance proof, the same as EnvelopMessage
+func balanceProofSignData(bp *balanceProof, chainID *big.Int) []byte {
+	var err error
+	buf := new(bytes.Buffer)
+	_, err = buf.Write(params.ContractSignaturePrefix)
+	_, err = buf.Write([]byte(params.ContractBalanceProofMessageLength))
+	_, err = buf.Write(utils.BigIntTo32Bytes(bp.TransferAmount))
+	_, err = buf.Write(bp.Locksroot[:])
+	err = binary.Write(buf, binary.BigEndian, bp.Nonce)
+	_, err = buf.Write(bp.AdditionHash[:])
+	_, err = buf.Write(bp.ChannelIdentifier[:])
+	err = binary.Write(buf, binary.BigEndian, bp.OpenBlockNumber)
+	_, err = buf.Write(utils.BigIntTo32Bytes(chainID))
+	if err != nil {
+		log.Error(fmt.Sprintf("signData err %s", err))
+	}
+	return buf.Bytes()
+}
+
+func writeJSON(w rest.ResponseWriter, v interface{}) {
+	err := w.WriteJson(v)
+	if err != nil {
+		log.Warn(fmt.Sprintf("writejson err %s", err))
+	}
+}
+
+//submitBalance submitter submits the latest balance proof its partner signed
+func (s *PfsServer) submitBalance(w rest.ResponseWriter, r *rest.Request) {
+	submitter, err := utils.HexToAddress(r.PathParam("addr"))
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	payload := &submitBalancePayload{}
+	err = r.DecodeJsonPayload(payload)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = s.updateBalance(submitter, payload)
+	if err == errChannelNotFound {
+		rest.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *PfsServer) updateBalance(submitter common.Address, payload *submitBalancePayload) (err error) {
+	bp := payload.BalanceProof
+	if bp == nil || bp.TransferAmount == nil || payload.LockAmount == nil {
+		return errors.New("balance proof incomplete")
+	}
+	err = checkSigner(payload.signData(), payload.BalanceSignature, submitter)
+	if err != nil {
+		return fmt.Errorf("balance signature err %s", err)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	c := s.channels[bp.ChannelIdentifier]
+	if c == nil || !c.isOpen() {
+		return errChannelNotFound
+	}
+	if c.OpenBlockNumber != bp.OpenBlockNumber {
+		return fmt.Errorf("open block number expect %d,got %d", c.OpenBlockNumber, bp.OpenBlockNumber)
+	}
+	me, partner := c.participant(submitter)
+	if me == nil {
+		return fmt.Errorf("%s is not a participant of channel %s", submitter.String(), bp.ChannelIdentifier.String())
+	}
+	//nothing transferred by partner yet, or an old balance proof arrives late
+	if bp.Nonce == 0 || bp.Nonce < partner.Nonce {
+		return nil
+	}
+	if s.chainID == nil {
+		return errors.New("pfs is not connected to chain yet")
+	}
+	err = checkSigner(balanceProofSignData(bp, s.chainID), bp.Signature, partner.Address)
+	if err != nil {
+		return fmt.Errorf("balance proof signature err %s", err)
+	}
+	partner.Nonce = bp.Nonce
+	partner.TransferAmount = new(big.Int).Set(bp.TransferAmount)
+	partner.LockAmount = new(big.Int).Set(payload.LockAmount)
+	return s.db.Save(c)
+}
+
+//setFeePolicy replaces the whole fee policy of a node
+func (s *PfsServer) setFeePolicy(w rest.ResponseWriter, r *rest.Request) {
+	addr, err := utils.HexToAddress(r.PathParam("addr"))
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fp := &models.FeePolicy{}
+	err = r.DecodeJsonPayload(fp)
+	if err == nil {
+		err = fp.VerifySignature(addr)
+	}
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if fp.TokenFeeMap == nil {
+		fp.TokenFeeMap = make(map[common.Address]*models.FeeSetting)
+	}
+	if fp.ChannelFeeMap == nil {
+		fp.ChannelFeeMap = make(map[common.Hash]*models.FeeSetting)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	err = s.saveFeePolicy(addr, fp)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *PfsServer) saveFeePolicy(addr common.Address, fp *models.FeePolicy) error {
+	fp.Key = addr.String()
+	s.feePolicies[addr] = fp
+	return s.db.Save(fp)
+}
+
+//feeSettingOf returns fee setting of node on account, token or channel level according to path params
+func (s *PfsServer) feeSettingOf(r *rest.Request) (addr common.Address, level int64, fs *models.FeeSetting, err error) {
+	addr, err = utils.HexToAddress(r.PathParam("addr"))
+	if err != nil {
+		return
+	}
+	fp := s.feePolicies[addr]
+	if len(r.PathParam("token")) > 0 {
+		level = feePolicyToken
+		var token common.Address
+		token, err = utils.HexToAddress(r.PathParam("token"))
+		if err == nil && fp != nil {
+			fs = fp.TokenFeeMap[token]
+		}
+	} else if len(r.PathParam("channel")) > 0 {
+		level = feePolicyChannel
+		channel := common.HexToHash(r.PathParam("channel"))
+		if fp != nil {
+			fs = fp.ChannelFeeMap[channel]
+		}
+	} else {
+		level = feePolicyAccount
+		if fp != nil {
+			fs = fp.AccountFee
+		}
+	}
+	return
+}
+
+//setFee sets fee of account, token or channel
+func (s *PfsServer) setFee(w rest.ResponseWriter, r *rest.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	addr, level, _, err := s.feeSettingOf(r)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	payload := &setFeePayload{}
+	err = r.DecodeJsonPayload(payload)
+	if err == nil && (payload.FeeConstant == nil || payload.FeeConstant.Sign() < 0 || payload.FeePercent < 0) {
+		err = errors.New("invalid fee")
+	}
+	if err == nil {
+		err = checkSigner(payload.signData(), payload.Signature, addr)
+	}
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fs := &models.FeeSetting{
+		FeeConstant: payload.FeeConstant,
+		FeePercent:  payload.FeePercent,
+		Signature:   payload.Signature,
+	}
+	fp := s.feePolicies[addr]
+	if fp == nil {
+		fp = &models.FeePolicy{
+			TokenFeeMap:   make(map[common.Address]*models.FeeSetting),
+			ChannelFeeMap: make(map[common.Hash]*models.FeeSetting),
+		}
+	}
+	switch level {
+	case feePolicyToken:
+		fp.TokenFeeMap[common.HexToAddress(r.PathParam("token"))] = fs
+	case feePolicyChannel:
+		fp.ChannelFeeMap[common.HexToHash(r.PathParam("channel"))] = fs
+	default:
+		fp.AccountFee = fs
+	}
+	err = s.saveFeePolicy(addr, fp)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+//getFee returns fee of account, token or channel
+func (s *PfsServer) getFee(w rest.ResponseWriter, r *rest.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, level, fs, err := s.feeSettingOf(r)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if fs == nil {
+		rest.Error(w, errFeeNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, &getFeeResponse{
+		FeePolicy:   level,
+		FeeConstant: fs.FeeConstant,
+		FeePercent:  fs.FeePercent,
+	})
+}
+
+/*
+chargeFee 是 node 转发 amount 给 next 收取的手续费, 通道设置优先, 其次 token 设置, 最后 account 设置.
+没有提交过手续费设置的节点不收费.
+*/
+/*
+ *	chargeFee : fee node charges for sending amount to next, setting of the channel first, then token, then account.
+ *	Nodes never submitting fee policy charge nothing.
+ */
+func (s *PfsServer) chargeFee(node, next, token common.Address, amount *big.Int) *big.Int {
+	fp := s.feePolicies[node]
+	if fp == nil {
+		return new(big.Int)
+	}
+	if next != utils.EmptyAddress {
+		if fs, ok := fp.ChannelFeeMap[blockchain.CalcChannelID(token, node, next)]; ok {
+			return fs.CalculateFee(amount)
+		}
+	}
+	if fs, ok := fp.TokenFeeMap[token]; ok {
+		return fs.CalculateFee(amount)
+	}
+	if fp.AccountFee != nil {
+		return fp.AccountFee.CalculateFee(amount)
+	}
+	return new(big.Int)
+}
+
+/*
+pathCharger is the fee.Charger of pfs, next hop of every node on the path is needed for fee of channel,
+without next hops, fee of token or account is used, it's good enough to order paths.
+*/
+type pathCharger struct {
+	s    *PfsServer
+	next map[common.Address]common.Address
+}
+
+func (c *pathCharger) GetNodeChargeFee(nodeAddress, tokenAddress common.Address, amount *big.Int) *big.Int {
+	return c.s.chargeFee(nodeAddress, c.next[nodeAddress], tokenAddress, amount)
+}
+
+//getNodes nodes of a token and how many open channels each of them has
+func (s *PfsServer) getNodes(w rest.ResponseWriter, r *rest.Request) {
+	token, err := utils.HexToAddress(r.PathParam("token"))
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.lock.Lock()
+	channels := make(map[common.Address]int)
+	for _, c := range s.channels {
+		if c.TokenAddress != token || !c.isOpen() {
+			continue
+		}
+		channels[c.Participants[0].Address]++
+		channels[c.Participants[1].Address]++
+	}
+	s.lock.Unlock()
+	resp := []*NodeChannelsResponse{}
+	for addr, n := range channels {
+		resp = append(resp, &NodeChannelsResponse{addr, n})
+	}
+	writeJSON(w, resp)
+}
+
+//findPath only the sender itself can ask for paths
+func (s *PfsServer) findPath(w rest.ResponseWriter, r *rest.Request) {
+	payload := &findPathPayload{}
+	err := r.DecodeJsonPayload(payload)
+	if err == nil && (payload.SendAmount == nil || payload.SendAmount.Sign() <= 0) {
+		err = errors.New("invalid send amount")
+	}
+	if err == nil {
+		err = checkSigner(payload.signData(), payload.Signature, payload.PeerFrom)
+	}
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp, err := s.findPaths(payload.PeerFrom, payload.PeerTo, payload.TokenAddress, payload.SendAmount, payload.LimitPaths)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, resp)
+}
+
+/*
+findPaths 返回从 from 到 to 转 amount 个 token 手续费最少的最多 limit 条路径.
+只有每个通道都有足够余额转出它要转出的金额(包括后面节点的手续费)的路径才会返回.
+和节点自己一样, 每个中间节点按照它转出的金额收费, 返回的 Fee 不包括 from 自己的手续费, from 是中间节点的时候按照 amount+Fee 收费.
+*/
+/*
+ *	findPaths : returns at most limit paths from sending amount tokens from to to, ordered by fee.
+ *	A path is returned only if every channel on it has enough balance for the amount it sends, fee of later mediators included.
+ *	The same as nodes themselves, every mediator charges on the amount it sends on,
+ *	Fee returned doesn't include fee of from, which charges on amount+Fee when it's a mediator.
+ */
+func (s *PfsServer) findPaths(from, to, token common.Address, amount *big.Int, limit int) (resp []*FindPathResponse, err error) {
+	if limit <= 0 {
+		limit = 1
+	}
+	if limit > maxLimitPaths {
+		limit = maxLimitPaths
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	cg := graph.NewChannelGraph(from, token, nil)
+	channels := make(map[common.Hash]*pfsChannel)
+	for _, c := range s.channels {
+		if c.TokenAddress != token || !c.isOpen() {
+			continue
+		}
+		channels[c.ChannelIdentifier] = c
+		p1, p2 := c.Participants[0].Address, c.Participants[1].Address
+		if c.capacity(p1).Cmp(amount) >= 0 {
+			cg.AddDirectedPath(p1, p2)
+		}
+		if c.capacity(p2).Cmp(amount) >= 0 {
+			cg.AddDirectedPath(p2, p1)
+		}
+	}
+	//fee of later mediators may use up balance of earlier channels, so find more paths than needed
+	paths, err := cg.KShortestPaths(from, to, 2*limit, amount, &pathCharger{s: s})
+	if err != nil {
+		return nil, errNoPath
+	}
+	for _, p := range paths {
+		charger := &pathCharger{s: s, next: make(map[common.Address]common.Address)}
+		for i := 1; i < len(p.Hops)-1; i++ {
+			charger.next[p.Hops[i]] = p.Hops[i+1]
+		}
+		mediators := p.Hops[1 : len(p.Hops)-1]
+		total, fees := fee.PathCost(charger, token, mediators, amount)
+		send := new(big.Int).Set(total)
+		enough := true
+		for i := 0; i < len(p.Hops)-1; i++ {
+			c := channels[blockchain.CalcChannelID(token, p.Hops[i], p.Hops[i+1])]
+			if c == nil || c.capacity(p.Hops[i]).Cmp(send) < 0 {
+				enough = false
+				break
+			}
+			if i < len(fees) {
+				send.Sub(send, fees[i])
+			}
+		}
+		if !enough {
+			continue
+		}
+		r := &FindPathResponse{
+			PathHop: len(mediators),
+			Fee:     total.Sub(total, amount),
+		}
+		for _, h := range p.Hops[1:] {
+			r.Result = append(r.Result, h.String())
+		}
+		resp = append(resp, r)
+	}
+	if len(resp) == 0 {
+		return nil, errNoPath
+	}
+	sort.SliceStable(resp, func(i, j int) bool {
+		return resp[i].Fee.Cmp(resp[j].Fee) < 0
+	})
+	if len(resp) > limit {
+		resp = resp[:limit]
+	}
+	for i, r := range resp {
+		r.PathID = i
+	}
+	return
+}
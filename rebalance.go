@@ -0,0 +1,113 @@
+package atmosphere
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/SmartMeshFoundation/Atmosphere/log"
+	"github.com/SmartMeshFoundation/Atmosphere/network/graph"
+	"github.com/SmartMeshFoundation/Atmosphere/params"
+	"github.com/SmartMeshFoundation/Atmosphere/rerr"
+	"github.com/SmartMeshFoundation/Atmosphere/transfer/mediatedtransfer"
+	"github.com/SmartMeshFoundation/Atmosphere/transfer/route"
+	"github.com/SmartMeshFoundation/Atmosphere/utils"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+/*
+rebalanceChannel 发起一笔给自己的交易,从我的其他通道转出,再从与 partner 的通道转回给我,
+这样不需要链上存取款就可以补充我在这个通道上的可用余额.
+路由费用超过 maxFee 的路由会被忽略, 转出以后可用余额会低于 Config.RebalanceThreshold 的通道也不会使用.
+*/
+/*
+ *	rebalanceChannel : function to send a mediated transfer to ourselves, out through one of our other channels
+ *	and back through the channel with `partner`, so our distributable balance on that channel is refilled
+ *	without any on-chain deposit or withdraw.
+ *
+ *	Note that routes whose total fee is larger than `maxFee` are ignored,
+ *	and so are channels whose distributable would drop below Config.RebalanceThreshold after sending.
+ */
+func (rs *Service) rebalanceChannel(tokenAddress, partner common.Address, amount, maxFee *big.Int) (result *utils.AsyncResult) {
+	if rs.Config.IsMeshNetwork {
+		return utils.NewAsyncResultWithError(errors.New("no mediated transfer on mesh only network"))
+	}
+	g := rs.getToken2ChannelGraph(tokenAddress)
+	if g == nil {
+		return utils.NewAsyncResultWithError(rerr.UnknownTokenAddress(tokenAddress.String()))
+	}
+	if g.GetPartenerAddress2Channel(partner) == nil {
+		return utils.NewAsyncResultWithError(rerr.ChannelNotFound(fmt.Sprintf("token:%s,partner:%s", utils.APex2(tokenAddress), utils.APex2(partner))))
+	}
+	var availableRoutes []*route.State
+	for _, r := range g.GetCircularRoutes(rs.Protocol, partner, amount, graph.EmptyExlude, rs, rs.Config.RebalanceThreshold) {
+		if r.TotalFee.Cmp(maxFee) > 0 {
+			log.Debug(fmt.Sprintf("rebalance route via %s ignored, fee %s exceeds max fee %s", utils.APex2(r.HopNode()), r.TotalFee, maxFee))
+			continue
+		}
+		availableRoutes = append(availableRoutes, r)
+	}
+	if len(availableRoutes) <= 0 {
+		return utils.NewAsyncResultWithError(errors.New("no available circular route"))
+	}
+	secret := utils.NewRandomHash()
+	lockSecretHash := utils.ShaSecret(secret[:])
+	rs.dao().NewTransferStatus(tokenAddress, lockSecretHash)
+	result = utils.NewAsyncResult()
+	result.LockSecretHash = lockSecretHash
+	rs.initiateMediatedTransfer(tokenAddress, rs.NodeAddress, amount, lockSecretHash, 0, secret, availableRoutes, result, &mediatedtransfer.TransferConstraints{MaxFee: maxFee, LastHop: partner}, nil)
+	return
+}
+
+/*
+autoRebalance 每隔 params.DefaultRebalanceCheckInterval 块检查一次所有通道,
+如果某个通道上我的可用余额低于 Config.RebalanceThreshold, 就发起一次 rebalance 把余额补充到阈值.
+同一个通道同一时间只会有一笔 rebalance.
+*/
+/*
+ *	autoRebalance : function to check all channels every params.DefaultRebalanceCheckInterval blocks,
+ *	once our distributable balance on a channel drops below Config.RebalanceThreshold, start a rebalance to refill it up to the threshold.
+ *
+ *	Note that there is at most one rebalance on the way for a channel.
+ */
+func (rs *Service) autoRebalance(blockNumber int64) {
+	threshold := rs.Config.RebalanceThreshold
+	if threshold == nil || blockNumber%params.DefaultRebalanceCheckInterval != 0 {
+		return
+	}
+	if rs.StopCreateNewTransfers || rs.Config.IsMeshNetwork {
+		return
+	}
+	for tokenAddress, g := range rs.Token2ChannelGraph {
+		for channelIdentifier, c := range g.ChannelIdentifier2Channel {
+			if key, ok := rs.Channel2RebalanceKey[channelIdentifier]; ok {
+				if rs.Transfer2StateManager[key] != nil {
+					continue
+				}
+				delete(rs.Channel2RebalanceKey, channelIdentifier)
+			}
+			if !c.CanTransfer() {
+				continue
+			}
+			distributable := c.Distributable()
+			if distributable.Cmp(threshold) >= 0 {
+				continue
+			}
+			amount := new(big.Int).Sub(threshold, distributable)
+			result := rs.rebalanceChannel(tokenAddress, c.PartnerState.Address, amount, rs.Config.RebalanceMaxFee)
+			key := utils.Sha3(result.LockSecretHash[:], tokenAddress[:])
+			if result.LockSecretHash != utils.EmptyHash && rs.Transfer2StateManager[key] != nil {
+				log.Info(fmt.Sprintf("auto rebalance channel %s amount=%s lockSecretHash=%s", c.ChannelIdentifier.String(), amount, result.LockSecretHash.String()))
+				rs.Channel2RebalanceKey[channelIdentifier] = key
+				continue
+			}
+			select {
+			case err := <-result.Result:
+				if err != nil {
+					log.Warn(fmt.Sprintf("auto rebalance channel %s failed, err %s", c.ChannelIdentifier.String(), err))
+				}
+			default:
+			}
+		}
+	}
+}
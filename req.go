@@ -3,6 +3,9 @@ package atmosphere
 import (
 	"math/big"
 
+	"github.com/SmartMeshFoundation/Atmosphere/encoding"
+	"github.com/SmartMeshFoundation/Atmosphere/models"
+	"github.com/SmartMeshFoundation/Atmosphere/transfer/mediatedtransfer"
 	"github.com/SmartMeshFoundation/Atmosphere/utils"
 	"github.com/ethereum/go-ethereum/common"
 )
@@ -44,6 +47,12 @@ const depositChannelReqName = "deposit"
 const tokenSwapMakerReqName = "tokenswapmaker"
 const tokenSwapTakerReqName = "tokenswaptaker"
 const cancelTransfer = "canceltransfer"
+const rebalanceReqName = "rebalance"
+const autopilotDecisionsReqName = "autopilotdecisions"
+const heldTransfersReqName = "heldtransfers"
+const settleHeldTransferReqName = "settleheldtransfer"
+const cancelHeldTransferReqName = "cancelheldtransfer"
+const settleOperationReqName = "settleoperation"
 
 /*
 transfer api
@@ -55,6 +64,8 @@ type transferReq struct {
 	Fee              *big.Int
 	Secret           common.Hash
 	IsDirectTransfer bool
+	Constraints      *mediatedtransfer.TransferConstraints
+	RouteHints       []*encoding.RouteHint
 }
 
 /*
@@ -75,6 +86,14 @@ type closeSettleChannelReq struct {
 	addr common.Hash //channel address
 }
 
+/*
+settle channel cooperatively, fall back to close if timeout
+*/
+type settleOperationReq struct {
+	addr    common.Hash
+	timeout int64 //blocks
+}
+
 type withdrawReq struct {
 	addr   common.Hash //channel address
 	amount *big.Int
@@ -110,6 +129,31 @@ type cancelTransferReq struct {
 	TokenAddress   common.Address
 }
 
+/*
+rebalance api
+*/
+type rebalanceReq struct {
+	TokenAddress common.Address
+	Partner      common.Address //the channel to refill
+	Amount       *big.Int
+	MaxFee       *big.Int
+}
+
+/*
+autopilot dry run api
+*/
+type autopilotDecisionsReq struct {
+	Policy *models.AutopilotPolicy
+}
+
+/*
+settle or cancel held transfer api
+*/
+type heldTransferReq struct {
+	LockSecretHash common.Hash
+	TokenAddress   common.Address
+}
+
 /*
 general req's wraper
 */
@@ -131,7 +175,7 @@ Transfer `amount` between this node and `target`.
            - Network speed, making the transfer sufficiently fast so it doesn't
              expire.
 */
-func (rs *Service) transferAsyncClient(tokenAddress common.Address, amount *big.Int, fee *big.Int, target common.Address, secret common.Hash, isDirectTransfer bool) *utils.AsyncResult {
+func (rs *Service) transferAsyncClient(tokenAddress common.Address, amount *big.Int, fee *big.Int, target common.Address, secret common.Hash, isDirectTransfer bool, constraints *mediatedtransfer.TransferConstraints, hints []*encoding.RouteHint) *utils.AsyncResult {
 	req := &apiReq{
 		ReqID: utils.RandomString(10),
 		Name:  transferReqName,
@@ -142,6 +186,8 @@ func (rs *Service) transferAsyncClient(tokenAddress common.Address, amount *big.
 			Secret:           secret,
 			Fee:              fee,
 			IsDirectTransfer: isDirectTransfer,
+			Constraints:      constraints,
+			RouteHints:       hints,
 		},
 	}
 	return rs.sendReqClient(req)
@@ -227,6 +273,17 @@ func (rs *Service) cancelMarkChannelForCooperativeSettleClient(channelIdentifier
 	}
 	return rs.sendReqClient(req)
 }
+func (rs *Service) settleOperationClient(channelIdentifier common.Hash, timeout int64) *utils.AsyncResult {
+	req := &apiReq{
+		ReqID: utils.RandomString(10),
+		Name:  settleOperationReqName,
+		Req: &settleOperationReq{
+			addr:    channelIdentifier,
+			timeout: timeout,
+		},
+	}
+	return rs.sendReqClient(req)
+}
 func (rs *Service) withdrawClient(channelIdentifier common.Hash, amount *big.Int) *utils.AsyncResult {
 	req := &apiReq{
 		ReqID: utils.RandomString(10),
@@ -285,3 +342,47 @@ func (rs *Service) cancelTransferClient(lockSecretHash common.Hash, tokenAddress
 	}
 	return rs.sendReqClient(req)
 }
+func (rs *Service) rebalanceClient(tokenAddress, partner common.Address, amount, maxFee *big.Int) *utils.AsyncResult {
+	req := &apiReq{
+		ReqID: utils.RandomString(10),
+		Name:  rebalanceReqName,
+		Req: &rebalanceReq{
+			TokenAddress: tokenAddress,
+			Partner:      partner,
+			Amount:       amount,
+			MaxFee:       maxFee,
+		},
+	}
+	return rs.sendReqClient(req)
+}
+func (rs *Service) autopilotDecisionsClient(policy *models.AutopilotPolicy) *utils.AsyncResult {
+	req := &apiReq{
+		ReqID: utils.RandomString(10),
+		Name:  autopilotDecisionsReqName,
+		Req:   &autopilotDecisionsReq{policy},
+	}
+	return rs.sendReqClient(req)
+}
+func (rs *Service) heldTransfersClient() *utils.AsyncResult {
+	req := &apiReq{
+		ReqID: utils.RandomString(10),
+		Name:  heldTransfersReqName,
+	}
+	return rs.sendReqClient(req)
+}
+func (rs *Service) settleHeldTransferClient(lockSecretHash common.Hash, tokenAddress common.Address) *utils.AsyncResult {
+	req := &apiReq{
+		ReqID: utils.RandomString(10),
+		Name:  settleHeldTransferReqName,
+		Req:   &heldTransferReq{lockSecretHash, tokenAddress},
+	}
+	return rs.sendReqClient(req)
+}
+func (rs *Service) cancelHeldTransferClient(lockSecretHash common.Hash, tokenAddress common.Address) *utils.AsyncResult {
+	req := &apiReq{
+		ReqID: utils.RandomString(10),
+		Name:  cancelHeldTransferReqName,
+		Req:   &heldTransferReq{lockSecretHash, tokenAddress},
+	}
+	return rs.sendReqClient(req)
+}
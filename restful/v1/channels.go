@@ -410,3 +410,66 @@ func BalanceUpdateForPFS(w rest.ResponseWriter, r *rest.Request) {
 		log.Warn(fmt.Sprintf("writejson err %s", err))
 	}
 }
+
+/*
+SettleChannel settle a channel cooperatively, fall back to close and settle automatically if partner doesn't agree in time.
+it returns immediately, query progress by GetSettleOperation.
+{"timeout":20} timeout is blocks to wait for cooperative settle
+*/
+func SettleChannel(w rest.ResponseWriter, r *rest.Request) {
+	var err error
+	defer func() {
+		log.Trace(fmt.Sprintf("Restful Api Call ----> SettleChannel ,err=%v", err))
+	}()
+	chstr := r.PathParam("channel")
+	if len(chstr) != len(utils.EmptyHash.String()) {
+		rest.Error(w, "argument error", http.StatusBadRequest)
+		return
+	}
+	type Req struct {
+		Timeout int64
+	}
+	req := &Req{}
+	err = r.DecodeJsonPayload(req)
+	if err != nil && err != rest.ErrJsonPayloadEmpty {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	op, err := API.StartSettleOperation(common.HexToHash(chstr), req.Timeout)
+	if err != nil {
+		log.Error(err.Error())
+		rest.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	err = w.WriteJson(op)
+	if err != nil {
+		log.Warn(fmt.Sprintf("writejson err %s", err))
+	}
+}
+
+//GetSettleOperation progress of settling a channel
+func GetSettleOperation(w rest.ResponseWriter, r *rest.Request) {
+	chstr := r.PathParam("channel")
+	if len(chstr) != len(utils.EmptyHash.String()) {
+		rest.Error(w, "argument error", http.StatusBadRequest)
+		return
+	}
+	op, err := API.GetSettleOperation(common.HexToHash(chstr))
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	err = w.WriteJson(op)
+	if err != nil {
+		log.Warn(fmt.Sprintf("writejson err %s", err))
+	}
+}
+
+//GetSettleOperations all settle operations
+func GetSettleOperations(w rest.ResponseWriter, r *rest.Request) {
+	err := w.WriteJson(API.GetSettleOperations())
+	if err != nil {
+		log.Warn(fmt.Sprintf("writejson err %s", err))
+	}
+}
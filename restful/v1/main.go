@@ -45,12 +45,18 @@ func Start() {
 		rest.Post("/api/1/transfers/:token/:target", Transfers),
 		rest.Get("/api/1/transferstatus/:token/:locksecrethash", GetTransferStatus),
 		rest.Post("/api/1/transfercancel/:token/:locksecrethash", CancelTransfer),
+		rest.Post("/api/1/rebalance/:token/:partner", Rebalance),
 		/*
 			transfer with specified secret
 		*/
 		rest.Post("/api/1/transfers/allowrevealsecret", AllowRevealSecret),
 		rest.Get("/api/1/getunfinishedreceivedtransfer/:tokenaddress/:locksecrethash", GetUnfinishedReceivedTransfer),
 		rest.Post("/api/1/registersecret", RegisterSecret),
+		/*
+			hold payments
+		*/
+		rest.Get("/api/1/heldtransfers", GetHeldTransfers),
+		rest.Post("/api/1/heldtransfers/:token/:locksecrethash/:op", SettleOrCancelHeldTransfer),
 		/*
 			token swap
 		*/
@@ -84,6 +90,29 @@ func Start() {
 		rest.Get("/api/1/fee_policy", GetFeePolicy),
 		rest.Post("/api/1/fee_policy", SetFeePolicy),
 		rest.Get("/api/1/fee", GetAllFeeChargeRecord),
+		rest.Get("/api/1/secret-register-cost", GetAllSecretRegisterCost),
+		rest.Get("/api/1/reveal-margin", GetRevealMargin),
+		rest.Get("/api/1/disputes", GetDisputeActions),
+		rest.Get("/api/1/auto-settle", GetAutoSettles),
+		/*
+			autopilot
+		*/
+		rest.Get("/api/1/autopilot/:token", GetAutopilotPolicy),
+		rest.Post("/api/1/autopilot/:token", SetAutopilotPolicy),
+		rest.Get("/api/1/autopilot/:token/decisions", GetAutopilotDecisions),
+		/*
+			risk limits of mediation, limits without partner apply to the whole token
+			{"max_locked_amount":1000,"max_transfer_amount":100,"max_pending_locks":10}
+		*/
+		rest.Get("/api/1/mediation-limits", GetMediationLimits),
+		rest.Post("/api/1/mediation-limits/:token", SetMediationLimit),
+		rest.Post("/api/1/mediation-limits/:token/:partner", SetMediationLimit),
+		rest.Delete("/api/1/mediation-limits/:token", RemoveMediationLimit),
+		rest.Delete("/api/1/mediation-limits/:token/:partner", RemoveMediationLimit),
+		rest.Get("/api/1/routing-history", GetRoutingHistory),
+		rest.Get("/api/1/routing-history/:amount", GetRoutingHistory),
+		rest.Delete("/api/1/routing-history", ResetRoutingHistory),
+		rest.Delete("/api/1/routing-history/:token/:partner", ResetRoutingHistory),
 
 		/*
 			test
@@ -105,12 +134,12 @@ func Start() {
 		*/
 		rest.Put("/api/1/withdraw/:channel", withdraw),
 		/*
-			1. prepare for withdraw:
-			{"op":"preparesettle",}
-			3. cancel prepare:
-			{"op": "cancelprepare"}
+			settle channel cooperatively, fall back to close and settle automatically if partner doesn't agree in time
+			{"timeout":20}
 		*/
-		rest.Put("/api/1/settle/:channel", nil),
+		rest.Put("/api/1/settle/:channel", SettleChannel),
+		rest.Get("/api/1/settle/:channel", GetSettleOperation),
+		rest.Get("/api/1/settle", GetSettleOperations),
 		/*
 			events
 		*/
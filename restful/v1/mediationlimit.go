@@ -0,0 +1,81 @@
+package v1
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/SmartMeshFoundation/Atmosphere/log"
+	"github.com/SmartMeshFoundation/Atmosphere/models"
+	"github.com/SmartMeshFoundation/Atmosphere/utils"
+	"github.com/ant0ine/go-json-rest/rest"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// mediationLimitAddresses : token and partner in path, partner is empty if not given
+func mediationLimitAddresses(r *rest.Request) (tokenAddr, partnerAddr common.Address, err error) {
+	tokenAddr, err = utils.HexToAddress(r.PathParam("token"))
+	if err != nil {
+		return
+	}
+	if len(r.PathParam("partner")) > 0 {
+		partnerAddr, err = utils.HexToAddress(r.PathParam("partner"))
+	}
+	return
+}
+
+// GetMediationLimits : all risk limits of mediation
+func GetMediationLimits(w rest.ResponseWriter, r *rest.Request) {
+	err := w.WriteJson(API.GetMediationLimits())
+	if err != nil {
+		log.Warn(fmt.Sprintf("writejson err %s", err))
+	}
+}
+
+// SetMediationLimit : create or replace risk limit of mediation on token, for partner if given
+func SetMediationLimit(w rest.ResponseWriter, r *rest.Request) {
+	var err error
+	defer func() {
+		log.Trace(fmt.Sprintf("Restful Api Call ----> SetMediationLimit ,err=%v", err))
+	}()
+	tokenAddr, partnerAddr, err := mediationLimitAddresses(r)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req := &models.MediationLimit{}
+	err = r.DecodeJsonPayload(req)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.TokenAddress = tokenAddr
+	req.PartnerAddress = partnerAddr
+	err = API.SetMediationLimit(req)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = w.WriteJson(req)
+	if err != nil {
+		log.Warn(fmt.Sprintf("writejson err %s", err))
+	}
+}
+
+// RemoveMediationLimit : remove risk limit of mediation on token, for partner if given
+func RemoveMediationLimit(w rest.ResponseWriter, r *rest.Request) {
+	var err error
+	defer func() {
+		log.Trace(fmt.Sprintf("Restful Api Call ----> RemoveMediationLimit ,err=%v", err))
+	}()
+	tokenAddr, partnerAddr, err := mediationLimitAddresses(r)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = API.RemoveMediationLimit(tokenAddr, partnerAddr)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
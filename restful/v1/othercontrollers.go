@@ -164,3 +164,35 @@ func GetAllFeeChargeRecord(w rest.ResponseWriter, r *rest.Request) {
 		log.Warn(fmt.Sprintf("writejson err %s", err))
 	}
 }
+
+// GetAllSecretRegisterCost :
+func GetAllSecretRegisterCost(w rest.ResponseWriter, r *rest.Request) {
+	err := w.WriteJson(API.GetAllSecretRegisterCost())
+	if err != nil {
+		log.Warn(fmt.Sprintf("writejson err %s", err))
+	}
+}
+
+// GetDisputeActions :
+func GetDisputeActions(w rest.ResponseWriter, r *rest.Request) {
+	err := w.WriteJson(API.GetDisputeActions())
+	if err != nil {
+		log.Warn(fmt.Sprintf("writejson err %s", err))
+	}
+}
+
+// GetAutoSettles :
+func GetAutoSettles(w rest.ResponseWriter, r *rest.Request) {
+	err := w.WriteJson(API.GetAutoSettles())
+	if err != nil {
+		log.Warn(fmt.Sprintf("writejson err %s", err))
+	}
+}
+
+// GetRevealMargin :
+func GetRevealMargin(w rest.ResponseWriter, r *rest.Request) {
+	err := w.WriteJson(API.GetRevealMargin())
+	if err != nil {
+		log.Warn(fmt.Sprintf("writejson err %s", err))
+	}
+}
@@ -0,0 +1,59 @@
+package v1
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+
+	"github.com/SmartMeshFoundation/Atmosphere/log"
+	"github.com/SmartMeshFoundation/Atmosphere/utils"
+	"github.com/ant0ine/go-json-rest/rest"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// GetRoutingHistory : transfer results of all channels and how likely a transfer of amount succeeds now,
+// amount in path is optional, the latest transfer amount of every channel is used if not given
+func GetRoutingHistory(w rest.ResponseWriter, r *rest.Request) {
+	var amount *big.Int
+	if len(r.PathParam("amount")) > 0 {
+		var ok bool
+		amount, ok = new(big.Int).SetString(r.PathParam("amount"), 0)
+		if !ok || amount.Sign() < 0 {
+			rest.Error(w, fmt.Sprintf("invalid amount %s", r.PathParam("amount")), http.StatusBadRequest)
+			return
+		}
+	}
+	err := w.WriteJson(API.GetRoutingHistory(amount))
+	if err != nil {
+		log.Warn(fmt.Sprintf("writejson err %s", err))
+	}
+}
+
+// ResetRoutingHistory : forget transfer results of channel on token with partner, or all channels if not given
+func ResetRoutingHistory(w rest.ResponseWriter, r *rest.Request) {
+	var err error
+	defer func() {
+		log.Trace(fmt.Sprintf("Restful Api Call ----> ResetRoutingHistory ,err=%v", err))
+	}()
+	var tokenAddr, partnerAddr common.Address
+	if len(r.PathParam("token")) > 0 {
+		tokenAddr, err = utils.HexToAddress(r.PathParam("token"))
+		if err == nil {
+			partnerAddr, err = utils.HexToAddress(r.PathParam("partner"))
+		}
+		if err == nil && (tokenAddr == utils.EmptyAddress || partnerAddr == utils.EmptyAddress) {
+			err = errors.New("token and partner must not be empty")
+		}
+		if err != nil {
+			rest.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	err = API.ResetRoutingHistory(tokenAddr, partnerAddr)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -5,9 +5,12 @@ import (
 	"math/big"
 	"net/http"
 	"strings"
+	"time"
 
+	"github.com/SmartMeshFoundation/Atmosphere/encoding"
 	"github.com/SmartMeshFoundation/Atmosphere/log"
 	"github.com/SmartMeshFoundation/Atmosphere/params"
+	"github.com/SmartMeshFoundation/Atmosphere/transfer/mediatedtransfer"
 	"github.com/SmartMeshFoundation/Atmosphere/utils"
 	"github.com/ant0ine/go-json-rest/rest"
 	"github.com/ethereum/go-ethereum/common"
@@ -15,15 +18,19 @@ import (
 
 //TransferData post for transfers
 type TransferData struct {
-	Initiator      string   `json:"initiator_address"`
-	Target         string   `json:"target_address"`
-	Token          string   `json:"token_address"`
-	Amount         *big.Int `json:"amount"`
-	Secret         string   `json:"secret,omitempty"` // 当用户想使用自己指定的密码,而非随机密码时使用	// client can assign specific secret
-	LockSecretHash string   `json:"lockSecretHash"`
-	Fee            *big.Int `json:"fee,omitempty"`
-	IsDirect       bool     `json:"is_direct,omitempty"`
-	Sync           bool     `json:"sync,omitempty"` //是否同步
+	Initiator      string                `json:"initiator_address"`
+	Target         string                `json:"target_address"`
+	Token          string                `json:"token_address"`
+	Amount         *big.Int              `json:"amount"`
+	Secret         string                `json:"secret,omitempty"` // 当用户想使用自己指定的密码,而非随机密码时使用	// client can assign specific secret
+	LockSecretHash string                `json:"lockSecretHash"`
+	Fee            *big.Int              `json:"fee,omitempty"`
+	IsDirect       bool                  `json:"is_direct,omitempty"`
+	Sync           bool                  `json:"sync,omitempty"`            //是否同步
+	MaxFee         *big.Int              `json:"max_fee,omitempty"`         // 给中间节点的总手续费上限	// max total fee paid to mediators
+	MaxLockBlocks  int64                 `json:"max_lock_blocks,omitempty"` // 锁定的最长块数	// max number of blocks tokens are locked
+	Deadline       int64                 `json:"deadline,omitempty"`        // 截止块数	// block number after which no route is tried
+	RouteHints     []*encoding.RouteHint `json:"route_hints,omitempty"`     // 收款人提供的到达它的最后几跳	// last hops to reach the target provided by the target
 }
 
 /*
@@ -110,11 +117,23 @@ func Transfers(w rest.ResponseWriter, r *rest.Request) {
 		rest.Error(w, "Invalid secret", http.StatusBadRequest)
 		return
 	}
+	if (req.MaxFee != nil && req.MaxFee.Sign() < 0) || req.MaxLockBlocks < 0 || req.Deadline < 0 {
+		rest.Error(w, "Invalid constraints", http.StatusBadRequest)
+		return
+	}
+	var constraints *mediatedtransfer.TransferConstraints
+	if req.MaxFee != nil || req.MaxLockBlocks > 0 || req.Deadline > 0 {
+		constraints = &mediatedtransfer.TransferConstraints{
+			MaxFee:        req.MaxFee,
+			MaxLockBlocks: req.MaxLockBlocks,
+			Deadline:      req.Deadline,
+		}
+	}
 	var result *utils.AsyncResult
 	if req.Sync {
-		result, err = API.Transfer(tokenAddr, req.Amount, req.Fee, targetAddr, common.HexToHash(req.Secret), params.DefaultMaxRequestTimeout, req.IsDirect)
+		result, err = API.Transfer(tokenAddr, req.Amount, req.Fee, targetAddr, common.HexToHash(req.Secret), params.DefaultMaxRequestTimeout, req.IsDirect, constraints, req.RouteHints)
 	} else {
-		result, err = API.TransferAsync(tokenAddr, req.Amount, req.Fee, targetAddr, common.HexToHash(req.Secret), req.IsDirect)
+		result, err = API.TransferAsync(tokenAddr, req.Amount, req.Fee, targetAddr, common.HexToHash(req.Secret), req.IsDirect, constraints, req.RouteHints)
 	}
 	if err != nil {
 		rest.Error(w, err.Error(), http.StatusConflict)
@@ -178,3 +197,63 @@ func CancelTransfer(w rest.ResponseWriter, r *rest.Request) {
 		return
 	}
 }
+
+//RebalanceData post for rebalance
+type RebalanceData struct {
+	Token          string   `json:"token_address"`
+	Partner        string   `json:"partner_address"`
+	Amount         *big.Int `json:"amount"`
+	MaxFee         *big.Int `json:"max_fee,omitempty"`
+	LockSecretHash string   `json:"lockSecretHash"`
+	Sync           bool     `json:"sync,omitempty"` //是否同步
+}
+
+/*
+Rebalance is the api of /rebalance/:token/:partner
+it refills our balance on the channel with partner by sending tokens to ourselves through a circular route.
+*/
+func Rebalance(w rest.ResponseWriter, r *rest.Request) {
+	var err error
+	defer func() {
+		log.Trace(fmt.Sprintf("Restful Api Call ----> Rebalance ,err=%v", err))
+	}()
+	tokenAddr, err := utils.HexToAddress(r.PathParam("token"))
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	partnerAddr, err := utils.HexToAddress(r.PathParam("partner"))
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req := &RebalanceData{}
+	err = r.DecodeJsonPayload(req)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Amount == nil || req.Amount.Cmp(utils.BigInt0) <= 0 {
+		rest.Error(w, "Invalid amount", http.StatusBadRequest)
+		return
+	}
+	if req.MaxFee == nil {
+		req.MaxFee = utils.BigInt0
+	}
+	var timeout time.Duration
+	if req.Sync {
+		timeout = params.DefaultMaxRequestTimeout
+	}
+	result, err := API.Rebalance(tokenAddr, partnerAddr, req.Amount, req.MaxFee, timeout)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	req.Token = tokenAddr.String()
+	req.Partner = partnerAddr.String()
+	req.LockSecretHash = result.LockSecretHash.String()
+	err = w.WriteJson(req)
+	if err != nil {
+		log.Warn(fmt.Sprintf("writejson err %s", err))
+	}
+}
@@ -96,3 +96,61 @@ func RegisterSecret(w rest.ResponseWriter, r *rest.Request) {
 		return
 	}
 }
+
+// GetHeldTransfers :
+// 应用要求 hold 的交易中,所有等待 settle 或者 cancel 的交易
+// GetHeldTransfers : transfers the application asked to hold, which are waiting to be settled or canceled.
+func GetHeldTransfers(w rest.ResponseWriter, r *rest.Request) {
+	var err error
+	defer func() {
+		log.Trace(fmt.Sprintf("Restful Api Call ----> GetHeldTransfers ,err=%v", err))
+	}()
+	transfers, err := API.GetHeldTransfers()
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = w.WriteJson(transfers)
+	if err != nil {
+		log.Warn(fmt.Sprintf("writejson err %s", err))
+	}
+}
+
+// SettleOrCancelHeldTransfer :
+// op 为 hold 时,收到这笔交易以后 hold 住, 必须在收到之前调用; 为 settle 时接受 hold 住的交易, 为 cancel 时拒绝.
+// SettleOrCancelHeldTransfer : hold the transfer when it's received if op is hold, which must be done before it's received,
+// accept the held transfer when op is settle, refuse it when op is cancel.
+func SettleOrCancelHeldTransfer(w rest.ResponseWriter, r *rest.Request) {
+	var err error
+	defer func() {
+		log.Trace(fmt.Sprintf("Restful Api Call ----> SettleOrCancelHeldTransfer ,err=%v", err))
+	}()
+	const OpHold = "hold"
+	const OpSettle = "settle"
+	const OpCancel = "cancel"
+	tokenAddress, err := utils.HexToAddress(r.PathParam("token"))
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	lockSecretHash := common.HexToHash(r.PathParam("locksecrethash"))
+	if lockSecretHash == utils.EmptyHash {
+		rest.Error(w, "Invalid lockSecretHash", http.StatusBadRequest)
+		return
+	}
+	switch r.PathParam("op") {
+	case OpHold:
+		err = API.HoldTransfer(lockSecretHash, tokenAddress)
+	case OpSettle:
+		err = API.SettleHeldTransfer(lockSecretHash, tokenAddress)
+	case OpCancel:
+		err = API.CancelHeldTransfer(lockSecretHash, tokenAddress)
+	default:
+		rest.Error(w, "unknown op", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+}
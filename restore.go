@@ -2,9 +2,13 @@ package atmosphere
 
 import (
 	"fmt"
+	"sort"
 
 	"github.com/SmartMeshFoundation/Atmosphere/channel"
+	"github.com/SmartMeshFoundation/Atmosphere/channel/channeltype"
+	"github.com/SmartMeshFoundation/Atmosphere/encoding"
 	"github.com/SmartMeshFoundation/Atmosphere/log"
+	"github.com/SmartMeshFoundation/Atmosphere/models"
 	"github.com/SmartMeshFoundation/Atmosphere/transfer"
 	"github.com/SmartMeshFoundation/Atmosphere/transfer/mediatedtransfer"
 	"github.com/SmartMeshFoundation/Atmosphere/transfer/mediatedtransfer/crashnode"
@@ -15,46 +19,242 @@ import (
 
 /*
 重启完毕以后,根据数据库中保存的数据,恢复操作
-1. 未发送成功的 EnvelopMessage 继续发送
-2. 持有的锁,建立对应的 StateManager, 对这些未完成的交易进行简单维护处理
+1. 从快照和 StateChange 日志恢复进行中交易的 StateManager
+2. 持有的锁,如果没有恢复出来对应的 StateManager, 建立 crashnode StateManager, 对这些未完成的交易进行简单维护处理
+3. 未发送成功的 EnvelopMessage 继续发送
+4. 没有完成的 settle 操作继续执行
 */
 /*
  *	restore : function to restore data.
  *
  *	Note that
- *		1. unsuccessful EnvelopMessages resume to be sent.
- *		2. to create related StateManager as to those locks withholden by a particpant.
+ *		1. StateManagers of ongoing transfers are restored from snapshots and logs of StateChange.
+ *		2. to create crashnode StateManager as to those locks withholden by a particpant, if no StateManager is restored for them.
+ *		3. unsuccessful EnvelopMessages resume to be sent.
+ *		4. settle operations not finished go on.
  */
 func (rs *Service) restore() {
-	//1. 处理未完成的锁
-	// 1. handle incomplete locks
+	//1. 恢复进行中的交易
+	// 1. restore ongoing transfers
+	rs.restoreStateManagers()
+	//2. 处理未完成的锁
+	// 2. handle incomplete locks
 	rs.restoreLocks()
-	//2. 为发送成功的 EnvelopMessage 继续发送
-	// 2. keep sending EnvelopMessage that failed previously.
-	rs.reSendEnvelopMessage()
+	//3. 为发送成功的 EnvelopMessage 继续发送, 要等到连接上公链并且历史事件处理完毕以后, 否则通道状态和块高度都可能是旧的
+	// 3. keep sending EnvelopMessage that failed previously after connected to chain and history events are handled,
+	// otherwise channel state and block number may be out of date.
+	rs.resendAfterHistoryEvents = true
+	//4. 继续执行没有完成的 settle 操作
+	// 4. go on with settle operations not finished
+	rs.settleOperations.restore()
 }
+
+/*
+restoreStateManagers 从最近的快照恢复每个 StateManager, 然后按照写入的顺序把快照之后的 StateChange 重新交给状态机处理.
+通道已经不存在等原因导致无法恢复的 StateManager 直接删除, 它持有的锁交给 crashnode 处理.
+*/
+/*
+ *	restoreStateManagers : restore every StateManager from its latest snapshot,
+ *	then hand StateChanges after the snapshot to state machine again in the order they were written.
+ *	StateManager which can not be restored, because its channel no longer exists for example, is removed,
+ *	and locks it holds are handled by crashnode.
+ */
+func (rs *Service) restoreStateManagers() {
+	id2Manager := make(map[int64]*transfer.StateManager)
+	for _, mgr := range rs.db.GetAllStateManagers() {
+		mgr.FuncStateTransition = transfer.GetStateTransition(mgr.Name)
+		var err error
+		if mgr.FuncStateTransition == nil {
+			err = fmt.Errorf("unknown state machine %s", mgr.Name)
+		} else {
+			err = mediatedtransfer.RestoreState(mgr.CurrentState, rs.db, rs.getChannelWithAddr)
+		}
+		if err != nil {
+			log.Error(fmt.Sprintf("restore StateManager %s err %s", utils.HPex(mgr.Identifier), err))
+			rs.removeStoredStateManager(mgr)
+			continue
+		}
+		id2Manager[mgr.ID] = mgr
+	}
+	logs := rs.db.GetAllStateChangeLogs()
+	hasLog := make(map[int64]bool)
+	for _, l := range logs {
+		mgr := id2Manager[l.StateManagerID]
+		if mgr == nil {
+			continue
+		}
+		err := mediatedtransfer.RestoreStateChange(l.StateChange, rs.db, rs.getChannelWithAddr)
+		if err != nil {
+			log.Error(fmt.Sprintf("restore StateChange %d of StateManager %s err %s", l.ID, utils.HPex(mgr.Identifier), err))
+			rs.removeStoredStateManager(mgr)
+			delete(id2Manager, mgr.ID)
+			continue
+		}
+		hasLog[mgr.ID] = true
+	}
+	for id, mgr := range id2Manager {
+		//崩溃在第一个 StateChange 写入之前,这个 StateManager 什么都没做
+		// crash before the first StateChange is written, this StateManager did nothing.
+		if mgr.CurrentState == nil && !hasLog[id] {
+			rs.removeStoredStateManager(mgr)
+			delete(id2Manager, id)
+			continue
+		}
+		rs.Transfer2StateManager[mgr.Key] = mgr
+	}
+	for _, l := range logs {
+		mgr := id2Manager[l.StateManagerID]
+		//重放的过程中可能已经移除了
+		// it may be removed during replay
+		if mgr == nil || rs.Transfer2StateManager[mgr.Key] != mgr {
+			continue
+		}
+		rs.StateMachineEventHandler.replay(mgr, l)
+	}
+	log.Info(fmt.Sprintf("restore %d StateManagers, replay %d StateChanges", len(id2Manager), len(logs)))
+}
+/*
+resendSummary 重启后重发消息的统计, 记录每一类被丢弃的消息有多少.
+*/
+// resendSummary : statistics of resending messages after restart, how many messages are dropped for every reason.
+type resendSummary struct {
+	resend        int
+	noChannel     int //通道不存在或者已经 settle 以后重新打开 // channel not found or reopened after settle
+	closedChannel int
+	wrongReceiver int
+	unknownNonce  int //通道中没有记录的 nonce // nonce not recorded in channel
+	expired       int //已经过期但是仍然要发送的 MediatedTransfer // expired MediatedTransfer which is still resent
+	removeExpired int //过期以后补发 RemoveExpiredHashlockTransfer 的锁 // locks followed by RemoveExpiredHashlockTransfer since expired
+}
+
+func (s *resendSummary) String() string {
+	return fmt.Sprintf("resend %d messages(%d expired MediatedTransfer,%d followed by RemoveExpiredHashlockTransfer),drop %d for missing channel,%d for closed channel,%d for wrong receiver,%d for unknown nonce",
+		s.resend, s.expired, s.removeExpired, s.noChannel, s.closedChannel, s.wrongReceiver, s.unknownNonce)
+}
+
+/*
+classifyEnvelopMessages 根据通道当前的状态检查每一个没有收到 ack 的消息:
+1. 通道不存在, 或者是已经 settle 的旧通道的消息, 丢弃
+2. 通道已经关闭或者 settle, 对方不可能再处理链下的消息, 丢弃
+3. 接收方不是通道的对方, 丢弃
+4. nonce 比通道中我方最新的 nonce 还大, 说明通道没有保存这个消息的修改, 丢弃
+剩下的消息按照通道分组, 每个通道内部按照 nonce 从小到大排序.
+通道打开的情况下, 即使 MediatedTransfer 已经过期, 或者 Unlock 对应的密码已经在链上注册, 也必须原样发送,
+因为后面的每一个消息都是建立在它的 nonce 之上的, 对方也可能已经处理过只是 ack 丢了, 丢掉或者用同样的 nonce 换一个消息, 通道双方就再也无法同步了.
+过期的 MediatedTransfer 如果锁仍然在通道中, 放到 removeExpired 中, 由调用者在这个通道的最后一个消息之后补发 RemoveExpiredHashlockTransfer 移除这个锁.
+Unlock 不需要改写, 密码在链上注册以后状态机本来就要发送 Unlock, 它已经把锁从 locksroot 中移除了, 对方不会既在链上又在链下拿到这笔钱.
+*/
+/*
+ *	classifyEnvelopMessages : check every message not acked yet against current state of its channel:
+ *	1. channel not found, or message of an old channel which has been settled, drop it.
+ *	2. channel is closed or settled, partner can no longer handle off-chain messages, drop it.
+ *	3. receiver is not partner of channel, drop it.
+ *	4. nonce is larger than our latest nonce in channel, modifications of this message were not saved in channel, drop it.
+ *	The rest are grouped by channel and ordered by nonce within each channel.
+ *	When the channel is open, a MediatedTransfer must be sent as is even if it has expired, so must an Unlock whose secret has been registered on-chain,
+ *	because every later message builds on its nonce, and partner may have handled it with only the ack lost,
+ *	dropping any of them or replacing it with another message of the same nonce breaks sync of both participants forever.
+ *	An expired MediatedTransfer whose lock is still in channel is put into removeExpired,
+ *	the caller follows the last message of its channel with a RemoveExpiredHashlockTransfer to remove the lock.
+ *	An Unlock needs no rewrite, state machine sends Unlock right after the secret is registered on-chain,
+ *	and it has removed the lock from locksroot, partner can't get the tokens both on-chain and off-chain.
+ */
+func classifyEnvelopMessages(msgs []*models.SentEnvelopMessager, findChannel mediatedtransfer.ChannelFinder, blockNumber int64) (resend, drop, removeExpired []*models.SentEnvelopMessager, summary *resendSummary) {
+	summary = &resendSummary{}
+	var channelOrder []common.Hash
+	channel2Msgs := make(map[common.Hash][]*models.SentEnvelopMessager)
+	for _, msg := range msgs {
+		env := msg.Message.GetEnvelopMessage()
+		ch := findChannel(env.ChannelIdentifier)
+		switch {
+		case ch == nil || ch.ChannelIdentifier.OpenBlockNumber != env.OpenBlockNumber:
+			summary.noChannel++
+		case ch.State == channeltype.StateClosed || ch.State == channeltype.StateSettled || ch.ExternState.ClosedBlock != 0:
+			summary.closedChannel++
+		case ch.PartnerState.Address != msg.Receiver:
+			summary.wrongReceiver++
+		case env.Nonce > ch.OurState.BalanceProofState.Nonce:
+			summary.unknownNonce++
+		default:
+			if mtr, ok := msg.Message.(*encoding.MediatedTransfer); ok && mtr.Expiration <= blockNumber {
+				summary.expired++
+				if _, ok = ch.OurState.Lock2PendingLocks[mtr.LockSecretHash]; ok {
+					removeExpired = append(removeExpired, msg)
+				}
+			}
+			if _, ok := channel2Msgs[env.ChannelIdentifier]; !ok {
+				channelOrder = append(channelOrder, env.ChannelIdentifier)
+			}
+			channel2Msgs[env.ChannelIdentifier] = append(channel2Msgs[env.ChannelIdentifier], msg)
+			continue
+		}
+		drop = append(drop, msg)
+	}
+	for _, c := range channelOrder {
+		cmsgs := channel2Msgs[c]
+		sort.SliceStable(cmsgs, func(i, j int) bool {
+			return cmsgs[i].Message.GetEnvelopMessage().Nonce < cmsgs[j].Message.GetEnvelopMessage().Nonce
+		})
+		resend = append(resend, cmsgs...)
+	}
+	summary.resend = len(resend)
+	summary.removeExpired = len(removeExpired)
+	return
+}
+
+/*
+reSendEnvelopMessage 重发没有收到 ack 的消息, 必须在历史的链上事件处理完毕以后调用, 这样通道状态才是最新的.
+*/
+// reSendEnvelopMessage : resend messages not acked yet, it must be called after history events on chain are handled, so that channel state is up to date.
 func (rs *Service) reSendEnvelopMessage() {
+	commit := rs.beginUnitOfWork()
+	defer commit()
 	msgs := rs.db.GetAllOrderedSentEnvelopMessager()
-	for _, msg := range msgs {
-		/*
-			todo 存在问题:
-			1.应该等待历史消息处理完毕以后再发送消息
-			2. 有些消息是不需要发送的,比如 unlock 消息,如果对在链上注册了密码,那么会在其他地方触发发送 unlock 消息
-			3. 已经过期的MediatedTransfer?
-			4. 通道已经 settle 的消息?
-		*/
-		/*
-		 *	todo have problem here :
-		 *	1. we should wait after handling history message then continue.
-		 *	2. Some messages are no need to send, like unlock, if pairs register their secret on chain, then other pairs will be triggered to send unlock.
-		 *	3. How to deal with expired MediatedTransfer?
-		 *	4. How to deal with messages after channel settle?
-		 */
+	resend, drop, removeExpired, summary := classifyEnvelopMessages(msgs, rs.getChannelWithAddr, rs.GetBlockNumber())
+	for _, msg := range drop {
+		log.Info(fmt.Sprintf("reSendEnvelopMessage drop %s to %s", msg.Message, utils.APex2(msg.Receiver)))
+		rs.dao().DeleteEnvelopMessager(common.BytesToHash(msg.EchoHash))
+	}
+	for _, msg := range resend {
 		err := rs.sendAsync(msg.Receiver, msg.Message)
 		if err != nil {
 			log.Error(fmt.Sprintf("reSendEnvelopMessage %s to %s err %s", msg.Message, msg.Receiver, err))
 		}
 	}
+	for _, msg := range removeExpired {
+		mtr := msg.Message.(*encoding.MediatedTransfer)
+		err := rs.removeExpiredLock(rs.getChannelWithAddr(mtr.ChannelIdentifier), mtr.LockSecretHash)
+		if err != nil {
+			log.Error(fmt.Sprintf("reSendEnvelopMessage remove expired lock %s err %s", utils.HPex(mtr.LockSecretHash), err))
+		}
+	}
+	log.Info(fmt.Sprintf("reSendEnvelopMessage %s", summary))
+}
+
+/*
+removeExpiredLock 给对方发送 RemoveExpiredHashlockTransfer, 移除我发出的已经过期的锁.
+重发的消息已经在前面排队了, 所以它一定在这个通道之前所有消息的后面.
+*/
+// removeExpiredLock : send RemoveExpiredHashlockTransfer to partner to remove an expired lock sent by me,
+// it's queued after all previous messages of the channel since they are resent already.
+func (rs *Service) removeExpiredLock(ch *channel.Channel, lockSecretHash common.Hash) error {
+	tr, err := ch.CreateRemoveExpiredHashLockTransfer(lockSecretHash, rs.GetBlockNumber())
+	if err != nil {
+		return err
+	}
+	err = tr.Sign(rs.PrivateKey, tr)
+	if err != nil {
+		return err
+	}
+	err = ch.RegisterRemoveExpiredHashlockTransfer(tr, rs.GetBlockNumber())
+	if err != nil {
+		return err
+	}
+	err = rs.dao().UpdateChannelNoTx(channel.NewChannelSerialization(ch))
+	if err != nil {
+		return err
+	}
+	return rs.sendAsync(ch.PartnerState.Address, tr)
 }
 
 type lockInfo struct {
@@ -136,6 +336,11 @@ func (rs *Service) restoreLocks() {
 	//根据ActionInitCrashRestartStateChange,创建对应的 stateManager
 	// Create corresponding stateManager, according to ActionInitCrashRestartStateChange.
 	for k, st := range token2ActionInitCrashRestartStateChange {
+		if rs.Transfer2StateManager[k] != nil {
+			//这笔交易的 StateManager 已经从日志中恢复了
+			// StateManager of this transfer is already restored from log
+			continue
+		}
 		stateManager := transfer.NewStateManager(crashnode.StateTransition, nil, crashnode.NameCrashNodeTransition, st.LockSecretHash, st.Token)
 		rs.Transfer2StateManager[k] = stateManager
 		rs.StateMachineEventHandler.dispatch(stateManager, st)
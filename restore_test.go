@@ -0,0 +1,440 @@
+package atmosphere
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/gob"
+	"math/big"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+
+	"github.com/SmartMeshFoundation/Atmosphere/channel"
+	"github.com/SmartMeshFoundation/Atmosphere/channel/channeltype"
+	"github.com/SmartMeshFoundation/Atmosphere/encoding"
+	"github.com/SmartMeshFoundation/Atmosphere/models"
+	"github.com/SmartMeshFoundation/Atmosphere/network"
+	"github.com/SmartMeshFoundation/Atmosphere/network/graph"
+	"github.com/SmartMeshFoundation/Atmosphere/notify"
+	"github.com/SmartMeshFoundation/Atmosphere/params"
+	"github.com/SmartMeshFoundation/Atmosphere/transfer"
+	"github.com/SmartMeshFoundation/Atmosphere/transfer/mediatedtransfer"
+	"github.com/SmartMeshFoundation/Atmosphere/transfer/mediatedtransfer/initiator"
+	"github.com/SmartMeshFoundation/Atmosphere/transfer/mediatedtransfer/mediator"
+	"github.com/SmartMeshFoundation/Atmosphere/transfer/mediatedtransfer/target"
+	"github.com/SmartMeshFoundation/Atmosphere/transfer/mtree"
+	"github.com/SmartMeshFoundation/Atmosphere/transfer/route"
+	"github.com/SmartMeshFoundation/Atmosphere/utils"
+	"github.com/SmartMeshFoundation/Atmosphere/utils/utest"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyEnvelopMessages(t *testing.T) {
+	var blockNumber int64 = 100
+	ch1 := utest.MakeRoute(utest.HOP1, big.NewInt(100), utest.UnitSettleTimeout, utest.UnitRevealTimeout, 0, utils.NewRandomHash()).Channel()
+	ch1.OurState.BalanceProofState.Nonce = 3
+	ch2 := utest.MakeRoute(utest.HOP2, big.NewInt(100), utest.UnitSettleTimeout, utest.UnitRevealTimeout, 50, utils.NewRandomHash()).Channel()
+	findChannel := func(channelIdentifier common.Hash) *channel.Channel {
+		for _, ch := range []*channel.Channel{ch1, ch2} {
+			if ch.ChannelIdentifier.ChannelIdentifier == channelIdentifier {
+				return ch
+			}
+		}
+		return nil
+	}
+	newMsg := func(ch *channel.Channel, nonce uint64, receiver common.Address, expiration int64) *models.SentEnvelopMessager {
+		cid := ch.ChannelIdentifier
+		bp := encoding.NewBalanceProof(nonce, utils.BigInt0, utils.EmptyHash, &cid)
+		var msg encoding.EnvelopMessager
+		if expiration > 0 {
+			msg = encoding.NewMediatedTransfer(bp, &mtree.Lock{Expiration: expiration, Amount: big.NewInt(1), LockSecretHash: utils.NewRandomHash()}, utest.HOP3, utest.ADDR, utils.BigInt0)
+		} else {
+			msg = encoding.NewDirectTransfer(bp)
+		}
+		return &models.SentEnvelopMessager{
+			Message:  msg,
+			Receiver: receiver,
+			EchoHash: utils.NewRandomHash().Bytes(),
+		}
+	}
+	expired := newMsg(ch1, 3, utest.HOP1, blockNumber-1)
+	lock := expired.Message.(*encoding.MediatedTransfer).GetLock()
+	ch1.OurState.Lock2PendingLocks[lock.LockSecretHash] = channeltype.PendingLock{Lock: lock, LockHash: lock.Hash()}
+	//lock already removed
+	removed := newMsg(ch1, 1, utest.HOP1, blockNumber)
+	direct := newMsg(ch1, 2, utest.HOP1, 0)
+	oldChannel := newMsg(ch1, 1, utest.HOP1, 0)
+	oldChannel.Message.GetEnvelopMessage().OpenBlockNumber++
+	noChannel := newMsg(ch1, 1, utest.HOP1, 0)
+	noChannel.Message.GetEnvelopMessage().ChannelIdentifier = utils.NewRandomHash()
+	msgs := []*models.SentEnvelopMessager{
+		expired,
+		newMsg(ch1, 4, utest.HOP1, 0), //unknown nonce
+		newMsg(ch1, 1, utest.HOP2, 0), //wrong receiver
+		newMsg(ch2, 1, utest.HOP2, 0), //closed channel
+		noChannel,
+		oldChannel,
+		direct,
+		removed,
+	}
+	resend, drop, removeExpired, summary := classifyEnvelopMessages(msgs, findChannel, blockNumber)
+	if len(resend) != 3 || resend[0] != removed || resend[1] != direct || resend[2] != expired {
+		t.Errorf("resend should be ordered by nonce,got %v", resend)
+	}
+	if len(drop) != 5 {
+		t.Errorf("drop %d messages,expect 5", len(drop))
+	}
+	if len(removeExpired) != 1 || removeExpired[0] != expired {
+		t.Errorf("only expired lock still in channel should be removed,got %v", removeExpired)
+	}
+	if summary.resend != 3 || summary.expired != 2 || summary.removeExpired != 1 || summary.unknownNonce != 1 || summary.wrongReceiver != 1 ||
+		summary.closedChannel != 1 || summary.noChannel != 2 {
+		t.Errorf("wrong summary %s", summary)
+	}
+}
+
+func newTestReplayService(t *testing.T, db *models.ModelDB, key *ecdsa.PrivateKey, chs ...*channel.Channel) *Service {
+	nodeAddress := crypto.PubkeyToAddress(key.PublicKey)
+	g := graph.NewChannelGraph(nodeAddress, chs[0].TokenAddress, nil)
+	for _, ch := range chs {
+		err := g.AddChannel(ch)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	rs := &Service{
+		PrivateKey:                      key,
+		NodeAddress:                     nodeAddress,
+		Config:                          &params.Config{},
+		BlockNumber:                     new(atomic.Value),
+		NotifyHandler:                   notify.NewNotifyHandler(),
+		db:                              db,
+		Token2ChannelGraph:              map[common.Address]*graph.ChannelGraph{chs[0].TokenAddress: g},
+		Token2Hashlock2Channels:         make(map[common.Address]map[common.Hash][]*channel.Channel),
+		Transfer2StateManager:           make(map[common.Hash]*transfer.StateManager),
+		SentMediatedTransferListenerMap: make(map[*SentMediatedTransferListener]bool),
+	}
+	rs.BlockNumber.Store(int64(1))
+	rs.StateMachineEventHandler = newStateMachineEventHandler(rs)
+	/* #nosec */
+	rs.Protocol = network.NewPhotonProtocol(network.MakeTestUDPTransport(utils.RandomString(10), rand.Intn(1000)+40000), key, rs)
+	return rs
+}
+
+func encodeState(t *testing.T, state transfer.State) []byte {
+	//db is set when restored
+	switch s := state.(type) {
+	case *mediatedtransfer.InitiatorState:
+		s.Db = nil
+	case *mediatedtransfer.MediatorState:
+		s.Db = nil
+	case *mediatedtransfer.TargetState:
+		s.Db = nil
+	}
+	buf := new(bytes.Buffer)
+	err := gob.NewEncoder(buf).Encode(&state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+const (
+	crashBeforeDispatch = iota
+	crashBeforeSnapshot //events are applied, but snapshot is not saved
+	crashAfterDispatch
+)
+
+//crashReplayCase StateChanges dispatched to one StateManager of a node
+type crashReplayCase struct {
+	nodeKey      *ecdsa.PrivateKey
+	key          common.Hash                                        //key of the StateManager, Sha3(lockSecretHash,tokenAddress)
+	newChannels  func(ourAddress common.Address) []*channel.Channel //channels with the same identifiers for every run
+	newManager   func() *transfer.StateManager
+	stateChanges []transfer.StateChange
+	check        func(state transfer.State) //check end state without crash
+}
+
+/*
+在每一个 StateChange 处理之前, 事件已经处理但是快照还没有保存以及处理之后崩溃, 用 restoreStateManagers 恢复,
+继续处理剩下的 StateChange, 最终的状态必须和没有崩溃时完全一样, 已经处理过的事件恢复的时候不能再发送消息.
+*/
+// crash before every StateChange is handled, after its events are applied but before snapshot, and after it's handled,
+// restore by restoreStateManagers and go on with the rest, end state must be identical to that without crash,
+// and no message is sent again for events already applied when restored.
+func testCrashAndReplay(t *testing.T, c *crashReplayCase) {
+	ourAddress := crypto.PubkeyToAddress(c.nodeKey.PublicKey)
+	var chs []*channel.Channel
+	findChannel := func(channelIdentifier common.Hash) *channel.Channel {
+		for _, ch := range chs {
+			if channelIdentifier == ch.ChannelIdentifier.ChannelIdentifier {
+				return ch
+			}
+		}
+		return nil
+	}
+	//the same StateChange objects are handled many times, keep them unchanged by encoding
+	var encoded [][]byte
+	for _, st := range c.stateChanges {
+		encoded = append(encoded, encodeState(t, st))
+	}
+	decode := func(rs *Service, i int) transfer.StateChange {
+		var st transfer.StateChange
+		err := gob.NewDecoder(bytes.NewReader(encoded[i])).Decode(&st)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = mediatedtransfer.RestoreStateChange(st, rs.db, findChannel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch st2 := st.(type) {
+		case *mediatedtransfer.ActionInitTargetStateChange:
+			st2.Message.SetTag(&transfer.MessageTag{EchoHash: utils.NewRandomHash()})
+		case *mediatedtransfer.ActionInitMediatorStateChange:
+			st2.Message.SetTag(&transfer.MessageTag{EchoHash: utils.NewRandomHash()})
+		}
+		return st
+	}
+	key := c.key
+	dispatch := func(rs *Service, i int) {
+		st := decode(rs, i)
+		if _, ok := st.(*transfer.BlockStateChange); ok {
+			rs.StateMachineEventHandler.dispatchToAllTasks(st)
+		} else {
+			rs.StateMachineEventHandler.dispatch(rs.Transfer2StateManager[key], st)
+		}
+	}
+	start := func() *Service {
+		db, err := newTestDb()
+		if err != nil {
+			t.Fatal(err)
+		}
+		chs = c.newChannels(ourAddress)
+		rs := newTestReplayService(t, db, c.nodeKey, chs...)
+		rs.addStateManager(key, c.newManager())
+		return rs
+	}
+	stop := func(rs *Service) {
+		rs.Protocol.StopAndWait()
+		rs.db.CloseDB()
+	}
+
+	rs := start()
+	for i := range c.stateChanges {
+		dispatch(rs, i)
+	}
+	c.check(rs.Transfer2StateManager[key].CurrentState)
+	expected := encodeState(t, rs.Transfer2StateManager[key].CurrentState)
+	stop(rs)
+
+	for crash := range c.stateChanges {
+		for _, how := range []int{crashBeforeDispatch, crashBeforeSnapshot, crashAfterDispatch} {
+			rs = start()
+			for i := 0; i < crash; i++ {
+				dispatch(rs, i)
+			}
+			mgr := rs.Transfer2StateManager[key]
+			switch how {
+			case crashBeforeDispatch:
+				_, err := rs.db.LogStateChange(mgr, decode(rs, crash))
+				if err != nil {
+					t.Fatal(err)
+				}
+			case crashBeforeSnapshot:
+				//the snapshot saved before, and the log marked applied together with modifications of events
+				snapshot := rs.db.GetAllStateManagers()[0]
+				dispatch(rs, crash)
+				err := rs.db.AddStateManager(snapshot)
+				if err != nil {
+					t.Fatal(err)
+				}
+				id, err := rs.db.LogStateChange(snapshot, decode(rs, crash))
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = rs.db.MarkStateChangeApplied(id)
+				if err != nil {
+					t.Fatal(err)
+				}
+			case crashAfterDispatch:
+				dispatch(rs, crash)
+			}
+			db := rs.db
+			rs.Protocol.StopAndWait()
+
+			//restart, channels in memory are what committed before crash
+			rs = newTestReplayService(t, db, c.nodeKey, chs...)
+			rs.restoreStateManagers()
+			if how != crashBeforeDispatch {
+				assert.Empty(t, rs.Protocol.SentHashesToChannel, "crash at %d,how %d", crash, how)
+			}
+			for i := crash + 1; i < len(c.stateChanges); i++ {
+				dispatch(rs, i)
+			}
+			assert.EqualValues(t, expected, encodeState(t, rs.Transfer2StateManager[key].CurrentState), "crash at %d,how %d", crash, how)
+			stop(rs)
+		}
+	}
+}
+
+//newTestReplayChannel an opened channel with partner, its identifier is id
+func newTestReplayChannel(ourAddress, partner common.Address, id common.Hash) *channel.Channel {
+	ch := utest.MakeRoute(partner, big.NewInt(100), utest.UnitSettleTimeout, utest.UnitRevealTimeout, 0, id).Channel()
+	ch.State = channeltype.StateOpened
+	ch.TokenAddress = utest.UnitTokenAddress
+	ch.OurState.Address = ourAddress
+	ch.ExternState.MyAddress = ourAddress
+	return ch
+}
+
+//newTestReplayRoute a route on ch charges nothing
+func newTestReplayRoute(ch *channel.Channel) *route.State {
+	r := route.NewState(ch)
+	r.Fee = utils.BigInt0
+	r.TotalFee = utils.BigInt0
+	return r
+}
+
+func TestRestoreTargetAfterCrash(t *testing.T) {
+	var blockNumber int64 = 1
+	var amount int64 = 1
+	initiator := utest.HOP1
+	key, _ := crypto.GenerateKey()
+	ourAddress := crypto.PubkeyToAddress(key.PublicKey)
+	expire := int64(utest.UnitRevealTimeout) + blockNumber + 5
+	channelIdentifier := utils.NewRandomHash()
+	fromRoute, fromTransfer := utest.MakeFrom(big.NewInt(amount), ourAddress, expire, initiator, utils.EmptyHash)
+	fromRoute = newTestReplayRoute(newTestReplayChannel(ourAddress, initiator, channelIdentifier))
+	cid := fromRoute.Channel().ChannelIdentifier
+	bp := encoding.NewBalanceProof(1, utils.BigInt0, utils.EmptyHash, &cid)
+	msg := encoding.NewMediatedTransfer(bp, &mtree.Lock{Expiration: expire, Amount: big.NewInt(amount), LockSecretHash: fromTransfer.LockSecretHash}, ourAddress, initiator, utils.BigInt0)
+	testCrashAndReplay(t, &crashReplayCase{
+		nodeKey: key,
+		key:     utils.Sha3(fromTransfer.LockSecretHash[:], fromTransfer.Token[:]),
+		newChannels: func(ourAddress common.Address) []*channel.Channel {
+			return []*channel.Channel{newTestReplayChannel(ourAddress, initiator, channelIdentifier)}
+		},
+		newManager: func() *transfer.StateManager {
+			return transfer.NewStateManager(target.StateTransiton, nil, target.NameTargetTransition, fromTransfer.LockSecretHash, fromTransfer.Token)
+		},
+		stateChanges: []transfer.StateChange{
+			&mediatedtransfer.ActionInitTargetStateChange{
+				OurAddress:  ourAddress,
+				FromRoute:   fromRoute,
+				FromTranfer: fromTransfer,
+				BlockNumber: blockNumber,
+				Message:     msg,
+				Hold:        true,
+			},
+			&transfer.BlockStateChange{BlockNumber: blockNumber + 1},
+			&mediatedtransfer.ReceiveSecretRevealStateChange{Secret: utest.UnitSecret, Sender: initiator},
+			&transfer.BlockStateChange{BlockNumber: blockNumber + 2},
+			&mediatedtransfer.ActionSettleHeldTransferStateChange{LockSecretHash: fromTransfer.LockSecretHash},
+			&transfer.BlockStateChange{BlockNumber: blockNumber + 3},
+		},
+		check: func(state transfer.State) {
+			assert.EqualValues(t, mediatedtransfer.StateRevealSecret, state.(*mediatedtransfer.TargetState).State)
+		},
+	})
+}
+
+func TestRestoreInitiatorAfterCrash(t *testing.T) {
+	var blockNumber int64 = 1
+	amount := big.NewInt(10)
+	mediatorAddress := utest.HOP1
+	targetAddress := utest.HOP2
+	key, _ := crypto.GenerateKey()
+	ourAddress := crypto.PubkeyToAddress(key.PublicKey)
+	channelIdentifier := utils.NewRandomHash()
+	secret := utils.NewRandomHash()
+	lockSecretHash := utils.ShaSecret(secret[:])
+	routes := []*route.State{newTestReplayRoute(newTestReplayChannel(ourAddress, mediatorAddress, channelIdentifier))}
+	testCrashAndReplay(t, &crashReplayCase{
+		nodeKey: key,
+		key:     utils.Sha3(lockSecretHash[:], utest.UnitTokenAddress[:]),
+		newChannels: func(ourAddress common.Address) []*channel.Channel {
+			return []*channel.Channel{newTestReplayChannel(ourAddress, mediatorAddress, channelIdentifier)}
+		},
+		newManager: func() *transfer.StateManager {
+			return transfer.NewStateManager(initiator.StateTransition, nil, initiator.NameInitiatorTransition, lockSecretHash, utest.UnitTokenAddress)
+		},
+		stateChanges: []transfer.StateChange{
+			&mediatedtransfer.ActionInitInitiatorStateChange{
+				OurAddress: ourAddress,
+				Tranfer: &mediatedtransfer.LockedTransferState{
+					Amount:       amount,
+					Initiator:    ourAddress,
+					Target:       targetAddress,
+					Token:        utest.UnitTokenAddress,
+					TargetAmount: amount,
+					Fee:          utils.BigInt0,
+				},
+				Routes:         route.NewRoutesState(routes),
+				BlockNumber:    blockNumber,
+				LockSecretHash: lockSecretHash,
+				Secret:         secret,
+			},
+			&transfer.BlockStateChange{BlockNumber: blockNumber + 1},
+			&mediatedtransfer.ReceiveSecretRequestStateChange{Amount: amount, LockSecretHash: lockSecretHash, Sender: targetAddress},
+			&transfer.BlockStateChange{BlockNumber: blockNumber + 2},
+		},
+		check: func(state transfer.State) {
+			s := state.(*mediatedtransfer.InitiatorState)
+			assert.NotNil(t, s.RevealSecret)
+			assert.EqualValues(t, mediatorAddress, s.Route.HopNode())
+		},
+	})
+}
+
+func TestRestoreMediatorAfterCrash(t *testing.T) {
+	var blockNumber int64 = 1
+	amount := big.NewInt(10)
+	initiatorAddress := utest.HOP1
+	targetAddress := utest.HOP3
+	payeeAddress := utest.HOP2
+	key, _ := crypto.GenerateKey()
+	ourAddress := crypto.PubkeyToAddress(key.PublicKey)
+	payerChannelIdentifier := utils.NewRandomHash()
+	payeeChannelIdentifier := utils.NewRandomHash()
+	newChannels := func(ourAddress common.Address) []*channel.Channel {
+		return []*channel.Channel{
+			newTestReplayChannel(ourAddress, initiatorAddress, payerChannelIdentifier),
+			newTestReplayChannel(ourAddress, payeeAddress, payeeChannelIdentifier),
+		}
+	}
+	chs := newChannels(ourAddress)
+	expire := int64(utest.UnitSettleTimeout) + blockNumber
+	fromTransfer := utest.MakeTransfer(amount, initiatorAddress, targetAddress, expire, utils.EmptyHash, utils.EmptyHash, utest.UnitTokenAddress)
+	cid := chs[0].ChannelIdentifier
+	bp := encoding.NewBalanceProof(1, utils.BigInt0, utils.EmptyHash, &cid)
+	msg := encoding.NewMediatedTransfer(bp, &mtree.Lock{Expiration: expire, Amount: amount, LockSecretHash: fromTransfer.LockSecretHash}, targetAddress, initiatorAddress, utils.BigInt0)
+	testCrashAndReplay(t, &crashReplayCase{
+		nodeKey:     key,
+		key:         utils.Sha3(fromTransfer.LockSecretHash[:], fromTransfer.Token[:]),
+		newChannels: newChannels,
+		newManager: func() *transfer.StateManager {
+			return transfer.NewStateManager(mediator.StateTransition, nil, mediator.NameMediatorTransition, fromTransfer.LockSecretHash, fromTransfer.Token)
+		},
+		stateChanges: []transfer.StateChange{
+			&mediatedtransfer.ActionInitMediatorStateChange{
+				OurAddress:  ourAddress,
+				FromTranfer: fromTransfer,
+				Routes:      route.NewRoutesState([]*route.State{newTestReplayRoute(chs[1])}),
+				FromRoute:   newTestReplayRoute(chs[0]),
+				BlockNumber: blockNumber,
+				Message:     msg,
+			},
+			&transfer.BlockStateChange{BlockNumber: blockNumber + 1},
+			&mediatedtransfer.ReceiveSecretRevealStateChange{Secret: utest.UnitSecret, Sender: payeeAddress},
+			&transfer.BlockStateChange{BlockNumber: blockNumber + 2},
+		},
+		check: func(state transfer.State) {
+			s := state.(*mediatedtransfer.MediatorState)
+			assert.EqualValues(t, 1, len(s.TransfersPair))
+			assert.EqualValues(t, utest.UnitSecret, s.Secret)
+		},
+	})
+}
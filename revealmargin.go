@@ -0,0 +1,123 @@
+package atmosphere
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/SmartMeshFoundation/Atmosphere/log"
+	"github.com/SmartMeshFoundation/Atmosphere/params"
+)
+
+type blockSample struct {
+	blockNumber int64
+	arrival     time.Time
+}
+
+/*
+revealMarginMonitor 记录最近的出块时间, 和公链的断线次数以及建议的 gas price,
+据此计算中间节点转发交易时要求锁至少还剩多少块.
+*/
+/*
+ *	revealMarginMonitor : it records recent block times, disconnections from eth rpc server and suggested gas price,
+ *	and decides how many blocks a lock must have left before mediators forward it.
+ */
+type revealMarginMonitor struct {
+	policy        *params.RevealMarginPolicy
+	revealTimeout int
+	//suggestGasPrice returns nil if not connected to chain
+	suggestGasPrice func() func(ctx context.Context) (*big.Int, error)
+	now             func() time.Time
+	lock            sync.Mutex
+	blocks          []blockSample
+	disconnects     []time.Time
+	gasPrice        *big.Int
+	querying        bool
+	wg              sync.WaitGroup
+}
+
+func newRevealMarginMonitor(rs *Service) *revealMarginMonitor {
+	return &revealMarginMonitor{
+		policy:        &rs.Config.RevealMarginPolicy,
+		revealTimeout: rs.Config.RevealTimeout,
+		suggestGasPrice: func() func(ctx context.Context) (*big.Int, error) {
+			if rs.Chain == nil || rs.Chain.Client == nil || !rs.Chain.Client.IsConnected() {
+				return nil
+			}
+			return rs.Chain.Client.SuggestGasPrice
+		},
+		now: time.Now,
+	}
+}
+
+//onBlock record arrival time of new block and refresh suggested gas price
+func (m *revealMarginMonitor) onBlock(blockNumber int64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if l := len(m.blocks); l > 0 && m.blocks[l-1].blockNumber >= blockNumber {
+		return
+	}
+	m.blocks = append(m.blocks, blockSample{blockNumber, m.now()})
+	if len(m.blocks) > params.RevealMarginBlockSamples {
+		m.blocks = m.blocks[len(m.blocks)-params.RevealMarginBlockSamples:]
+	}
+	suggest := m.suggestGasPrice()
+	if suggest == nil || m.querying {
+		return
+	}
+	m.querying = true
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), params.DefaultTxTimeout)
+		gasPrice, err := suggest(ctx)
+		cancel()
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		m.querying = false
+		if err != nil {
+			log.Warn(fmt.Sprintf("SuggestGasPrice err %s", err))
+			return
+		}
+		m.gasPrice = gasPrice
+	}()
+}
+
+//onDisconnect connection with eth rpc server is lost
+func (m *revealMarginMonitor) onDisconnect() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.disconnects = append(m.disconnects, m.now())
+}
+
+//conditions returns recent chain conditions
+func (m *revealMarginMonitor) conditions() *params.ChainConditions {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	c := &params.ChainConditions{}
+	if l := len(m.blocks); l > 1 {
+		/*
+			按块号而不是样本数平均, 节点追赶落下的块时会一次收到很多块
+		*/
+		// average by block numbers instead of samples, node may receive many blocks at once when catching up
+		first, last := m.blocks[0], m.blocks[l-1]
+		c.AvgBlockPeriod = last.arrival.Sub(first.arrival) / time.Duration(last.blockNumber-first.blockNumber)
+	}
+	since := m.now().Add(-m.policy.DisconnectWindow)
+	i := 0
+	for ; i < len(m.disconnects) && m.disconnects[i].Before(since); i++ {
+	}
+	m.disconnects = m.disconnects[i:]
+	c.Disconnects = len(m.disconnects)
+	if m.gasPrice != nil {
+		c.GasPrice = new(big.Int).Set(m.gasPrice)
+	}
+	return c
+}
+
+//margin returns blocks a lock must have left before mediators forward it
+func (m *revealMarginMonitor) margin() int {
+	return m.policy.Margin(m.revealTimeout, m.conditions())
+}
@@ -0,0 +1,87 @@
+package atmosphere
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/SmartMeshFoundation/Atmosphere/params"
+)
+
+func TestRevealMarginMonitor(t *testing.T) {
+	now := time.Unix(1000, 0)
+	var gasPrice *big.Int
+	connected := true
+	m := &revealMarginMonitor{
+		policy: &params.RevealMarginPolicy{
+			BlockPeriod:       10 * time.Second,
+			DisconnectWindow:  time.Minute,
+			CongestedGasPrice: big.NewInt(100),
+			MaxExtraBlocks:    10,
+		},
+		revealTimeout: 10,
+		suggestGasPrice: func() func(ctx context.Context) (*big.Int, error) {
+			if !connected {
+				return nil
+			}
+			return func(ctx context.Context) (*big.Int, error) {
+				if gasPrice == nil {
+					return nil, errors.New("rpc error")
+				}
+				return gasPrice, nil
+			}
+		},
+		now: func() time.Time { return now },
+	}
+	onBlock := func(blockNumber int64) {
+		m.onBlock(blockNumber)
+		m.wg.Wait()
+	}
+	//no samples yet
+	if margin := m.margin(); margin != 10 {
+		t.Fatalf("expect reveal timeout,got %d", margin)
+	}
+	//normal blocks, many blocks at once when catching up doesn't matter
+	onBlock(1)
+	now = now.Add(10 * time.Second)
+	onBlock(2)
+	onBlock(3)
+	onBlock(3)
+	now = now.Add(10 * time.Second)
+	onBlock(4)
+	if c := m.conditions(); c.AvgBlockPeriod != 20*time.Second/3 || c.GasPrice != nil {
+		t.Fatalf("wrong conditions %+v", c)
+	}
+	if margin := m.margin(); margin != 10 {
+		t.Fatalf("expect reveal timeout,got %d", margin)
+	}
+	//slow blocks
+	now = now.Add(200 * time.Second)
+	onBlock(5)
+	if margin := m.margin(); margin != 15 {
+		t.Fatalf("slow blocks,expect 15,got %d", margin)
+	}
+	//congested
+	gasPrice = big.NewInt(101)
+	onBlock(6)
+	if margin := m.margin(); margin != 20 {
+		t.Fatalf("slow and congested,expect 20,got %d", margin)
+	}
+	//disconnected, but never more than MaxExtraBlocks
+	connected = false
+	m.onDisconnect()
+	onBlock(7)
+	if c := m.conditions(); c.Disconnects != 1 || c.GasPrice.Cmp(gasPrice) != 0 {
+		t.Fatalf("wrong conditions %+v", c)
+	}
+	if margin := m.margin(); margin != 20 {
+		t.Fatalf("expect at most 20,got %d", margin)
+	}
+	//disconnection is forgotten after the window
+	now = now.Add(2 * time.Minute)
+	if c := m.conditions(); c.Disconnects != 0 {
+		t.Fatalf("disconnection should be forgotten,got %d", c.Disconnects)
+	}
+}
@@ -0,0 +1,72 @@
+package atmosphere
+
+import (
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/SmartMeshFoundation/Atmosphere/log"
+	"github.com/SmartMeshFoundation/Atmosphere/models"
+	"github.com/SmartMeshFoundation/Atmosphere/utils"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+/*
+routingHistory 记录经过每个通道转发交易的成功和失败,
+收到下家的 AnnounceDisposed 或者给下家的锁过期都是失败, 给下家发送 Unlock 是成功.
+路由时据此估计成功的概率, 避开刚刚失败过的通道.
+*/
+/*
+ *	routingHistory : it records successes and failures of transfers via every channel,
+ *	AnnounceDisposed from payee or expiration of the lock sent to payee is a failure, Unlock sent to payee is a success.
+ *	Routing estimates success probability from them, so channels failed recently are avoided.
+ */
+type routingHistory struct {
+	db       *models.ModelDB
+	dao      func() models.Dao //results are saved in the current unit of work if there is one
+	halfLife time.Duration
+	now      func() time.Time
+}
+
+func newRoutingHistory(rs *Service) *routingHistory {
+	return &routingHistory{
+		db:       rs.db,
+		dao:      rs.dao,
+		halfLife: rs.Config.RoutingHistoryHalfLife,
+		now:      time.Now,
+	}
+}
+
+/*
+record saves result of a transfer of amount via channel with partnerAddress,
+it's committed with the unit of work handling the event, so replay after crash doesn't record it twice.
+*/
+func (h *routingHistory) record(tokenAddress, partnerAddress common.Address, amount *big.Int, success bool) {
+	if h == nil || amount == nil {
+		return
+	}
+	err := h.dao().AddRoutingEvent(tokenAddress, partnerAddress, &models.RoutingEvent{
+		Amount:  new(big.Int).Set(amount),
+		Success: success,
+		Time:    h.now().Unix(),
+	})
+	if err != nil {
+		log.Error(fmt.Sprintf("record routing result via %s err %s", utils.APex2(partnerAddress), err))
+	}
+}
+
+//SuccessProbability implements graph.RoutingHistory
+func (h *routingHistory) SuccessProbability(tokenAddress, partnerAddress common.Address, amount *big.Int) float64 {
+	if h == nil {
+		return 1
+	}
+	r, err := h.db.GetRoutingHistory(tokenAddress, partnerAddress)
+	if err != nil {
+		log.Error(fmt.Sprintf("GetRoutingHistory err %s", err))
+		return 1
+	}
+	if r == nil {
+		return 1
+	}
+	return r.SuccessProbability(amount, h.now(), h.halfLife)
+}
@@ -0,0 +1,52 @@
+package atmosphere
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/SmartMeshFoundation/Atmosphere/models"
+	"github.com/SmartMeshFoundation/Atmosphere/utils"
+)
+
+func TestRoutingHistory(t *testing.T) {
+	db, err := newTestDb()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.CloseDB()
+	now := time.Unix(100000, 0)
+	h := &routingHistory{
+		db:       db,
+		dao:      func() models.Dao { return db },
+		halfLife: time.Hour,
+		now:      func() time.Time { return now },
+	}
+	token, partner := utils.NewRandomAddress(), utils.NewRandomAddress()
+	if p := h.SuccessProbability(token, partner, big.NewInt(10)); p != 1 {
+		t.Fatalf("no history,expect 1,got %f", p)
+	}
+	h.record(token, partner, big.NewInt(10), false)
+	h.record(token, partner, big.NewInt(10), false)
+	if p := h.SuccessProbability(token, partner, big.NewInt(10)); p != 1.0/3 {
+		t.Fatalf("expect 1/3,got %f", p)
+	}
+	//failures are forgotten gradually
+	now = now.Add(2 * time.Hour)
+	if p := h.SuccessProbability(token, partner, big.NewInt(10)); p != 1/1.5 {
+		t.Fatalf("expect 2/3,got %f", p)
+	}
+	h.record(token, partner, big.NewInt(10), true)
+	if p := h.SuccessProbability(token, partner, big.NewInt(10)); p != 2/2.5 {
+		t.Fatalf("expect 0.8,got %f", p)
+	}
+	//other channels are not affected
+	if p := h.SuccessProbability(token, utils.NewRandomAddress(), big.NewInt(10)); p != 1 {
+		t.Fatalf("expect 1,got %f", p)
+	}
+	var nilHistory *routingHistory
+	nilHistory.record(token, partner, big.NewInt(10), false)
+	if p := nilHistory.SuccessProbability(token, partner, big.NewInt(10)); p != 1 {
+		t.Fatalf("expect 1,got %f", p)
+	}
+}
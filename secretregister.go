@@ -0,0 +1,289 @@
+package atmosphere
+
+import (
+	"fmt"
+	"math/big"
+	"sync"
+
+	"github.com/SmartMeshFoundation/Atmosphere/channel"
+	"github.com/SmartMeshFoundation/Atmosphere/log"
+	"github.com/SmartMeshFoundation/Atmosphere/models"
+	"github.com/SmartMeshFoundation/Atmosphere/network/rpc"
+	"github.com/SmartMeshFoundation/Atmosphere/params"
+	"github.com/SmartMeshFoundation/Atmosphere/utils"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+//secretRegistrar registers secrets on chain, it's SecretRegistryProxy except in test
+type secretRegistrar interface {
+	SendSecrets(secrets []common.Hash, gasPrice *big.Int) (txs []*rpc.SecretRegisterTx, failed []*rpc.SecretRegisterResult)
+	ReplaceSecretRegisterTx(tx *rpc.SecretRegisterTx, gasPrice *big.Int) error
+	WaitSecretRegisterTx(tx *rpc.SecretRegisterTx) *rpc.SecretRegisterResult
+}
+
+/*
+secretRegisterScheduler 收集需要在链上注册的密码, 每个块统一提交一次, 这样同一个块中需要注册的多个密码只需要一个交易.
+gas price 由离过期最近的锁决定, 越接近过期越高. 还没有打包的交易每个块用同样的 nonce 和更高的 gas price 替换.
+交易失败的密码在下一个块重试, 直到锁过期.
+每个交易的花费平摊到它注册的密码以及对应的锁上, 保存在数据库中.
+*/
+/*
+ *	secretRegisterScheduler : collect secrets need to be registered on chain and submit them once every block,
+ *	so many secrets needed in one block are registered in one tx.
+ *	Gas price is decided by the lock closest to expiration, the closer the higher.
+ *	Txs not mined yet are replaced every block by ones with the same nonce and a higher gas price.
+ *	Secrets of failed tx are retried in next block until their locks expire.
+ *	Cost of every tx is shared by secrets it registers and their locks, and saved to db.
+ */
+type secretRegisterScheduler struct {
+	policy    *params.GasPricePolicy
+	db        *models.ModelDB
+	registrar func() secretRegistrar //nil if not connected to chain
+	//lockInfo returns the earliest expiration and number of locks of this secret, expiration is 0 if no lock found. only called in main loop
+	lockInfo func(lockSecretHash common.Hash) (expiration int64, locks int)
+	lock     sync.Mutex
+	pending  map[common.Hash]bool
+	inflight map[common.Hash]bool
+	txs      map[*rpc.SecretRegisterTx]*inflightSecretTx //txs sent but not mined yet
+	wg       sync.WaitGroup
+}
+
+//inflightSecretTx a tx registering secrets sent but not mined yet
+type inflightSecretTx struct {
+	expiration int64 //the earliest expiration of locks of its secrets, 0 if unknown
+	gasPrice   *big.Int
+	replacing  bool
+}
+
+func newSecretRegisterScheduler(rs *Service) *secretRegisterScheduler {
+	return &secretRegisterScheduler{
+		policy: &rs.Config.SecretRegisterGasPolicy,
+		db:     rs.db,
+		registrar: func() secretRegistrar {
+			if rs.Chain.SecretRegistryProxy == nil {
+				return nil
+			}
+			return rs.Chain.SecretRegistryProxy
+		},
+		lockInfo: rs.getLockInfoBySecretHash,
+		pending:  make(map[common.Hash]bool),
+		inflight: make(map[common.Hash]bool),
+		txs:      make(map[*rpc.SecretRegisterTx]*inflightSecretTx),
+	}
+}
+
+//add secret to be registered in next submission
+func (s *secretRegisterScheduler) add(secret common.Hash) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.inflight[secret] || s.pending[secret] {
+		return
+	}
+	s.pending[secret] = true
+}
+
+//gasPrice returns gas price to use when the earliest lock expires at expiration
+func (s *secretRegisterScheduler) gasPrice(expiration, blockNumber int64) (gasPrice *big.Int, blocksLeft int64) {
+	blocksLeft = s.policy.EscalateBlocks
+	if expiration > 0 && expiration-blockNumber < blocksLeft {
+		blocksLeft = expiration - blockNumber
+	}
+	return s.policy.GasPrice(blocksLeft), blocksLeft
+}
+
+//onBlock replace txs not mined yet with higher gas price and submit all pending secrets in one round
+func (s *secretRegisterScheduler) onBlock(blockNumber int64) {
+	registrar := s.registrar()
+	if registrar == nil {
+		return
+	}
+	s.replaceInflight(registrar, blockNumber)
+	s.lock.Lock()
+	if len(s.pending) == 0 {
+		s.lock.Unlock()
+		return
+	}
+	pending := s.pending
+	s.pending = make(map[common.Hash]bool)
+	s.lock.Unlock()
+
+	var secrets []common.Hash
+	secret2Locks := make(map[common.Hash]int)
+	secret2Expiration := make(map[common.Hash]int64)
+	var earliest int64
+	for secret := range pending {
+		expiration, locks := s.lockInfo(utils.ShaSecret(secret[:]))
+		if expiration > 0 && expiration <= blockNumber {
+			log.Error(fmt.Sprintf("give up registering secret %s, locks expired, you may lose your token", secret.String()))
+			continue
+		}
+		secrets = append(secrets, secret)
+		secret2Locks[secret] = locks
+		secret2Expiration[secret] = expiration
+		if expiration > 0 && (earliest == 0 || expiration < earliest) {
+			earliest = expiration
+		}
+	}
+	if len(secrets) == 0 {
+		return
+	}
+	s.lock.Lock()
+	for _, secret := range secrets {
+		s.inflight[secret] = true
+	}
+	s.lock.Unlock()
+	gasPrice, blocksLeft := s.gasPrice(earliest, blockNumber)
+	log.Info(fmt.Sprintf("register %d secrets on chain, gas price %s, %d blocks left", len(secrets), gasPrice, blocksLeft))
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		txs, failed := registrar.SendSecrets(secrets, gasPrice)
+		sent := make(map[common.Hash]bool)
+		s.lock.Lock()
+		for _, tx := range txs {
+			info := &inflightSecretTx{gasPrice: gasPrice}
+			for _, secret := range tx.Secrets {
+				sent[secret] = true
+				e := secret2Expiration[secret]
+				if e > 0 && (info.expiration == 0 || e < info.expiration) {
+					info.expiration = e
+				}
+			}
+			s.txs[tx] = info
+		}
+		//already registered or failed to send
+		for _, secret := range secrets {
+			if !sent[secret] {
+				delete(s.inflight, secret)
+			}
+		}
+		s.lock.Unlock()
+		for _, r := range failed {
+			s.onResult(r, secret2Locks)
+		}
+		//等待所有交易是并行的
+		// wait for all txs in parallel
+		for _, tx := range txs {
+			s.wg.Add(1)
+			go func(tx *rpc.SecretRegisterTx) {
+				defer s.wg.Done()
+				r := registrar.WaitSecretRegisterTx(tx)
+				s.lock.Lock()
+				delete(s.txs, tx)
+				for _, secret := range tx.Secrets {
+					delete(s.inflight, secret)
+				}
+				s.lock.Unlock()
+				s.onResult(r, secret2Locks)
+			}(tx)
+		}
+	}()
+}
+
+/*
+replaceInflight 锁越来越接近过期, 还没有打包的交易用同样的 nonce 和更高的 gas price 替换.
+节点只接受 gas price 至少高 10% 的替换交易, 所以可能会稍微超过 MaxGasPrice.
+*/
+/*
+ *	replaceInflight : as locks get closer to expiration, txs not mined yet are replaced by ones with the same nonce and a higher gas price.
+ *	Nodes accept a replacement only if its gas price is at least 10% higher, so it may be a little higher than MaxGasPrice.
+ */
+func (s *secretRegisterScheduler) replaceInflight(registrar secretRegistrar, blockNumber int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for tx, info := range s.txs {
+		if info.replacing {
+			continue
+		}
+		gasPrice, blocksLeft := s.gasPrice(info.expiration, blockNumber)
+		if gasPrice.Cmp(info.gasPrice) <= 0 {
+			continue
+		}
+		minGasPrice := new(big.Int).Mul(info.gasPrice, big.NewInt(110))
+		minGasPrice.Div(minGasPrice, big.NewInt(100))
+		if gasPrice.Cmp(minGasPrice) < 0 {
+			gasPrice = minGasPrice
+		}
+		log.Info(fmt.Sprintf("replace tx registering %d secrets nonce=%d, gas price %s->%s, %d blocks left", len(tx.Secrets), tx.Nonce, info.gasPrice, gasPrice, blocksLeft))
+		info.replacing = true
+		s.wg.Add(1)
+		go func(tx *rpc.SecretRegisterTx, info *inflightSecretTx, gasPrice *big.Int) {
+			defer s.wg.Done()
+			err := registrar.ReplaceSecretRegisterTx(tx, gasPrice)
+			if err != nil {
+				//可能已经打包了
+				// it may have been mined
+				log.Warn(fmt.Sprintf("replace tx registering secrets nonce=%d err %s", tx.Nonce, err))
+			}
+			s.lock.Lock()
+			info.replacing = false
+			if err == nil {
+				info.gasPrice = gasPrice
+			}
+			s.lock.Unlock()
+		}(tx, info, gasPrice)
+	}
+}
+
+//onResult save cost of the tx, and retry its secrets in next block if failed
+func (s *secretRegisterScheduler) onResult(r *rpc.SecretRegisterResult, secret2Locks map[common.Hash]int) {
+	s.saveCost(r, secret2Locks)
+	if r.Err == nil {
+		return
+	}
+	for _, secret := range r.Secrets {
+		log.Error(fmt.Sprintf("register secret on chain err %s,secret=%s, retry in next block", r.Err, secret.String()))
+		s.add(secret)
+	}
+}
+
+func (s *secretRegisterScheduler) saveCost(r *rpc.SecretRegisterResult, secret2Locks map[common.Hash]int) {
+	if r.TxHash == utils.EmptyHash || len(r.Secrets) == 0 {
+		//tx never sent, no cost
+		return
+	}
+	share := new(big.Int).Div(r.Cost(), big.NewInt(int64(len(r.Secrets))))
+	for _, secret := range r.Secrets {
+		locks := secret2Locks[secret]
+		perLock := new(big.Int).Set(share)
+		if locks > 1 {
+			perLock.Div(perLock, big.NewInt(int64(locks)))
+		}
+		err := s.db.SaveSecretRegisterCost(&models.SecretRegisterCost{
+			LockSecretHash: utils.ShaSecret(secret[:]),
+			TxHash:         r.TxHash,
+			BatchSize:      len(r.Secrets),
+			Locks:          locks,
+			GasPrice:       r.GasPrice,
+			Cost:           share,
+			CostPerLock:    perLock,
+			Success:        r.Err == nil,
+		})
+		if err != nil {
+			log.Error(err.Error())
+		}
+	}
+}
+
+/*
+getLockInfoBySecretHash 找到这个密码对应的所有锁, 返回最早的过期块以及锁的数量.
+*/
+// getLockInfoBySecretHash : find all locks of this secret, returns the earliest expiration and number of locks.
+func (rs *Service) getLockInfoBySecretHash(lockSecretHash common.Hash) (expiration int64, locks int) {
+	found := func(e int64) {
+		locks++
+		if expiration == 0 || e < expiration {
+			expiration = e
+		}
+	}
+	for _, ch := range rs.findAllChannelsByLockSecretHash(lockSecretHash) {
+		for _, end := range []*channel.EndState{ch.PartnerState, ch.OurState} {
+			if l, ok := end.Lock2PendingLocks[lockSecretHash]; ok {
+				found(l.Lock.Expiration)
+			} else if l, ok := end.Lock2UnclaimedLocks[lockSecretHash]; ok {
+				found(l.Lock.Expiration)
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,198 @@
+package atmosphere
+
+import (
+	"errors"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SmartMeshFoundation/Atmosphere/network/rpc"
+	"github.com/SmartMeshFoundation/Atmosphere/params"
+	"github.com/SmartMeshFoundation/Atmosphere/utils"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+type fakeSecretRegistrar struct {
+	lock      sync.Mutex
+	batches   [][]common.Hash
+	gasPrices []*big.Int
+	replaced  []*big.Int
+	txPrice   map[*rpc.SecretRegisterTx]*big.Int
+	fail      bool
+	mined     chan struct{} //WaitSecretRegisterTx blocks until it's closed if not nil
+}
+
+func (f *fakeSecretRegistrar) SendSecrets(secrets []common.Hash, gasPrice *big.Int) ([]*rpc.SecretRegisterTx, []*rpc.SecretRegisterResult) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.batches = append(f.batches, secrets)
+	f.gasPrices = append(f.gasPrices, gasPrice)
+	tx := &rpc.SecretRegisterTx{Secrets: secrets}
+	f.txPrice[tx] = gasPrice
+	return []*rpc.SecretRegisterTx{tx}, nil
+}
+
+func (f *fakeSecretRegistrar) ReplaceSecretRegisterTx(tx *rpc.SecretRegisterTx, gasPrice *big.Int) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.replaced = append(f.replaced, gasPrice)
+	f.txPrice[tx] = gasPrice
+	return nil
+}
+
+func (f *fakeSecretRegistrar) WaitSecretRegisterTx(tx *rpc.SecretRegisterTx) *rpc.SecretRegisterResult {
+	f.lock.Lock()
+	mined := f.mined
+	f.lock.Unlock()
+	if mined != nil {
+		<-mined
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	r := &rpc.SecretRegisterResult{
+		Secrets:  tx.Secrets,
+		TxHash:   utils.NewRandomHash(),
+		GasUsed:  100,
+		GasPrice: f.txPrice[tx],
+	}
+	if f.fail {
+		r.Err = errors.New("tx failed")
+	}
+	return r
+}
+
+func TestSecretRegisterScheduler(t *testing.T) {
+	db, err := newTestDb()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.CloseDB()
+	policy := &params.GasPricePolicy{
+		BaseGasPrice:   big.NewInt(10),
+		MaxGasPrice:    big.NewInt(50),
+		EscalateBlocks: 10,
+	}
+	registrar := &fakeSecretRegistrar{txPrice: make(map[*rpc.SecretRegisterTx]*big.Int)}
+	secret1, secret2, secret3 := utils.NewRandomHash(), utils.NewRandomHash(), utils.NewRandomHash()
+	expirations := map[common.Hash]int64{
+		utils.ShaSecret(secret1[:]): 120,
+		utils.ShaSecret(secret2[:]): 105,
+		utils.ShaSecret(secret3[:]): 100,
+	}
+	s := &secretRegisterScheduler{
+		policy:    policy,
+		db:        db,
+		registrar: func() secretRegistrar { return registrar },
+		lockInfo: func(lockSecretHash common.Hash) (int64, int) {
+			return expirations[lockSecretHash], 2
+		},
+		pending:  make(map[common.Hash]bool),
+		inflight: make(map[common.Hash]bool),
+		txs:      make(map[*rpc.SecretRegisterTx]*inflightSecretTx),
+	}
+
+	//secrets of one block are registered in one tx, gas price is decided by the lock closest to expiration
+	s.add(secret1)
+	s.add(secret2)
+	s.add(secret1)
+	s.onBlock(100)
+	s.wg.Wait()
+	if len(registrar.batches) != 1 || len(registrar.batches[0]) != 2 {
+		t.Fatalf("expect one batch of two secrets,got %v", registrar.batches)
+	}
+	if registrar.gasPrices[0].Cmp(big.NewInt(30)) != 0 {
+		t.Errorf("expect gas price 30 when 5 blocks left,got %s", registrar.gasPrices[0])
+	}
+	costs, err := db.GetAllSecretRegisterCost()
+	if err != nil || len(costs) != 2 {
+		t.Fatalf("expect 2 costs,got %v err %v", costs, err)
+	}
+	//3000 wei shared by 2 secrets and 2 locks each
+	if costs[0].Cost.Cmp(big.NewInt(1500)) != 0 || costs[0].CostPerLock.Cmp(big.NewInt(750)) != 0 {
+		t.Errorf("wrong cost %s,cost per lock %s", costs[0].Cost, costs[0].CostPerLock)
+	}
+
+	//failed secret is retried in next block with a higher gas price
+	registrar.fail = true
+	s.add(secret1)
+	s.onBlock(111)
+	s.wg.Wait()
+	registrar.fail = false
+	s.onBlock(115)
+	s.wg.Wait()
+	if len(registrar.batches) != 3 || registrar.gasPrices[2].Cmp(big.NewInt(30)) != 0 {
+		t.Errorf("expect retry with gas price 30,got %v", registrar.gasPrices)
+	}
+
+	//locks expired, no need to register
+	s.add(secret3)
+	s.onBlock(101)
+	s.wg.Wait()
+	if len(registrar.batches) != 3 {
+		t.Errorf("secret of expired locks should not be registered")
+	}
+
+	//tx not mined is replaced with a higher gas price as the lock gets closer to expiration
+	waitFor := func(cond func() bool) {
+		for i := 0; i < 100 && !cond(); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if !cond() {
+			t.Fatal("timeout")
+		}
+	}
+	registrar.mined = make(chan struct{})
+	s.add(secret1)
+	s.onBlock(110)
+	waitFor(func() bool {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		return len(s.txs) == 1
+	})
+	if registrar.gasPrices[3].Cmp(big.NewInt(10)) != 0 {
+		t.Errorf("expect gas price 10 when 10 blocks left,got %s", registrar.gasPrices[3])
+	}
+	replaced := func() int {
+		registrar.lock.Lock()
+		defer registrar.lock.Unlock()
+		return len(registrar.replaced)
+	}
+	s.onBlock(115)
+	waitFor(func() bool { return replaced() == 1 })
+	waitFor(func() bool {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		for _, info := range s.txs {
+			return !info.replacing
+		}
+		return false
+	})
+	//no higher gas price in the same block
+	s.onBlock(115)
+	s.onBlock(116)
+	waitFor(func() bool { return replaced() == 2 })
+	close(registrar.mined)
+	s.wg.Wait()
+	if len(registrar.batches) != 4 {
+		t.Errorf("replacement should not send a new tx")
+	}
+	//30*1.1=33 is required by nodes, and policy gives 34
+	if registrar.replaced[0].Cmp(big.NewInt(30)) != 0 || registrar.replaced[1].Cmp(big.NewInt(34)) != 0 {
+		t.Errorf("expect replaced with gas price 30 and 34,got %v", registrar.replaced)
+	}
+	if len(s.txs) != 0 || len(s.inflight) != 0 {
+		t.Errorf("mined tx should be removed")
+	}
+	costs, err = db.GetAllSecretRegisterCost()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, c := range costs {
+		found = found || c.GasPrice.Cmp(big.NewInt(34)) == 0
+	}
+	if !found {
+		t.Errorf("cost should be computed with gas price of the mined tx")
+	}
+}
@@ -0,0 +1,271 @@
+package atmosphere
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/SmartMeshFoundation/Atmosphere/channel"
+	"github.com/SmartMeshFoundation/Atmosphere/channel/channeltype"
+	"github.com/SmartMeshFoundation/Atmosphere/log"
+	"github.com/SmartMeshFoundation/Atmosphere/models"
+	"github.com/SmartMeshFoundation/Atmosphere/utils"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+/*
+settleOperationManager 先尝试合作关闭通道, 对方不在线, 拒绝或者超时没有回应的时候, 撤销合作关闭, 改为 close,
+然后在 settle 窗口结束时自动 settle.
+整个过程作为一个操作, 用户可以随时查询进度.
+SettleRequest 一旦发出就不能撤销, 只能 close.
+每次进度变化都保存到数据库中, 重启以后从 restore 继续执行.
+*/
+/*
+ *	settleOperationManager : it tries cooperative settle first, if partner is offline, refuses or doesn't answer before timeout,
+ *	it cancels cooperative settle, falls back to close and settles automatically when settle window ends.
+ *	The whole process is one operation, user can query its progress at any time.
+ *	SettleRequest can not be canceled once sent, channel can only be closed.
+ *	Progress is saved to db whenever it changes, and continues from restore after restart.
+ */
+type settleOperationManager struct {
+	//all functions below are only called in main loop
+	findChannel       func(channelIdentifier common.Hash) *channel.Channel
+	isOnline          func(addr common.Address) bool
+	prepare           func(channelIdentifier common.Hash) *utils.AsyncResult
+	cancelPrepare     func(channelIdentifier common.Hash) *utils.AsyncResult
+	cooperativeSettle func(channelIdentifier common.Hash) *utils.AsyncResult
+	closeChannel      func(channelIdentifier common.Hash) *utils.AsyncResult
+	autoSettle        func(ch *channel.Channel)
+	db                *models.ModelDB
+	lock              sync.Mutex
+	ops               map[common.Hash]*models.SettleOperation
+	closeInflight     map[common.Hash]bool //close tx of this channel is sent and not failed
+	wg                sync.WaitGroup
+}
+
+func newSettleOperationManager(rs *Service) *settleOperationManager {
+	return &settleOperationManager{
+		findChannel: func(channelIdentifier common.Hash) *channel.Channel {
+			ch, err := rs.findChannelByIdentifier(channelIdentifier)
+			if err != nil {
+				return nil
+			}
+			return ch
+		},
+		isOnline: func(addr common.Address) bool {
+			_, isOnline := rs.Protocol.GetNetworkStatus(addr)
+			return isOnline
+		},
+		prepare:           rs.prepareCooperativeSettleChannel,
+		cancelPrepare:     rs.cancelPrepareForCooperativeSettleChannelOrWithdraw,
+		cooperativeSettle: rs.cooperativeSettleChannel,
+		closeChannel: func(channelIdentifier common.Hash) *utils.AsyncResult {
+			return rs.closeOrSettleChannel(channelIdentifier, closeChannelReqName)
+		},
+		autoSettle:    rs.autoSettleScheduler.add,
+		db:            rs.db,
+		ops:           make(map[common.Hash]*models.SettleOperation),
+		closeInflight: make(map[common.Hash]bool),
+	}
+}
+
+//restore load operations saved in db, unfinished ones go on from next block
+func (m *settleOperationManager) restore() {
+	ops, err := m.db.GetAllSettleOperations()
+	if err != nil {
+		log.Error(err.Error())
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, o := range ops {
+		m.ops[o.ChannelIdentifier] = o
+	}
+}
+
+func (m *settleOperationManager) save(o *models.SettleOperation) {
+	err := m.db.SaveSettleOperation(o)
+	if err != nil {
+		log.Error(err.Error())
+	}
+}
+
+//start a settle operation, returns the operation if there is one running already
+func (m *settleOperationManager) start(channelIdentifier common.Hash, timeout int64, blockNumber int64) (op models.SettleOperation, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if old, ok := m.ops[channelIdentifier]; ok && old.Phase != models.SettlePhaseSettled {
+		return *old, nil
+	}
+	ch := m.findChannel(channelIdentifier)
+	if ch == nil {
+		err = errors.New("channel not exist")
+		return
+	}
+	if ch.State != channeltype.StateOpened && ch.State != channeltype.StatePrepareForCooperativeSettle {
+		err = fmt.Errorf("channel state is %s, cannot settle", ch.State)
+		return
+	}
+	if ch.State == channeltype.StateOpened {
+		err = <-m.prepare(channelIdentifier).Result
+		if err != nil {
+			return
+		}
+	}
+	o := &models.SettleOperation{
+		ChannelIdentifier: channelIdentifier,
+		OpenBlockNumber:   ch.ChannelIdentifier.OpenBlockNumber,
+		StartBlock:        blockNumber,
+		Timeout:           timeout,
+	}
+	o.SetPhase(models.SettlePhasePreparing)
+	m.ops[channelIdentifier] = o
+	delete(m.closeInflight, channelIdentifier)
+	//don't wait for next block if cooperative settle can start right now
+	m.step(o, blockNumber)
+	m.save(o)
+	return *o, nil
+}
+
+//get returns a copy of the operation of this channel
+func (m *settleOperationManager) get(channelIdentifier common.Hash) (op models.SettleOperation, found bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	o, found := m.ops[channelIdentifier]
+	if found {
+		op = *o
+	}
+	return
+}
+
+//all returns copies of all operations
+func (m *settleOperationManager) all() (ops []models.SettleOperation) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, o := range m.ops {
+		ops = append(ops, *o)
+	}
+	return
+}
+
+//onSettleResponse partner agreed to settle cooperatively
+func (m *settleOperationManager) onSettleResponse(channelIdentifier common.Hash) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if o, ok := m.ops[channelIdentifier]; ok && o.Phase == models.SettlePhaseRequested {
+		o.SetPhase(models.SettlePhaseCooperative)
+		m.save(o)
+	}
+}
+
+//onCooperativeSettleFailed cooperative settle tx failed, fall back to close in next block
+func (m *settleOperationManager) onCooperativeSettleFailed(channelIdentifier common.Hash, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if o, ok := m.ops[channelIdentifier]; ok && o.Phase == models.SettlePhaseCooperative {
+		o.LastError = err.Error()
+		o.FallbackReason = "cooperative settle tx failed"
+		m.save(o)
+	}
+}
+
+//onBlock drive all running operations
+func (m *settleOperationManager) onBlock(blockNumber int64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, o := range m.ops {
+		old := *o
+		m.step(o, blockNumber)
+		if *o != old {
+			m.save(o)
+		}
+	}
+}
+
+func (m *settleOperationManager) step(o *models.SettleOperation, blockNumber int64) {
+	if o.Phase == models.SettlePhaseSettled {
+		return
+	}
+	ch := m.findChannel(o.ChannelIdentifier)
+	if ch == nil || ch.ChannelIdentifier.OpenBlockNumber != o.OpenBlockNumber {
+		o.SetPhase(models.SettlePhaseSettled)
+		return
+	}
+	if ch.State == channeltype.StateClosed && o.Phase != models.SettlePhaseClosed {
+		//closed by me or by partner
+		m.autoSettle(ch)
+		o.SetPhase(models.SettlePhaseClosed)
+		return
+	}
+	timeout := blockNumber >= o.StartBlock+o.Timeout
+	switch o.Phase {
+	case models.SettlePhasePreparing:
+		if timeout {
+			if !m.isOnline(ch.PartnerState.Address) {
+				m.fallback(o, "partner is offline")
+			} else {
+				m.fallback(o, "locks are not cleared before timeout")
+			}
+			return
+		}
+		if !ch.CanWithdrawOrCooperativeSettle() || !m.isOnline(ch.PartnerState.Address) {
+			return
+		}
+		err := <-m.cooperativeSettle(o.ChannelIdentifier).Result
+		if err != nil {
+			o.LastError = err.Error()
+			return
+		}
+		o.SetPhase(models.SettlePhaseRequested)
+	case models.SettlePhaseRequested:
+		if timeout {
+			m.fallback(o, "partner doesn't answer SettleRequest")
+		}
+	case models.SettlePhaseCooperative:
+		if len(o.FallbackReason) > 0 {
+			m.fallback(o, o.FallbackReason)
+		}
+	case models.SettlePhaseClosing:
+		if !m.closeInflight[o.ChannelIdentifier] {
+			//last close failed
+			m.sendClose(o)
+		}
+	}
+}
+
+/*
+fallback 放弃合作关闭, 改为 close.
+如果还没有发出 SettleRequest, 要先撤销 PrepareForCooperativeSettle.
+*/
+// fallback : give up cooperative settle and close channel, PrepareForCooperativeSettle must be canceled if SettleRequest is not sent yet.
+func (m *settleOperationManager) fallback(o *models.SettleOperation, reason string) {
+	log.Warn(fmt.Sprintf("cooperative settle channel %s failed: %s, close it", utils.HPex(o.ChannelIdentifier), reason))
+	o.FallbackReason = reason
+	if o.Phase == models.SettlePhasePreparing {
+		err := <-m.cancelPrepare(o.ChannelIdentifier).Result
+		if err != nil {
+			log.Error(fmt.Sprintf("cancel prepare for cooperative settle err %s", err))
+		}
+	}
+	o.SetPhase(models.SettlePhaseClosing)
+	m.sendClose(o)
+}
+
+func (m *settleOperationManager) sendClose(o *models.SettleOperation) {
+	m.closeInflight[o.ChannelIdentifier] = true
+	result := m.closeChannel(o.ChannelIdentifier)
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		err := <-result.Result
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		if err != nil {
+			log.Error(fmt.Sprintf("close channel %s err %s, retry in next block", utils.HPex(o.ChannelIdentifier), err))
+			o.LastError = err.Error()
+			m.closeInflight[o.ChannelIdentifier] = false
+			m.save(o)
+		}
+		//wait for close event if success
+	}()
+}
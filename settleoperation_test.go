@@ -0,0 +1,167 @@
+package atmosphere
+
+import (
+	"errors"
+	"math/big"
+	"sync"
+	"testing"
+
+	"github.com/SmartMeshFoundation/Atmosphere/channel"
+	"github.com/SmartMeshFoundation/Atmosphere/channel/channeltype"
+	"github.com/SmartMeshFoundation/Atmosphere/models"
+	"github.com/SmartMeshFoundation/Atmosphere/utils"
+	"github.com/SmartMeshFoundation/Atmosphere/utils/utest"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestSettleOperation(t *testing.T) {
+	ch1 := utest.MakeRoute(utest.HOP1, big.NewInt(100), utest.UnitSettleTimeout, utest.UnitRevealTimeout, 100, utils.NewRandomHash()).Channel()
+	ch2 := utest.MakeRoute(utest.HOP2, big.NewInt(100), utest.UnitSettleTimeout, utest.UnitRevealTimeout, 100, utils.NewRandomHash()).Channel()
+	channels := map[common.Hash]*channel.Channel{
+		ch1.ChannelIdentifier.ChannelIdentifier: ch1,
+		ch2.ChannelIdentifier.ChannelIdentifier: ch2,
+	}
+	online := map[common.Address]bool{ch1.PartnerState.Address: true}
+	var lock sync.Mutex
+	var calls []string
+	closeFail := true
+	record := func(call string, err error) *utils.AsyncResult {
+		lock.Lock()
+		calls = append(calls, call)
+		lock.Unlock()
+		return utils.NewAsyncResultWithError(err)
+	}
+	var autoSettled []common.Hash
+	db, err := newTestDb()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.CloseDB()
+	newManager := func() *settleOperationManager {
+		return &settleOperationManager{
+			findChannel: func(channelIdentifier common.Hash) *channel.Channel {
+				return channels[channelIdentifier]
+			},
+			isOnline: func(addr common.Address) bool { return online[addr] },
+			prepare: func(channelIdentifier common.Hash) *utils.AsyncResult {
+				channels[channelIdentifier].State = channeltype.StatePrepareForCooperativeSettle
+				return record("prepare", nil)
+			},
+			cancelPrepare: func(channelIdentifier common.Hash) *utils.AsyncResult {
+				channels[channelIdentifier].State = channeltype.StateOpened
+				return record("cancel", nil)
+			},
+			cooperativeSettle: func(channelIdentifier common.Hash) *utils.AsyncResult {
+				return record("cooperative", nil)
+			},
+			closeChannel: func(channelIdentifier common.Hash) *utils.AsyncResult {
+				if closeFail {
+					return record("close", errors.New("tx failed"))
+				}
+				return record("close", nil)
+			},
+			autoSettle: func(ch *channel.Channel) {
+				autoSettled = append(autoSettled, ch.ChannelIdentifier.ChannelIdentifier)
+			},
+			db:            db,
+			ops:           make(map[common.Hash]*models.SettleOperation),
+			closeInflight: make(map[common.Hash]bool),
+		}
+	}
+	m := newManager()
+	onBlock := func(blockNumber int64) {
+		m.onBlock(blockNumber)
+		m.wg.Wait()
+	}
+	phase := func(ch *channel.Channel) models.SettlePhase {
+		op, found := m.get(ch.ChannelIdentifier.ChannelIdentifier)
+		if !found {
+			t.Fatalf("operation of %s not found", utils.HPex(ch.ChannelIdentifier.ChannelIdentifier))
+		}
+		return op.Phase
+	}
+
+	//partner online, SettleRequest is sent right now
+	op, err := m.start(ch1.ChannelIdentifier.ChannelIdentifier, 5, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if op.Phase != models.SettlePhaseRequested {
+		t.Fatalf("expect requested,got %s", op.Phase)
+	}
+	//partner is offline, wait until timeout
+	_, err = m.start(ch2.ChannelIdentifier.ChannelIdentifier, 3, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if phase(ch2) != models.SettlePhasePreparing {
+		t.Fatalf("expect preparing,got %s", phase(ch2))
+	}
+	//start again returns the running one
+	op, err = m.start(ch1.ChannelIdentifier.ChannelIdentifier, 10, 101)
+	if err != nil || op.StartBlock != 100 {
+		t.Fatalf("expect running operation,got %v,err=%v", op, err)
+	}
+
+	//ch2 times out, cancel prepare and close, first close fails
+	onBlock(103)
+	if phase(ch2) != models.SettlePhaseClosing || ch2.State != channeltype.StateOpened {
+		t.Fatalf("expect closing,got %s,channel state %s", phase(ch2), ch2.State)
+	}
+	op, _ = m.get(ch2.ChannelIdentifier.ChannelIdentifier)
+	if op.FallbackReason != "partner is offline" || op.LastError == "" {
+		t.Fatalf("wrong fallback reason %s,last error %s", op.FallbackReason, op.LastError)
+	}
+	//close is retried
+	closeFail = false
+	onBlock(104)
+	//ch1 partner doesn't answer, close without cancel
+	onBlock(105)
+	if phase(ch1) != models.SettlePhaseClosing {
+		t.Fatalf("expect closing,got %s", phase(ch1))
+	}
+	expect := []string{"prepare", "cooperative", "prepare", "cancel", "close", "close", "close"}
+	if len(calls) != len(expect) {
+		t.Fatalf("expect %v,got %v", expect, calls)
+	}
+	for i := range expect {
+		if calls[i] != expect[i] {
+			t.Fatalf("expect %v,got %v", expect, calls)
+		}
+	}
+
+	//restart, close whose result is unknown is sent again
+	m = newManager()
+	m.restore()
+	if len(m.all()) != 2 || phase(ch1) != models.SettlePhaseClosing || phase(ch2) != models.SettlePhaseClosing {
+		t.Fatalf("expect operations restored,got %v", m.all())
+	}
+	onBlock(105)
+	if len(calls) != len(expect)+2 || calls[len(calls)-1] != "close" {
+		t.Fatalf("expect close sent again after restart,got %v", calls)
+	}
+
+	//channel closed, plan to settle automatically
+	ch1.State = channeltype.StateClosed
+	ch2.State = channeltype.StateClosed
+	onBlock(106)
+	onBlock(107)
+	if phase(ch1) != models.SettlePhaseClosed || phase(ch2) != models.SettlePhaseClosed || len(autoSettled) != 2 {
+		t.Fatalf("expect closed and auto settle,got %s %s %v", phase(ch1), phase(ch2), autoSettled)
+	}
+	//channel is gone after settle
+	delete(channels, ch1.ChannelIdentifier.ChannelIdentifier)
+	onBlock(200)
+	if phase(ch1) != models.SettlePhaseSettled || len(m.all()) != 2 {
+		t.Fatalf("expect settled,got %s", phase(ch1))
+	}
+	_, err = m.start(ch1.ChannelIdentifier.ChannelIdentifier, 5, 201)
+	if err == nil {
+		t.Fatal("cannot settle a channel not exist")
+	}
+	m = newManager()
+	m.restore()
+	if phase(ch1) != models.SettlePhaseSettled || phase(ch2) != models.SettlePhaseClosed {
+		t.Fatalf("expect progress saved,got %s %s", phase(ch1), phase(ch2))
+	}
+}
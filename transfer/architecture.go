@@ -4,6 +4,7 @@ import (
 	"encoding/gob"
 
 	"github.com/SmartMeshFoundation/Atmosphere/encoding"
+	"github.com/SmartMeshFoundation/Atmosphere/params"
 	"github.com/ethereum/go-ethereum/common"
 )
 
@@ -105,6 +106,8 @@ type StateManager struct {
 	Identifier          common.Hash //transfer identifier
 	Name                string
 	LastReceivedMessage encoding.SignedMessager
+	Key                 common.Hash //key of this StateManager in Transfer2StateManager
+	LastStateChangeID   int64       //id of the last logged state change which CurrentState already includes
 }
 
 //MessageTag for save and restore
@@ -144,6 +147,39 @@ func (sm *StateManager) Dispatch(stateChange StateChange) (events []Event) {
 	return
 }
 
+/*
+NeedSnapshot 处理完 id 为 stateChangeID 的 StateChange 以后是否应该保存 CurrentState 的快照.
+产生了事件的 StateChange 会修改通道, 重放的时候通道已经不是当时的状态了, 所以处理完以后必须立即保存快照,
+其他的 StateChange 每隔 params.StateManagerSnapshotInterval 保存一次.
+*/
+/*
+ *	NeedSnapshot : whether snapshot of CurrentState should be saved after StateChange with id stateChangeID is handled.
+ *	StateChange producing events changes channels, which are no longer the same when replayed,
+ *	so snapshot must be saved right after it is handled,
+ *	other StateChanges are saved every params.StateManagerSnapshotInterval.
+ */
+func (sm *StateManager) NeedSnapshot(stateChangeID int64, hasEvents bool) bool {
+	return hasEvents || stateChangeID-sm.LastStateChangeID >= params.StateManagerSnapshotInterval
+}
+
+var stateTransitions = make(map[string]FuncStateTransition)
+
+/*
+RegisterStateTransition 注册名为 name 的状态机, 从数据库恢复 StateManager 的时候根据 Name 找回 FuncStateTransition.
+*/
+/*
+ *	RegisterStateTransition : register state machine with name,
+ *	FuncStateTransition is found by Name when StateManager is restored from db.
+ */
+func RegisterStateTransition(name string, stateTransition FuncStateTransition) {
+	stateTransitions[name] = stateTransition
+}
+
+//GetStateTransition returns state machine registered with name, nil if not found.
+func GetStateTransition(name string) FuncStateTransition {
+	return stateTransitions[name]
+}
+
 func init() {
 	gob.Register(&StateManager{})
 	gob.Register(&TransitionResult{})
@@ -5,6 +5,7 @@ import (
 
 	"math/big"
 
+	"github.com/SmartMeshFoundation/Atmosphere/encoding"
 	"github.com/ethereum/go-ethereum/common"
 )
 
@@ -17,7 +18,15 @@ type EventSendMediatedTransfer struct {
 	Target         common.Address
 	Expiration     int64
 	Receiver       common.Address
-	Fee            *big.Int // target should get amount-fee.
+	Fee            *big.Int              // target should get amount-fee.
+	Onion          []byte                //onion packet to send, Initiator and Target are hidden from Receiver if it's not empty
+	RouteHints     []*encoding.RouteHint //last hops to reach the target, they are not sent with the onion
+	/*
+		发起方选择的路径和每个中间节点的手续费, 如果每个节点都支持洋葱路由, 就用它们构造洋葱.
+	*/
+	// path and fee of every mediator chosen by the initiator, the onion is built on them if every node supports onion routing.
+	Path     []common.Address
+	PathFees []*big.Int
 	/*
 		which channel received a mediated transfer and then I have to send another mediated transfer,
 		因为哪个 channel 收到了 MediatedTransfer, 导致我需要发送新的 Transfer.
@@ -40,6 +49,8 @@ func NewEventSendMediatedTransfer(transfer *LockedTransferState, receiver common
 		Expiration:     transfer.Expiration,
 		Receiver:       receiver,
 		Fee:            transfer.Fee,
+		Onion:          transfer.Onion,
+		RouteHints:     transfer.RouteHints,
 	}
 }
 
@@ -115,6 +126,30 @@ type EventSendSecretRequest struct {
 	Receiver          common.Address
 }
 
+/*
+EventTransferHeld 接收方收到了应用要求 hold 的锁, 等待应用 settle 或者 cancel
+*/
+// EventTransferHeld : target received a lock but holds it until application settles or cancels it.
+type EventTransferHeld struct {
+	Token             common.Address
+	ChannelIdentifier common.Hash
+	LockSecretHash    common.Hash
+	Amount            *big.Int
+	Initiator         common.Address
+	Expiration        int64
+}
+
+/*
+EventHeldTransferCanceled 应用在 reveal timeout 之前没有 settle 或者 cancel, hold 住的交易被自动取消了
+*/
+// EventHeldTransferCanceled : held transfer is canceled automatically because application neither settled nor canceled it before reveal timeout.
+type EventHeldTransferCanceled struct {
+	Token          common.Address
+	LockSecretHash common.Hash
+	Amount         *big.Int
+	Expiration     int64
+}
+
 /*
 EventSendAnnounceDisposed used to cleanly backtrack the current node in the route.
 
@@ -233,6 +268,8 @@ func init() {
 	gob.Register(&EventSendRevealSecret{})
 	gob.Register(&EventSendBalanceProof{})
 	gob.Register(&EventSendSecretRequest{})
+	gob.Register(&EventTransferHeld{})
+	gob.Register(&EventHeldTransferCanceled{})
 	gob.Register(&EventSendAnnounceDisposed{})
 	gob.Register(&EventContractSendRegisterSecret{})
 	gob.Register(&EventContractSendWithdraw{})
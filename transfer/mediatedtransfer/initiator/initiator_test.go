@@ -1,6 +1,7 @@
 package initiator
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/SmartMeshFoundation/Atmosphere/params"
@@ -83,6 +84,48 @@ func TestNextRoute(t *testing.T) {
 	assert(t, state.Routes.CanceledRoutes != nil, true)
 }
 
+func TestTransferConstraints(t *testing.T) {
+	var blockNumber int64 = 10
+	routes := []*route.State{
+		utest.MakeRoute(utest.HOP2, utest.UnitTransferAmount, utest.UnitSettleTimeout, utest.UnitRevealTimeout, 0, utils.NewRandomHash()),
+		utest.MakeRoute(utest.HOP3, utest.UnitTransferAmount, utest.UnitSettleTimeout, utest.UnitRevealTimeout, 0, utils.NewRandomHash()),
+	}
+	routes[0].TotalFee = big.NewInt(10)
+	routes[1].TotalFee = big.NewInt(3)
+	st := makeInitStateChange(routes, utest.HOP1, utest.UnitTransferAmount, blockNumber, utest.ADDR, utest.UnitTokenAddress)
+	st.Constraints = &mediatedtransfer.TransferConstraints{
+		MaxFee:        big.NewInt(5),
+		MaxLockBlocks: 20,
+	}
+	it := StateTransition(nil, st)
+	state := it.NewState.(*mediatedtransfer.InitiatorState)
+	assert(t, state.Route, routes[1])
+	assert(t, len(state.Routes.IgnoredRoutes), 1)
+	assert(t, state.Transfer.Expiration, blockNumber+20)
+
+	//lock is too short for reveal timeout
+	routes = []*route.State{
+		utest.MakeRoute(utest.HOP2, utest.UnitTransferAmount, utest.UnitSettleTimeout, utest.UnitRevealTimeout, 0, utils.NewRandomHash()),
+	}
+	st = makeInitStateChange(routes, utest.HOP1, utest.UnitTransferAmount, blockNumber, utest.ADDR, utest.UnitTokenAddress)
+	st.Constraints = &mediatedtransfer.TransferConstraints{
+		Deadline: blockNumber + int64(utest.UnitRevealTimeout),
+	}
+	it = StateTransition(nil, st)
+	assert(t, it.NewState == nil, true)
+	failed := it.Events[0].(*transfer.EventTransferSentFailed)
+	assert(t, strings.Contains(failed.Reason, "reveal timeout"), true)
+
+	//deadline reached
+	st = makeInitStateChange(routes, utest.HOP1, utest.UnitTransferAmount, blockNumber, utest.ADDR, utest.UnitTokenAddress)
+	st.Constraints = &mediatedtransfer.TransferConstraints{
+		Deadline: blockNumber,
+	}
+	it = StateTransition(nil, st)
+	failed = it.Events[0].(*transfer.EventTransferSentFailed)
+	assert(t, strings.Contains(failed.Reason, "deadline"), true)
+}
+
 func TestInitWithUsableRoutes(t *testing.T) {
 	amount := utest.UnitTransferAmount
 	blockNumber := utest.UnitBlockNumber
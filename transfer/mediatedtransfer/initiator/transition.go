@@ -17,6 +17,10 @@ import (
 //NameInitiatorTransition name for state manager
 const NameInitiatorTransition = "InitiatorTransition"
 
+func init() {
+	transfer.RegisterStateTransition(NameInitiatorTransition, StateTransition)
+}
+
 /*
 Clear current state and try a new route.
 
@@ -62,20 +66,58 @@ func userCancelTransfer(state *mt.InitiatorState) *transfer.TransitionResult {
 	}
 }
 
+/*
+tryNewRoute 使用下一个邻居重试, Routes 中每个邻居只有一条路由, 是经过它的最短路径.
+不会用经过同一个邻居的其他路径(比如 KShortestPaths 返回的)重试: 对方在这个通道上 AnnounceDisposed 以后,
+再收到同一个锁会直接忽略(IsLockSecretHashChannelIdentifierDisposed), 而且 AnnounceDisposed 也没有说明是后面哪个节点失败了.
+*/
+/*
+ *	tryNewRoute : retry with the next neighbor, there is only one route for every neighbor in Routes, the shortest path via it.
+ *	Other paths via the same neighbor (returned by KShortestPaths for example) are not used to retry:
+ *	once the partner AnnounceDisposed on this channel, it ignores the same lock received again (IsLockSecretHashChannelIdentifierDisposed),
+ *	and AnnounceDisposed doesn't tell which later node failed either.
+ */
 func tryNewRoute(state *mt.InitiatorState) *transfer.TransitionResult {
 	if state.Route != nil {
 		panic("cannot try a new route while one is being used")
 	}
 	var tryRoute *route.State
+	var lockExpiration int64
+	reason := "no route available"
 	for len(state.Routes.AvailableRoutes) > 0 {
 		r := state.Routes.AvailableRoutes[0]
 		state.Routes.AvailableRoutes = state.Routes.AvailableRoutes[1:]
 		if !r.CanTransfer() || r.AvailableBalance().Cmp(new(big.Int).Add(state.Transfer.TargetAmount, r.Fee)) < 0 {
 			state.Routes.IgnoredRoutes = append(state.Routes.IgnoredRoutes, r)
-		} else {
-			tryRoute = r
-			break
+			continue
+		}
+		/*
+					  The initiator doesn't need to learn the secret, so there is no need
+			         to decrement reveal_timeout from the lock timeout.
+
+			         The lock_expiration could be set to a value larger than
+			         settle_timeout, this is not useful since the next hop will take this
+			         channel settle_timeout as an upper limit for expiration.
+
+			         The two nodes will most likely disagree on latest block, as far as
+			         the expiration goes this is no problem.
+		*/
+		expiration := state.BlockNumber + int64(r.SettleTimeout()) - int64(params.RevealTimeout) // - revealTimeout for test
+		if expiration > state.Transfer.Expiration && state.Transfer.Expiration != 0 {
+			expiration = state.Transfer.Expiration
+		}
+		expiration, why := state.Constraints.Check(r.TotalFee, state.BlockNumber, expiration, r.RevealTimeout())
+		if why != "" {
+			//记录最后一个不满足的原因,所有路由都不满足时作为失败原因
+			// remember the reason, it is the failure reason when no route meets constraints.
+			log.Info(fmt.Sprintf("route via %s ignored, %s", utils.APex2(r.HopNode()), why))
+			reason = fmt.Sprintf("no route meets constraints, %s", why)
+			state.Routes.IgnoredRoutes = append(state.Routes.IgnoredRoutes, r)
+			continue
 		}
+		tryRoute = r
+		lockExpiration = expiration
+		break
 	}
 	if tryRoute == nil {
 		/*
@@ -88,7 +130,7 @@ func tryNewRoute(state *mt.InitiatorState) *transfer.TransitionResult {
 		*/
 		transferFailed := &transfer.EventTransferSentFailed{
 			LockSecretHash: state.Transfer.LockSecretHash,
-			Reason:         "no route available",
+			Reason:         reason,
 			Target:         state.Transfer.Target,
 			Token:          state.Transfer.Token,
 		}
@@ -102,21 +144,6 @@ func tryNewRoute(state *mt.InitiatorState) *transfer.TransitionResult {
 			Events:   events,
 		}
 	}
-	/*
-				  The initiator doesn't need to learn the secret, so there is no need
-		         to decrement reveal_timeout from the lock timeout.
-
-		         The lock_expiration could be set to a value larger than
-		         settle_timeout, this is not useful since the next hop will take this
-		         channel settle_timeout as an upper limit for expiration.
-
-		         The two nodes will most likely disagree on latest block, as far as
-		         the expiration goes this is no problem.
-	*/
-	lockExpiration := state.BlockNumber + int64(tryRoute.SettleTimeout()) - int64(params.RevealTimeout) // - revealTimeout for test
-	if lockExpiration > state.Transfer.Expiration && state.Transfer.Expiration != 0 {
-		lockExpiration = state.Transfer.Expiration
-	}
 	tr := &mt.LockedTransferState{
 		TargetAmount:   state.Transfer.TargetAmount,
 		Amount:         new(big.Int).Add(state.Transfer.TargetAmount, tryRoute.TotalFee),
@@ -127,8 +154,11 @@ func tryNewRoute(state *mt.InitiatorState) *transfer.TransitionResult {
 		LockSecretHash: state.LockSecretHash,
 		Secret:         state.Secret,
 		Fee:            tryRoute.TotalFee,
+		RouteHints:     state.Transfer.RouteHints,
 	}
 	msg := mt.NewEventSendMediatedTransfer(tr, tryRoute.HopNode())
+	msg.Path = tryRoute.Path
+	msg.PathFees = tryRoute.PathFees
 	if len(state.Routes.CanceledRoutes) > 0 {
 		/*
 			保存上次尝试的路由信息,否则当发起方收到AnnounceDisposed的时候,尝试新路由时,会出现异常
@@ -390,6 +420,7 @@ func StateTransition(originalState transfer.State, st transfer.StateChange) *tra
 				LockSecretHash: staii.LockSecretHash,
 				Secret:         staii.Secret,
 				Db:             staii.Db,
+				Constraints:    staii.Constraints,
 			}
 			return tryNewRoute(state)
 		}
@@ -132,9 +132,9 @@ func TestIsRegisterSecretNeededUnpaid(t *testing.T) {
 		unpaidPair.PayeeState = unpaidState
 		assert(t, unpaidPair.PayerRoute.State(), channeltype.StateOpened)
 		safeBlock := expiration - int64(revealTimeout) - 1
-		assert(t, isSecretRegisterNeeded(unpaidPair, safeBlock), false)
+		assert(t, isSecretRegisterNeeded(unpaidPair, safeBlock, 0), false)
 		unsafeBlock := expiration - int64(revealTimeout)
-		assert(t, isSecretRegisterNeeded(unpaidPair, unsafeBlock), false)
+		assert(t, isSecretRegisterNeeded(unpaidPair, unsafeBlock, 0), false)
 	}
 }
 
@@ -150,9 +150,9 @@ func TestIsRegisterSecretNeededPaid(t *testing.T) {
 		paidPair.PayeeState = paidState
 		assert(t, paidPair.PayerRoute.State(), channeltype.StateOpened)
 		safeBlock := expiration - int64(revealTimeout) - 1
-		assert(t, isSecretRegisterNeeded(paidPair, safeBlock), false)
+		assert(t, isSecretRegisterNeeded(paidPair, safeBlock, 0), false)
 		unsafeBlock := expiration - int64(revealTimeout)
-		assert(t, isSecretRegisterNeeded(paidPair, unsafeBlock), true)
+		assert(t, isSecretRegisterNeeded(paidPair, unsafeBlock, 0), true)
 	}
 }
 
@@ -168,9 +168,9 @@ func TestIsRegisterSecretNeedChannelClosed(t *testing.T) {
 		pair.PayerRoute.SetState(channeltype.StateClosed)
 
 		safeBlock := expiration - int64(revealTimeout) - 1
-		assert(t, isSecretRegisterNeeded(pair, safeBlock), false)
+		assert(t, isSecretRegisterNeeded(pair, safeBlock, 0), false)
 		unsafeBlock := expiration - int64(revealTimeout)
-		assert(t, isSecretRegisterNeeded(pair, unsafeBlock), false)
+		assert(t, isSecretRegisterNeeded(pair, unsafeBlock, 0), false)
 	}
 }
 
@@ -184,9 +184,9 @@ func TestIsRegisterSecretNeededClosed(t *testing.T) {
 
 	assert(t, pair.PayerRoute.State(), channeltype.StateOpened)
 	safeBlock := expiration - int64(revealTimeout) - 1
-	assert(t, isSecretRegisterNeeded(pair, safeBlock), false)
+	assert(t, isSecretRegisterNeeded(pair, safeBlock, 0), false)
 	unsafeBlock := expiration - int64(revealTimeout)
-	assert(t, isSecretRegisterNeeded(pair, unsafeBlock), true)
+	assert(t, isSecretRegisterNeeded(pair, unsafeBlock, 0), true)
 
 }
 func TestIsValidRefund(t *testing.T) {
@@ -356,6 +356,65 @@ func TestNextTransferPair(t *testing.T) {
 	assert(t, len(routesState.AvailableRoutes), 0)
 }
 
+func TestNextOnionTransferPair(t *testing.T) {
+	timeoutBlocks := 47
+	var blockNumber int64 = 3
+	var balance = big.NewInt(10)
+	payerRoute := utest.MakeRoute(utest.HOP1, balance, 0, 0, 0, utils.NewRandomHash())
+	makePayerTransfer := func(expiration int64) *mediatedtransfer.LockedTransferState {
+		tr := utest.MakeTransfer(balance, utils.EmptyAddress, utils.EmptyAddress, 50, utils.EmptyHash, utils.EmptyHash, utest.UnitTokenAddress)
+		tr.OnionHop = &mediatedtransfer.OnionHop{
+			NextHop:    utest.HOP3,
+			Amount:     big.NewInt(8),
+			Expiration: expiration,
+			Onion:      []byte{1, 2, 3},
+		}
+		return tr
+	}
+	makeRoutes := func(fee int64) []*route.State {
+		routes := []*route.State{
+			utest.MakeRoute(utest.HOP2, balance, utest.UnitSettleTimeout, utest.UnitRevealTimeout, 0, utils.NewRandomHash()),
+			utest.MakeRoute(utest.HOP3, balance, utest.UnitSettleTimeout, utest.UnitRevealTimeout, 0, utils.NewRandomHash()),
+		}
+		routes[1].Fee = big.NewInt(fee)
+		return routes
+	}
+
+	//only the next hop in the onion is used
+	payerTransfer := makePayerTransfer(40)
+	routes := makeRoutes(2)
+	routesState := route.NewRoutesState(routes)
+	pair, events := nextTransferPair(payerRoute, payerTransfer, routesState, timeoutBlocks, blockNumber)
+	assert(t, pair != nil, true)
+	assert(t, pair.PayeeRoute, routes[1])
+	assert(t, routesState.IgnoredRoutes, routes[:1])
+	assert(t, len(events), 1)
+	tr, ok := events[0].(*mediatedtransfer.EventSendMediatedTransfer)
+	assert(t, ok, true)
+	assert(t, tr.Receiver, utest.HOP3)
+	assert(t, tr.Amount, big.NewInt(8))
+	assert(t, tr.Expiration, int64(40))
+	assert(t, tr.Onion, []byte{1, 2, 3})
+	assert(t, tr.Initiator, utils.EmptyAddress)
+	assert(t, tr.Target, utils.EmptyAddress)
+	assert(t, pair.PayerTransfer.AlmostEqual(pair.PayeeTransfer), true)
+
+	//fee is less than our fee
+	routesState = route.NewRoutesState(makeRoutes(3))
+	pair, _ = nextTransferPair(payerRoute, makePayerTransfer(40), routesState, timeoutBlocks, blockNumber)
+	assert(t, pair == nil, true)
+
+	//expiration later than payer's
+	routesState = route.NewRoutesState(makeRoutes(0))
+	pair, _ = nextTransferPair(payerRoute, makePayerTransfer(51), routesState, timeoutBlocks, blockNumber)
+	assert(t, pair == nil, true)
+
+	//not enough blocks for reveal timeout
+	routesState = route.NewRoutesState(makeRoutes(0))
+	pair, _ = nextTransferPair(payerRoute, makePayerTransfer(blockNumber+int64(utest.UnitRevealTimeout)), routesState, timeoutBlocks, blockNumber)
+	assert(t, pair == nil, true)
+}
+
 func TestSetPayee(t *testing.T) {
 	pairs := makeTransfersPair(utest.HOP1, []common.Address{utest.HOP2, utest.HOP3, utest.HOP4}, utest.HOP6, 10, utest.UnitSecret, 0, utest.UnitRevealTimeout)
 	assert(t, pairs[0].PayerState, mediatedtransfer.StatePayerPending)
@@ -506,7 +565,7 @@ func TestEventsForBanalceProof(t *testing.T) {
 	lastpair.PayeeState = mediatedtransfer.StatePayeeSecretRevealed
 	// the lock has not expired yet
 	blockNumber := lastpair.PayeeTransfer.Expiration
-	events := eventsForBalanceProof(pairs, blockNumber)
+	events := eventsForBalanceProof(pairs, blockNumber, 0)
 	assert(t, len(events), 2)
 	var balanceProof *mediatedtransfer.EventSendBalanceProof
 	var unlockSuccess *mediatedtransfer.EventUnlockSuccess
@@ -539,7 +598,7 @@ func TestEventsForBalanceProofChannelClosed(t *testing.T) {
 		lastpair.PayeeRoute.SetState(state)
 		lastpair.PayeeRoute.SetClosedBlock(blockNumber)
 		lastpair.PayeeState = mediatedtransfer.StatePayeeSecretRevealed
-		events := eventsForBalanceProof(pairs, blockNumber)
+		events := eventsForBalanceProof(pairs, blockNumber, 0)
 		assert(t, len(events), 0)
 	}
 }
@@ -557,7 +616,7 @@ func TestEventsForBalanceProofMiddleSecret(t *testing.T) {
 	var blockNumber int64 = 1
 	middlePair := pairs[1]
 	middlePair.PayeeState = mediatedtransfer.StatePayeeSecretRevealed
-	events := eventsForBalanceProof(pairs, blockNumber)
+	events := eventsForBalanceProof(pairs, blockNumber, 0)
 	assert(t, len(events), 2)
 	var balanceProof *mediatedtransfer.EventSendBalanceProof
 	var unlockSuccess *mediatedtransfer.EventUnlockSuccess
@@ -580,7 +639,7 @@ func TestEventsFroBalanceProofSecretUnkown(t *testing.T) {
 	var blockNumber int64 = 1
 	pairs := makeTransfersPair(utest.HOP1, []common.Address{utest.HOP2, utest.HOP3, utest.HOP4}, utest.HOP6, 10, utils.EmptyHash, 0, utest.UnitRevealTimeout)
 	//pairs[1].PayeeState = mediated_transfer.STATE_PAYEE_SECRET_REVEALED
-	events := eventsForBalanceProof(pairs, blockNumber)
+	events := eventsForBalanceProof(pairs, blockNumber, 0)
 	assert(t, len(events), 0)
 
 	pairs = makeTransfersPair(utest.HOP1, []common.Address{utest.HOP2, utest.HOP3, utest.HOP4}, utest.HOP6, 10, utest.UnitSecret, 0, utest.UnitRevealTimeout)
@@ -590,7 +649,7 @@ func TestEventsFroBalanceProofSecretUnkown(t *testing.T) {
 		     to reach, in reality someone needs to reveal the secret to the mediator,
 		     so at least one other node knows the secret.
 	*/
-	events = eventsForBalanceProof(pairs, blockNumber)
+	events = eventsForBalanceProof(pairs, blockNumber, 0)
 	assert(t, len(events), 0)
 }
 
@@ -601,7 +660,7 @@ func TestEventsForBalanceProofLockExpired(t *testing.T) {
 	lastpair.PayeeState = mediatedtransfer.StatePayeeSecretRevealed
 	var blockNumber = lastpair.PayeeTransfer.Expiration + 1
 	//the lock has expired, do not send a balance proof
-	events := eventsForBalanceProof(pairs, blockNumber)
+	events := eventsForBalanceProof(pairs, blockNumber, 0)
 	assert(t, len(events), 0)
 	middlePair := pairs[len(pairs)-2]
 	middlePair.PayeeState = mediatedtransfer.StatePayeeSecretRevealed
@@ -612,7 +671,7 @@ func TestEventsForBalanceProofLockExpired(t *testing.T) {
 		     the last hop needs to choose a proper reveal_timeout and must go on-chain
 		     to withdraw the token before the lock expires.
 	*/
-	events = eventsForBalanceProof(pairs, blockNumber)
+	events = eventsForBalanceProof(pairs, blockNumber, 0)
 	var balanceProof *mediatedtransfer.EventSendBalanceProof
 	var unlockSuccess *mediatedtransfer.EventUnlockSuccess
 	for _, e := range events {
@@ -636,7 +695,7 @@ func TestEventsForRegisterSecret(t *testing.T) {
 		pair := pairs[0]
 		pair.PayeeState = payeeState
 		blockNumber := pair.PayerTransfer.Expiration - int64(pair.PayeeRoute.RevealTimeout())
-		events := eventsForRegisterSecret(pairs, blockNumber)
+		events := eventsForRegisterSecret(pairs, blockNumber, 0)
 		assert(t, len(events), 1)
 		ev := events[0].(*mediatedtransfer.EventContractSendRegisterSecret)
 		assert(t, ev != nil, true)
@@ -659,13 +718,13 @@ func TestEventsForCloseHoldForUnpaidPayee(t *testing.T) {
 
 	// do not generate events if the secret is known AND the payee is not paid
 	firstUnSafeBlock := pair.PayerTransfer.Expiration - int64(pair.PayerRoute.RevealTimeout())
-	events := eventsForRegisterSecret(pairs, firstUnSafeBlock)
+	events := eventsForRegisterSecret(pairs, firstUnSafeBlock, 0)
 	assert(t, len(events), 0)
 	assert(t, stateTransferPaidMaps[pair.PayeeState], false)
 	assert(t, stateTransferPaidMaps[pair.PayerState], false)
 
 	payerExpirationBlock := pair.PayerTransfer.Expiration
-	events = eventsForRegisterSecret(pairs, payerExpirationBlock)
+	events = eventsForRegisterSecret(pairs, payerExpirationBlock, 0)
 	assert(t, len(events), 0)
 	assert(t, stateTransferPaidMaps[pair.PayeeState], false)
 	assert(t, stateTransferPaidMaps[pair.PayerState], false)
@@ -739,6 +798,41 @@ func TestMediateTransfer(t *testing.T) {
 
 }
 
+func TestMediateTransferRevealMargin(t *testing.T) {
+	var amount = big.NewInt(10)
+	var blockNumber int64 = 5
+	var expiration int64 = 30
+	mediate := func(margin int) (mediated, refund int) {
+		var routes = []*route.State{utest.MakeRoute(utest.HOP2, utest.UnitTransferAmount, utest.UnitSettleTimeout, utest.UnitRevealTimeout, 0, utils.NewRandomHash())}
+		state := &mediatedtransfer.MediatorState{
+			OurAddress:   utest.ADDR,
+			Routes:       route.NewRoutesState(routes),
+			BlockNumber:  blockNumber,
+			Hashlock:     utest.UnitHashLock,
+			RevealMargin: margin,
+		}
+		payerroute, payertransfer := utest.MakeFrom(amount, utest.HOP6, expiration, utils.NewRandomAddress(), utils.EmptyHash)
+		it := mediateTransfer(state, payerroute, payertransfer)
+		for _, e := range it.Events {
+			switch e.(type) {
+			case *mediatedtransfer.EventSendMediatedTransfer:
+				mediated++
+			case *mediatedtransfer.EventSendAnnounceDisposed:
+				refund++
+			}
+		}
+		return
+	}
+	//25 blocks left, enough
+	mediated, refund := mediate(int(expiration - blockNumber))
+	assert(t, mediated, 1)
+	assert(t, refund, 0)
+	//chain is slow, 25 blocks are not enough
+	mediated, refund = mediate(int(expiration-blockNumber) + 1)
+	assert(t, mediated, 0)
+	assert(t, refund, 1)
+}
+
 func TestInitMediator(t *testing.T) {
 	fromRoute, FromTransfer := utest.MakeFrom(utest.UnitTransferAmount, utest.HOP2, int64(utest.Hop1Timeout), utils.NewRandomAddress(), utils.EmptyHash)
 	var routes = []*route.State{utest.MakeRoute(utest.HOP2, utest.UnitTransferAmount, utest.UnitSettleTimeout, utest.UnitRevealTimeout, 0, utils.NewRandomHash())}
@@ -768,6 +862,26 @@ func TestInitMediator(t *testing.T) {
 	assert(t, mtr.LockSecretHash, FromTransfer.LockSecretHash)
 }
 
+func TestInitMediatorRejected(t *testing.T) {
+	fromRoute, FromTransfer := utest.MakeFrom(utest.UnitTransferAmount, utest.HOP2, int64(utest.Hop1Timeout), utils.NewRandomAddress(), utils.EmptyHash)
+	var routes = []*route.State{utest.MakeRoute(utest.HOP2, utest.UnitTransferAmount, utest.UnitSettleTimeout, utest.UnitRevealTimeout, 0, utils.NewRandomHash())}
+	initStateChange := makeInitStateChange(FromTransfer, fromRoute, routes, utest.ADDR)
+	initStateChange.RejectReason = "exceed risk limits"
+	sm := transfer.NewStateManager(StateTransition, nil, "mediator", utils.ShaSecret([]byte("3")), utils.NewRandomAddress())
+	events := sm.Dispatch(initStateChange)
+	var refunds []*mediatedtransfer.EventSendAnnounceDisposed
+	for _, e := range events {
+		switch e2 := e.(type) {
+		case *mediatedtransfer.EventSendMediatedTransfer:
+			t.Fatal("rejected transfer should not be forwarded")
+		case *mediatedtransfer.EventSendAnnounceDisposed:
+			refunds = append(refunds, e2)
+		}
+	}
+	assert(t, len(refunds), 1)
+	assert(t, refunds[0].LockSecretHash, FromTransfer.LockSecretHash)
+}
+
 func TestNoValidRoutes(t *testing.T) {
 	fromRoute, FromTransfer := utest.MakeFrom(utest.UnitTransferAmount, utest.HOP2, int64(utest.Hop1Timeout), utils.NewRandomAddress(), utils.EmptyHash)
 	var routes = []*route.State{utest.MakeRoute(utest.HOP2, x.Sub(utest.UnitTransferAmount, big.NewInt(1)), utest.UnitSettleTimeout, utest.UnitRevealTimeout, 0, utils.NewRandomHash()),
@@ -20,6 +20,10 @@ import (
 //NameMediatorTransition name for state manager
 const NameMediatorTransition = "MediatorTransition"
 
+func init() {
+	transfer.RegisterStateTransition(NameMediatorTransition, StateTransition)
+}
+
 /*
  Reduce the lock expiration by some additional blocks to prevent this exploit:
  The payee could reveal the secret on it's lock expiration block, the lock
@@ -67,6 +71,17 @@ func IsSafeToWait(tr *mediatedtransfer.LockedTransferState, revealTimeout int, b
 	return blockNumber < tr.Expiration-int64(revealTimeout)
 }
 
+/*
+revealMargin 通道的 reveal timeout 和根据链上状况调整的 margin 中较大的那个.
+*/
+// revealMargin : the larger one of reveal timeout of channel and margin adjusted by chain conditions.
+func revealMargin(r *route.State, margin int) int {
+	if margin > r.RevealTimeout() {
+		return margin
+	}
+	return r.RevealTimeout()
+}
+
 //IsValidRefund returns True if the refund transfer matches the original transfer.
 func IsValidRefund(originTr *mediatedtransfer.LockedTransferState, originRoute *route.State, st *mediatedtransfer.ReceiveAnnounceDisposedStateChange) bool {
 	//Ignore a refund from the target
@@ -92,12 +107,12 @@ True if this node needs to register secret on chain
     has received, this prevents attacks were the payee node burns it's payment
     to force a close with the payer channel.
 */
-func isSecretRegisterNeeded(tr *mediatedtransfer.MediationPairState, blockNumber int64) bool {
+func isSecretRegisterNeeded(tr *mediatedtransfer.MediationPairState, blockNumber int64, margin int) bool {
 	payeeReceived := stateTransferPaidMaps[tr.PayeeState]
 	payerPayed := stateTransferPaidMaps[tr.PayerState]
 	payerChannelOpen := tr.PayerRoute.State() == channeltype.StateOpened
 	AlreadyRegisterring := tr.PayerState == mediatedtransfer.StatePayerWaitingRegisterSecret
-	safeToWait := IsSafeToWait(tr.PayerTransfer, tr.PayerRoute.RevealTimeout(), blockNumber)
+	safeToWait := IsSafeToWait(tr.PayerTransfer, revealMargin(tr.PayerRoute, margin), blockNumber)
 
 	return payeeReceived && !payerPayed && payerChannelOpen && !AlreadyRegisterring && !safeToWait
 }
@@ -307,6 +322,9 @@ func nextTransferPair(payerRoute *route.State, payerTransfer *mediatedtransfer.L
 	if int64(timeoutBlocks) > payerTransfer.Expiration-blockNumber {
 		panic("timeoutBlocks >payerTransfer.Expiration-blockNumber")
 	}
+	if payerTransfer.OnionHop != nil {
+		return nextOnionTransferPair(payerRoute, payerTransfer, routesState, timeoutBlocks, blockNumber)
+	}
 	payeeRoute := nextRoute(payerRoute, routesState, timeoutBlocks, payerTransfer.Amount, payerTransfer.Fee)
 	if payeeRoute != nil {
 		/*
@@ -321,6 +339,12 @@ func nextTransferPair(payerRoute *route.State, payerTransfer *mediatedtransfer.L
 		//不再减少时间,没有必要了,只要这个时间不超过 payee 的 settle timeout 即可
 		lockTimeout := timeoutBlocks //- payeeRoute.RevealTimeout()
 		lockExpiration := int64(lockTimeout) + blockNumber
+		/*
+			payeeRoute.Fee 是按照转给下一跳的金额, 即 TargetAmount 加上后面节点的手续费计算的, 和 fee.PathCost 一致,
+			上家正好给了 PathCost 计算的金额时, 转出的金额就是这个计算基数.
+		*/
+		// payeeRoute.Fee is charged on the amount sent to next hop, that's TargetAmount plus fee of later mediators,
+		// the same as fee.PathCost, the amount sent on is exactly the base if payer pays what PathCost calculates.
 		payeeTransfer := &mediatedtransfer.LockedTransferState{
 			TargetAmount:   payerTransfer.TargetAmount,
 			Amount:         big.NewInt(0).Sub(payerTransfer.Amount, payeeRoute.Fee),
@@ -331,6 +355,7 @@ func nextTransferPair(payerRoute *route.State, payerTransfer *mediatedtransfer.L
 			LockSecretHash: payerTransfer.LockSecretHash,
 			Secret:         payerTransfer.Secret,
 			Fee:            big.NewInt(0).Sub(payerTransfer.Fee, payeeRoute.Fee),
+			RouteHints:     payerTransfer.RouteHints,
 		}
 		if payeeRoute.HopNode() == payeeTransfer.Target {
 			//i'm the last hop,so take the rest of the fee
@@ -346,6 +371,60 @@ func nextTransferPair(payerRoute *route.State, payerTransfer *mediatedtransfer.L
 	return
 }
 
+/*
+nextOnionTransferPair 洋葱路由的交易只能发给洋葱中指定的下一跳, 金额和过期块也由洋葱指定,
+只有上家给的手续费足够, 并且过期块对我安全时才转发.
+*/
+/*
+ *	nextOnionTransferPair : an onion routed transfer can only be sent to the next hop specified by the onion,
+ *	with amount and expiration specified by the onion too.
+ *	It's forwarded only if the payer pays enough fee and the expiration is safe for us.
+ */
+func nextOnionTransferPair(payerRoute *route.State, payerTransfer *mediatedtransfer.LockedTransferState,
+	routesState *route.RoutesState, timeoutBlocks int, blockNumber int64) (
+	transferPair *mediatedtransfer.MediationPairState, events []transfer.Event) {
+	hop := payerTransfer.OnionHop
+	fee := new(big.Int).Sub(payerTransfer.Amount, hop.Amount)
+	lockTimeout := hop.Expiration - blockNumber
+	var payeeRoute *route.State
+	for len(routesState.AvailableRoutes) > 0 {
+		r := routesState.AvailableRoutes[0]
+		routesState.AvailableRoutes = routesState.AvailableRoutes[1:]
+		/*
+			1. 必须是洋葱指定的下一跳
+			2. 通道金额足够, 收费也够
+			3. 过期块不晚于上家的, 锁剩余时间超过 reveal timeout 并且不超过 settle timeout
+		*/
+		if r.HopNode() == hop.NextHop && r.HopNode() != payerRoute.HopNode() && r.CanTransfer() &&
+			r.AvailableBalance().Cmp(hop.Amount) >= 0 && fee.Cmp(r.Fee) >= 0 &&
+			lockTimeout <= int64(timeoutBlocks) && lockTimeout > int64(r.RevealTimeout()) && lockTimeout <= int64(r.SettleTimeout()) {
+			payeeRoute = r
+			break
+		}
+		routesState.IgnoredRoutes = append(routesState.IgnoredRoutes, r)
+	}
+	if payeeRoute == nil {
+		log.Warn(fmt.Sprintf("cannot forward onion transfer %s to %s, amount=%s,fee=%s,expiration=%d",
+			utils.HPex(payerTransfer.LockSecretHash), utils.APex2(hop.NextHop), hop.Amount, fee, hop.Expiration))
+		return
+	}
+	payeeTransfer := &mediatedtransfer.LockedTransferState{
+		TargetAmount:   payerTransfer.TargetAmount,
+		Amount:         new(big.Int).Set(hop.Amount),
+		Token:          payerTransfer.Token,
+		Expiration:     hop.Expiration,
+		LockSecretHash: payerTransfer.LockSecretHash,
+		Secret:         payerTransfer.Secret,
+		Fee:            big.NewInt(0),
+		Onion:          hop.Onion,
+	}
+	transferPair = mediatedtransfer.NewMediationPairState(payerRoute, payeeRoute, payerTransfer, payeeTransfer)
+	eventSendMediatedTransfer := mediatedtransfer.NewEventSendMediatedTransfer(payeeTransfer, payeeRoute.HopNode())
+	eventSendMediatedTransfer.FromChannel = payerRoute.ChannelIdentifier
+	events = []transfer.Event{eventSendMediatedTransfer}
+	return
+}
+
 /*
 Set the state of a transfer *sent* to a payee and check the secret is
     being revealed backwards.
@@ -572,7 +651,7 @@ func eventsForRevealSecret(transfersPair []*mediatedtransfer.MediationPairState,
 }
 
 //Send the balance proof to nodes that know the secret.
-func eventsForBalanceProof(transfersPair []*mediatedtransfer.MediationPairState, blockNumber int64) (events []transfer.Event) {
+func eventsForBalanceProof(transfersPair []*mediatedtransfer.MediationPairState, blockNumber int64, margin int) (events []transfer.Event) {
 	for j := len(transfersPair) - 1; j >= 0; j-- {
 		pair := transfersPair[j]
 		payeeKnowsSecret := stateSecretKnownMaps[pair.PayeeState]
@@ -591,7 +670,7 @@ func eventsForBalanceProof(transfersPair []*mediatedtransfer.MediationPairState,
 		// If the time I receive secret from my previous node is near reveal_timeout, then we better do nothing.
 		// to force failure of this transfer or next node to register secret.
 		// My partner should not reveal this secret to me near reveal_timeout instead that he should reveal it ahead.
-		payerTransferInDanger := blockNumber > pair.PayerTransfer.Expiration-int64(pair.PayerRoute.RevealTimeout())
+		payerTransferInDanger := blockNumber > pair.PayerTransfer.Expiration-int64(revealMargin(pair.PayerRoute, margin))
 		/*
 					  todo: All nodes must register the secret  on-chain if the
 			         lock is nearing it's expiration block, what should be the strategy
@@ -628,12 +707,12 @@ Close the channels that are in the unsafe region prior to an on-chain
  *	Close the channels that are in the unsafe region prior to an on-chain withdraw
  *	All channel participants should be responsbile to send reveal secret when necessary.
  */
-func eventsForRegisterSecret(transfersPair []*mediatedtransfer.MediationPairState, blockNumber int64) (events []transfer.Event) {
+func eventsForRegisterSecret(transfersPair []*mediatedtransfer.MediationPairState, blockNumber int64, margin int) (events []transfer.Event) {
 	pendings := getPendingTransferPairs(transfersPair)
 	needRegisterSecret := false
 	for j := len(pendings) - 1; j >= 0; j-- {
 		pair := pendings[j]
-		if isSecretRegisterNeeded(pair, blockNumber) {
+		if isSecretRegisterNeeded(pair, blockNumber, margin) {
 			//只需发出一次注册请求,所有的 pair 状态都应该修改为StatePayerWaitingRegisterSecret
 			// we only need to send reveal secret once, all pairs state should switch to StatePayerWaitingRegisterSecret.
 			if needRegisterSecret {
@@ -667,8 +746,8 @@ func secretLearned(state *mediatedtransfer.MediatorState, secret common.Hash, pa
 	var events []transfer.Event
 	eventsWrongOrder := setPayeeStateAndCheckRevealOrder(state.TransfersPair, payeeAddress, newPayeeState)
 	eventsSecretReveal := eventsForRevealSecret(state.TransfersPair, state.OurAddress)
-	eventBalanceProof := eventsForBalanceProof(state.TransfersPair, state.BlockNumber)
-	eventsRegisterSecretEvent := eventsForRegisterSecret(state.TransfersPair, state.BlockNumber)
+	eventBalanceProof := eventsForBalanceProof(state.TransfersPair, state.BlockNumber, state.RevealMargin)
+	eventsRegisterSecretEvent := eventsForRegisterSecret(state.TransfersPair, state.BlockNumber, state.RevealMargin)
 	events = append(events, eventsWrongOrder...)
 	events = append(events, eventsSecretReveal...)
 	events = append(events, eventBalanceProof...)
@@ -691,7 +770,21 @@ Try a new route or fail back to a refund.
 func mediateTransfer(state *mediatedtransfer.MediatorState, payerRoute *route.State, payerTransfer *mediatedtransfer.LockedTransferState) *transfer.TransitionResult {
 	var transferPair *mediatedtransfer.MediationPairState
 	var events []transfer.Event
-
+	/*
+		链上注册密码可能会比较慢的时候, 锁剩余的时间不够就拒绝转发, 否则下家在锁快过期时才给出密码, 我就来不及在链上注册密码拿回钱.
+	*/
+	/*
+	 *	When registering secret on chain may be slow, refuse to forward the lock if it doesn't have enough blocks left,
+	 *	otherwise payee may reveal the secret near expiration and I have no time to register it on chain.
+	 */
+	if state.RevealMargin > 0 && payerTransfer.Expiration-state.BlockNumber < int64(revealMargin(payerRoute, state.RevealMargin)) {
+		log.Warn(fmt.Sprintf("lock %s expires at %d, less than %d blocks left, reject",
+			utils.HPex(payerTransfer.LockSecretHash), payerTransfer.Expiration, revealMargin(payerRoute, state.RevealMargin)))
+		return &transfer.TransitionResult{
+			NewState: state,
+			Events:   eventsForRefund(payerRoute, payerTransfer),
+		}
+	}
 	timeoutBlocks := int(getTimeoutBlocks(payerRoute, payerTransfer, state.BlockNumber))
 	if timeoutBlocks > 0 {
 		transferPair, events = nextTransferPair(payerRoute, payerTransfer, state.Routes, timeoutBlocks, state.BlockNumber)
@@ -747,6 +840,18 @@ func mediateTransfer(state *mediatedtransfer.MediatorState, payerRoute *route.St
 	}
 }
 
+/*
+rejectTransfer 不转发这笔交易, 通过 AnnounceDisposed 退回给上家, 不会创建 MediationPairState.
+*/
+// rejectTransfer : don't forward this transfer and return it to payer by AnnounceDisposed, no MediationPairState is created.
+func rejectTransfer(state *mediatedtransfer.MediatorState, payerRoute *route.State, payerTransfer *mediatedtransfer.LockedTransferState, reason string) *transfer.TransitionResult {
+	log.Warn(fmt.Sprintf("reject mediated transfer %s from %s: %s", utils.HPex(payerTransfer.LockSecretHash), utils.APex2(payerRoute.HopNode()), reason))
+	return &transfer.TransitionResult{
+		NewState: state,
+		Events:   eventsForRefund(payerRoute, payerTransfer),
+	}
+}
+
 /*
 
  */
@@ -794,6 +899,12 @@ func cancelCurrentRoute(state *mediatedtransfer.MediatorState, refundChannelIden
 */
 // receive another mediatedTransfer
 func handleMediatedTransferAgain(state *mediatedtransfer.MediatorState, st *mediatedtransfer.MediatorReReceiveStateChange) *transfer.TransitionResult {
+	if st.RevealMargin > 0 {
+		state.RevealMargin = st.RevealMargin
+	}
+	if len(st.RejectReason) > 0 {
+		return rejectTransfer(state, st.FromRoute, st.FromTransfer, st.RejectReason)
+	}
 	return mediateTransfer(state, st.FromRoute, st.FromTransfer)
 }
 
@@ -811,7 +922,10 @@ func handleBlock(state *mediatedtransfer.MediatorState, st *transfer.BlockStateC
 		blockNumber = st.BlockNumber
 	}
 	state.BlockNumber = blockNumber
-	closeEvents := eventsForRegisterSecret(state.TransfersPair, blockNumber)
+	if st.RevealMargin > 0 {
+		state.RevealMargin = st.RevealMargin
+	}
+	closeEvents := eventsForRegisterSecret(state.TransfersPair, blockNumber, state.RevealMargin)
 	unlockfailEvents, hasNotExpired := setExpiredPairs(state.TransfersPair, blockNumber)
 	var events []transfer.Event
 	events = append(events, closeEvents...)
@@ -1048,8 +1162,13 @@ func StateTransition(originalState transfer.State, stateChange transfer.StateCha
 				Db:             aim.Db,
 				Token:          aim.FromTranfer.Token,
 				LockSecretHash: aim.FromTranfer.LockSecretHash,
+				RevealMargin:   aim.RevealMargin,
+			}
+			if len(aim.RejectReason) > 0 {
+				it = rejectTransfer(state, aim.FromRoute, aim.FromTranfer, aim.RejectReason)
+			} else {
+				it = mediateTransfer(state, aim.FromRoute, aim.FromTranfer)
 			}
-			it = mediateTransfer(state, aim.FromRoute, aim.FromTranfer)
 		}
 	} else {
 		switch st2 := stateChange.(type) {
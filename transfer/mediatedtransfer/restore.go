@@ -0,0 +1,112 @@
+package mediatedtransfer
+
+import (
+	"fmt"
+
+	"github.com/SmartMeshFoundation/Atmosphere/channel"
+	"github.com/SmartMeshFoundation/Atmosphere/channel/channeltype"
+	"github.com/SmartMeshFoundation/Atmosphere/transfer"
+	"github.com/SmartMeshFoundation/Atmosphere/transfer/route"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+/*
+ChannelFinder 根据 ChannelIdentifier 查找通道,找不到返回 nil
+*/
+// ChannelFinder : find channel by ChannelIdentifier, returns nil if not found
+type ChannelFinder func(channelIdentifier common.Hash) *channel.Channel
+
+/*
+从数据库中恢复出来的 State 和 StateChange 不包含通道指针以及 Db,
+需要重新关联到节点当前的通道和数据库上才能继续使用.
+如果某个路由的通道已经不存在了(比如已经 settle),返回错误,这个 StateManager 不能再恢复.
+*/
+/*
+ *	State and StateChange restored from db contain neither channel pointer nor Db,
+ *	they must be linked to channels and db of this node again before use.
+ *	If the channel of a route no longer exists(settled for example), an error is returned and this StateManager can not be restored.
+ */
+func restoreRoute(r *route.State, findChannel ChannelFinder) error {
+	if r == nil {
+		return nil
+	}
+	ch := findChannel(r.ChannelIdentifier)
+	if ch == nil {
+		return fmt.Errorf("channel %s of route not found", r.ChannelIdentifier.String())
+	}
+	r.SetChannel(ch)
+	return nil
+}
+
+func restoreRoutes(rs *route.RoutesState, findChannel ChannelFinder) (err error) {
+	if rs == nil {
+		return
+	}
+	for _, routes := range [][]*route.State{rs.AvailableRoutes, rs.IgnoredRoutes, rs.RefundedRoutes, rs.CanceledRoutes} {
+		for _, r := range routes {
+			err = restoreRoute(r, findChannel)
+			if err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+//RestoreState link State decoded from db to db and channels of this node
+func RestoreState(state transfer.State, db channeltype.Db, findChannel ChannelFinder) (err error) {
+	switch s := state.(type) {
+	case nil:
+	case *InitiatorState:
+		s.Db = db
+		err = restoreRoutes(s.Routes, findChannel)
+		if err != nil {
+			return
+		}
+		err = restoreRoute(s.Route, findChannel)
+	case *MediatorState:
+		s.Db = db
+		err = restoreRoutes(s.Routes, findChannel)
+		if err != nil {
+			return
+		}
+		for _, pair := range s.TransfersPair {
+			err = restoreRoute(pair.PayerRoute, findChannel)
+			if err != nil {
+				return
+			}
+			err = restoreRoute(pair.PayeeRoute, findChannel)
+			if err != nil {
+				return
+			}
+		}
+	case *TargetState:
+		s.Db = db
+		err = restoreRoute(s.FromRoute, findChannel)
+	default:
+		err = fmt.Errorf("unknown state %T to restore", state)
+	}
+	return
+}
+
+//RestoreStateChange link StateChange decoded from db to db and channels of this node
+func RestoreStateChange(stateChange transfer.StateChange, db channeltype.Db, findChannel ChannelFinder) (err error) {
+	switch st := stateChange.(type) {
+	case *ActionInitInitiatorStateChange:
+		st.Db = db
+		err = restoreRoutes(st.Routes, findChannel)
+	case *ActionInitMediatorStateChange:
+		st.Db = db
+		err = restoreRoutes(st.Routes, findChannel)
+		if err != nil {
+			return
+		}
+		err = restoreRoute(st.FromRoute, findChannel)
+	case *MediatorReReceiveStateChange:
+		err = restoreRoute(st.FromRoute, findChannel)
+	case *ActionInitTargetStateChange:
+		st.Db = db
+		err = restoreRoute(st.FromRoute, findChannel)
+	}
+	return
+}
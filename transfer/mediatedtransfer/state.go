@@ -2,6 +2,7 @@ package mediatedtransfer
 
 import (
 	"encoding/gob"
+	"fmt"
 
 	"math/big"
 
@@ -17,15 +18,32 @@ import (
 LockedTransferState is State of a transfer that is time hash locked.
 */
 type LockedTransferState struct {
-	TargetAmount   *big.Int       //amount target should recevied
-	Amount         *big.Int       // Amount of `token` being transferred.
-	Token          common.Address //Token being transferred.
-	Initiator      common.Address //Transfer initiator
-	Target         common.Address //Transfer target address.
-	Expiration     int64          //The absolute block number that the lock expires.
-	LockSecretHash common.Hash    // The hashlock.
-	Secret         common.Hash    //The secret that unlocks the lock, may be None.
-	Fee            *big.Int       // how much fee left for other hop node.
+	TargetAmount   *big.Int              //amount target should recevied
+	Amount         *big.Int              // Amount of `token` being transferred.
+	Token          common.Address        //Token being transferred.
+	Initiator      common.Address        //Transfer initiator
+	Target         common.Address        //Transfer target address.
+	Expiration     int64                 //The absolute block number that the lock expires.
+	LockSecretHash common.Hash           // The hashlock.
+	Secret         common.Hash           //The secret that unlocks the lock, may be None.
+	Fee            *big.Int              // how much fee left for other hop node.
+	Onion          []byte                //onion packet sent with this transfer, Initiator and Target are empty if it's not empty
+	OnionHop       *OnionHop             //what we peeled from the onion of a received transfer, nil if it's a cleartext transfer
+	RouteHints     []*encoding.RouteHint //last hops to reach the target, forwarded with the transfer
+}
+
+/*
+OnionHop 中间节点从收到的洋葱中解出的下一跳信息, 中间节点只能按照它转发, 不知道发起方和接收方.
+*/
+/*
+ *	OnionHop : the next hop a mediator peeled from the onion received,
+ *	the mediator can only forward the transfer as it says, without knowing the initiator and the target.
+ */
+type OnionHop struct {
+	NextHop    common.Address
+	Amount     *big.Int //amount to send to NextHop
+	Expiration int64    //expiration of the lock sent to NextHop
+	Onion      []byte   //onion packet for NextHop
 }
 
 //AlmostEqual if two state equals?
@@ -49,6 +67,7 @@ func LockedTransferFromMessage(msg *encoding.MediatedTransfer, tokenAddress comm
 		LockSecretHash: msg.LockSecretHash,
 		Fee:            msg.Fee,
 		Token:          tokenAddress,
+		RouteHints:     msg.RouteHints,
 	}
 }
 
@@ -87,6 +106,54 @@ type InitiatorState struct {
 	RevealSecret      *EventSendRevealSecret
 	CanceledTransfers []*EventSendMediatedTransfer
 	Db                channeltype.Db
+	Constraints       *TransferConstraints //nil means no constraint
+}
+
+/*
+TransferConstraints 发起方对一笔交易的限制,满足不了的路由会被忽略,零值表示不限制.
+*/
+/*
+ *	TransferConstraints : constraints of initiator on a transfer, routes which can not meet them are ignored,
+ *	zero value means no constraint.
+ */
+type TransferConstraints struct {
+	MaxFee        *big.Int //total fee paid to mediators must not exceed it
+	MaxLockBlocks int64    //tokens must not be locked longer than this number of blocks
+	Deadline      int64    //no route is tried at or after this block, and no lock expires after it
+	//if not empty, a transfer to ourselves must come back through the channel with LastHop, such as rebalance
+	LastHop common.Address
+}
+
+/*
+Check 检查使用 fee 的路由在 blockNumber 时是否满足限制,返回锁的过期块数,以及不满足时的原因.
+*/
+/*
+ *	Check : check whether a route with fee meets constraints at blockNumber,
+ *	returns expiration of the lock and the reason when it does not.
+ */
+func (c *TransferConstraints) Check(fee *big.Int, blockNumber, lockExpiration int64, revealTimeout int) (expiration int64, reason string) {
+	expiration = lockExpiration
+	if c == nil {
+		return
+	}
+	if c.Deadline > 0 && blockNumber >= c.Deadline {
+		reason = fmt.Sprintf("deadline %d reached", c.Deadline)
+		return
+	}
+	if c.MaxFee != nil && fee != nil && fee.Cmp(c.MaxFee) > 0 {
+		reason = fmt.Sprintf("fee %s exceeds max fee %s", fee, c.MaxFee)
+		return
+	}
+	if c.MaxLockBlocks > 0 && expiration > blockNumber+c.MaxLockBlocks {
+		expiration = blockNumber + c.MaxLockBlocks
+	}
+	if c.Deadline > 0 && expiration > c.Deadline {
+		expiration = c.Deadline
+	}
+	if expiration-blockNumber <= int64(revealTimeout) {
+		reason = fmt.Sprintf("lock of %d blocks is shorter than reveal timeout %d", expiration-blockNumber, revealTimeout)
+	}
+	return
 }
 
 /*
@@ -106,6 +173,7 @@ type MediatorState struct {
 	LockSecretHash common.Hash
 	Token          common.Address
 	Db             channeltype.Db
+	RevealMargin   int //blocks a lock must have left to be forwarded, 0 means reveal timeout of channel
 }
 
 /*
@@ -134,6 +202,12 @@ const StateBalanceProof = "balance_proof"
 //StateWaitingRegisterSecret wait register secret on chain
 const StateWaitingRegisterSecret = "waiting_register_secret"
 
+/*
+StateHeld 接收方的应用要求 hold 这笔交易, 收到的锁在应用调用 settle 或者 cancel 之前既不索要密码,也不披露密码.
+*/
+// StateHeld : target holds the received lock, neither requests nor reveals secret until application settles or cancels it.
+const StateHeld = "held"
+
 /*
 StateSecretRegistered 密码已经在链上披露了
 整个交易的所有参与方都可以认为这笔交易从彻底完成了,
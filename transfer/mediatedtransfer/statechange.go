@@ -38,17 +38,20 @@ type ActionInitInitiatorStateChange struct {
 	Db             channeltype.Db       //get the latest channel state
 	LockSecretHash common.Hash
 	Secret         common.Hash
+	Constraints    *TransferConstraints //nil means no constraint
 }
 
 //ActionInitMediatorStateChange  Initial state for a new mediator.
 type ActionInitMediatorStateChange struct {
-	OurAddress  common.Address             //This node address.
-	FromTranfer *LockedTransferState       //The received MediatedTransfer.
-	Routes      *route.RoutesState         //The current available routes.
-	FromRoute   *route.State               //The route from which the MediatedTransfer was received.
-	BlockNumber int64                      //The current block number.
-	Message     *encoding.MediatedTransfer //the message trigger this statechange
-	Db          channeltype.Db             //get the latest channel state
+	OurAddress   common.Address             //This node address.
+	FromTranfer  *LockedTransferState       //The received MediatedTransfer.
+	Routes       *route.RoutesState         //The current available routes.
+	FromRoute    *route.State               //The route from which the MediatedTransfer was received.
+	BlockNumber  int64                      //The current block number.
+	Message      *encoding.MediatedTransfer //the message trigger this statechange
+	Db           channeltype.Db             //get the latest channel state
+	RevealMargin int                        //blocks a lock must have left to be forwarded, 0 means reveal timeout of channel
+	RejectReason string                     //not empty if this transfer must not be forwarded, such as exceeding risk limits
 }
 
 //MediatorReReceiveStateChange 中间节点再次收到 MediatedTransfer
@@ -57,6 +60,8 @@ type MediatorReReceiveStateChange struct {
 	FromRoute    *route.State
 	FromTransfer *LockedTransferState
 	BlockNumber  int64
+	RevealMargin int    //blocks a lock must have left to be forwarded, 0 means reveal timeout of channel
+	RejectReason string //not empty if this transfer must not be forwarded, such as exceeding risk limits
 }
 
 //ActionInitTargetStateChange Initial state for a new target.
@@ -67,6 +72,19 @@ type ActionInitTargetStateChange struct {
 	BlockNumber int64
 	Message     *encoding.MediatedTransfer //the message trigger this statechange
 	Db          channeltype.Db             //get the latest channel state
+	Hold        bool                       //hold this transfer until application settles or cancels it
+	//not empty if this transfer must be refused, such as a rebalance coming back through another channel
+	RejectReason string
+}
+
+//ActionSettleHeldTransferStateChange application accepts a held transfer, target continues to request or reveal the secret.
+type ActionSettleHeldTransferStateChange struct {
+	LockSecretHash common.Hash
+}
+
+//ActionCancelHeldTransferStateChange application refuses a held transfer, target disposes the lock.
+type ActionCancelHeldTransferStateChange struct {
+	LockSecretHash common.Hash
 }
 
 /*
@@ -282,14 +300,21 @@ func (e *ContractBalanceProofUpdatedStateChange) GetBlockNumber() int64 {
 func init() {
 	gob.Register(&ActionInitInitiatorStateChange{})
 	gob.Register(&ActionInitMediatorStateChange{})
+	gob.Register(&MediatorReReceiveStateChange{})
 	gob.Register(&ActionInitTargetStateChange{})
+	gob.Register(&ActionSettleHeldTransferStateChange{})
+	gob.Register(&ActionCancelHeldTransferStateChange{})
 	gob.Register(&ActionCancelRouteStateChange{})
 	gob.Register(&ReceiveSecretRequestStateChange{})
 	gob.Register(&ReceiveSecretRevealStateChange{})
 	gob.Register(&ReceiveAnnounceDisposedStateChange{})
 	gob.Register(&ReceiveUnlockStateChange{})
 	gob.Register(&ContractSecretRevealOnChainStateChange{})
+	gob.Register(&ContractUnlockStateChange{})
+	gob.Register(&ContractChannelWithdrawStateChange{})
 	gob.Register(&ContractClosedStateChange{})
+	gob.Register(&ContractCooperativeSettledStateChange{})
+	gob.Register(&ContractPunishedStateChange{})
 	gob.Register(&ContractSettledStateChange{})
 	gob.Register(&ContractBalanceStateChange{})
 	gob.Register(&ContractNewChannelStateChange{})
@@ -137,6 +137,113 @@ func TestHandleInitTargetBadExpiration(t *testing.T) {
 	assert(t, len(it.Events), 0)
 }
 
+/*
+Held transfer neither requests nor reveals the secret until it is settled.
+*/
+func TestHoldTransfer(t *testing.T) {
+	var blockNumber int64 = 1
+	var amount int64 = 1
+	var expire = int64(utest.UnitRevealTimeout) + blockNumber + 5
+	initiator := utest.HOP1
+	st := makeInitStateChange(utest.ADDR, amount, blockNumber, initiator, expire)
+	st.FromRoute = utest.MakeRoute(utest.HOP2, big.NewInt(amount), utest.UnitSettleTimeout, utest.UnitRevealTimeout, 0, utils.NewRandomHash())
+	st.Hold = true
+	it := StateTransiton(nil, st)
+	state := it.NewState.(*mediatedtransfer.TargetState)
+	assert(t, state.State, mediatedtransfer.StateHeld)
+	assert(t, len(it.Events), 1)
+	_, ok := it.Events[0].(*mediatedtransfer.EventTransferHeld)
+	assert(t, ok, true)
+
+	//secret is remembered but not revealed
+	it = StateTransiton(state, &mediatedtransfer.ReceiveSecretRevealStateChange{Secret: utest.UnitSecret, Sender: initiator})
+	assert(t, len(it.Events), 0)
+	assert(t, state.FromTransfer.Secret, utest.UnitSecret)
+	assert(t, state.State, mediatedtransfer.StateHeld)
+
+	it = StateTransiton(state, &mediatedtransfer.ActionSettleHeldTransferStateChange{LockSecretHash: state.FromTransfer.LockSecretHash})
+	assert(t, len(it.Events), 1)
+	ev := it.Events[0].(*mediatedtransfer.EventSendRevealSecret)
+	assert(t, ev.Receiver, utest.HOP2)
+	assert(t, state.State, mediatedtransfer.StateRevealSecret)
+}
+
+func TestCancelHeldTransfer(t *testing.T) {
+	var blockNumber int64 = 1
+	var amount int64 = 1
+	var expire = int64(utest.UnitRevealTimeout) + blockNumber + 5
+	initiator := utest.HOP1
+	st := makeInitStateChange(utest.ADDR, amount, blockNumber, initiator, expire)
+	st.FromRoute = utest.MakeRoute(utest.HOP2, big.NewInt(amount), utest.UnitSettleTimeout, utest.UnitRevealTimeout, 0, utils.NewRandomHash())
+	st.Hold = true
+	it := StateTransiton(nil, st)
+	state := it.NewState.(*mediatedtransfer.TargetState)
+
+	//cancel of another lock is ignored
+	it = StateTransiton(state, &mediatedtransfer.ActionCancelHeldTransferStateChange{LockSecretHash: utils.NewRandomHash()})
+	assert(t, it.NewState, state)
+	assert(t, len(it.Events), 0)
+	it = StateTransiton(state, &mediatedtransfer.ActionCancelHeldTransferStateChange{LockSecretHash: state.FromTransfer.LockSecretHash})
+	assert(t, it.NewState == nil, true)
+	ev := it.Events[0].(*mediatedtransfer.EventSendAnnounceDisposed)
+	assert(t, ev.Receiver, utest.HOP2)
+	assert(t, ev.LockSecretHash, state.FromTransfer.LockSecretHash)
+
+	//settle without secret requests it from initiator
+	state.State = mediatedtransfer.StateHeld
+	it = StateTransiton(state, &mediatedtransfer.ActionSettleHeldTransferStateChange{LockSecretHash: state.FromTransfer.LockSecretHash})
+	req := it.Events[0].(*mediatedtransfer.EventSendSecretRequest)
+	assert(t, req.Receiver, initiator)
+	assert(t, state.State, mediatedtransfer.StateSecretRequest)
+}
+
+//held transfer is canceled when it's too late to settle
+func TestHeldTransferCanceledAtRevealTimeout(t *testing.T) {
+	var blockNumber int64 = 1
+	var amount int64 = 1
+	var expire = int64(utest.UnitRevealTimeout) + blockNumber + 5
+	initiator := utest.HOP1
+	st := makeInitStateChange(utest.ADDR, amount, blockNumber, initiator, expire)
+	st.FromRoute = utest.MakeRoute(utest.HOP2, big.NewInt(amount), utest.UnitSettleTimeout, utest.UnitRevealTimeout, 0, utils.NewRandomHash())
+	st.Hold = true
+	it := StateTransiton(nil, st)
+	state := it.NewState.(*mediatedtransfer.TargetState)
+
+	it = StateTransiton(state, &transfer.BlockStateChange{BlockNumber: expire - int64(utest.UnitRevealTimeout) - 1})
+	assert(t, it.NewState, state)
+	assert(t, len(it.Events), 0)
+	//even if secret is known, it's not revealed
+	state.FromTransfer.Secret = utest.UnitSecret
+	it = StateTransiton(state, &transfer.BlockStateChange{BlockNumber: expire - int64(utest.UnitRevealTimeout)})
+	assert(t, it.NewState == nil, true)
+	assert(t, len(it.Events), 4)
+	ev := it.Events[0].(*mediatedtransfer.EventSendAnnounceDisposed)
+	assert(t, ev.Receiver, utest.HOP2)
+	_, ok := it.Events[1].(*mediatedtransfer.EventWithdrawFailed)
+	assert(t, ok, true)
+	_, ok = it.Events[2].(*mediatedtransfer.EventRemoveStateManager)
+	assert(t, ok, true)
+	canceled := it.Events[3].(*mediatedtransfer.EventHeldTransferCanceled)
+	assert(t, canceled.LockSecretHash, state.FromTransfer.LockSecretHash)
+}
+
+//a rejected transfer is disposed at once
+func TestRejectTransfer(t *testing.T) {
+	var blockNumber int64 = 1
+	var amount int64 = 1
+	var expire = int64(utest.UnitRevealTimeout) + blockNumber + 5
+	st := makeInitStateChange(utest.ADDR, amount, blockNumber, utest.ADDR, expire)
+	st.FromRoute = utest.MakeRoute(utest.HOP2, big.NewInt(amount), utest.UnitSettleTimeout, utest.UnitRevealTimeout, 0, utils.NewRandomHash())
+	st.RejectReason = "must come back from another channel"
+	it := StateTransiton(nil, st)
+	assert(t, it.NewState == nil, true)
+	assert(t, len(it.Events), 3)
+	ev := it.Events[0].(*mediatedtransfer.EventSendAnnounceDisposed)
+	assert(t, ev.Receiver, utest.HOP2)
+	failed := it.Events[1].(*mediatedtransfer.EventWithdrawFailed)
+	assert(t, failed.Reason, st.RejectReason)
+}
+
 /*
 The target node needs to inform the secret to the previous node to
     receive an updated balance proof.
@@ -2,6 +2,7 @@ package target
 
 import (
 	"fmt"
+	"math/big"
 
 	"github.com/SmartMeshFoundation/Atmosphere/log"
 	"github.com/SmartMeshFoundation/Atmosphere/transfer"
@@ -14,6 +15,7 @@ import (
 const NameTargetTransition = "TargetTransition"
 
 func init() {
+	transfer.RegisterStateTransition(NameTargetTransition, StateTransiton)
 }
 
 /*
@@ -47,11 +49,29 @@ func handleInitTraget(st *mediatedtransfer.ActionInitTargetStateChange) *transfe
 		BlockNumber:  blockNumber,
 		Db:           st.Db,
 	}
+	if len(st.RejectReason) > 0 {
+		return rejectTransfer(state, st.RejectReason)
+	}
 	safeToWait := mediator.IsSafeToWait(tr, route.RevealTimeout(), blockNumber)
 	/*
 			  if there is not enough time to safely withdraw the token on-chain
 		     silently let the transfer expire.
 	*/
+	if safeToWait && st.Hold {
+		state.State = mediatedtransfer.StateHeld
+		held := &mediatedtransfer.EventTransferHeld{
+			Token:             tr.Token,
+			ChannelIdentifier: route.ChannelIdentifier,
+			LockSecretHash:    tr.LockSecretHash,
+			Amount:            tr.Amount,
+			Initiator:         tr.Initiator,
+			Expiration:        tr.Expiration,
+		}
+		return &transfer.TransitionResult{
+			NewState: state,
+			Events:   []transfer.Event{held},
+		}
+	}
 	if safeToWait {
 		secretRequest := &mediatedtransfer.EventSendSecretRequest{
 			ChannelIdentifier: route.ChannelIdentifier,
@@ -72,6 +92,90 @@ func handleInitTraget(st *mediatedtransfer.ActionInitTargetStateChange) *transfe
 	}
 }
 
+/*
+handleSettleHeld 应用接受了 hold 的交易,如果已经知道密码就直接向上家披露,否则向发起方索要密码.
+必须在 reveal timeout 之前调用,否则没有足够的时间安全的拿到钱,交易只能等待过期.
+*/
+/*
+ *	handleSettleHeld : application accepts the held transfer, reveal the secret to the previous node if we know it,
+ *	otherwise request it from the initiator.
+ *	It must be called before reveal timeout, otherwise there is no time to get tokens safely and the transfer just expires.
+ */
+func handleSettleHeld(state *mediatedtransfer.TargetState, st *mediatedtransfer.ActionSettleHeldTransferStateChange) (it *transfer.TransitionResult) {
+	it = &transfer.TransitionResult{
+		NewState: state,
+	}
+	tr := state.FromTransfer
+	route := state.FromRoute
+	if state.State != mediatedtransfer.StateHeld || st.LockSecretHash != tr.LockSecretHash ||
+		!mediator.IsSafeToWait(tr, route.RevealTimeout(), state.BlockNumber) {
+		log.Warn(fmt.Sprintf("settle held transfer %s ignored, state=%s", utils.HPex(st.LockSecretHash), state.State))
+		return
+	}
+	if tr.Secret != utils.EmptyHash {
+		state.State = mediatedtransfer.StateRevealSecret
+		it.Events = append(it.Events, &mediatedtransfer.EventSendRevealSecret{
+			LockSecretHash: tr.LockSecretHash,
+			Secret:         tr.Secret,
+			Token:          tr.Token,
+			Receiver:       route.HopNode(),
+			Sender:         state.OurAddress,
+		})
+		return
+	}
+	state.State = mediatedtransfer.StateSecretRequest
+	it.Events = append(it.Events, &mediatedtransfer.EventSendSecretRequest{
+		ChannelIdentifier: route.ChannelIdentifier,
+		LockSecretHash:    tr.LockSecretHash,
+		Amount:            tr.Amount,
+		Receiver:          tr.Initiator,
+	})
+	return
+}
+
+/*
+handleCancelHeld 应用拒绝了 hold 的交易,声明放弃这个锁,上家可以选择其他路径或者退回.
+*/
+/*
+ *	handleCancelHeld : application refuses the held transfer, announce that this lock is disposed,
+ *	the previous node may try another route or refund it.
+ */
+func handleCancelHeld(state *mediatedtransfer.TargetState, st *mediatedtransfer.ActionCancelHeldTransferStateChange) (it *transfer.TransitionResult) {
+	tr := state.FromTransfer
+	if state.State != mediatedtransfer.StateHeld || st.LockSecretHash != tr.LockSecretHash {
+		log.Warn(fmt.Sprintf("cancel held transfer %s ignored, state=%s", utils.HPex(st.LockSecretHash), state.State))
+		return &transfer.TransitionResult{
+			NewState: state,
+		}
+	}
+	return rejectTransfer(state, "held transfer canceled")
+}
+
+//rejectTransfer announce that the lock is disposed, and this state manager finishes
+func rejectTransfer(state *mediatedtransfer.TargetState, reason string) *transfer.TransitionResult {
+	tr := state.FromTransfer
+	log.Warn(fmt.Sprintf("reject mediated transfer %s from %s: %s", utils.HPex(tr.LockSecretHash), utils.APex2(state.FromRoute.HopNode()), reason))
+	disposed := &mediatedtransfer.EventSendAnnounceDisposed{
+		Token:          tr.Token,
+		Amount:         new(big.Int).Set(tr.Amount),
+		LockSecretHash: tr.LockSecretHash,
+		Expiration:     tr.Expiration,
+		Receiver:       state.FromRoute.HopNode(),
+	}
+	failed := &mediatedtransfer.EventWithdrawFailed{
+		LockSecretHash:    tr.LockSecretHash,
+		ChannelIdentifier: state.FromRoute.ChannelIdentifier,
+		Reason:            reason,
+	}
+	removed := &mediatedtransfer.EventRemoveStateManager{
+		Key: utils.Sha3(tr.LockSecretHash[:], tr.Token[:]),
+	}
+	return &transfer.TransitionResult{
+		NewState: nil,
+		Events:   []transfer.Event{disposed, failed, removed},
+	}
+}
+
 //handleSecretRegisteredOnChain this state manager has finished
 func handleSecretRegisteredOnChain(state *mediatedtransfer.TargetState, st *mediatedtransfer.ContractSecretRevealOnChainStateChange) (it *transfer.TransitionResult) {
 	var events []transfer.Event
@@ -107,7 +211,11 @@ func handleSecretRegisteredOnChain(state *mediatedtransfer.TargetState, st *medi
 func handleSecretReveal(state *mediatedtransfer.TargetState, st *mediatedtransfer.ReceiveSecretRevealStateChange) (it *transfer.TransitionResult) {
 	validSecret := utils.ShaSecret(st.Secret[:]) == state.FromTransfer.LockSecretHash
 	var events []transfer.Event
-	if validSecret {
+	if validSecret && state.State == mediatedtransfer.StateHeld {
+		//记住密码,但是在应用 settle 之前不向上家披露
+		// remember the secret, but do not reveal it to the previous node until application settles.
+		state.FromTransfer.Secret = st.Secret
+	} else if validSecret {
 		tr := state.FromTransfer
 		route := state.FromRoute
 		state.State = mediatedtransfer.StateRevealSecret
@@ -167,6 +275,9 @@ func handleBlock(state *mediatedtransfer.TargetState, st *transfer.BlockStateCha
 	   only emit the close event once
 
 	*/
+	if state.State == mediatedtransfer.StateHeld {
+		return handleHeldBlock(state)
+	}
 	var events []transfer.Event
 	if state.State != mediatedtransfer.StateWaitingRegisterSecret && state.State != mediatedtransfer.StateSecretRegistered {
 		events = eventsForRegisterSecret(state)
@@ -178,6 +289,33 @@ func handleBlock(state *mediatedtransfer.TargetState, st *transfer.BlockStateCha
 	return
 }
 
+/*
+handleHeldBlock 应用必须在 reveal timeout 之前 settle, 之后就无法安全的拿到钱了,
+所以到了 Expiration - RevealTimeout 还没有 settle 或者 cancel, 就像应用 cancel 一样放弃这个锁, 并通知应用.
+*/
+/*
+ *	handleHeldBlock : application must settle before reveal timeout, after that tokens can not be got safely,
+ *	so if it's neither settled nor canceled at Expiration - RevealTimeout, the lock is disposed
+ *	just as application cancels it, and application is notified.
+ */
+func handleHeldBlock(state *mediatedtransfer.TargetState) *transfer.TransitionResult {
+	tr := state.FromTransfer
+	if mediator.IsSafeToWait(tr, state.FromRoute.RevealTimeout(), state.BlockNumber) {
+		return &transfer.TransitionResult{
+			NewState: state,
+		}
+	}
+	it := rejectTransfer(state, "held transfer neither settled nor canceled before reveal timeout")
+	canceled := &mediatedtransfer.EventHeldTransferCanceled{
+		Token:          tr.Token,
+		LockSecretHash: tr.LockSecretHash,
+		Amount:         tr.Amount,
+		Expiration:     tr.Expiration,
+	}
+	it.Events = append(it.Events, canceled)
+	return it
+}
+
 //Clear the state if the transfer was either completed or failed
 func clearIfFinalized(previt *transfer.TransitionResult) (it *transfer.TransitionResult) {
 	if previt.NewState == nil {
@@ -253,6 +391,10 @@ func StateTransiton(originalState transfer.State, stateChange transfer.StateChan
 				// such as when using token swap, or circuit exist.
 				it = handleSecretReveal(state, st2)
 			}
+		case *mediatedtransfer.ActionSettleHeldTransferStateChange:
+			it = handleSettleHeld(state, st2)
+		case *mediatedtransfer.ActionCancelHeldTransferStateChange:
+			it = handleCancelHeld(state, st2)
 		case *mediatedtransfer.ReceiveUnlockStateChange:
 			//有可能在不知道密码的情况下直接收到 unlock 消息,比如
 			// Maybe we can receive unlock message without receiving secret.
@@ -25,6 +25,8 @@ type State struct {
 	IsSend            bool             //用这个 route 来发送还是接收?	// whether this route is used to send or receive.
 	Fee               *big.Int         // how much fee to this channel charge charge .
 	TotalFee          *big.Int         // how much fee for all path when initiator use this route
+	Path              []common.Address // nodes from hop node to target the fee is calculated on, empty if unknown
+	PathFees          []*big.Int       // fee of every mediator on Path, the target charges nothing
 }
 
 //NewState create route state
@@ -80,6 +82,11 @@ func (rs *State) Channel() *channel.Channel {
 	return rs.ch
 }
 
+//SetChannel link the route to ch again after it is restored from db, ch must have the same ChannelIdentifier.
+func (rs *State) SetChannel(ch *channel.Channel) {
+	rs.ch = ch
+}
+
 //State of route channel
 func (rs *State) State() channeltype.State {
 	return rs.ch.State
@@ -11,7 +11,8 @@ import (
 
 //BlockStateChange used when a new block is mined.
 type BlockStateChange struct {
-	BlockNumber int64
+	BlockNumber  int64
+	RevealMargin int //blocks a lock must have left to be forwarded by mediators, 0 means unchanged
 }
 
 /*
@@ -62,4 +63,7 @@ func init() {
 	gob.Register(&ActionCancelTransferStateChange{})
 	gob.Register(&ActionTransferDirectStateChange{})
 	gob.Register(&ReceiveTransferDirectStateChange{})
+	gob.Register(&CooperativeSettleStateChange{})
+	gob.Register(&WithdrawRequestStateChange{})
+	gob.Register(&StopTransferRightNowStateChange{})
 }